@@ -20,6 +20,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -38,6 +39,7 @@ type S3Config struct {
 	RoleExternalId  string
 	RoleSessionName string
 	StsEndpoint     string
+	Anonymous       bool
 
 	RequesterPays bool
 	Region        string
@@ -139,6 +141,11 @@ func (c *S3Config) ToAwsConfig(flags *FlagStorage) (*aws.Config, error) {
 			})
 	}
 
+	if c.Anonymous {
+		// Requests with these credentials aren't signed
+		c.Credentials = credentials.AnonymousCredentials
+	}
+
 	if c.Credentials != nil {
 		awsConfig.Credentials = c.Credentials
 	}
@@ -148,6 +155,16 @@ func (c *S3Config) ToAwsConfig(flags *FlagStorage) (*aws.Config, error) {
 		if err != nil {
 			return nil, fmt.Errorf("sse-c is not base64-encoded: %v", err)
 		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("sse-c key must be 32 bytes long (AES-256), got %v bytes", len(key))
+		}
+		if c.UseSSE {
+			return nil, fmt.Errorf("sse-c can't be used together with sse or sse-kms")
+		}
+		if strings.HasPrefix(strings.ToLower(flags.Endpoint), "http://") {
+			// The SDK refuses to send the key over plain HTTP, so every request would fail
+			return nil, fmt.Errorf("sse-c requires an https endpoint, got %v", flags.Endpoint)
+		}
 
 		c.SseC = string(key)
 		m := md5.Sum(key)
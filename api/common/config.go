@@ -31,6 +31,14 @@ type PartSizeConfig struct {
 	PartCount uint64
 }
 
+// Range of --uid-map/--gid-map: Count ids starting from Stored in object
+// metadata are shown as ids starting from Local
+type IdMapRange struct {
+	Stored uint32
+	Local  uint32
+	Count  uint32
+}
+
 type FlagStorage struct {
 	// File system
 	MountOptions      map[string]string
@@ -45,23 +53,50 @@ type FlagStorage struct {
 	Setuid   int
 	Setgid   int
 
+	CreateBucket bool
+
 	// Common Backend Config
 	UseContentType bool
 	Endpoint       string
+	UserAgent      string
 	Backend        interface{}
 
 	// Tuning
 	MemoryLimit           uint64
 	GCInterval            uint64
+	CompressBuffers       bool
+	MaxInodes             uint64
+	LazyDirInodes         bool
+	StatfsBlockSize       uint32
+	StatfsTotalBlocks     uint64
+	FsTotalSize           uint64
 	Cheap                 bool
 	ExplicitDir           bool
 	NoDirObject           bool
 	MaxFlushers           int64
+	MaxDirtyBytes         uint64
+	AbortStaleMPU         time.Duration
+	MaxUploadBytesPerSec  uint64
+	MaxDownloadBytesPerSec uint64
+	TreeOpConcurrency     int
 	MaxParallelParts      int
 	MaxParallelCopy       int
 	StatCacheTTL          time.Duration
+	NegCacheTTL           time.Duration
+	SymlinkCacheTTL       time.Duration
+	RenameListGrace       time.Duration
+	ConsistentRead        time.Duration
+	RenameFlushOrder      string
+	PrefixStatsTTL        time.Duration
 	HTTPTimeout           time.Duration
 	RetryInterval         time.Duration
+	RetryIntervalMax      time.Duration
+	RetryJitter           int
+	FlushRetries          int
+	FlushRetryTimeout     time.Duration
+	FlushWakeupDebounce   time.Duration
+	PartRetries           int
+	UnmountFlushTimeout   time.Duration
 	ReadAheadKB           uint64
 	SmallReadCount        uint64
 	SmallReadCutoffKB     uint64
@@ -69,28 +104,73 @@ type FlagStorage struct {
 	LargeReadCutoffKB     uint64
 	ReadAheadLargeKB      uint64
 	ReadAheadParallelKB   uint64
+	MaxReadAheadPerHandleKB uint64
+	MaxReadAheadTotalKB   uint64
 	ReadMergeKB           uint64
+	StreamReadCutoffKB    uint64
+	PrefetchOnReaddir     string
+	XattrPrefetch         int
+	ReadCachePolicy       string
 	SinglePartMB          uint64
+	MergeLastPartKB       uint64
 	MaxMergeCopyMB        uint64
 	IgnoreFsync           bool
+	DirectSyncWrites      bool
+	ExclusiveWriter       bool
+	DeleteOnClose         bool
 	EnablePerms           bool
 	EnableSpecials        bool
 	EnableMtime           bool
+	DirMtimeMarker        bool
+	RootMtime             string
 	UidAttr               string
 	GidAttr               string
+	UidMap                []IdMapRange
+	GidMap                []IdMapRange
 	FileModeAttr          string
 	RdevAttr              string
 	MtimeAttr             string
 	SymlinkAttr           string
+	MetadataPrefix        string
+	WebsiteRedirectSymlinks bool
+	MetadataSidecar       bool
+	HidePatterns          []string
+	VersionHistoryDirs    bool
+	ChangeLog             bool
+	StableInodeOnRename   bool
 	RefreshAttr           string
+	XattrNamespaces       map[string]string
+	LazyXattrList         bool
+	MaxMetadataSize       int
+	MaxXattrValueSize     int
+	MaxKeyLength          int
+	FileDirCollision      string
+	CollisionSuffix       string
+	ConflictDetect        string
+	ConflictPolicy        string
+	SendContentMD5        bool
+	PartManifest          bool
+	VerifyChecksums       bool
+	Trash                 string
+	RemoteDeleteDuringRead string
+	PartialReadOnError    bool
+	UploadCompression     string
+	UploadCompressionLevel int
+	UploadCompressionMinKB uint64
+	UploadCompressionSkip map[string]bool
 	CachePopularThreshold int64
 	CacheMaxHits          int64
 	CacheAgeInterval      int64
 	CacheAgeDecrement     int64
+	CacheRecencyLimit     uint64
+	CacheEviction         string
+	CacheLowWatermark     int
+	CacheHighWatermark    int
 	CacheToDiskHits       int64
 	CachePath             string
 	MaxDiskCacheFD        int64
 	CacheFileMode         os.FileMode
+	ValidateDiskCache     bool
 	PartSizes             []PartSizeConfig
 
 	// Debugging
@@ -98,6 +178,7 @@ type FlagStorage struct {
 	DebugFuse  bool
 	DebugS3    bool
 	PProf      string
+	MetricsAddr string
 	Foreground bool
 	LogFile    string
 
@@ -124,6 +124,29 @@ function rm_tree {
     fsync_dir
 }
 
+function create_deep_tree {
+    (path=deep
+    for i in $(seq 1 8); do
+        path=$path/$i
+        mkdir -p $path
+        for j in $(seq 1 20); do
+            echo $j > $path/file$j & true
+        done
+    done
+    wait)
+    fsync_dir
+}
+
+function mv_deep_tree {
+    mv deep deep_renamed
+    fsync_dir
+}
+
+function rm_deep_tree {
+    rm -Rf deep_renamed
+    fsync_dir
+}
+
 function create_files_parallel {
     get_howmany $@
 
@@ -262,6 +285,15 @@ if [ "$t" = "find_find" ]; then
     done
 fi
 
+# Run by run_bench.sh with each of $TREE_OP_CONCURRENCY values
+if [ "$t" = "tree_ops" ]; then
+    for i in $(seq 1 $iter); do
+        create_deep_tree
+        run_test mv_deep_tree
+        run_test rm_deep_tree
+    done
+fi
+
 if [ "$t" = "issue231" ]; then
     run_test write_md5
     (for i in $(seq 1 20); do
@@ -11,6 +11,8 @@ set -o pipefail
 : ${AWS_ACCESS_KEY_ID:=""}
 : ${AWS_SECRET_ACCESS_KEY:=""}
 : ${PROG:="geesefs"}
+# --tree-op-concurrency values compared by the tree_ops test
+: ${TREE_OP_CONCURRENCY:="1 4 16 0"}
 
 if [ $# = 1 ]; then
     t=$1
@@ -115,6 +117,12 @@ else
         mount_and_bench bench-mnt cleanup |& tee -a $dir/bench.$PROG
     elif [ "$t" = "cleanup" ]; then
         mount_and_bench bench-mnt cleanup |& tee -a $dir/bench.$PROG
+    elif [ "$t" = "tree_ops" -a "$PROG" = "geesefs" ]; then
+        for c in $TREE_OP_CONCURRENCY; do
+            MOUNTER="geesefs --stat-cache-ttl 1s --tree-op-concurrency $c $OPT $BUCKET bench-mnt"
+            echo "tree_op_concurrency $c" |& tee -a $dir/bench.$PROG
+            mount_and_bench bench-mnt tree_ops |& tee -a $dir/bench.$PROG
+        done
     else
         mount_and_bench bench-mnt $t |& tee $dir/bench.$PROG
     fi
@@ -0,0 +1,175 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// POSIX ACLs. system.posix_acl_access and system.posix_acl_default xattrs
+// are kept in user metadata under reserved keys in the binary form used by
+// the kernel: a version header followed by (tag, perm, id) entries.
+// With --enable-perms, the access ACL and the file mode are kept in sync
+// like in local file systems: owner, other and mask (or group if there's no
+// mask) entries are the permission bits of the mode.
+package internal
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+)
+
+const (
+	ACL_ACCESS_XATTR = "system.posix_acl_access"
+	ACL_DEFAULT_XATTR = "system.posix_acl_default"
+	ACL_ACCESS_ATTR = "geesefs-acl-access"
+	ACL_DEFAULT_ATTR = "geesefs-acl-default"
+
+	ACL_XATTR_VERSION = 2
+	ACL_HEADER_SIZE = 4
+	ACL_ENTRY_SIZE = 8
+
+	ACL_USER_OBJ = 0x01
+	ACL_USER = 0x02
+	ACL_GROUP_OBJ = 0x04
+	ACL_GROUP = 0x08
+	ACL_MASK = 0x10
+	ACL_OTHER = 0x20
+)
+
+// Metadata key of an ACL xattr
+func aclAttr(name string) string {
+	switch name {
+	case ACL_ACCESS_XATTR:
+		return ACL_ACCESS_ATTR
+	case ACL_DEFAULT_XATTR:
+		return ACL_DEFAULT_ATTR
+	}
+	return ""
+}
+
+// Xattr name of an ACL metadata key
+func aclXattrName(key string) string {
+	switch key {
+	case ACL_ACCESS_ATTR:
+		return ACL_ACCESS_XATTR
+	case ACL_DEFAULT_ATTR:
+		return ACL_DEFAULT_XATTR
+	}
+	return ""
+}
+
+func validAcl(value []byte) bool {
+	if len(value) < ACL_HEADER_SIZE || (len(value)-ACL_HEADER_SIZE)%ACL_ENTRY_SIZE != 0 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(value) == ACL_XATTR_VERSION
+}
+
+// Check an ACL before setting it
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) checkAcl(key string, value []byte) error {
+	if !validAcl(value) {
+		return syscall.EINVAL
+	}
+	if key == ACL_DEFAULT_ATTR && !inode.isDir() {
+		// Only directories have default ACLs
+		return syscall.EACCES
+	}
+	return nil
+}
+
+// Permission bits of the mode represented by the access ACL
+func aclMode(value []byte) (perm os.FileMode, ok bool) {
+	if !validAcl(value) {
+		return 0, false
+	}
+	var user, group, mask, other uint16
+	var hasUser, hasGroup, hasMask, hasOther bool
+	for off := ACL_HEADER_SIZE; off < len(value); off += ACL_ENTRY_SIZE {
+		tag := binary.LittleEndian.Uint16(value[off:])
+		bits := binary.LittleEndian.Uint16(value[off+2:]) & 7
+		switch tag {
+		case ACL_USER_OBJ:
+			user, hasUser = bits, true
+		case ACL_GROUP_OBJ:
+			group, hasGroup = bits, true
+		case ACL_MASK:
+			mask, hasMask = bits, true
+		case ACL_OTHER:
+			other, hasOther = bits, true
+		}
+	}
+	if !hasUser || !hasGroup || !hasOther {
+		return 0, false
+	}
+	if hasMask {
+		group = mask
+	}
+	return os.FileMode(user<<6 | group<<3 | other), true
+}
+
+// Copy of the access ACL with owner, mask (or group) and other entries
+// changed to permission bits of the mode
+func aclWithMode(value []byte, perm os.FileMode) []byte {
+	value = Dup(value)
+	hasMask := false
+	for off := ACL_HEADER_SIZE; off+ACL_ENTRY_SIZE <= len(value); off += ACL_ENTRY_SIZE {
+		if binary.LittleEndian.Uint16(value[off:]) == ACL_MASK {
+			hasMask = true
+		}
+	}
+	for off := ACL_HEADER_SIZE; off+ACL_ENTRY_SIZE <= len(value); off += ACL_ENTRY_SIZE {
+		var bits os.FileMode
+		switch binary.LittleEndian.Uint16(value[off:]) {
+		case ACL_USER_OBJ:
+			bits = perm >> 6
+		case ACL_GROUP_OBJ:
+			if hasMask {
+				continue
+			}
+			bits = perm >> 3
+		case ACL_MASK:
+			bits = perm >> 3
+		case ACL_OTHER:
+			bits = perm
+		default:
+			continue
+		}
+		binary.LittleEndian.PutUint16(value[off+2:], uint16(bits&7))
+	}
+	return value
+}
+
+// Apply the just set access ACL to the mode
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setModeFromAcl() error {
+	if !inode.fs.flags.EnablePerms || inode.userMetadata == nil {
+		return nil
+	}
+	perm, ok := aclMode(inode.userMetadata[ACL_ACCESS_ATTR])
+	if !ok || perm == inode.Attributes.Mode&os.ModePerm {
+		return nil
+	}
+	_, err := inode.setFileMode(inode.Attributes.Mode&^os.ModePerm | perm)
+	return err
+}
+
+// Apply the changed mode to the access ACL
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setAclFromMode() {
+	if !inode.fs.flags.EnablePerms || inode.userMetadata == nil {
+		return
+	}
+	acl := inode.userMetadata[ACL_ACCESS_ATTR]
+	if perm, ok := aclMode(acl); ok && perm != inode.Attributes.Mode&os.ModePerm {
+		inode.setUserMeta(ACL_ACCESS_ATTR, aclWithMode(acl, inode.Attributes.Mode&os.ModePerm))
+	}
+}
@@ -18,8 +18,18 @@ import (
 	. "github.com/yandex-cloud/geesefs/api/common"
 	. "gopkg.in/check.v1"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"bytes"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -47,6 +57,205 @@ func (s *AwsTest) TestRegionDetection(t *C) {
 	t.Assert(isAws, Equals, true)
 }
 
+func (s *AwsTest) TestUserAgent(t *C) {
+	s3b, err := NewS3("bucket", &FlagStorage{UserAgent: "geesefs/test mount=/mnt"}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	t.Assert(err, IsNil)
+
+	req, _ := s3b.S3.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("key"),
+	})
+	err = req.Sign()
+	t.Assert(err, IsNil)
+	t.Assert(req.HTTPRequest.Header.Get("User-Agent"), Equals, "geesefs/test mount=/mnt")
+	t.Assert(req.HTTPRequest.Header.Get("Authorization"), Not(Equals), "")
+}
+
+func (s *AwsTest) TestAnonymous(t *C) {
+	var signed, writes int32
+	// Public bucket rejecting signed requests, like it would for invalid credentials
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			atomic.AddInt32(&signed, 1)
+			w.WriteHeader(403)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			atomic.AddInt32(&writes, 1)
+			w.WriteHeader(403)
+			return
+		}
+		if r.URL.Path != "/public/file" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("ETag", "\"5d41402abc4b2a76b9719d911017c592\"")
+		w.WriteHeader(200)
+		if r.Method == "GET" {
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	s3b, err := NewS3("public", &FlagStorage{Endpoint: server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Anonymous: true,
+	})
+	t.Assert(err, IsNil)
+
+	head, err := s3b.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size, Equals, uint64(5))
+	resp, err := s3b.GetBlob(&GetBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "hello")
+
+	// Writes fail without reaching the server
+	_, err = s3b.PutBlob(&PutBlobInput{Key: "file", Body: bytes.NewReader([]byte("world")), Size: PUInt64(5)})
+	t.Assert(err, Equals, syscall.EROFS)
+	_, err = s3b.DeleteBlob(&DeleteBlobInput{Key: "file"})
+	t.Assert(err, Equals, syscall.EROFS)
+
+	t.Assert(atomic.LoadInt32(&signed), Equals, int32(0))
+	t.Assert(atomic.LoadInt32(&writes), Equals, int32(0))
+}
+
+func (s *AwsTest) TestRegionRedirect(t *C) {
+	var redirects, served int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Credential=<key>/<date>/<region>/s3/aws4_request
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-3/s3/") {
+			atomic.AddInt32(&redirects, 1)
+			w.Header().Set("X-Amz-Bucket-Region", "eu-west-3")
+			w.WriteHeader(301)
+			return
+		}
+		atomic.AddInt32(&served, 1)
+		if r.URL.Path != "/bucket/file" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	config := &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+	s3b, err := NewS3("bucket", &FlagStorage{Endpoint: server.URL}, config)
+	t.Assert(err, IsNil)
+	head, err := s3b.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size, Equals, uint64(5))
+	t.Assert(atomic.LoadInt32(&redirects), Equals, int32(1))
+
+	// The detected region is remembered
+	_, err = s3b.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(atomic.LoadInt32(&redirects), Equals, int32(1))
+	t.Assert(atomic.LoadInt32(&served), Equals, int32(2))
+
+	// Explicit --region isn't overridden
+	config.RegionSet = true
+	s3b, err = NewS3("bucket", &FlagStorage{Endpoint: server.URL}, config)
+	t.Assert(err, IsNil)
+	_, err = s3b.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, NotNil)
+	t.Assert(strings.Contains(err.Error(), "eu-west-3"), Equals, true)
+	t.Assert(atomic.LoadInt32(&redirects), Equals, int32(2))
+	t.Assert(atomic.LoadInt32(&served), Equals, int32(2))
+}
+
+func (s *AwsTest) TestSseCKeyValidation(t *C) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newS3 := func(endpoint string, config *S3Config) (*S3Backend, error) {
+		config.Region = "us-east-1"
+		return NewS3("bucket", &FlagStorage{Endpoint: endpoint}, config)
+	}
+
+	_, err := newS3("", &S3Config{SseC: "not base64!"})
+	t.Assert(err, NotNil)
+	_, err = newS3("", &S3Config{SseC: base64.StdEncoding.EncodeToString([]byte("short key"))})
+	t.Assert(err, NotNil)
+	t.Assert(strings.Contains(err.Error(), "32 bytes"), Equals, true)
+	_, err = newS3("", &S3Config{SseC: key, UseSSE: true})
+	t.Assert(err, NotNil)
+	_, err = newS3("http://localhost:9000", &S3Config{SseC: key})
+	t.Assert(err, NotNil)
+
+	s3b, err := newS3("https://localhost:9000", &S3Config{SseC: key})
+	t.Assert(err, IsNil)
+	t.Assert(s3b.Capabilities().OpaqueETag, Equals, true)
+	t.Assert(len(s3b.config.SseC), Equals, 32)
+}
+
+func (s *AwsTest) TestPrefixThrottle(t *C) {
+	throttle := NewPrefixThrottle()
+	// Fake clock: sleeping just advances it
+	now := time.Unix(1000000, 0)
+	throttle.now = func() time.Time { return now }
+	throttle.sleep = func(d time.Duration) { now = now.Add(d) }
+	// Number of requests to prefix sent during one second
+	requestsPerSecond := func(prefix string) int {
+		start := now
+		n := 0
+		for {
+			throttle.Wait(prefix)
+			if now.Sub(start) >= time.Second {
+				return n
+			}
+			n++
+		}
+	}
+
+	t.Assert(keyPrefix("dir/sub/file"), Equals, "dir/sub/")
+	t.Assert(keyPrefix("file"), Equals, "")
+
+	req, _ := s.s3.S3.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("dir/file"),
+	})
+	t.Assert(keyPrefix(requestKey(req)), Equals, "dir/")
+
+	throttle.Done("dir/", false)
+	t.Assert(len(throttle.Rates()), Equals, 0)
+	t.Assert(throttle.Throttled(), Equals, uint64(0))
+	throttle.Done("dir/", true)
+	t.Assert(throttle.Rates()["dir/"], Equals, THROTTLE_INITIAL_RATE)
+	t.Assert(throttle.Throttled(), Equals, uint64(1))
+	// Other prefixes are unaffected
+	start := now
+	throttle.Wait("other/")
+	throttle.Wait("other/")
+	t.Assert(now, Equals, start)
+
+	now = now.Add(20*time.Millisecond)
+	throttle.Done("dir/", true)
+	t.Assert(throttle.Rates()["dir/"], Equals, THROTTLE_INITIAL_RATE/2)
+	t.Assert(throttle.Throttled(), Equals, uint64(2))
+	t.Assert(requestsPerSecond("dir/"), Equals, int(THROTTLE_INITIAL_RATE/2))
+
+	now = now.Add(time.Second)
+	throttle.Done("dir/", false)
+	t.Assert(throttle.Rates()["dir/"], Equals, THROTTLE_INITIAL_RATE/2+THROTTLE_RATE_INCREASE)
+	// Intervals are rounded down to nanoseconds, so one more may fit
+	n := requestsPerSecond("dir/")
+	t.Assert(n >= int(THROTTLE_INITIAL_RATE/2+THROTTLE_RATE_INCREASE) && n <= int(THROTTLE_INITIAL_RATE/2+THROTTLE_RATE_INCREASE)+1, Equals, true)
+}
+
 func (s *AwsTest) TestBucket404(t *C) {
 	s.s3.bucket = RandStringBytesMaskImprSrc(64)
 
@@ -28,9 +28,21 @@ import (
 
 type Capabilities struct {
 	MaxMultipartSize    uint64
+	// maximum size of a single escaped metadata value, 0 means unlimited
+	MaxXattrValueSize int
+	// maximum total size of escaped user metadata keys and values, 0 means unlimited
+	MaxMetadataSize int
+	// maximum length of an object key in bytes, 0 means unlimited
+	MaxKeyLength int
 	// indicates that the blob store has native support for directories
 	DirBlob bool
 	Name    string
+	// ETag isn't a content hash and may differ between responses
+	// for the same object, like for SSE-C encrypted objects
+	OpaqueETag bool
+	// metadata is only returned by HEAD, but HEADs are cheap enough to send
+	// many of them in parallel, so --xattr-prefetch is useful
+	ParallelHead bool
 }
 
 type HeadBlobInput struct {
@@ -45,6 +57,11 @@ type BlobItemOutput struct {
 	StorageClass *string
 	// may be nil in list responses for backends that don't return metadata in listings
 	Metadata     map[string]*string
+	// content checksum as "algorithm:value", only returned by HEAD and only by some backends
+	Checksum     *string
+	// x-amz-website-redirect-location with --website-redirect-symlinks,
+	// only returned by HEAD and GET and only by S3
+	WebsiteRedirect *string
 }
 
 type HeadBlobOutput struct {
@@ -52,6 +69,8 @@ type HeadBlobOutput struct {
 
 	ContentType *string
 	IsDirBlob   bool
+	// restore status of an archived object (x-amz-restore), nil if it's not restored
+	Restore *string
 
 	RequestId string
 }
@@ -110,9 +129,18 @@ type CopyBlobInput struct {
 	ETag         *string            // if non-nil, do conditional copy
 	Metadata     map[string]*string // if nil, copy from Source
 	StorageClass *string            // if nil, copy from Source
+	// only used if Metadata is non-nil, only supported by S3
+	WebsiteRedirect *string
+	ContentEncoding *string
+	// only used if Metadata is non-nil, if nil, it's guessed from the name
+	ContentType *string
 }
 
 type CopyBlobOutput struct {
+	// ETag and modification time of the new object, if known
+	ETag         *string
+	LastModified *time.Time
+
 	RequestId string
 }
 
@@ -121,6 +149,8 @@ type GetBlobInput struct {
 	Start   uint64
 	Count   uint64
 	IfMatch *string
+	// only supported by backends implementing VersionedBackend
+	VersionId *string
 }
 
 type GetBlobOutput struct {
@@ -136,6 +166,13 @@ type PutBlobInput struct {
 	Metadata    map[string]*string
 	ContentType *string
 	DirBlob     bool
+	// x-amz-website-redirect-location, only supported by S3
+	WebsiteRedirect *string
+	ContentEncoding *string
+	// base64-encoded MD5 of the body, checked by the server
+	ContentMD5 *string
+	// if nil, the default storage class is used
+	StorageClass *string
 
 	Body io.ReadSeeker
 	Size *uint64
@@ -150,18 +187,22 @@ type PutBlobOutput struct {
 }
 
 type MultipartBlobBeginInput struct {
-	Key         string
-	Metadata    map[string]*string
-	ContentType *string
+	Key          string
+	Metadata     map[string]*string
+	ContentType  *string
+	StorageClass *string // if nil, the default storage class is used
+	// only supported by S3
+	ContentEncoding *string
 }
 
 type MultipartBlobCommitInput struct {
 	Key *string
 
-	Metadata map[string]*string
-	UploadId *string
-	Parts    []*string
-	NumParts uint32
+	Metadata     map[string]*string
+	StorageClass *string
+	UploadId     *string
+	Parts        []*string
+	NumParts     uint32
 
 	// for GCS
 	backendData interface{}
@@ -172,6 +213,7 @@ type MultipartBlobAddInput struct {
 	PartNumber uint32
 
 	Body io.ReadSeeker
+	ContentMD5 *string
 
 	Size   uint64 // GCS wants to know part size
 	Offset uint64 // ADLv2 needs to know offset
@@ -203,11 +245,33 @@ type MultipartBlobCommitOutput struct {
 	RequestId string
 }
 
+// Returned by MultipartBlobCommit when the server rejects some of the parts,
+// so that only these parts may be uploaded again
+type MultipartPartsRejectedError struct {
+	// 1-based part numbers and ETags sent in the commit request
+	Parts []MPUPart
+	Err   error
+}
+
+func (e *MultipartPartsRejectedError) Error() string {
+	nums := make([]string, len(e.Parts))
+	for i, p := range e.Parts {
+		nums[i] = fmt.Sprintf("%v", p.Num)
+	}
+	return fmt.Sprintf("%v (rejected parts: %v)", e.Err, strings.Join(nums, ", "))
+}
+
 type MultipartBlobAbortOutput struct {
 	RequestId string
 }
 
 type MultipartExpireInput struct {
+	// Only expire uploads of keys with this prefix
+	Prefix string
+	// Expire uploads older than this instead of the backend default
+	Age time.Duration
+	// Uploads for which it returns true are kept
+	Keep func(key, uploadId string) bool
 }
 
 type MultipartExpireOutput struct {
@@ -259,6 +323,29 @@ type StorageBackend interface {
 	Delegate() interface{}
 }
 
+// Backends which can list previous versions of objects
+type VersionedBackend interface {
+	ListBlobVersions(key string) ([]BlobVersionOutput, error)
+}
+
+// Backends which can restore archived objects (GLACIER, DEEP_ARCHIVE)
+type RestorableBackend interface {
+	RestoreBlob(key string, days int64) error
+}
+
+// Backends which support object tags
+type TaggingBackend interface {
+	GetBlobTags(key string) (map[string]string, error)
+	PutBlobTags(key string, tags map[string]string) error
+}
+
+type BlobVersionOutput struct {
+	VersionId    string
+	LastModified time.Time
+	Size         uint64
+	IsLatest     bool
+}
+
 type Delegator interface {
 	Delegate() interface{}
 }
@@ -322,6 +409,13 @@ type StorageBackendInitWrapper struct {
 
 const INIT_ERR_BLOB = "mount.err"
 
+func unwrapCloud(cloud StorageBackend) StorageBackend {
+	if w, ok := cloud.(*StorageBackendInitWrapper); ok {
+		return w.StorageBackend
+	}
+	return cloud
+}
+
 func (s *StorageBackendInitWrapper) Init(key string) error {
 	s.init.Do(func() {
 		s.initErr = s.StorageBackend.Init(s.initKey)
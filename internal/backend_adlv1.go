@@ -141,6 +141,9 @@ func NewADLv1(bucket string, flags *FlagStorage, config *ADLv1Config) (*ADLv1, e
 	adlClient.BaseClient.Client.Authorizer = config.Authorizer
 	adlClient.BaseClient.Client.RequestInspector = LogRequest
 	adlClient.BaseClient.Client.ResponseInspector = LogResponse
+	if flags.UserAgent != "" {
+		adlClient.BaseClient.Client.UserAgent = flags.UserAgent
+	}
 	adlClient.BaseClient.AdlsFileSystemDNSSuffix = parts[1]
 	adlClient.BaseClient.Sender.(*http.Client).Transport = GetHTTPTransport()
 
@@ -168,6 +168,9 @@ func NewADLv2(bucket string, flags *FlagStorage, config *ADLv2Config) (*ADLv2, e
 	client.Authorizer = config.Authorizer
 	client.RequestInspector = LogRequest
 	client.ResponseInspector = LogResponse
+	if flags.UserAgent != "" {
+		client.UserAgent = flags.UserAgent
+	}
 	client.Sender.(*http.Client).Transport = GetHTTPTransport()
 
 	b := &ADLv2{
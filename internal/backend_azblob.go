@@ -182,6 +182,11 @@ func NewAZBlob(container string, config *AZBlobConfig) (*AZBlob, error) {
 		cap: Capabilities{
 			MaxMultipartSize: 100 * 1024 * 1024,
 			Name:             "wasb",
+			// the whole metadata is limited to 8 KB
+			MaxXattrValueSize: 8192,
+			MaxMetadataSize:   8192,
+			MaxKeyLength:      1024,
+			ParallelHead:      true,
 		},
 		pipeline:         p,
 		bucket:           container,
@@ -41,6 +41,8 @@ func NewGCS3(bucket string, flags *FlagStorage, config *S3Config) (*GCS3, error)
 		return nil, err
 	}
 	s3Backend.Capabilities().Name = "gcs"
+	s3Backend.Capabilities().MaxXattrValueSize = 8192
+	s3Backend.Capabilities().MaxMetadataSize = 8192
 	s := &GCS3{S3Backend: s3Backend}
 	s.S3Backend.gcs = true
 	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
@@ -36,6 +36,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/corehandlers"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 
@@ -59,6 +60,11 @@ type S3Backend struct {
 	iamToken atomic.Value
 	iamTokenExpiration time.Time
 	iamRefreshTimer *time.Timer
+
+	// Bucket region learned from redirects of regular requests
+	detectedRegion atomic.Value
+
+	throttle *PrefixThrottle
 }
 
 func NewS3(bucket string, flags *FlagStorage, config *S3Config) (*S3Backend, error) {
@@ -77,8 +83,15 @@ func NewS3(bucket string, flags *FlagStorage, config *S3Config) (*S3Backend, err
 		cap: Capabilities{
 			Name:             "s3",
 			MaxMultipartSize: 5 * 1024 * 1024 * 1024,
+			// the whole user metadata is limited to 2 KB
+			MaxXattrValueSize: 2048,
+			MaxMetadataSize:   2048,
+			MaxKeyLength:      1024,
+			ParallelHead:      true,
 		},
+		throttle:  NewPrefixThrottle(),
 	}
+	s.cap.OpaqueETag = config.SseC != ""
 
 	if flags.DebugS3 {
 		awsConfig.LogLevel = aws.LogLevel(aws.LogDebug | aws.LogDebugWithRequestErrors)
@@ -233,6 +246,66 @@ func addRequestPayer(req *request.Request) {
 	}
 }
 
+// Unsigned requests may only read public buckets, so fail writes
+// clearly without sending them
+func rejectAnonymousWrite(req *request.Request) {
+	if req.HTTPRequest.Method != "GET" && req.HTTPRequest.Method != "HEAD" {
+		req.Error = syscall.EROFS
+	}
+}
+
+// Buckets answer requests signed for a wrong region with 301 or 400 and
+// report their actual region in X-Amz-Bucket-Region. Remember it and retry
+// the request so that it's signed for the correct region.
+func (s *S3Backend) detectRegionOnError(req *request.Request) {
+	if req.HTTPResponse == nil ||
+		req.HTTPResponse.StatusCode != 301 && req.HTTPResponse.StatusCode != 400 {
+		return
+	}
+	region := req.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+	current := req.ClientInfo.SigningRegion
+	if current == "" {
+		current = aws.StringValue(req.Config.Region)
+	}
+	if region == "" || region == current {
+		return
+	}
+	if s.config.RegionSet {
+		req.Error = awserr.New("IncorrectRegion", fmt.Sprintf(
+			"bucket %v is in region '%v', but --region is '%v'", s.bucket, region, current), req.Error)
+		req.Retryable = aws.Bool(false)
+		return
+	}
+	if prev, _ := s.detectedRegion.Load().(string); prev != region {
+		s3Log.Infof("Switching from region '%v' to '%v'", current, region)
+		s.detectedRegion.Store(region)
+	}
+	req.Retryable = aws.Bool(true)
+}
+
+// Sign requests for the detected bucket region and send them to the endpoint
+// of that region when using the default AWS endpoint
+func (s *S3Backend) applyDetectedRegion(req *request.Request) {
+	region, _ := s.detectedRegion.Load().(string)
+	if region == "" || region == req.ClientInfo.SigningRegion {
+		return
+	}
+	if aws.StringValue(s.awsConfig.Endpoint) == "" {
+		oldUrl, err1 := url.Parse(req.ClientInfo.Endpoint)
+		resolved, err2 := endpoints.DefaultResolver().EndpointFor(s3.EndpointsID, region)
+		if err1 == nil && err2 == nil {
+			newUrl, err := url.Parse(resolved.URL)
+			if err == nil && oldUrl.Host != "" {
+				req.HTTPRequest.URL.Host = strings.Replace(req.HTTPRequest.URL.Host, oldUrl.Host, newUrl.Host, 1)
+				req.HTTPRequest.Host = ""
+				req.ClientInfo.Endpoint = resolved.URL
+			}
+		}
+	}
+	req.Config.Region = aws.String(region)
+	req.ClientInfo.SigningRegion = region
+}
+
 func (s *S3Backend) setV2Signer(handlers *request.Handlers) {
 	handlers.Sign.Clear()
 	handlers.Sign.PushBack(SignV2)
@@ -249,13 +322,35 @@ func (s *S3Backend) newS3() {
 	} else if s.v2Signer {
 		s.setV2Signer(&s.S3.Handlers)
 	}
+	if s.config.Anonymous {
+		s.S3.Handlers.Validate.PushBack(rejectAnonymousWrite)
+	}
+	s.S3.Handlers.Sign.PushFront(s.applyDetectedRegion)
+	s.S3.Handlers.Retry.PushFront(s.detectRegionOnError)
 	s.S3.Handlers.Sign.PushBack(addAcceptEncoding)
+	s.throttle.addHandlers(&s.S3.Handlers)
 	s.S3.Handlers.Build.RemoveByName("core.SDKVersionUserAgentHandler")
-	s.S3.Handlers.Build.PushBackNamed(request.NamedHandler{
-		Name: "core.SDKVersionUserAgentHandler",
-		Fn: request.MakeAddToUserAgentHandler("GeeseFS", GEESEFS_VERSION,
-			runtime.Version(), runtime.GOOS, runtime.GOARCH),
-	})
+	if s.flags.UserAgent != "" {
+		// User-Agent is set in the Build phase, before signing, and
+		// it's not a signed header for both V2 and V4 signatures
+		userAgent := s.flags.UserAgent
+		s.S3.Handlers.Build.PushBackNamed(request.NamedHandler{
+			Name: "core.SDKVersionUserAgentHandler",
+			Fn: func(r *request.Request) {
+				r.HTTPRequest.Header.Set("User-Agent", userAgent)
+			},
+		})
+	} else {
+		s.S3.Handlers.Build.PushBackNamed(request.NamedHandler{
+			Name: "core.SDKVersionUserAgentHandler",
+			Fn: request.MakeAddToUserAgentHandler("GeeseFS", GEESEFS_VERSION,
+				runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		})
+	}
+}
+
+func (s *S3Backend) PrefixThrottle() *PrefixThrottle {
+	return s.throttle
 }
 
 func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
@@ -282,6 +377,9 @@ func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
 	if err != nil {
 		return
 	}
+	if s.flags.UserAgent != "" {
+		req.Header.Set("User-Agent", s.flags.UserAgent)
+	}
 
 	allowFails := 3
 	for i := 0; i < allowFails; i++ {
@@ -381,7 +479,8 @@ func (s *S3Backend) Init(key string) error {
 			// or we can use anonymous access, or both
 			s.newS3()
 		} else if err == syscall.ENXIO {
-			return fmt.Errorf("bucket %v does not exist", s.bucket)
+			s3Log.Errorf("bucket %v does not exist", s.bucket)
+			return err
 		} else {
 			// this is NOT AWS, we expect the request to fail with 403 if this is not
 			// an anonymous bucket
@@ -413,6 +512,41 @@ func (s *S3Backend) Init(key string) error {
 		}
 	}
 
+	if s.config.SseC != "" {
+		return s.testSseCKey(key)
+	}
+
+	return nil
+}
+
+// A wrong SSE-C key doesn't prevent mounting, but makes existing objects
+// unreadable, so try to read one of them before mounting
+func (s *S3Backend) testSseCKey(key string) error {
+	prefix := ""
+	if slash := strings.LastIndex(key, "/"); slash != -1 {
+		prefix = key[0 : slash+1]
+	}
+	resp, err := s.ListBlobs(&ListBlobsInput{
+		Prefix:  &prefix,
+		MaxKeys: PUInt32(10),
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range resp.Items {
+		if strings.HasSuffix(*item.Key, "/") {
+			continue
+		}
+		_, err = s.HeadBlob(&HeadBlobInput{Key: *item.Key})
+		// Objects encrypted with another key return 403. Objects which aren't
+		// encrypted with SSE-C return 400, they're readable without the key
+		if mapAwsError(err) == syscall.EACCES {
+			s3Log.Errorf("%v can't be read with the --sse-c key, it's probably encrypted with another key: %v",
+				*item.Key, err)
+			return fmt.Errorf("%v can't be read with the --sse-c key: %v", *item.Key, err)
+		}
+		break
+	}
 	return nil
 }
 
@@ -503,6 +637,14 @@ func metadataToLower(m map[string]*string) map[string]*string {
 	return m
 }
 
+// Website redirect of the object to present as a symlink, if enabled
+func (s *S3Backend) websiteRedirect(redirect *string) *string {
+	if !s.flags.WebsiteRedirectSymlinks || redirect == nil || *redirect == "" {
+		return nil
+	}
+	return redirect
+}
+
 func (s *S3Backend) getRequestId(r *request.Request) string {
 	return r.HTTPResponse.Header.Get("x-amz-request-id") + ": " +
 		r.HTTPResponse.Header.Get("x-amz-id-2")
@@ -531,9 +673,12 @@ func (s *S3Backend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 			Size:         uint64(*resp.ContentLength),
 			StorageClass: resp.StorageClass,
 			Metadata:     metadataToLower(resp.Metadata),
+			Checksum:     getChecksum(req.HTTPResponse),
+			WebsiteRedirect: s.websiteRedirect(resp.WebsiteRedirectLocation),
 		},
 		ContentType: resp.ContentType,
 		IsDirBlob:   strings.HasSuffix(param.Key, "/"),
+		Restore:     resp.Restore,
 		RequestId:   s.getRequestId(req),
 	}, nil
 }
@@ -707,16 +852,19 @@ func (s *S3Backend) mpuCopyParts(size int64, from string, to string, mpuId strin
 }
 
 func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuId string,
-	srcEtag *string, metadata map[string]*string, storageClass *string) (requestId string, err error) {
+	srcEtag *string, metadata map[string]*string, storageClass *string, contentType *string) (requestId string, etag *string, err error) {
 	nParts, partSize := sizeToParts(size)
 	etags := make([]*string, nParts)
 
 	if mpuId == "" {
+		if contentType == nil {
+			contentType = s.flags.GetMimeType(to)
+		}
 		params := &s3.CreateMultipartUploadInput{
 			Bucket:       &s.bucket,
 			Key:          &to,
 			StorageClass: storageClass,
-			ContentType:  s.flags.GetMimeType(to),
+			ContentType:  contentType,
 			Metadata:     metadataToLower(metadata),
 		}
 
@@ -737,7 +885,7 @@ func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuI
 
 		resp, err := s.CreateMultipartUpload(params)
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 
 		mpuId = *resp.UploadId
@@ -767,12 +915,13 @@ func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuI
 
 		s3Log.Debug(params)
 
-		req, _ := s.CompleteMultipartUploadRequest(params)
+		req, resp := s.CompleteMultipartUploadRequest(params)
 		err = req.Send()
 		if err != nil {
 			s3Log.Errorf("Complete MPU %v = %v", params, err)
 		} else {
 			requestId = s.getRequestId(req)
+			etag = resp.ETag
 		}
 	}
 
@@ -801,7 +950,9 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 		if param.Metadata == nil {
 			param.Metadata = resp.Metadata
 		}
-		param.StorageClass = resp.StorageClass
+		if param.StorageClass == nil {
+			param.StorageClass = resp.StorageClass
+		}
 	}
 
 	if param.StorageClass == nil {
@@ -813,13 +964,17 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 	}
 
 	from := s.bucket + "/" + param.Source
+	contentType := s.flags.GetMimeType(param.Destination)
+	if param.Metadata != nil && param.ContentType != nil {
+		contentType = param.ContentType
+	}
 
 	if !s.gcs && *param.Size > s.config.MultipartCopyThreshold {
-		reqId, err := s.copyObjectMultipart(int64(*param.Size), from, param.Destination, "", param.ETag, param.Metadata, param.StorageClass)
+		reqId, etag, err := s.copyObjectMultipart(int64(*param.Size), from, param.Destination, "", param.ETag, param.Metadata, param.StorageClass, contentType)
 		if err != nil {
 			return nil, err
 		}
-		return &CopyBlobOutput{reqId}, nil
+		return &CopyBlobOutput{ETag: etag, RequestId: reqId}, nil
 	}
 
 	params := &s3.CopyObjectInput{
@@ -827,10 +982,14 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 		CopySource:        aws.String(pathEscape(from)),
 		Key:               &param.Destination,
 		StorageClass:      param.StorageClass,
-		ContentType:       s.flags.GetMimeType(param.Destination),
+		ContentType:       contentType,
 		Metadata:          metadataToLower(param.Metadata),
 		MetadataDirective: &metadataDirective,
 	}
+	if param.Metadata != nil {
+		params.WebsiteRedirectLocation = param.WebsiteRedirect
+		params.ContentEncoding = param.ContentEncoding
+	}
 
 	s3Log.Debug(params)
 
@@ -852,7 +1011,7 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 		params.ACL = &s.config.ACL
 	}
 
-	req, _ := s.CopyObjectRequest(params)
+	req, resp := s.CopyObjectRequest(params)
 	// make a shallow copy of the client so we can change the
 	// timeout only for this request but still re-use the
 	// connection pool
@@ -865,7 +1024,12 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 		return nil, err
 	}
 
-	return &CopyBlobOutput{s.getRequestId(req)}, nil
+	out := &CopyBlobOutput{RequestId: s.getRequestId(req)}
+	if resp.CopyObjectResult != nil {
+		out.ETag = resp.CopyObjectResult.ETag
+		out.LastModified = resp.CopyObjectResult.LastModified
+	}
+	return out, nil
 }
 
 func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
@@ -890,6 +1054,7 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 		get.Range = &bytes
 	}
 	// TODO handle IfMatch
+	get.VersionId = param.VersionId
 
 	req, resp := s.GetObjectRequest(&get)
 	err := req.Send()
@@ -906,6 +1071,7 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 				Size:         uint64(*resp.ContentLength),
 				StorageClass: resp.StorageClass,
 				Metadata:     metadataToLower(resp.Metadata),
+				WebsiteRedirect: s.websiteRedirect(resp.WebsiteRedirectLocation),
 			},
 			ContentType: resp.ContentType,
 		},
@@ -914,6 +1080,88 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 	}, nil
 }
 
+func (s *S3Backend) RestoreBlob(key string, days int64) error {
+	req, _ := s.RestoreObjectRequest(&s3.RestoreObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		RestoreRequest: &s3.RestoreRequest{
+			Days: &days,
+		},
+	})
+	err := req.Send()
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "RestoreAlreadyInProgress":
+			return nil
+		case "InvalidObjectState":
+			// The object isn't archived
+			return syscall.EINVAL
+		}
+	}
+	return err
+}
+
+func (s *S3Backend) GetBlobTags(key string) (map[string]string, error) {
+	resp, err := s.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(resp.TagSet))
+	for _, tag := range resp.TagSet {
+		tags[NilStr(tag.Key)] = NilStr(tag.Value)
+	}
+	return tags, nil
+}
+
+func (s *S3Backend) PutBlobTags(key string, tags map[string]string) error {
+	if len(tags) == 0 {
+		_, err := s.DeleteObjectTagging(&s3.DeleteObjectTaggingInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+		})
+		return err
+	}
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: PString(k), Value: PString(v)})
+	}
+	_, err := s.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  &s.bucket,
+		Key:     &key,
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+func (s *S3Backend) ListBlobVersions(key string) ([]BlobVersionOutput, error) {
+	versions := []BlobVersionOutput{}
+	err := s.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: &s.bucket,
+		Prefix: &key,
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			// Prefix also matches longer keys
+			if NilStr(v.Key) != key || v.VersionId == nil || v.LastModified == nil || v.Size == nil {
+				continue
+			}
+			versions = append(versions, BlobVersionOutput{
+				VersionId:    *v.VersionId,
+				LastModified: *v.LastModified,
+				Size:         uint64(*v.Size),
+				IsLatest:     v.IsLatest != nil && *v.IsLatest,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return versions, nil
+}
+
 func getDate(resp *http.Response) *time.Time {
 	date := resp.Header.Get("Date")
 	if date != "" {
@@ -927,9 +1175,33 @@ func getDate(resp *http.Response) *time.Time {
 	return nil
 }
 
+// Content checksum headers returned by HEAD if the object was uploaded with a checksum
+var checksumHeaders = []string{
+	"x-amz-checksum-sha256",
+	"x-amz-checksum-sha1",
+	"x-amz-checksum-crc32c",
+	"x-amz-checksum-crc32",
+	"Content-MD5",
+}
+
+func getChecksum(resp *http.Response) *string {
+	if resp == nil {
+		return nil
+	}
+	for _, h := range checksumHeaders {
+		v := resp.Header.Get(h)
+		if v != "" {
+			return PString(strings.ToLower(strings.TrimPrefix(h, "x-amz-checksum-"))+":"+v)
+		}
+	}
+	return nil
+}
+
 func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	storageClass := s.config.StorageClass
-	if param.Size != nil && *param.Size < 128*1024 && storageClass == "STANDARD_IA" {
+	if param.StorageClass != nil {
+		storageClass = *param.StorageClass
+	} else if param.Size != nil && *param.Size < 128*1024 && storageClass == "STANDARD_IA" {
 		storageClass = "STANDARD"
 	}
 
@@ -940,6 +1212,9 @@ func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 		Body:         param.Body,
 		StorageClass: &storageClass,
 		ContentType:  param.ContentType,
+		WebsiteRedirectLocation: param.WebsiteRedirect,
+		ContentEncoding: param.ContentEncoding,
+		ContentMD5:   param.ContentMD5,
 	}
 
 	if s.config.UseSSE {
@@ -977,6 +1252,10 @@ func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*Multipa
 		Key:          &param.Key,
 		StorageClass: &s.config.StorageClass,
 		ContentType:  param.ContentType,
+		ContentEncoding: param.ContentEncoding,
+	}
+	if param.StorageClass != nil {
+		mpu.StorageClass = param.StorageClass
 	}
 
 	if s.config.UseSSE {
@@ -1003,10 +1282,11 @@ func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*Multipa
 	}
 
 	return &MultipartBlobCommitInput{
-		Key:      &param.Key,
-		Metadata: mpu.Metadata,
-		UploadId: resp.UploadId,
-		Parts:    make([]*string, 10000), // at most 10K parts
+		Key:          &param.Key,
+		Metadata:     mpu.Metadata,
+		StorageClass: mpu.StorageClass,
+		UploadId:     resp.UploadId,
+		Parts:        make([]*string, 10000), // at most 10K parts
 	}, nil
 }
 
@@ -1017,6 +1297,7 @@ func (s *S3Backend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBl
 		PartNumber: aws.Int64(int64(param.PartNumber)),
 		UploadId:   param.Commit.UploadId,
 		Body:       param.Body,
+		ContentMD5: param.ContentMD5,
 	}
 	if s.config.SseC != "" {
 		params.SSECustomerAlgorithm = PString("AES256")
@@ -1094,6 +1375,12 @@ func (s *S3Backend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multi
 	req, resp := s.CompleteMultipartUploadRequest(&mpu)
 	err := req.Send()
 	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidPart" {
+			rejected := s.findRejectedParts(param)
+			if len(rejected) > 0 {
+				return nil, &MultipartPartsRejectedError{Parts: rejected, Err: err}
+			}
+		}
 		return nil, err
 	}
 
@@ -1102,10 +1389,38 @@ func (s *S3Backend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multi
 	return &MultipartBlobCommitOutput{
 		ETag:         resp.ETag,
 		LastModified: getDate(req.HTTPResponse),
+		StorageClass: param.StorageClass,
 		RequestId:    s.getRequestId(req),
 	}, nil
 }
 
+// Find parts which are missing on the server or differ from the ones we commit
+func (s *S3Backend) findRejectedParts(param *MultipartBlobCommitInput) (rejected []MPUPart) {
+	serverParts := make(map[int64]string)
+	err := s.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   &s.bucket,
+		Key:      param.Key,
+		UploadId: param.UploadId,
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			if p.PartNumber != nil && p.ETag != nil {
+				serverParts[*p.PartNumber] = *p.ETag
+			}
+		}
+		return true
+	})
+	if err != nil {
+		s3Log.Warnf("Failed to list parts of multipart upload %v of %v: %v", NilStr(param.UploadId), NilStr(param.Key), err)
+		return nil
+	}
+	for i := uint32(0); i < param.NumParts; i++ {
+		if param.Parts[i] != nil && serverParts[int64(i+1)] != *param.Parts[i] {
+			rejected = append(rejected, MPUPart{Num: i+1, ETag: *param.Parts[i]})
+		}
+	}
+	return
+}
+
 func (s *S3Backend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
 	mpu := s3.AbortMultipartUploadInput{
 		Bucket:   &s.bucket,
@@ -1121,34 +1436,61 @@ func (s *S3Backend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*Multip
 }
 
 func (s *S3Backend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
-	mpu, err := s.ListMultipartUploads(&s3.ListMultipartUploadsInput{
+	list := &s3.ListMultipartUploadsInput{
 		Bucket: &s.bucket,
-	})
+	}
+	if param.Prefix != "" {
+		list.Prefix = &param.Prefix
+	}
+	mpu, err := s.ListMultipartUploads(list)
 	if err != nil {
 		return nil, err
 	}
 	s3Log.Debug(mpu)
 
+	age := s.config.MultipartAge
+	if param.Age != 0 {
+		age = param.Age
+	}
 	go func() {
 		now := time.Now()
-		for _, upload := range mpu.Uploads {
-			expireTime := upload.Initiated.Add(s.config.MultipartAge)
-
-			if !expireTime.After(now) {
-				// FIXME: Maybe keep parts with known etags if we load them from disk
-				params := &s3.AbortMultipartUploadInput{
-					Bucket:   &s.bucket,
-					Key:      upload.Key,
-					UploadId: upload.UploadId,
+		for {
+			for _, upload := range mpu.Uploads {
+				expireTime := upload.Initiated.Add(age)
+
+				if !expireTime.After(now) && (param.Keep == nil || !param.Keep(*upload.Key, *upload.UploadId)) {
+					// FIXME: Maybe keep parts with known etags if we load them from disk
+					params := &s3.AbortMultipartUploadInput{
+						Bucket:   &s.bucket,
+						Key:      upload.Key,
+						UploadId: upload.UploadId,
+					}
+					resp, err := s.AbortMultipartUpload(params)
+					s3Log.Debug(resp)
+
+					if mapAwsError(err) == syscall.EACCES {
+						return
+					}
+					if err != nil {
+						s3Log.Warnf("Failed to abort stale multipart upload of %v (upload ID %v): %v",
+							*upload.Key, *upload.UploadId, err)
+					} else {
+						s3Log.Infof("Aborted stale multipart upload of %v (upload ID %v, initiated %v)",
+							*upload.Key, *upload.UploadId, *upload.Initiated)
+					}
+				} else {
+					s3Log.Debugf("Keeping MPU Key=%v Id=%v", *upload.Key, *upload.UploadId)
 				}
-				resp, err := s.AbortMultipartUpload(params)
-				s3Log.Debug(resp)
-
-				if mapAwsError(err) == syscall.EACCES {
-					break
-				}
-			} else {
-				s3Log.Debugf("Keeping MPU Key=%v Id=%v", *upload.Key, *upload.UploadId)
+			}
+			if mpu.IsTruncated == nil || !*mpu.IsTruncated {
+				return
+			}
+			list.KeyMarker = mpu.NextKeyMarker
+			list.UploadIdMarker = mpu.NextUploadIdMarker
+			mpu, err = s.ListMultipartUploads(list)
+			if err != nil {
+				s3Log.Warnf("Failed to list multipart uploads: %v", err)
+				return
 			}
 		}
 	}()
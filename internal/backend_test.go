@@ -16,6 +16,10 @@
 
 package internal
 
+import (
+	"sync"
+)
+
 type TestBackend struct {
 	StorageBackend
 	err error
@@ -118,3 +122,142 @@ func (s *TestBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartEx
 	}
 	return s.StorageBackend.MultipartExpire(param)
 }
+
+// Test backend which counts requests and lets tests intercept them.
+// Requests without a hook go to the wrapped backend, hooks may call it
+// through StorageBackend. Hooks are called without holding mu
+type HookBackend struct {
+	StorageBackend
+	mu sync.Mutex
+	calls map[string]int
+	// all GetBlob requests, to check read ranges
+	gets []GetBlobInput
+
+	head func(param *HeadBlobInput) (*HeadBlobOutput, error)
+	list func(param *ListBlobsInput) (*ListBlobsOutput, error)
+	del func(param *DeleteBlobInput) (*DeleteBlobOutput, error)
+	copy func(param *CopyBlobInput) (*CopyBlobOutput, error)
+	get func(param *GetBlobInput) (*GetBlobOutput, error)
+	put func(param *PutBlobInput) (*PutBlobOutput, error)
+	mpuBegin func(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error)
+	mpuAdd func(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error)
+	mpuAbort func(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error)
+	mpuCommit func(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error)
+}
+
+func (s *HookBackend) count(op string) {
+	s.mu.Lock()
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	s.calls[op]++
+	s.mu.Unlock()
+}
+
+// Number of requests of the type since the last reset
+func (s *HookBackend) Calls(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+func (s *HookBackend) ResetCalls() {
+	s.mu.Lock()
+	s.calls = nil
+	s.gets = nil
+	s.mu.Unlock()
+}
+
+func (s *HookBackend) Gets() []GetBlobInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]GetBlobInput{}, s.gets...)
+}
+
+func (s *HookBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	s.count("HeadBlob")
+	if s.head != nil {
+		return s.head(param)
+	}
+	return s.StorageBackend.HeadBlob(param)
+}
+
+func (s *HookBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	s.count("ListBlobs")
+	if s.list != nil {
+		return s.list(param)
+	}
+	return s.StorageBackend.ListBlobs(param)
+}
+
+func (s *HookBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	s.count("DeleteBlob")
+	if s.del != nil {
+		return s.del(param)
+	}
+	return s.StorageBackend.DeleteBlob(param)
+}
+
+func (s *HookBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	s.count("CopyBlob")
+	if s.copy != nil {
+		return s.copy(param)
+	}
+	return s.StorageBackend.CopyBlob(param)
+}
+
+func (s *HookBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	s.count("GetBlob")
+	s.mu.Lock()
+	s.gets = append(s.gets, *param)
+	s.mu.Unlock()
+	if s.get != nil {
+		return s.get(param)
+	}
+	return s.StorageBackend.GetBlob(param)
+}
+
+func (s *HookBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	s.count("PutBlob")
+	if s.put != nil {
+		return s.put(param)
+	}
+	return s.StorageBackend.PutBlob(param)
+}
+
+func (s *HookBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	s.count("MultipartBlobBegin")
+	if s.mpuBegin != nil {
+		return s.mpuBegin(param)
+	}
+	return s.StorageBackend.MultipartBlobBegin(param)
+}
+
+func (s *HookBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	s.count("MultipartBlobAdd")
+	if s.mpuAdd != nil {
+		return s.mpuAdd(param)
+	}
+	return s.StorageBackend.MultipartBlobAdd(param)
+}
+
+func (s *HookBackend) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobCopyOutput, error) {
+	s.count("MultipartBlobCopy")
+	return s.StorageBackend.MultipartBlobCopy(param)
+}
+
+func (s *HookBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	s.count("MultipartBlobAbort")
+	if s.mpuAbort != nil {
+		return s.mpuAbort(param)
+	}
+	return s.StorageBackend.MultipartBlobAbort(param)
+}
+
+func (s *HookBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	s.count("MultipartBlobCommit")
+	if s.mpuCommit != nil {
+		return s.mpuCommit(param)
+	}
+	return s.StorageBackend.MultipartBlobCommit(param)
+}
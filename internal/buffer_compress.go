@@ -0,0 +1,83 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// In-memory compression of dirty buffers. With --compress-buffers, buffers
+// which can't be evicted because they're not flushed yet are compressed when
+// memory is low and they weren't touched recently. Compressed data replaces
+// the original one in FileBuffer.data, FileBuffer.length stays the same, and
+// memory usage is accounted by the compressed size. Buffers are decompressed
+// again before any access to their data.
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Smaller buffers aren't worth compressing
+const MIN_COMPRESS_BUF = 64 * 1024
+
+// Compress a dirty buffer, return the amount of freed memory
+// LOCKS_REQUIRED(inode.mu)
+// LOCKS_REQUIRED(inode.fs.bufferPool.mu)
+func (inode *Inode) compressBuffer(buf *FileBuffer, skipRecent uint64) int64 {
+	if buf.compressed || buf.zero || buf.loading || buf.ptr == nil || buf.ptr.refs != 1 ||
+		buf.length < MIN_COMPRESS_BUF || skipRecent != 0 && buf.recency > skipRecent ||
+		inode.IsRangeLocked(buf.offset, buf.length, false) {
+		return 0
+	}
+	var out bytes.Buffer
+	w, _ := flate.NewWriter(&out, flate.BestSpeed)
+	w.Write(buf.data)
+	w.Close()
+	if uint64(out.Len()) > buf.length*9/10 {
+		// Incompressible, don't try again until the buffer is old again
+		buf.recency = atomic.LoadUint64(&inode.fs.memRecency)
+		return 0
+	}
+	compressed := append([]byte(nil), out.Bytes()...)
+	freed := int64(len(buf.ptr.mem)) - int64(len(compressed))
+	buf.data = compressed
+	buf.ptr = &BufferPointer{
+		mem:  compressed,
+		refs: 1,
+	}
+	buf.compressed = true
+	inode.fs.bufferPool.UseUnlocked(-freed, false)
+	return freed
+}
+
+// Decompress buffer data before accessing it
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) inflateBuffer(buf *FileBuffer) {
+	if !buf.compressed {
+		return
+	}
+	data := make([]byte, buf.length)
+	_, err := io.ReadFull(flate.NewReader(bytes.NewReader(buf.data)), data)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to decompress buffer %x+%x of %v: %v", buf.offset, buf.length, inode.FullName(), err))
+	}
+	// Other buffers can't be freed under the inode lock
+	inode.fs.bufferPool.Track(int64(len(data)) - int64(len(buf.ptr.mem)))
+	buf.data = data
+	buf.ptr = &BufferPointer{
+		mem:  data,
+		refs: 1,
+	}
+	buf.compressed = false
+}
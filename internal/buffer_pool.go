@@ -44,6 +44,12 @@ type BufferPool struct {
 	gcInterval uint64
 
 	FreeSomeCleanBuffers func(size int64) (int64, bool)
+
+	// clean buffers are evicted in the background when memory usage exceeds
+	// the high watermark, until it drops below the low one
+	lowWatermark int64
+	highWatermark int64
+	evictWakeup chan struct{}
 }
 
 // Several FileBuffers may be slices of the same array,
@@ -195,6 +201,32 @@ func (pool *BufferPool) recomputeBufferLimit() {
 		pool.limit >> 20, usedMem >> 20, (ms.Alloc-uint64(usedMem)) >> 20, ms.Sys >> 20)
 }
 
+// Enable background eviction between --cache-low-watermark and
+// --cache-high-watermark, given in percent of the memory limit
+func (pool *BufferPool) StartEvictor(lowPercent, highPercent int) {
+	if highPercent <= 0 {
+		return
+	}
+	pool.lowWatermark = pool.max * int64(lowPercent) / 100
+	pool.highWatermark = pool.max * int64(highPercent) / 100
+	pool.evictWakeup = make(chan struct{}, 1)
+	go pool.evictor()
+}
+
+func (pool *BufferPool) evictor() {
+	for range pool.evictWakeup {
+		pool.mu.Lock()
+		for atomic.LoadInt64(&pool.cur) > pool.lowWatermark {
+			freed, _ := pool.FreeSomeCleanBuffers(atomic.LoadInt64(&pool.cur) - pool.lowWatermark)
+			bufferLog.Debugf("Evicted %v, now: %v/%v", freed, atomic.LoadInt64(&pool.cur), pool.max)
+			if freed == 0 {
+				break
+			}
+		}
+		pool.mu.Unlock()
+	}
+}
+
 func (pool *BufferPool) Use(size int64, ignoreMemoryLimit bool) (err error) {
 	if size <= 0 {
 		atomic.AddInt64(&pool.cur, size)
@@ -206,6 +238,11 @@ func (pool *BufferPool) Use(size int64, ignoreMemoryLimit bool) (err error) {
 	return
 }
 
+// Account memory allocated when other buffers can't be freed, i.e. under an inode lock
+func (pool *BufferPool) Track(size int64) {
+	atomic.AddInt64(&pool.cur, size)
+}
+
 func (pool *BufferPool) UseUnlocked(size int64, ignoreMemoryLimit bool) error {
 	if size > 0 {
 		req := atomic.AddUint64(&pool.requested, uint64(size))
@@ -219,6 +256,13 @@ func (pool *BufferPool) UseUnlocked(size int64, ignoreMemoryLimit bool) error {
 
 	newSize := atomic.AddInt64(&pool.cur, size)
 
+	if size > 0 && pool.highWatermark > 0 && newSize > pool.highWatermark {
+		select {
+		case pool.evictWakeup <- struct{}{}:
+		default:
+		}
+	}
+
 	if size > 0 && newSize > pool.max {
 		// Try to free clean buffers, then flush dirty buffers
 		freed, canFreeMoreAsync := pool.FreeSomeCleanBuffers(newSize - pool.max)
@@ -0,0 +1,176 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+
+	. "github.com/yandex-cloud/geesefs/api/common"
+
+	"github.com/google/btree"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Order in which cached files are evicted (--cache-eviction).
+// Reads and opens report hits, DeRef forgets inodes, and the buffer
+// allocation path, the disk FD closer and the inode evictor walk
+// inodes with Pick starting from the first candidate for eviction
+type CachePolicy interface {
+	Hit(id fuseops.InodeID, hits int64)
+	// Read counter of the inode, -1 if it's not tracked
+	GetHits(id fuseops.InodeID) int64
+	// Next item after `prev` in the eviction order, the first one if `prev` is nil
+	Pick(prev CacheItem) CacheItem
+	Forget(id fuseops.InodeID)
+	Len() int
+}
+
+type CacheItem interface {
+	Id() fuseops.InodeID
+	Hits() int64
+}
+
+func NewCachePolicy(flags *FlagStorage) CachePolicy {
+	switch flags.CacheEviction {
+	case "lru":
+		return NewQueuePolicy(true)
+	case "fifo":
+		return NewQueuePolicy(false)
+	}
+	return NewLFRU(flags.CachePopularThreshold, flags.CacheMaxHits, flags.CacheAgeInterval, flags.CacheAgeDecrement,
+		flags.CacheRecencyLimit)
+}
+
+// LRU or FIFO eviction order
+type QueuePolicy struct {
+	mu sync.Mutex
+	// move items to the end of the queue on every hit (LRU) or never (FIFO)
+	moveOnHit bool
+	seq uint64
+	items map[fuseops.InodeID]*QueueItem
+	index *btree.BTree
+}
+
+func NewQueuePolicy(moveOnHit bool) *QueuePolicy {
+	return &QueuePolicy{
+		moveOnHit: moveOnHit,
+		items: make(map[fuseops.InodeID]*QueueItem),
+		index: btree.New(32),
+	}
+}
+
+func (c *QueuePolicy) Hit(id fuseops.InodeID, hits int64) {
+	c.mu.Lock()
+	item := c.items[id]
+	if item == nil {
+		c.seq++
+		item = &QueueItem{
+			id: id,
+			hits: hits,
+			seq: c.seq,
+		}
+		c.items[id] = item
+		c.index.ReplaceOrInsert(item)
+	} else {
+		item.hits += hits
+		if c.moveOnHit && item.seq != c.seq {
+			c.index.Delete(item)
+			c.seq++
+			item.seq = c.seq
+			c.index.ReplaceOrInsert(item)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *QueuePolicy) GetHits(id fuseops.InodeID) (r int64) {
+	c.mu.Lock()
+	item := c.items[id]
+	if item == nil {
+		r = -1
+	} else {
+		r = item.hits
+	}
+	c.mu.Unlock()
+	return r
+}
+
+func (c *QueuePolicy) Pick(prev CacheItem) CacheItem {
+	var next *QueueItem
+	c.mu.Lock()
+	if prev == nil {
+		c.index.Ascend(func(ai btree.Item) bool {
+			next = ai.(*QueueItem)
+			return false
+		})
+	} else {
+		// `prev` is a copy, so it keeps its position even if the item
+		// is moved to the end of the queue or forgotten meanwhile
+		p := prev.(*QueueItem)
+		c.index.AscendGreaterOrEqual(p, func(ai btree.Item) bool {
+			a := ai.(*QueueItem)
+			if p.Less(a) {
+				next = a
+				return false
+			}
+			return true
+		})
+	}
+	if next == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	r := *next
+	c.mu.Unlock()
+	return &r
+}
+
+func (c *QueuePolicy) Forget(id fuseops.InodeID) {
+	c.mu.Lock()
+	item := c.items[id]
+	if item != nil {
+		c.index.Delete(item)
+		delete(c.items, id)
+	}
+	c.mu.Unlock()
+}
+
+func (c *QueuePolicy) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+type QueueItem struct {
+	id fuseops.InodeID
+	hits int64
+	seq uint64
+}
+
+func (a *QueueItem) Less(bi btree.Item) bool {
+	b := bi.(*QueueItem)
+	if a.seq != b.seq {
+		return a.seq < b.seq
+	}
+	return a.id < b.id
+}
+
+func (a *QueueItem) Id() fuseops.InodeID {
+	return a.id
+}
+
+func (a *QueueItem) Hits() int64 {
+	return a.hits
+}
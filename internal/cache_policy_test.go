@@ -0,0 +1,60 @@
+package internal
+
+import (
+	. "gopkg.in/check.v1"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type CachePolicyTest struct{}
+
+var _ = Suite(&CachePolicyTest{})
+
+func pickAll(c CachePolicy) (ids []fuseops.InodeID) {
+	for i := c.Pick(nil); i != nil; i = c.Pick(i) {
+		ids = append(ids, i.Id())
+	}
+	return
+}
+
+func (s *CachePolicyTest) TestLRU(t *C) {
+	c := NewQueuePolicy(true)
+	c.Hit(1, 0)
+	c.Hit(2, 0)
+	c.Hit(3, 0)
+	c.Hit(1, 1)
+	t.Assert(pickAll(c), DeepEquals, []fuseops.InodeID{2, 3, 1})
+	t.Assert(c.GetHits(1), Equals, int64(1))
+	t.Assert(c.GetHits(4), Equals, int64(-1))
+	c.Forget(3)
+	t.Assert(pickAll(c), DeepEquals, []fuseops.InodeID{2, 1})
+	t.Assert(c.Len(), Equals, 2)
+}
+
+func (s *CachePolicyTest) TestFIFO(t *C) {
+	c := NewQueuePolicy(false)
+	c.Hit(1, 0)
+	c.Hit(2, 0)
+	c.Hit(3, 0)
+	c.Hit(1, 5)
+	t.Assert(pickAll(c), DeepEquals, []fuseops.InodeID{1, 2, 3})
+	t.Assert(c.GetHits(1), Equals, int64(5))
+}
+
+func (s *CachePolicyTest) TestLRUPickMoved(t *C) {
+	c := NewQueuePolicy(true)
+	c.Hit(1, 0)
+	c.Hit(2, 0)
+	c.Hit(3, 0)
+	i := c.Pick(nil)
+	t.Assert(i.Id(), Equals, fuseops.InodeID(1))
+	// Moving the picked item to the end doesn't skip the rest of the queue
+	c.Hit(1, 1)
+	i = c.Pick(i)
+	t.Assert(i.Id(), Equals, fuseops.InodeID(2))
+	c.Forget(2)
+	i = c.Pick(i)
+	t.Assert(i.Id(), Equals, fuseops.InodeID(3))
+	i = c.Pick(i)
+	t.Assert(i.Id(), Equals, fuseops.InodeID(1))
+	t.Assert(c.Pick(i), IsNil)
+}
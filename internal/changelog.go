@@ -0,0 +1,203 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Changelog of local modifications. With --changelog, the mount root gets
+// a hidden virtual directory ".geesefs" with a read-only "changelog" file.
+// It's a stream of JSON lines, one per created, modified, deleted or renamed
+// object since the mount. Only the last CHANGELOG_MAX_SIZE bytes are kept.
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const CONTROL_DIR_NAME = ".geesefs"
+const CHANGELOG_NAME = "changelog"
+const CHANGELOG_MAX_SIZE = 16*1024*1024
+
+type ChangeLog struct {
+	mu sync.Mutex
+	data []byte
+	// stream offset of data[0]
+	start uint64
+}
+
+type changeLogEntry struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	Key  string    `json:"key"`
+	From string    `json:"from,omitempty"`
+}
+
+func (l *ChangeLog) Add(op string, key string, from string) {
+	line, err := json.Marshal(&changeLogEntry{
+		Time: time.Now(),
+		Op:   op,
+		Key:  key,
+		From: from,
+	})
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.data = append(append(l.data, line...), '\n')
+	if len(l.data) > CHANGELOG_MAX_SIZE {
+		// Forget the older half
+		drop := len(l.data) - CHANGELOG_MAX_SIZE/2
+		for drop < len(l.data) && l.data[drop-1] != '\n' {
+			drop++
+		}
+		l.start += uint64(drop)
+		l.data = append([]byte(nil), l.data[drop:]...)
+	}
+}
+
+// Stream size, including forgotten entries
+func (l *ChangeLog) Size() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.start + uint64(len(l.data))
+}
+
+// Read from the stream. Forgotten entries are skipped
+func (l *ChangeLog) Read(offset uint64, size uint64) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset < l.start {
+		offset = l.start
+	}
+	end := offset+size
+	if end > l.start+uint64(len(l.data)) {
+		end = l.start+uint64(len(l.data))
+	}
+	if offset >= end {
+		return nil
+	}
+	return append([]byte(nil), l.data[offset-l.start:end-l.start]...)
+}
+
+// Create the control directory with the changelog
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) enableChangeLog() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	root := fs.inodes[fuseops.RootInodeID]
+
+	dir := NewInode(fs, root, CONTROL_DIR_NAME)
+	dir.ToDir()
+	dir.Attributes.Mode = fs.flags.DirMode &^ 0222 | os.ModeDir
+	dir.Attributes.Mtime = fs.rootAttrs.Mtime
+	dir.Attributes.Ctime = fs.rootAttrs.Ctime
+	dir.userMetadata = make(map[string][]byte)
+	dir.Id = fs.allocateInodeId()
+	// Control inodes are never forgotten
+	dir.refcnt = 1
+	fs.inodes[dir.Id] = dir
+
+	file := NewInode(fs, dir, CHANGELOG_NAME)
+	file.Attributes.Mode = fs.flags.FileMode &^ 0222
+	file.Attributes.Mtime = fs.rootAttrs.Mtime
+	file.Attributes.Ctime = fs.rootAttrs.Ctime
+	file.userMetadata = make(map[string][]byte)
+	file.Id = fs.allocateInodeId()
+	file.refcnt = 1
+	fs.inodes[file.Id] = file
+
+	fs.changeLog = &ChangeLog{}
+	fs.controlDir = dir
+	fs.changeLogFile = file
+}
+
+// Record a change of the inode, if the changelog is enabled
+func (inode *Inode) logChange(op string, from string) {
+	if inode.fs.changeLog == nil || inode.isVirtual() {
+		return
+	}
+	_, key := inode.cloud()
+	if inode.isDir() {
+		key += "/"
+		if from != "" {
+			from += "/"
+		}
+	}
+	inode.fs.changeLog.Add(op, key, from)
+}
+
+// Look up the control directory and files in it
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) lookUpControl(op *fuseops.LookUpInodeOp) (handled bool, err error) {
+	if fs.changeLog == nil {
+		return false, nil
+	}
+	var inode *Inode
+	if op.Parent == fuseops.RootInodeID && op.Name == CONTROL_DIR_NAME {
+		inode = fs.controlDir
+	} else if op.Parent == fs.controlDir.Id && op.Name == CHANGELOG_NAME {
+		inode = fs.changeLogFile
+	} else if op.Parent == fs.controlDir.Id {
+		return true, fuse.ENOENT
+	} else {
+		return false, nil
+	}
+	inode.Ref()
+	op.Entry.Child = inode.Id
+	op.Entry.Attributes = inode.controlAttributes()
+	return true, nil
+}
+
+// Check if the name is the control directory or is inside it
+// or inside a version history directory
+func (fs *Goofys) isControlPath(parent *Inode, name string) bool {
+	return parent.versionsOf != nil || fs.changeLog != nil && (parent == fs.controlDir ||
+		parent.Id == fuseops.RootInodeID && name == CONTROL_DIR_NAME) ||
+		// The name of --dir-mtime-marker objects is reserved
+		fs.isMtimeMarker(name)
+}
+
+// Attributes of control inodes, the changelog grows all the time
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) controlAttributes() fuseops.InodeAttributes {
+	if inode == inode.fs.changeLogFile {
+		inode.mu.Lock()
+		inode.Attributes.Size = inode.fs.changeLog.Size()
+		inode.mu.Unlock()
+	}
+	return inode.InflateAttributes()
+}
+
+// List the control directory
+func (fs *Goofys) readControlDir(op *fuseops.ReadDirOp) {
+	entries := []fuseutil.Dirent{
+		{Name: ".", Type: fuseutil.DT_Directory, Inode: fs.controlDir.Id},
+		{Name: "..", Type: fuseutil.DT_Directory, Inode: fuseops.RootInodeID},
+		{Name: CHANGELOG_NAME, Type: fuseutil.DT_File, Inode: fs.changeLogFile.Id},
+	}
+	for i := int(op.Offset); i < len(entries); i++ {
+		e := entries[i]
+		e.Offset = fuseops.DirOffset(i+1)
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+		op.BytesRead += n
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// End-to-end checksums. With --verify-checksums, CRC32C of every uploaded
+// object or part is saved in the object metadata as "<size>:<crc>,<size>:<crc>,..."
+// (one entry for single-part uploads, one per part for multipart uploads).
+// Reads of such objects are extended to whole checksummed units and every
+// unit is verified before its data is added to the cache.
+// Compressed objects and multipart uploads with server-side copied parts
+// don't get checksums.
+package internal
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const CHECKSUM_ATTR = "geesefs-crc32c"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type checksumUnit struct {
+	offset uint64
+	size uint64
+	crc uint32
+}
+
+// CRC32C of the upload body
+func bodyCRC32C(body io.ReadSeeker) (uint32, error) {
+	hash := crc32.New(crc32cTable)
+	_, err := io.Copy(hash, body)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+func parseChecksums(value string) ([]checksumUnit, error) {
+	var units []checksumUnit
+	offset := uint64(0)
+	for _, entry := range strings.Split(value, ",") {
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad checksum entry: %v", entry)
+		}
+		size, err := strconv.ParseUint(kv[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad checksum entry: %v", entry)
+		}
+		crc, err := strconv.ParseUint(kv[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad checksum entry: %v", entry)
+		}
+		units = append(units, checksumUnit{offset: offset, size: size, crc: uint32(crc)})
+		offset += size
+	}
+	return units, nil
+}
+
+func formatChecksums(units []checksumUnit) string {
+	entries := make([]string, len(units))
+	for i, u := range units {
+		entries[i] = fmt.Sprintf("%v:%08x", u.size, u.crc)
+	}
+	return strings.Join(entries, ",")
+}
+
+// Remove checksums from user metadata and remember them
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setChecksums() {
+	inode.checksums = nil
+	value := inode.userMetadata[CHECKSUM_ATTR]
+	if value == nil {
+		return
+	}
+	delete(inode.userMetadata, CHECKSUM_ATTR)
+	units, err := parseChecksums(string(value))
+	if err != nil {
+		log.Warnf("Ignoring checksums of %v: %v", inode.FullName(), err)
+		return
+	}
+	inode.checksums = units
+}
+
+// Remember checksums of the parts of the just completed multipart upload.
+// They're only saved if all parts were uploaded by us
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) recordPartChecksums(mpu *MultipartBlobCommitInput, finalSize uint64) {
+	partChecksums := inode.partChecksums
+	inode.partChecksums = nil
+	if !inode.fs.flags.VerifyChecksums {
+		return
+	}
+	numParts := mpu.NumParts
+	units := make([]checksumUnit, 0, numParts)
+	for i := uint32(0); i < numParts; i++ {
+		offset, size := inode.partRange(uint64(i))
+		if i == numParts-1 || offset+size > finalSize {
+			size = finalSize - offset
+		}
+		u, ok := partChecksums[uint64(i)]
+		if !ok || u.offset != offset || u.size != size {
+			return
+		}
+		units = append(units, u)
+	}
+	if !inode.metadataFits(CHECKSUM_ATTR, formatChecksums(units)) {
+		log.Warnf("Checksums of %v (%v parts) don't fit into --max-metadata-size, not saving them",
+			inode.FullName(), numParts)
+		return
+	}
+	inode.checksums = units
+	// Save them with a metadata update
+	inode.userMetadataDirty = 2
+}
+
+// Extend server requests to whole checksummed units so that all loaded data
+// can be verified. Ranges past the last unit are left as is
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) alignToChecksums(requests []uint64) []uint64 {
+	last := inode.checksums[len(inode.checksums)-1]
+	unitsEnd := last.offset+last.size
+	aligned := make([]uint64, 0, len(requests))
+	for i := 0; i < len(requests); i += 2 {
+		start, end := requests[i], requests[i]+requests[i+1]
+		for _, u := range inode.checksums {
+			if u.offset+u.size <= start || u.offset >= end {
+				continue
+			}
+			if n := len(aligned); n > 0 && aligned[n-2]+aligned[n-1] > u.offset {
+				// Already requested for the previous range
+				continue
+			}
+			aligned = append(aligned, u.offset, u.size)
+		}
+		if end > unitsEnd {
+			if start < unitsEnd {
+				start = unitsEnd
+			}
+			aligned = append(aligned, start, end-start)
+		}
+	}
+	return aligned
+}
+
+// Checksum of exactly this range, if it's a checksummed unit
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) checksumFor(offset, size uint64) (crc uint32, ok bool) {
+	for _, u := range inode.checksums {
+		if u.offset == offset && u.size == size {
+			return u.crc, true
+		}
+	}
+	return 0, false
+}
+
+// Check if checksums can be used to verify data read from the server,
+// i.e. if they describe the whole known object and it isn't truncated locally
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) hasChecksums() bool {
+	if !inode.fs.flags.VerifyChecksums || len(inode.checksums) == 0 {
+		return false
+	}
+	last := inode.checksums[len(inode.checksums)-1]
+	return last.offset+last.size == inode.knownSize && inode.Attributes.Size >= inode.knownSize
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Compression of uploaded objects. Compressed objects are stored with
+// Content-Encoding: gzip or zstd and their real size and encoding in the
+// metadata. Ranged reads of the original data are impossible, so they're
+// always loaded as a whole.
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	UNCOMPRESSED_SIZE_ATTR = "geesefs-uncompressed-size"
+	// Objects compressed before zstd support was added don't have it
+	COMPRESSION_ATTR = "geesefs-compression"
+)
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) shouldCompress(size uint64) bool {
+	flags := inode.fs.flags
+	if flags.UploadCompression == "" || size < flags.UploadCompressionMinKB*1024 {
+		return false
+	}
+	return !flags.UploadCompressionSkip[strings.ToLower(path.Ext(inode.Name))]
+}
+
+// Parts of a compressed object can't be uploaded separately, so files larger
+// than --single-part are compressed as a whole after they're closed and then
+// uploaded in parts cut from the compressed data. It's only done when all data
+// of the file is in memory, otherwise it's uploaded uncompressed
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) compressWhole() bool {
+	if inode.mpu != nil || inode.fileHandles != 0 && !inode.forceFlush ||
+		!inode.shouldCompress(inode.Attributes.Size) {
+		return false
+	}
+	end := uint64(0)
+	for _, b := range inode.buffers {
+		if b.state == BUF_FL_CLEARED || b.loading || b.ptr == nil && !b.zero ||
+			// Ranges without buffers are zeroes only in new files
+			b.offset != end && inode.CacheState != ST_CREATED {
+			return false
+		}
+		end = b.offset+b.length
+	}
+	return end >= inode.Attributes.Size || inode.CacheState == ST_CREATED
+}
+
+func compressData(r io.Reader, encoding string, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		w, err = gzip.NewWriterLevel(&buf, level)
+	case "zstd":
+		zlevel := zstd.SpeedDefault
+		if level != -1 {
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		w, err = zstd.NewWriter(&buf, zstd.WithEncoderLevel(zlevel), zstd.WithEncoderConcurrency(1))
+	default:
+		err = fmt.Errorf("unknown compression %v", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+	body io.ReadCloser
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.body.Close()
+}
+
+// Wrap the body of a compressed object into a decompressing reader
+func decompressReader(body io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gz, body}, nil
+	case "zstd":
+		dec, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{dec, body}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %v", encoding)
+}
+
+// Object metadata including the real size and the encoding of the compressed object
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) uploadMetadata(uncompressedSize uint64, encoding string) map[string]*string {
+	meta := escapeMetadata(inode.userMetadata)
+	if uncompressedSize != 0 {
+		if meta == nil {
+			meta = make(map[string]*string)
+		}
+		meta[UNCOMPRESSED_SIZE_ATTR] = PString(strconv.FormatUint(uncompressedSize, 10))
+		meta[COMPRESSION_ATTR] = PString(encoding)
+	}
+	return meta
+}
+
+// Remove the real size and encoding attributes from user metadata and remember them
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setUncompressedSize() {
+	sizeStr := inode.userMetadata[UNCOMPRESSED_SIZE_ATTR]
+	encoding := inode.userMetadata[COMPRESSION_ATTR]
+	inode.uncompressedSize = 0
+	inode.compression = ""
+	delete(inode.userMetadata, COMPRESSION_ATTR)
+	if sizeStr == nil {
+		return
+	}
+	delete(inode.userMetadata, UNCOMPRESSED_SIZE_ATTR)
+	size, err := strconv.ParseUint(string(sizeStr), 10, 64)
+	if err != nil {
+		return
+	}
+	inode.uncompressedSize = size
+	inode.compression = "gzip"
+	if encoding != nil {
+		inode.compression = string(encoding)
+	}
+	if inode.CacheState == ST_CACHED && len(inode.buffers) == 0 {
+		inode.Attributes.Size = size
+		inode.updateUsedBlocks()
+	}
+}
+
+// Compressed object can't be partially copied on the server, so reupload
+// all of its data when it has to be flushed using a multipart upload
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) dirtyCompressedData() error {
+	size := inode.uncompressedSize
+	if size > inode.Attributes.Size {
+		size = inode.Attributes.Size
+	}
+	inode.LockRange(0, size, true)
+	_, err := inode.LoadRange(0, size, 0, true)
+	inode.UnlockRange(0, size, true)
+	if err != nil {
+		return err
+	}
+	for _, b := range inode.buffers {
+		if b.offset >= size {
+			break
+		}
+		if b.dirtyID == 0 {
+			inode.fs.addDirty(int64(b.length))
+			b.dirtyID = atomic.AddUint64(&inode.fs.bufferPool.curDirtyID, 1)
+			b.state = BUF_DIRTY
+		}
+	}
+	inode.uncompressedSize = 0
+	inode.compression = ""
+	return nil
+}
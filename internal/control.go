@@ -0,0 +1,490 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Control xattrs. They are handled by GeeseFS itself, never stored
+// in object metadata and not returned by listxattr.
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const CONTROL_XATTR_PREFIX = "geesefs."
+
+// Read-only flush progress of a file. It's in the user namespace so that
+// unprivileged tools can read it, but it's never stored in object metadata
+const FLUSH_PROGRESS_XATTR = "user.geesefs.flush-progress"
+
+// Stop counting prefix stats after this number of objects
+const PREFIX_STATS_MAX_OBJECTS = 10000000
+
+// Value of FLUSH_PROGRESS_XATTR:
+// <flushed bytes>/<modified bytes>,state=<cache state>,parts=<uploaded parts>,flushing=<bool>
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) getFlushProgress() ([]byte, error) {
+	if inode.isDir() {
+		return nil, syscall.ENODATA
+	}
+	inode.mu.Lock()
+	flushed, dirty := inode.flushProgress()
+	parts := 0
+	if inode.mpu != nil {
+		for _, part := range inode.mpu.Parts {
+			if part != nil {
+				parts++
+			}
+		}
+	}
+	flushing := inode.IsFlushing > 0 || inode.forceFlush
+	state := inode.CacheState
+	inode.mu.Unlock()
+	return []byte(fmt.Sprintf("%v/%v,state=%v,parts=%v,flushing=%v",
+		flushed, dirty, cacheStateNames[state], parts, flushing)), nil
+}
+
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) getControlXattr(name string) ([]byte, error) {
+	fs := inode.fs
+	isRoot := inode.Id == fuseops.RootInodeID
+	switch {
+	case name == "pause-flush" && isRoot:
+		if atomic.LoadInt32(&fs.flushPaused) != 0 {
+			return []byte("1"), nil
+		}
+		return []byte("0"), nil
+	case name == "inode-count" && isRoot:
+		fs.mu.RLock()
+		count := len(fs.inodes)
+		fs.mu.RUnlock()
+		return []byte(strconv.Itoa(count)), nil
+	case name == "cache-balance" && isRoot:
+		memory, disk := fs.cacheBalance()
+		return []byte(fmt.Sprintf("memory=%v disk=%v", memory, disk)), nil
+	case name == "cache-occupancy" && isRoot:
+		return []byte(fmt.Sprintf("used=%v limit=%v low=%v high=%v files=%v",
+			atomic.LoadInt64(&fs.bufferPool.cur), fs.bufferPool.max, fs.bufferPool.lowWatermark,
+			fs.bufferPool.highWatermark, fs.cachePolicy.Len())), nil
+	case name == "readahead-bytes" && isRoot:
+		return []byte(strconv.FormatInt(atomic.LoadInt64(&fs.readAheadBytes), 10)), nil
+	case name == "dirty-bytes" && isRoot:
+		return []byte(fmt.Sprintf("dirty=%v limit=%v", atomic.LoadInt64(&fs.metrics.dirtyBytes),
+			fs.flags.MaxDirtyBytes)), nil
+	case name == "flush-pending" && isRoot:
+		inodes, bytes := fs.flushBacklog()
+		return []byte(fmt.Sprintf("inodes=%v bytes=%v", inodes, bytes)), nil
+	case name == "flush-stats" && isRoot:
+		inodes, bytes := fs.flushBacklog()
+		throughput, avgFlushTime := fs.flushStats.Get()
+		return []byte(fmt.Sprintf("inodes=%v bytes=%v throughput=%v avg-flush-ms=%v",
+			inodes, bytes, throughput, avgFlushTime.Milliseconds())), nil
+	case name == "ttl" && inode.isDir():
+		return []byte(inode.attrTTL().String()), nil
+	case name == "trash" && isRoot && fs.flags.Trash != "":
+		// One "<time>/<path>" line per trashed file
+		list, err := fs.listTrash()
+		if err != nil {
+			return nil, mapAwsError(err)
+		}
+		return []byte(list), nil
+	case name == "prefix-stats" && inode.isDir():
+		stats, err := inode.prefixStats()
+		if err != nil {
+			return nil, mapAwsError(err)
+		}
+		return []byte(stats), nil
+	case name == "bytes-read":
+		return []byte(strconv.FormatUint(atomic.LoadUint64(&inode.bytesRead), 10)), nil
+	case name == "bytes-written":
+		return []byte(strconv.FormatUint(atomic.LoadUint64(&inode.bytesWritten), 10)), nil
+	case name == "read-progress" && !inode.isDir():
+		inode.mu.Lock()
+		cached, size := inode.readProgress()
+		inode.mu.Unlock()
+		return []byte(fmt.Sprintf("cached=%v size=%v", cached, size)), nil
+	case name == "part-manifest" && !inode.isDir():
+		// Part layout of the last multipart upload
+		inode.mu.Lock()
+		manifest := inode.partManifest
+		unsaved := inode.partManifestUnsaved
+		inode.mu.Unlock()
+		if manifest == "" {
+			return nil, syscall.ENODATA
+		}
+		parts, err := parsePartManifest(manifest)
+		if err != nil {
+			log.Warnf("Failed to parse part manifest of %v: %v", inode.FullName(), err)
+			return nil, syscall.EIO
+		}
+		value := formatPartManifest(parts)
+		if unsaved {
+			value += PART_MANIFEST_UNSAVED
+		}
+		return []byte(value), nil
+	case name == "flush-error":
+		// Last flush error and the time left until the next retry
+		inode.mu.Lock()
+		defer inode.mu.Unlock()
+		if inode.flushError == nil {
+			return nil, syscall.ENODATA
+		}
+		retryIn := inode.flushRetryDelay() - time.Since(inode.flushErrorTime)
+		if retryIn < 0 {
+			retryIn = 0
+		}
+		// failures=<count>,delay=<retry delay>,retry-in=<time left>,error=<message>
+		return []byte(fmt.Sprintf("failures=%v,delay=%v,retry-in=%v,error=%v", inode.flushErrors,
+			inode.flushRetryDelay(), retryIn.Round(time.Second), inode.flushError)), nil
+	}
+	return nil, syscall.ENODATA
+}
+
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) setControlXattr(name string, value []byte) error {
+	fs := inode.fs
+	isRoot := inode.Id == fuseops.RootInodeID
+	switch {
+	case name == "pause-flush" && isRoot:
+		pause, err := strconv.ParseBool(string(value))
+		if err != nil {
+			return syscall.EINVAL
+		}
+		fs.PauseFlush(pause)
+		return nil
+	case name == "cache-balance" && isRoot:
+		// spill=N moves N% of clean buffers from memory to the disk cache,
+		// promote=N loads N% of buffers from the disk cache back into memory
+		kv := strings.SplitN(string(value), "=", 2)
+		if len(kv) != 2 {
+			return syscall.EINVAL
+		}
+		percent, err := strconv.Atoi(kv[1])
+		if err != nil || percent < 0 || percent > 100 {
+			return syscall.EINVAL
+		}
+		if fs.flags.CachePath == "" {
+			return syscall.ENOTSUP
+		}
+		switch kv[0] {
+		case "spill":
+			fs.spillToDisk(percent)
+		case "promote":
+			fs.promoteFromDisk(percent)
+		default:
+			return syscall.EINVAL
+		}
+		return nil
+	case name == "ttl" && inode.isDir():
+		// Metadata cache TTL of the subtree, empty value restores the inherited one.
+		// It's only kept in memory, so it's lost on unmount
+		ttl := int64(0)
+		if len(value) > 0 {
+			d, err := time.ParseDuration(string(value))
+			if err != nil || d < 0 {
+				return syscall.EINVAL
+			}
+			ttl = int64(d)
+			if ttl == 0 {
+				ttl = -1
+			}
+		}
+		atomic.StoreInt64(&inode.dir.attrTTL, ttl)
+		return nil
+	case name == "restore" && isRoot && fs.flags.Trash != "":
+		// Move a file listed by geesefs.trash back to its path
+		return fs.restoreFromTrash(strings.TrimSpace(string(value)))
+	}
+	return syscall.EINVAL
+}
+
+// Metadata cache TTL of the inode: set for the nearest directory
+// with the geesefs.ttl xattr, or --stat-cache-ttl
+func (inode *Inode) attrTTL() time.Duration {
+	dir := inode
+	if !dir.isDir() {
+		dir = inode.Parent
+	}
+	for ; dir != nil && dir.dir != nil; dir = dir.Parent {
+		ttl := atomic.LoadInt64(&dir.dir.attrTTL)
+		if ttl < 0 {
+			return 0
+		} else if ttl > 0 {
+			return time.Duration(ttl)
+		}
+	}
+	return inode.fs.flags.StatCacheTTL
+}
+
+// Pause or resume all uploads to the server
+func (fs *Goofys) PauseFlush(pause bool) {
+	if pause {
+		if atomic.CompareAndSwapInt32(&fs.flushPaused, 0, 1) {
+			inodes, bytes := fs.flushBacklog()
+			log.Infof("Flushing paused, %v inodes with %v dirty bytes are pending", inodes, bytes)
+		}
+	} else if atomic.CompareAndSwapInt32(&fs.flushPaused, 1, 0) {
+		inodes, bytes := fs.flushBacklog()
+		log.Infof("Flushing resumed, %v inodes with %v dirty bytes are pending", inodes, bytes)
+		fs.WakeupFlusher()
+	}
+}
+
+// Count objects under the directory prefix and their total size. It requires
+// a full listing, so the result is cached for --prefix-stats-ttl. Huge prefixes
+// are only counted up to PREFIX_STATS_MAX_OBJECTS and reported as incomplete
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) prefixStats() (string, error) {
+	start := time.Now()
+	inode.mu.Lock()
+	for inode.dir.prefixStatsLoading != nil {
+		// Another listing is in progress, use its result
+		loading := inode.dir.prefixStatsLoading
+		inode.mu.Unlock()
+		<-loading
+		inode.mu.Lock()
+	}
+	if inode.dir.prefixStats != "" && (!inode.dir.prefixStatsTime.Before(start) ||
+		!expired(inode.dir.prefixStatsTime, inode.fs.flags.PrefixStatsTTL)) {
+		stats := inode.dir.prefixStats
+		inode.mu.Unlock()
+		return stats, nil
+	}
+	cloud, prefix := inode.cloud()
+	loading := make(chan struct{})
+	inode.dir.prefixStatsLoading = loading
+	inode.mu.Unlock()
+	defer func() {
+		inode.mu.Lock()
+		inode.dir.prefixStatsLoading = nil
+		inode.mu.Unlock()
+		close(loading)
+	}()
+	if prefix != "" {
+		prefix += "/"
+	}
+	var objects, bytes uint64
+	var startAfter *string
+	complete := false
+	for objects < PREFIX_STATS_MAX_OBJECTS {
+		resp, err := cloud.ListBlobs(&ListBlobsInput{
+			Prefix:     &prefix,
+			StartAfter: startAfter,
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, item := range resp.Items {
+			objects++
+			bytes += item.Size
+		}
+		if !resp.IsTruncated || len(resp.Items) == 0 {
+			complete = true
+			break
+		}
+		// NextContinuationToken is not returned without delimiter
+		startAfter = resp.Items[len(resp.Items)-1].Key
+	}
+	stats := fmt.Sprintf("objects=%v bytes=%v complete=%v", objects, bytes, complete)
+	inode.mu.Lock()
+	inode.dir.prefixStats = stats
+	inode.dir.prefixStatsTime = time.Now()
+	inode.mu.Unlock()
+	return stats, nil
+}
+
+// Count modified inodes and their dirty data
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) flushBacklog() (inodes int, bytes uint64) {
+	fs.mu.RLock()
+	all := make([]*Inode, 0, len(fs.inodes))
+	for _, inode := range fs.inodes {
+		all = append(all, inode)
+	}
+	fs.mu.RUnlock()
+	for _, inode := range all {
+		inode.mu.Lock()
+		if inode.CacheState == ST_CREATED || inode.CacheState == ST_MODIFIED ||
+			inode.CacheState == ST_DELETED {
+			inodes++
+			for _, b := range inode.buffers {
+				if b.dirtyID != 0 {
+					bytes += b.length
+				}
+			}
+		}
+		inode.mu.Unlock()
+	}
+	return
+}
+
+// Bytes of the file available in memory or disk cache
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) readProgress() (cached, size uint64) {
+	size = inode.Attributes.Size
+	for _, b := range inode.buffers {
+		if b.loading || b.offset >= size {
+			continue
+		}
+		if b.ptr != nil || b.zero || b.onDisk {
+			end := b.offset+b.length
+			if end > size {
+				end = size
+			}
+			cached += end-b.offset
+		}
+	}
+	return
+}
+
+// Modified bytes of the file already uploaded as parts vs all modified bytes
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) flushProgress() (flushed, dirty uint64) {
+	for _, b := range inode.buffers {
+		if b.dirtyID != 0 {
+			dirty += b.length
+			if b.state != BUF_DIRTY {
+				flushed += b.length
+			}
+		}
+	}
+	return
+}
+
+// Inodes with cached data, least used first
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) cachedInodes() []*Inode {
+	fs.mu.RLock()
+	all := make([]*Inode, 0, len(fs.inodes))
+	for _, inode := range fs.inodes {
+		if !inode.isDir() {
+			all = append(all, inode)
+		}
+	}
+	fs.mu.RUnlock()
+	hits := make(map[*Inode]int64, len(all))
+	for _, inode := range all {
+		hits[inode] = fs.cachePolicy.GetHits(inode.Id)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return hits[all[i]] < hits[all[j]]
+	})
+	return all
+}
+
+// Count cached bytes in memory and in the disk cache
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) cacheBalance() (memory, disk uint64) {
+	for _, inode := range fs.cachedInodes() {
+		inode.mu.Lock()
+		for _, b := range inode.buffers {
+			if b.ptr != nil {
+				memory += b.length
+			}
+			if b.onDisk {
+				disk += b.length
+			}
+		}
+		inode.mu.Unlock()
+	}
+	return
+}
+
+// Write clean buffers of least used files to the disk cache and free their memory
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) spillToDisk(percent int) (spilled uint64) {
+	memory, _ := fs.cacheBalance()
+	target := memory * uint64(percent) / 100
+	for _, inode := range fs.cachedInodes() {
+		if spilled >= target {
+			break
+		}
+		inode.mu.Lock()
+		for _, b := range inode.buffers {
+			if spilled >= target {
+				break
+			}
+			if b.dirtyID != 0 || b.ptr == nil || b.loading || b.zero || b.compressed ||
+				inode.IsRangeLocked(b.offset, b.length, false) {
+				continue
+			}
+			if !b.onDisk && inode.saveToDiskCache(b) != nil {
+				break
+			}
+			b.ptr.refs--
+			if b.ptr.refs == 0 {
+				fs.bufferPool.Use(-int64(len(b.ptr.mem)), false)
+			}
+			b.ptr = nil
+			b.data = nil
+			spilled += b.length
+		}
+		inode.mu.Unlock()
+	}
+	log.Infof("Moved %v bytes of cached data from memory to disk", spilled)
+	return
+}
+
+// Load buffers of most used files from the disk cache back into memory
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) promoteFromDisk(percent int) (promoted uint64) {
+	all := fs.cachedInodes()
+	var onDisk uint64
+	for _, inode := range all {
+		inode.mu.Lock()
+		for _, b := range inode.buffers {
+			if b.onDisk && b.ptr == nil && !b.loading {
+				onDisk += b.length
+			}
+		}
+		inode.mu.Unlock()
+	}
+	target := onDisk * uint64(percent) / 100
+	for i := len(all)-1; i >= 0 && promoted < target; i-- {
+		inode := all[i]
+		inode.mu.Lock()
+		var ranges []uint64
+		for _, b := range inode.buffers {
+			if promoted >= target {
+				break
+			}
+			if !b.onDisk || b.ptr != nil || b.loading {
+				continue
+			}
+			ranges = append(ranges, b.offset, b.length)
+			promoted += b.length
+		}
+		// Load through the usual read path, so that memory usage is accounted
+		// and damaged cache files are reread from the server like for reads
+		for j := 0; j < len(ranges); j += 2 {
+			inode.LockRange(ranges[j], ranges[j+1], false)
+			_, err := inode.LoadRange(ranges[j], ranges[j+1], 0, false)
+			inode.UnlockRange(ranges[j], ranges[j+1], false)
+			if err != nil {
+				log.Errorf("Couldn't load %v bytes at offset %v of %v from the disk cache: %v",
+					ranges[j+1], ranges[j], inode.FullName(), err)
+				promoted -= ranges[j+1]
+			}
+		}
+		inode.mu.Unlock()
+	}
+	log.Infof("Moved %v bytes of cached data from disk to memory", promoted)
+	return
+}
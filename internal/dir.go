@@ -18,6 +18,7 @@ package internal
 import (
 	"fmt"
 	"os"
+	"path"
 	"sort"
 	"strings"
 	"sync"
@@ -60,6 +61,31 @@ type DirInodeData struct {
 	DeletedChildren map[string]*Inode
 	Gaps []*SlurpGap
 	handles []*DirHandle
+
+	// cached result of the geesefs.prefix-stats xattr
+	prefixStats string
+	prefixStatsTime time.Time
+	prefixStatsLoading chan struct{}
+
+	// set when listed entries are forgotten with --lazy-dir-inodes.
+	// Children are then incomplete even if the listing is fresh.
+	// Cleared when the whole directory is listed again
+	lazyEvicted bool
+	lazyEvictedTime time.Time
+	// time when the first page of the current listing was requested
+	listStartTime time.Time
+
+	// names not found on the server and the time of the lookup, for --neg-cache-ttl.
+	// A name is removed when a child with it is inserted
+	negCache map[string]time.Time
+
+	// metadata cache TTL of the subtree set with the geesefs.ttl xattr, atomic.
+	// 0 means inherited from the parent, TTL of 0 is stored as -1.
+	// Not saved to the server, so it only lasts until unmount
+	attrTTL int64
+
+	// mtime has to be saved in the --dir-mtime-marker object
+	mtimeMarkerDirty bool
 }
 
 type DirHandleEntry struct {
@@ -117,10 +143,22 @@ type DirHandle struct {
 	lastExternalOffset fuseops.DirOffset
 	lastInternalOffset int
 	lastName string
+	// entries created or moved here locally after this link generation
+	// are not returned until the listing is restarted
+	listGen uint64
+	// metadata sidecar to be returned after the last returned file
+	pendingSidecar *DirHandleEntry
+	// files returned by the current listing, for --prefetch-on-readdir
+	prefetch []*Inode
+	// files and directories returned by the current listing, for --xattr-prefetch
+	xattrPrefetch []*Inode
+	// set to 1 when the listing is restarted to stop the background prefetch
+	prefetchCancel *int32
 }
 
 func NewDirHandle(inode *Inode) (dh *DirHandle) {
 	dh = &DirHandle{inode: inode}
+	dh.listGen = atomic.LoadUint64(&inode.fs.linkGen)
 	return
 }
 
@@ -274,6 +312,7 @@ func (parent *Inode) listObjectsSlurp(inode *Inode, startAfter string, sealEnd b
 		Prefix:     &prefix,
 		StartAfter: startWith,
 	}
+	listStart := time.Now()
 	resp, err := cloud.ListBlobs(params)
 	if err != nil {
 		parent.fs.completeInflightListing(myList)
@@ -304,6 +343,7 @@ func (parent *Inode) listObjectsSlurp(inode *Inode, startAfter string, sealEnd b
 				d.mu.Lock()
 			}
 			d.sealDir()
+			d.lazyListed(listStart)
 			if d != parent {
 				d.mu.Unlock()
 			}
@@ -331,6 +371,7 @@ func (parent *Inode) listObjectsSlurp(inode *Inode, startAfter string, sealEnd b
 			inode.mu.Lock()
 		}
 		inode.sealDir()
+		inode.lazyListed(listStart)
 		if inode != parent {
 			inode.mu.Unlock()
 		}
@@ -407,13 +448,22 @@ func (inode *Inode) sealDir() {
 	inode.dir.lastFromCloud = nil
 	inode.dir.DirTime = time.Now()
 	if inode.fs.flags.EnableMtime && inode.userMetadata != nil &&
-		inode.userMetadata[inode.fs.flags.MtimeAttr] != nil {
+		inode.metadataAttr(inode.fs.flags.MtimeAttr) != nil {
 		_, inode.Attributes.Ctime = inode.findChildMaxTime()
 	} else {
 		inode.Attributes.Mtime, inode.Attributes.Ctime = inode.findChildMaxTime()
 	}
 }
 
+// Forget that children were evicted with --lazy-dir-inodes when the whole
+// directory is listed again, unless more were evicted after the listing started
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) lazyListed(listStart time.Time) {
+	if inode.dir.lazyEvicted && inode.dir.lazyEvictedTime.Before(listStart) {
+		inode.dir.lazyEvicted = false
+	}
+}
+
 // LOCKS_REQUIRED(dh.inode.mu)
 // LOCKS_EXCLUDED(dh.inode.fs.mu)
 func (dh *DirHandle) handleListResult(resp *ListBlobsOutput, prefix string, skipListing map[string]bool) {
@@ -433,6 +483,11 @@ func (dh *DirHandle) handleListResult(resp *ListBlobsOutput, prefix string, skip
 		}
 
 		if inode := parent.findChildUnlocked(dirName); inode != nil {
+			if !inode.isDir() {
+				if dir := parent.dirOverFile(inode); dir != nil {
+					inode = dir
+				}
+			}
 			now := time.Now()
 			// don't want to update time if this
 			// inode is setup to never expire
@@ -459,10 +514,18 @@ func (dh *DirHandle) handleListResult(resp *ListBlobsOutput, prefix string, skip
 		}
 
 		slash := strings.Index(baseName, "/")
+		if slash == -1 && parent.applyMtimeMarker(baseName, &obj) {
+			continue
+		}
 		if slash == -1 {
 			inode := parent.findChildUnlocked(baseName)
 			if inode != nil {
-				inode.SetFromBlobItem(&obj)
+				if inode.isDir() {
+					inode = parent.fileOverDir(inode, &obj)
+				}
+				if inode != nil {
+					inode.SetFromBlobItem(&obj)
+				}
 			} else {
 				// don't revive deleted items
 				_, deleted := parent.dir.DeletedChildren[baseName]
@@ -506,6 +569,7 @@ func (dh *DirHandle) listObjectsFlat() (err error) {
 		ContinuationToken: dh.inode.dir.listMarker,
 		Prefix:            &prefix,
 	}
+	listStart := time.Now()
 
 	dh.mu.Unlock()
 	resp, err := cloud.ListBlobs(params)
@@ -519,6 +583,9 @@ func (dh *DirHandle) listObjectsFlat() (err error) {
 	s3Log.Debug(resp)
 
 	dh.inode.mu.Lock()
+	if params.ContinuationToken == nil {
+		dh.inode.dir.listStartTime = listStart
+	}
 	dh.handleListResult(resp, prefix, dh.inode.fs.completeInflightListing(myList))
 
 	if resp.IsTruncated && resp.NextContinuationToken != nil {
@@ -550,6 +617,7 @@ func (dh *DirHandle) listObjectsFlat() (err error) {
 		}
 	} else {
 		dh.inode.sealDir()
+		dh.inode.lazyListed(dh.inode.dir.listStartTime)
 	}
 
 	dh.inode.mu.Unlock()
@@ -665,11 +733,14 @@ func (dh *DirHandle) ReadDir(internalOffset int, offset fuseops.DirOffset) (en *
 	}
 	parent.mu.Lock()
 
+	if internalOffset == 0 {
+		dh.listGen = atomic.LoadUint64(&fs.linkGen)
+	}
 	dh.lastInternalOffset = internalOffset
 	dh.lastExternalOffset = offset
 	dh.checkDirPosition()
 
-	if expired(dh.inode.dir.DirTime, dh.inode.fs.flags.StatCacheTTL) {
+	if expired(dh.inode.dir.DirTime, dh.inode.attrTTL()) {
 		err = dh.loadListing()
 		if err != nil {
 			parent.mu.Unlock()
@@ -715,6 +786,12 @@ func (dh *DirHandle) ReadDir(internalOffset int, offset fuseops.DirOffset) (en *
 	// May be -1 if we remove inodes above
 	dh.checkDirPosition()
 
+	// Present a snapshot as of the listing start: skip entries added locally since then
+	for dh.lastInternalOffset < len(parent.dir.Children) &&
+		parent.dir.Children[dh.lastInternalOffset].linkGen > dh.listGen {
+		dh.lastInternalOffset++
+	}
+
 	if dh.lastInternalOffset >= len(dh.inode.dir.Children) {
 		// we've reached the end
 		parent.dir.listDone = false
@@ -728,7 +805,48 @@ func (dh *DirHandle) ReadDir(internalOffset int, offset fuseops.DirOffset) (en *
 	return en, nil
 }
 
+// Check if the entry is filtered out of listings by --hide-pattern
+func (fs *Goofys) isHidden(name string) bool {
+	if name == "." || name == ".." {
+		return false
+	}
+	for _, pattern := range fs.flags.HidePatterns {
+		if hide, _ := path.Match(pattern, name); hide {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget inodes of returned entries which aren't referenced by the kernel,
+// with --lazy-dir-inodes. They're created again when looked up by name
+// LOCKS_REQUIRED(dh.mu)
+// LOCKS_EXCLUDED(dh.inode.mu)
+func (dh *DirHandle) releaseListed(inodes []*Inode) {
+	parent := dh.inode
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	for _, inode := range inodes {
+		inode.mu.Lock()
+		if inode.Parent == parent && inode.isEvictable() {
+			// Directory position is restored using lastName
+			parent.removeChildUnlocked(inode)
+			parent.dir.lazyEvicted = true
+			parent.dir.lazyEvictedTime = time.Now()
+		}
+		inode.mu.Unlock()
+	}
+}
+
 func (dh *DirHandle) CloseDir() error {
+	dh.mu.Lock()
+	// Prefetch of a complete listing goes on, ls closes the directory before
+	// it stats the files. Only inodes queued by an abandoned listing are dropped
+	releasePrefetch(dh.prefetch)
+	releasePrefetch(dh.xattrPrefetch)
+	dh.prefetch = nil
+	dh.xattrPrefetch = nil
+	dh.mu.Unlock()
 	dh.inode.mu.Lock()
 	i := 0
 	for ; i < len(dh.inode.dir.handles) && dh.inode.dir.handles[i] != dh; i++ {
@@ -777,6 +895,7 @@ func (inode *Inode) ResetForUnmount() {
 	// write operations under this directory will not know about this cloud.
 	inode.dir.cloud = nil
 	inode.dir.mountPrefix = ""
+	inode.fs.invalidateCloudPaths()
 
 	// Clear metadata.
 	// Set the metadata values to nil instead of deleting them so that
@@ -944,9 +1063,47 @@ func (parent *Inode) insertChild(inode *Inode) {
 	parent.insertChildUnlocked(inode)
 }
 
+// Negative cache entries are dropped when there are too many of them
+const NEG_CACHE_MAX = 4096
+
+// Remember that the name doesn't exist on the server
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) addNegCache(name string) {
+	ttl := parent.fs.flags.NegCacheTTL
+	if ttl <= 0 {
+		return
+	}
+	if parent.dir.negCache == nil {
+		parent.dir.negCache = make(map[string]time.Time)
+	} else if len(parent.dir.negCache) >= NEG_CACHE_MAX {
+		for name, t := range parent.dir.negCache {
+			if expired(t, ttl) {
+				delete(parent.dir.negCache, name)
+			}
+		}
+		if len(parent.dir.negCache) >= NEG_CACHE_MAX {
+			parent.dir.negCache = make(map[string]time.Time)
+		}
+	}
+	parent.dir.negCache[name] = time.Now()
+}
+
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) isNegCached(name string) bool {
+	t, ok := parent.dir.negCache[name]
+	if ok && expired(t, parent.fs.flags.NegCacheTTL) {
+		delete(parent.dir.negCache, name)
+		return false
+	}
+	return ok
+}
+
 // LOCKS_REQUIRED(parent.mu)
 func (parent *Inode) insertChildUnlocked(inode *Inode) {
 	inode.Ref()
+	if parent.dir.negCache != nil {
+		delete(parent.dir.negCache, inode.Name)
+	}
 
 	l := len(parent.dir.Children)
 	if l == 0 {
@@ -985,6 +1142,44 @@ func (parent *Inode) getChildName(name string) string {
 	}
 }
 
+// Update directory times after adding or removing a child
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) touchDir() {
+	dir.touch()
+	dir.saveDirMtime()
+}
+
+// Make the flusher save the directory mtime. With --dir-mtime-marker it's saved
+// in the marker object. With --enable-mtime it's saved in the directory object,
+// but only if it's known to exist, so that implicit directories don't get new objects
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) saveDirMtime() {
+	fs := dir.fs
+	if dir.isVirtual() {
+		return
+	}
+	if fs.flags.DirMtimeMarker {
+		dir.dir.mtimeMarkerDirty = true
+	} else if fs.flags.EnableMtime && dir.Parent != nil && !fs.flags.NoDirObject &&
+		!dir.ImplicitDir && dir.userMetadata != nil &&
+		(dir.CacheState == ST_CACHED || dir.CacheState == ST_CREATED || dir.CacheState == ST_MODIFIED) {
+		dir.setUserMeta(fs.flags.MtimeAttr, []byte(fmt.Sprintf("%d", dir.Attributes.Mtime.Unix())))
+	} else {
+		return
+	}
+	if dir.CacheState == ST_CACHED {
+		dir.SetCacheState(ST_MODIFIED)
+		fs.WakeupFlusher()
+	}
+}
+
+// Check if the directory object has to be sent, and not just the mtime marker
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) dirObjectDirty() bool {
+	return dir.CacheState == ST_CREATED || dir.userMetadataDirty != 0 || dir.oldParent != nil ||
+		!dir.dir.mtimeMarkerDirty
+}
+
 func (parent *Inode) Unlink(name string) (err error) {
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
@@ -995,15 +1190,47 @@ func (parent *Inode) Unlink(name string) (err error) {
 		inode.mu.Lock()
 		inode.doUnlink()
 		inode.mu.Unlock()
+		parent.touchDir()
 		inode.fs.WakeupFlusher()
 	}
 
 	return
 }
 
+// Deletes and renames of subtree entries are limited by --tree-op-concurrency
+// instead of --max-flushers. 0 makes them regular flushes
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) isTreeOp() bool {
+	return inode.treeOp && inode.fs.flags.TreeOpConcurrency > 0
+}
+
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) pendingTreeOp() bool {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+	return inode.isTreeOp() && inode.IsFlushing == 0
+}
+
+// Mark the removed directory and its pending deletes and renames
+// as a part of the subtree operation
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) markTreeOp() {
+	dir.treeOp = true
+	for _, child := range dir.dir.DeletedChildren {
+		child.mu.Lock()
+		child.treeOp = true
+		child.mu.Unlock()
+	}
+}
+
+// The caller must take a slot with startTreeOp if isTreeOp() is true
 func (inode *Inode) SendDelete() {
 	cloud, key := inode.Parent.cloud()
-	key = appendChildName(key, inode.Name)
+	if inode.cloudName != "" {
+		key = appendChildName(key, inode.cloudName)
+	} else {
+		key = appendChildName(key, inode.Name)
+	}
 	oldParent := inode.oldParent
 	oldName := inode.oldName
 	if oldParent != nil {
@@ -1015,21 +1242,36 @@ func (inode *Inode) SendDelete() {
 	if inode.isDir() && !cloud.Capabilities().DirBlob {
 		key += "/"
 	}
-	atomic.AddInt64(&inode.Parent.fs.activeFlushers, 1)
+	treeOp := inode.isTreeOp()
+	if !treeOp {
+		atomic.AddInt64(&inode.Parent.fs.activeFlushers, 1)
+	}
 	inode.IsFlushing += inode.fs.flags.MaxParallelParts
 	implicit := inode.ImplicitDir
+	deleteMarker := inode.isDir() && inode.fs.flags.DirMtimeMarker
 	go func() {
 		// Delete may race with a parallel listing
 		var err error
-		if !implicit {
+		if deleteMarker {
+			err = deleteMtimeMarker(inode.fs, cloud, key)
+		}
+		if err == nil && !implicit {
 			inode.fs.addInflightChange(key)
-			_, err = cloud.DeleteBlob(&DeleteBlobInput{
-				Key: key,
-			})
+			if trashKey := inode.trashKey(cloud, key); trashKey != "" {
+				err = moveObject(cloud, key, trashKey)
+			} else {
+				_, err = cloud.DeleteBlob(&DeleteBlobInput{
+					Key: key,
+				})
+			}
 			inode.fs.completeInflightChange(key)
 		}
 		inode.mu.Lock()
-		atomic.AddInt64(&inode.Parent.fs.activeFlushers, -1)
+		if treeOp {
+			inode.fs.finishTreeOp()
+		} else {
+			atomic.AddInt64(&inode.Parent.fs.activeFlushers, -1)
+		}
 		inode.IsFlushing -= inode.fs.flags.MaxParallelParts
 		if mapAwsError(err) == fuse.ENOENT {
 			// object is already deleted
@@ -1083,6 +1325,7 @@ func (parent *Inode) Create(name string) (inode *Inode, fh *FileHandle) {
 	now := time.Now()
 	inode = NewInode(fs, parent, name)
 	inode.userMetadata = make(map[string][]byte)
+	inode.linkGen = atomic.AddUint64(&fs.linkGen, 1)
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 	inode.Attributes = InodeAttributes{
@@ -1101,9 +1344,11 @@ func (parent *Inode) Create(name string) (inode *Inode, fh *FileHandle) {
 	fs.WakeupFlusher()
 
 	fh = NewFileHandle(inode)
+	fh.writer = true
 	inode.fileHandles = 1
+	inode.writeHandles = 1
 
-	parent.touch()
+	parent.touchDir()
 
 	return
 }
@@ -1163,13 +1408,9 @@ func (parent *Inode) doMkDir(name string) (inode *Inode) {
 				oldInode.Ref()
 				oldInode.SetCacheState(ST_MODIFIED)
 				oldInode.Attributes.Ctime = time.Now()
-				if parent.Attributes.Ctime.Before(oldInode.Attributes.Ctime) {
-					parent.Attributes.Ctime = oldInode.Attributes.Ctime
-				}
 				oldInode.Attributes.Mtime = time.Now()
-				if parent.Attributes.Mtime.Before(oldInode.Attributes.Mtime) {
-					parent.Attributes.Mtime = oldInode.Attributes.Mtime
-				}
+				parent.touchDir()
+				oldInode.linkGen = atomic.AddUint64(&parent.fs.linkGen, 1)
 				parent.insertChildUnlocked(oldInode)
 				oldInode.dir.Children[0].Id = inode.Id // "."
 				oldInode.dir.Children[1].Id = parent.Id // ".."
@@ -1182,14 +1423,10 @@ func (parent *Inode) doMkDir(name string) (inode *Inode) {
 	inode.userMetadata = make(map[string][]byte)
 	inode.ToDir()
 	inode.touch()
+	inode.linkGen = atomic.AddUint64(&parent.fs.linkGen, 1)
 	// Record dir as actual
 	inode.dir.DirTime = inode.Attributes.Ctime
-	if parent.Attributes.Ctime.Before(inode.Attributes.Ctime) {
-		parent.Attributes.Ctime = inode.Attributes.Ctime
-	}
-	if parent.Attributes.Mtime.Before(inode.Attributes.Mtime) {
-		parent.Attributes.Mtime = inode.Attributes.Mtime
-	}
+	parent.touchDir()
 	// one ref is for lookup
 	inode.Ref()
 	// another ref is for being in Children
@@ -1218,6 +1455,7 @@ func (parent *Inode) CreateSymlink(
 	inode.userMetadata = make(map[string][]byte)
 	inode.userMetadata[inode.fs.flags.SymlinkAttr] = []byte(target)
 	inode.userMetadataDirty = 2
+	inode.linkGen = atomic.AddUint64(&fs.linkGen, 1)
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 	inode.Attributes = InodeAttributes{
@@ -1235,7 +1473,7 @@ func (parent *Inode) CreateSymlink(
 	inode.SetCacheState(ST_CREATED)
 	fs.WakeupFlusher()
 
-	parent.touch()
+	parent.touchDir()
 
 	return inode
 }
@@ -1246,11 +1484,128 @@ func (inode *Inode) ReadSymlink() (target string, err error) {
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
-	if inode.userMetadata[inode.fs.flags.SymlinkAttr] == nil {
+	if inode.userMetadata == nil && inode.symlinkTarget != "" {
+		// Remembered with --symlink-cache-ttl
+		return inode.symlinkTarget, nil
+	}
+
+	if inode.metadataAttr(inode.fs.flags.SymlinkAttr) == nil {
+		if inode.redirectTarget != "" {
+			// Website redirect presented as a symlink
+			return inode.redirectTarget, nil
+		}
 		return "", fuse.EIO
 	}
 
-	return string(inode.userMetadata[inode.fs.flags.SymlinkAttr]), nil
+	if inode.fs.flags.SymlinkCacheTTL > 0 {
+		inode.fs.rememberSymlink(inode)
+	}
+	return string(inode.metadataAttr(inode.fs.flags.SymlinkAttr)), nil
+}
+
+type symlinkCacheEntry struct {
+	target string
+	etag string
+	mtime time.Time
+	time time.Time
+}
+
+// Symlink cache entries are dropped when there are too many of them
+const SYMLINK_CACHE_MAX = 65536
+
+// Remember the target of a symlink along with the version of its object
+// LOCKS_REQUIRED(inode.mu)
+func (fs *Goofys) rememberSymlink(inode *Inode) {
+	if inode.knownETag == "" || inode.knownMtime.IsZero() ||
+		inode.CacheState != ST_CACHED || inode.oldParent != nil {
+		// Only objects which are on the server in this exact version
+		return
+	}
+	if inode.metadataAttr(fs.flags.SymlinkAttr) == nil {
+		// Website redirects are always loaded with HEAD
+		return
+	}
+	_, key := inode.cloud()
+	ttl := fs.flags.SymlinkCacheTTL
+	fs.symlinkCacheMu.Lock()
+	defer fs.symlinkCacheMu.Unlock()
+	if fs.symlinkCache == nil {
+		fs.symlinkCache = make(map[string]*symlinkCacheEntry)
+	} else if len(fs.symlinkCache) >= SYMLINK_CACHE_MAX {
+		for k, e := range fs.symlinkCache {
+			if expired(e.time, ttl) {
+				delete(fs.symlinkCache, k)
+			}
+		}
+		if len(fs.symlinkCache) >= SYMLINK_CACHE_MAX {
+			fs.symlinkCache = make(map[string]*symlinkCacheEntry)
+		}
+	}
+	fs.symlinkCache[key] = &symlinkCacheEntry{
+		target: string(inode.metadataAttr(fs.flags.SymlinkAttr)),
+		etag: inode.knownETag,
+		mtime: inode.knownMtime,
+		time: time.Now(),
+	}
+}
+
+// Target of the symlink if it's remembered for the same version of the object
+// LOCKS_REQUIRED(inode.mu)
+func (fs *Goofys) cachedSymlink(inode *Inode) string {
+	if inode.knownETag == "" || inode.knownMtime.IsZero() {
+		return ""
+	}
+	_, key := inode.cloud()
+	fs.symlinkCacheMu.Lock()
+	defer fs.symlinkCacheMu.Unlock()
+	e := fs.symlinkCache[key]
+	if e == nil {
+		return ""
+	}
+	if expired(e.time, fs.flags.SymlinkCacheTTL) {
+		delete(fs.symlinkCache, key)
+		return ""
+	}
+	// Empty objects all have the same ETag, so also compare the time
+	if e.etag != inode.knownETag || !e.mtime.Equal(inode.knownMtime) {
+		return ""
+	}
+	return e.target
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (fs *Goofys) forgetSymlink(inode *Inode) {
+	_, key := inode.cloud()
+	fs.symlinkCacheMu.Lock()
+	if fs.symlinkCache != nil {
+		delete(fs.symlinkCache, key)
+	}
+	fs.symlinkCacheMu.Unlock()
+}
+
+// Website redirect location to store with the symlink object, if enabled.
+// S3 only accepts absolute paths and URLs there, so relative symlinks
+// are stored just as usual. Redirects of existing objects are kept.
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) websiteRedirect() *string {
+	if !inode.fs.flags.WebsiteRedirectSymlinks {
+		return nil
+	}
+	var target []byte
+	if inode.userMetadata != nil {
+		target = inode.metadataAttr(inode.fs.flags.SymlinkAttr)
+	}
+	if target == nil {
+		if inode.redirectTarget != "" {
+			return PString(inode.redirectTarget)
+		}
+		return nil
+	}
+	t := string(target)
+	if !strings.HasPrefix(t, "/") && !strings.HasPrefix(t, "http://") && !strings.HasPrefix(t, "https://") {
+		return nil
+	}
+	return &t
 }
 
 func (dir *Inode) SendMkDir() {
@@ -1266,6 +1621,7 @@ func (dir *Inode) SendMkDir() {
 		Metadata: escapeMetadata(dir.userMetadata),
 	}
 	dir.ImplicitDir = false
+	dir.userMetadataDirty = 0
 	dir.IsFlushing += dir.fs.flags.MaxParallelParts
 	atomic.AddInt64(&dir.fs.activeFlushers, 1)
 	go func() {
@@ -1277,10 +1633,16 @@ func (dir *Inode) SendMkDir() {
 		dir.recordFlushError(err)
 		if err != nil {
 			log.Errorf("Failed to create directory object %v: %v", key, err)
+			dir.userMetadataDirty = 2
 			return
 		}
 		if dir.CacheState == ST_CREATED || dir.CacheState == ST_MODIFIED {
-			dir.SetCacheState(ST_CACHED)
+			if dir.dir.mtimeMarkerDirty || dir.userMetadataDirty != 0 {
+				// The marker or new changes are sent next
+				dir.SetCacheState(ST_MODIFIED)
+			} else {
+				dir.SetCacheState(ST_CACHED)
+			}
 			dir.AttrTime = time.Now()
 		}
 		dir.fs.WakeupFlusher()
@@ -1294,12 +1656,78 @@ func appendChildName(parent, child string) string {
 	return parent + child
 }
 
+// Check if the directory may be removed. Children which aren't flushed yet
+// make it non-empty immediately, the others may be stale, so the server is
+// asked for any key under the prefix, skipping keys of locally deleted but
+// not yet flushed children. A directory without its own object and without
+// keys is implicit and its removal doesn't require a server request
+// LOCKS_EXCLUDED(inode.mu)
 func (inode *Inode) isEmptyDir() (bool, error) {
-	dh := NewDirHandle(inode)
-	dh.mu.Lock()
-	en, err := dh.ReadDir(2, 2)
-	dh.mu.Unlock()
-	return en == nil, err
+	inode.mu.Lock()
+	for _, child := range inode.dir.Children {
+		if child.Name != "." && child.Name != ".." && atomic.LoadInt32(&child.CacheState) != ST_CACHED {
+			inode.mu.Unlock()
+			return false, nil
+		}
+	}
+	cloud, key := inode.cloud()
+	var deleted map[string]bool
+	for name := range inode.dir.DeletedChildren {
+		if deleted == nil {
+			deleted = make(map[string]bool)
+		}
+		deleted[name] = true
+	}
+	inode.mu.Unlock()
+
+	prefix := appendChildName(key, "")
+	// One key besides the directory object is enough, unless we have to
+	// skip deleted children which may be many after rm -rf
+	maxKeys := uint32(2)
+	if deleted != nil {
+		maxKeys = 1000
+	}
+	hasDirObject := false
+	var token *string
+	for {
+		resp, err := cloud.ListBlobs(&ListBlobsInput{
+			Prefix:            &prefix,
+			MaxKeys:           &maxKeys,
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return false, mapAwsError(err)
+		}
+		for _, item := range resp.Items {
+			name := (*item.Key)[len(prefix):]
+			if name == "" {
+				hasDirObject = true
+				continue
+			}
+			if slash := strings.Index(name, "/"); slash != -1 {
+				name = name[0:slash]
+			} else if inode.fs.isMtimeMarker(name) {
+				continue
+			}
+			if !deleted[name] {
+				fuseLog.Debugf("Directory %v not empty: still has key %v", inode.FullName(), *item.Key)
+				return false, nil
+			}
+		}
+		if !resp.IsTruncated || resp.NextContinuationToken == nil {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+
+	if !hasDirObject && !cloud.Capabilities().DirBlob {
+		inode.mu.Lock()
+		if inode.CacheState == ST_CACHED && inode.IsFlushing == 0 {
+			inode.ImplicitDir = true
+		}
+		inode.mu.Unlock()
+	}
+	return true, nil
 }
 
 // LOCKS_REQUIRED(inode.Parent.mu)
@@ -1307,12 +1735,15 @@ func (inode *Inode) isEmptyDir() (bool, error) {
 func (inode *Inode) doUnlink() {
 	parent := inode.Parent
 
+	if inode.fs.flags.DeleteOnClose && !inode.isDir() && atomic.LoadInt32(&inode.fileHandles) > 0 {
+		inode.openUnlinked = true
+	}
 	if inode.oldParent != nil && !inode.renamingTo {
-		inode.resetCache()
+		inode.resetUnlinked()
 		inode.SetCacheState(ST_DELETED)
 	} else if inode.CacheState != ST_CREATED || inode.IsFlushing > 0 {
 		// resetCache will clear all buffers and abort the multipart upload
-		inode.resetCache()
+		inode.resetUnlinked()
 		if parent.dir.DeletedChildren == nil || parent.dir.DeletedChildren[inode.Name] == nil {
 			inode.SetCacheState(ST_DELETED)
 			if parent.dir.DeletedChildren == nil {
@@ -1324,14 +1755,24 @@ func (inode *Inode) doUnlink() {
 			inode.SetCacheState(ST_DEAD)
 		}
 	} else {
-		inode.resetCache()
+		inode.resetUnlinked()
 		inode.SetCacheState(ST_DEAD)
 	}
-	inode.Attributes.Size = 0
+	if !inode.openUnlinked {
+		inode.Attributes.Size = 0
+	}
 
 	parent.removeChildUnlocked(inode)
 }
 
+// Drop the cache of the unlinked file unless it's still open with --delete-on-close
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) resetUnlinked() {
+	if !inode.openUnlinked {
+		inode.resetCache()
+	}
+}
+
 func (parent *Inode) RmDir(name string) (err error) {
 	parent.logFuse("Rmdir", name)
 
@@ -1346,15 +1787,11 @@ func (parent *Inode) RmDir(name string) (err error) {
 			return fuse.ENOTDIR
 		}
 
-		dh := NewDirHandle(inode)
-		dh.mu.Lock()
-		en, err := dh.ReadDir(2, 2)
-		dh.mu.Unlock()
+		empty, err := inode.isEmptyDir()
 		if err != nil {
 			return err
 		}
-		if en != nil {
-			fuseLog.Debugf("Directory %v not empty: still has entry \"%v\"", inode.FullName(), en.Name)
+		if !empty {
 			return fuse.ENOTEMPTY
 		}
 
@@ -1362,8 +1799,13 @@ func (parent *Inode) RmDir(name string) (err error) {
 		inode := parent.findChildUnlocked(name)
 		if inode != nil {
 			inode.mu.Lock()
+			if len(inode.dir.DeletedChildren) > 0 {
+				// Children are still being deleted, so it's rm -r
+				inode.markTreeOp()
+			}
 			inode.doUnlink()
 			inode.mu.Unlock()
+			parent.touchDir()
 		}
 		parent.mu.Unlock()
 		inode.fs.WakeupFlusher()
@@ -1376,7 +1818,30 @@ func (parent *Inode) RmDir(name string) (err error) {
 func (inode *Inode) SetCacheState(state int32) {
 	wasModified := inode.CacheState == ST_CREATED || inode.CacheState == ST_DELETED || inode.CacheState == ST_MODIFIED
 	willBeModified := state == ST_CREATED || state == ST_DELETED || state == ST_MODIFIED
+	if inode.CacheState != state {
+		switch {
+		case state == ST_CREATED:
+			inode.logChange("create", "")
+		case state == ST_MODIFIED && inode.oldParent == nil:
+			// Renamed files are logged by renameInCache
+			inode.logChange("modify", "")
+		case state == ST_DELETED || state == ST_DEAD && inode.CacheState != ST_DELETED:
+			// Unlinked new files die without being deleted from the server
+			inode.logChange("delete", "")
+		}
+	}
+	inode.fs.metrics.cacheStateChanged(inode.CacheState, state)
 	atomic.StoreInt32(&inode.CacheState, state)
+	inode.updateUsedBlocks()
+	if !wasModified && willBeModified {
+		inode.dirtySince = time.Now()
+	} else if wasModified && !willBeModified {
+		if state == ST_CACHED && !inode.dirtySince.IsZero() {
+			inode.fs.flushStats.AddFlush(time.Since(inode.dirtySince))
+		}
+		inode.dirtySince = time.Time{}
+		inode.flushErrors = 0
+	}
 	if wasModified != willBeModified && (inode.isDir() || inode.fileHandles == 0) {
 		inc := int64(1)
 		if wasModified {
@@ -1396,6 +1861,61 @@ func (parent *Inode) addModified(inc int64) {
 	}
 }
 
+// Maximum object key length from --max-key-length or the backend, 0 means unlimited
+func (fs *Goofys) maxKeyLength(cloud StorageBackend) int {
+	if fs.flags.MaxKeyLength != 0 || cloud == nil {
+		return fs.flags.MaxKeyLength
+	}
+	return cloud.Capabilities().MaxKeyLength
+}
+
+// Check that the key of the new child fits into --max-key-length.
+// The key is checked as sent to the server, with the mount prefix
+// LOCKS_EXCLUDED(parent.mu)
+func (parent *Inode) checkKeyLength(name string, isDir bool) error {
+	parent.mu.Lock()
+	cloud, key := parent.cloud()
+	parent.mu.Unlock()
+	limit := parent.fs.maxKeyLength(cloud)
+	if limit <= 0 {
+		return nil
+	}
+	key = appendChildName(key, name)
+	if isDir && cloud != nil && !cloud.Capabilities().DirBlob {
+		key += "/"
+	}
+	if len(key) > limit {
+		log.Warnf("Key %v is longer than the maximum key length (%v)", key, limit)
+		return syscall.ENAMETOOLONG
+	}
+	return nil
+}
+
+// Length of the longest cached key relative to the directory
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) maxRelativeKeyLength() int {
+	max := 0
+	for _, child := range dir.dir.Children {
+		if child.Name == "." || child.Name == ".." {
+			continue
+		}
+		l := len(child.Name)
+		if child.cloudName != "" {
+			// Files escaped with --collision-suffix
+			l = len(child.cloudName)
+		}
+		if child.isDir() {
+			child.mu.Lock()
+			l += 1 + child.maxRelativeKeyLength()
+			child.mu.Unlock()
+		}
+		if l > max {
+			max = l
+		}
+	}
+	return max
+}
+
 // semantic of rename:
 // rename("any", "not_exists") = ok
 // rename("file1", "file2") = ok
@@ -1410,8 +1930,8 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 	fromCloud, fromPath := parent.cloud()
 	toCloud, toPath := newParent.cloud()
 	if fromCloud != toCloud {
-		// cannot rename across cloud backend
-		err = fuse.EINVAL
+		// Server-side copy is impossible across backends, let userspace copy the data
+		err = syscall.EXDEV
 		return
 	}
 
@@ -1421,6 +1941,10 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 	if fromInode == nil {
 		return fuse.ENOENT
 	}
+	if fromInode.cloudName != "" {
+		// Escaped files can't be renamed in place, let userspace copy them
+		return syscall.EXDEV
+	}
 	fromInode.mu.Lock()
 	defer fromInode.mu.Unlock()
 	if toInode != nil {
@@ -1442,21 +1966,10 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 
 	fromFullName := appendChildName(fromPath, from)
 	toFullName := appendChildName(toPath, to)
-
-	if toInode != nil {
-		// this file's been overwritten, it's
-		// been detached but we can't delete
-		// it just yet, because the kernel
-		// will still send forget ops to us
-		toInode.mu.Lock()
-		toInode.doUnlink()
-		toInode.mu.Unlock()
-	}
-
 	if fromInode.isDir() {
 		fromFullName += "/"
 		toFullName += "/"
-		// List all objects and rename them in cache (keeping the lock)
+		// List all objects to rename them in cache (keeping the lock)
 		var next string
 		var err error
 		fromInode.dir.listDone = false
@@ -1466,12 +1979,74 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 				return mapAwsError(err)
 			}
 		}
+	}
+	if limit := fromInode.fs.maxKeyLength(toCloud); limit > 0 {
+		keyLen := len(toFullName)
+		if fromInode.isDir() {
+			// Keys inside the directory become longer too
+			keyLen += fromInode.maxRelativeKeyLength()
+		}
+		if keyLen > limit {
+			return syscall.ENAMETOOLONG
+		}
+	}
+
+	stableInode := toInode != nil && !fromInode.isDir() && fromInode.fs.flags.StableInodeOnRename
+	var oldId fuseops.InodeID
+	if toInode != nil {
+		// this file's been overwritten, it's
+		// been detached but we can't delete
+		// it just yet, because the kernel
+		// will still send forget ops to us
+		toInode.mu.Lock()
+		if stableInode && atomic.LoadInt32(&toInode.fileHandles) > 0 {
+			// The kernel still uses the number of the destination for its
+			// open descriptors, fstat() or ftruncate() on them must not
+			// reach the renamed file. Fall back to the usual rename
+			stableInode = false
+		}
+		if stableInode {
+			// Keep the inode number of the destination. The old number
+			// of the source still refers to it until the kernel drops
+			// the moved dentry, see finishInodeSwap()
+			oldId = fromInode.Id
+			swapInodeIds(fromInode, toInode)
+			fromInode.fs.mu.Lock()
+			fromInode.fs.inodes[oldId] = fromInode
+			fromInode.fs.mu.Unlock()
+		}
+		toInode.doUnlink()
+		toInode.mu.Unlock()
+	}
+
+	if fromInode.isDir() {
 		renameRecursive(fromInode, newParent, to)
 	} else {
 		renameInCache(fromInode, newParent, to)
 	}
+	parent.touchDir()
+	if newParent != parent {
+		newParent.touchDir()
+	}
+
+	fs := fromInode.fs
+	if stableInode && fs.connection != nil {
+		// The kernel moves the source dentry to the new name, so it still
+		// refers to the source inode number. Make it look the name up again
+		// from another goroutine because the directory is locked until we reply
+		newParentId := newParent.Id
+		go func() {
+			fs.connection.Notify(&fuseops.NotifyInvalEntry{
+				Parent: newParentId,
+				Name:   to,
+			})
+			fs.finishInodeSwap(oldId, fromInode, toInode)
+		}()
+	} else if stableInode {
+		fs.finishInodeSwap(oldId, fromInode, toInode)
+	}
 
-	fromInode.fs.WakeupFlusher()
+	fs.WakeupFlusher()
 
 	return
 }
@@ -1481,17 +2056,7 @@ func renameRecursive(fromInode *Inode, newParent *Inode, to string) {
 	toDir.userMetadata = fromInode.userMetadata
 	toDir.ImplicitDir = fromInode.ImplicitDir
 	// Trick IDs
-	oldId := fromInode.Id
-	newId := toDir.Id
-	fromInode.Id = newId
-	toDir.Id = oldId
-	fs := fromInode.fs
-	fs.mu.Lock()
-	fs.inodes[newId] = fromInode
-	fs.inodes[oldId] = toDir
-	fs.mu.Unlock()
-	// Swap reference counts - the kernel will still send forget ops for the new inode
-	fromInode.refcnt, toDir.refcnt = toDir.refcnt, fromInode.refcnt
+	swapInodeIds(fromInode, toDir)
 	// 2 is to skip . and ..
 	for len(fromInode.dir.Children) > 2 {
 		child := fromInode.dir.Children[2]
@@ -1499,14 +2064,48 @@ func renameRecursive(fromInode *Inode, newParent *Inode, to string) {
 		if child.isDir() {
 			renameRecursive(child, toDir, child.Name)
 		} else {
+			child.treeOp = true
 			renameInCache(child, toDir, child.Name)
 		}
 		child.mu.Unlock()
 	}
+	if toDir.fs.flags.DirMtimeMarker {
+		// The old marker is deleted with the old directory
+		toDir.Attributes.Mtime = fromInode.Attributes.Mtime
+		toDir.saveDirMtime()
+	}
 	toDir.mu.Unlock()
+	fromInode.markTreeOp()
 	fromInode.doUnlink()
 }
 
+// Exchange inode numbers of two inodes, both must be in their parents' Children
+func swapInodeIds(a *Inode, b *Inode) {
+	aId := a.Id
+	bId := b.Id
+	a.Id = bId
+	b.Id = aId
+	fs := a.fs
+	fs.mu.Lock()
+	fs.inodes[bId] = a
+	fs.inodes[aId] = b
+	fs.mu.Unlock()
+	// Swap reference counts - the kernel will still send forget ops for the old numbers
+	a.refcnt, b.refcnt = b.refcnt, a.refcnt
+}
+
+// Give the old number of the renamed inode to the replaced one after the
+// kernel stops using it for the new name, so that stat() of the new name
+// never sees the replaced file
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) finishInodeSwap(oldId fuseops.InodeID, from *Inode, to *Inode) {
+	fs.mu.Lock()
+	if fs.inodes[oldId] == from && to.Id == oldId {
+		fs.inodes[oldId] = to
+	}
+	fs.mu.Unlock()
+}
+
 func renameInCache(fromInode *Inode, newParent *Inode, to string) {
 	fuseLog.Debugf("Rename %v to %v", fromInode.FullName(), newParent.getChildName(to))
 	// There's a lot of edge cases with the asynchronous rename to handle:
@@ -1583,8 +2182,15 @@ func renameInCache(fromInode *Inode, newParent *Inode, to string) {
 	}
 	fromInode.Ref()
 	parent.removeChildUnlocked(fromInode)
+	var fromKey string
+	if fromInode.fs.changeLog != nil {
+		_, fromKey = fromInode.cloud()
+	}
 	fromInode.Name = to
 	fromInode.Parent = newParent
+	// Keys of all children of a renamed directory change too
+	fromInode.fs.invalidateCloudPaths()
+	fromInode.logChange("rename", fromKey)
 	if fromInode.CacheState == ST_CACHED {
 		// Was not modified => we make it modified
 		fromInode.SetCacheState(ST_MODIFIED)
@@ -1592,6 +2198,10 @@ func renameInCache(fromInode *Inode, newParent *Inode, to string) {
 		// Was already modified => stays modified
 		newParent.addModified(1)
 	}
+	if newParent != parent {
+		// Renames within the directory keep the entry in started listings
+		fromInode.linkGen = atomic.AddUint64(&fromInode.fs.linkGen, 1)
+	}
 	newParent.insertChildUnlocked(fromInode)
 	fromInode.DeRef(1)
 }
@@ -1617,7 +2227,9 @@ func sealPastDirs(dirs map[*Inode]bool, d *Inode) {
 func (parent *Inode) insertSubTree(path string, obj *BlobItemOutput, dirs map[*Inode]bool) {
 	fs := parent.fs
 	slash := strings.Index(path, "/")
-	if slash == -1 {
+	if slash == -1 && parent.applyMtimeMarker(path, obj) {
+		sealPastDirs(dirs, parent)
+	} else if slash == -1 {
 		inode := parent.findChildUnlocked(path)
 		if inode == nil {
 			// don't revive deleted items
@@ -1629,7 +2241,12 @@ func (parent *Inode) insertSubTree(path string, obj *BlobItemOutput, dirs map[*I
 				inode.SetFromBlobItem(obj)
 			}
 		} else {
-			inode.SetFromBlobItem(obj)
+			if inode.isDir() {
+				inode = parent.fileOverDir(inode, obj)
+			}
+			if inode != nil {
+				inode.SetFromBlobItem(obj)
+			}
 		}
 		sealPastDirs(dirs, parent)
 	} else {
@@ -1647,19 +2264,7 @@ func (parent *Inode) insertSubTree(path string, obj *BlobItemOutput, dirs map[*I
 				fs.insertInode(parent, inode)
 			}
 		} else if !inode.isDir() {
-			// replace unmodified file item with a directory
-			if atomic.LoadInt32(&inode.CacheState) <= ST_DEAD {
-				inode.mu.Lock()
-				atomic.StoreInt32(&inode.refreshed, -1)
-				parent.removeChildUnlocked(inode)
-				inode.mu.Unlock()
-				// create a directory inode instead
-				inode = NewInode(fs, parent, dir)
-				inode.ToDir()
-				fs.insertInode(parent, inode)
-			} else {
-				inode = nil
-			}
+			inode = parent.dirOverFile(inode)
 		}
 
 		if inode != nil {
@@ -1687,6 +2292,97 @@ func (parent *Inode) insertSubTree(path string, obj *BlobItemOutput, dirs map[*I
 	}
 }
 
+// Resolve a collision between a cached file and a directory with the same
+// name found in the listing (keys "foo" and "foo/"). Returns the directory
+// inode, or nil if the file is kept.
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_EXCLUDED(parent.fs.mu)
+func (parent *Inode) dirOverFile(file *Inode) *Inode {
+	fs := parent.fs
+	if fs.flags.FileDirCollision == "file" || atomic.LoadInt32(&file.CacheState) > ST_DEAD {
+		return nil
+	}
+	// replace unmodified file item with a directory
+	file.mu.Lock()
+	atomic.StoreInt32(&file.refreshed, -1)
+	var item *BlobItemOutput
+	if fs.flags.FileDirCollision == "escape" {
+		_, key := file.cloud()
+		mtime := file.Attributes.Mtime
+		item = &BlobItemOutput{
+			Key:          &key,
+			LastModified: &mtime,
+			Size:         file.knownSize,
+		}
+		if file.knownETag != "" {
+			item.ETag = PString(file.knownETag)
+		}
+		if sc, ok := file.s3Metadata["storage-class"]; ok {
+			item.StorageClass = PString(string(sc))
+		}
+	}
+	parent.removeChildUnlocked(file)
+	file.mu.Unlock()
+	// create a directory inode instead
+	inode := NewInode(fs, parent, file.Name)
+	inode.ToDir()
+	fs.insertInode(parent, inode)
+	if item != nil {
+		parent.insertEscapedFile(file.Name, item)
+	}
+	return inode
+}
+
+// Resolve a collision between a cached directory and a file with the same
+// name found in the listing. Returns the inode to apply the listing item to,
+// or nil if it should be skipped.
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_EXCLUDED(parent.fs.mu)
+func (parent *Inode) fileOverDir(dir *Inode, item *BlobItemOutput) *Inode {
+	fs := parent.fs
+	switch fs.flags.FileDirCollision {
+	case "escape":
+		parent.insertEscapedFile(dir.Name, item)
+	case "file":
+		if atomic.LoadInt32(&dir.CacheState) > ST_DEAD ||
+			atomic.LoadInt64(&dir.dir.ModifiedChildren) != 0 {
+			return nil
+		}
+		// replace unmodified directory with a file
+		dir.mu.Lock()
+		atomic.StoreInt32(&dir.refreshed, -1)
+		dir.removeAllChildrenUnlocked()
+		parent.removeChildUnlocked(dir)
+		dir.mu.Unlock()
+		inode := NewInode(fs, parent, dir.Name)
+		fs.insertInode(parent, inode)
+		return inode
+	}
+	return nil
+}
+
+// Expose a file colliding with a directory under an escaped name
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_EXCLUDED(parent.fs.mu)
+func (parent *Inode) insertEscapedFile(name string, item *BlobItemOutput) {
+	fs := parent.fs
+	escName := name + fs.flags.CollisionSuffix
+	inode := parent.findChildUnlocked(escName)
+	if inode == nil {
+		// don't revive deleted items
+		if _, deleted := parent.dir.DeletedChildren[escName]; deleted {
+			return
+		}
+		inode = NewInode(fs, parent, escName)
+		inode.cloudName = name
+		fs.insertInode(parent, inode)
+	} else if inode.cloudName != name {
+		// a real object has the same name as the escaped one
+		return
+	}
+	inode.SetFromBlobItem(item)
+}
+
 func (parent *Inode) findChildMaxTime() (maxMtime, maxCtime time.Time) {
 	maxCtime = parent.Attributes.Ctime
 	maxMtime = parent.Attributes.Mtime
@@ -1708,6 +2404,21 @@ func (parent *Inode) findChildMaxTime() (maxMtime, maxCtime time.Time) {
 }
 
 func (parent *Inode) LookUp(name string, doSlurp bool) (*Inode, error) {
+	suffix := parent.fs.flags.CollisionSuffix
+	if parent.fs.flags.FileDirCollision == "escape" &&
+		len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+		// Escaped files are found by looking up the original name
+		_, err := parent.LookUp(name[0 : len(name)-len(suffix)], doSlurp)
+		if err != nil && mapAwsError(err) != fuse.ENOENT {
+			return nil, err
+		}
+		parent.mu.Lock()
+		inode := parent.findChildUnlocked(name)
+		parent.mu.Unlock()
+		if inode != nil {
+			return inode, nil
+		}
+	}
 	_, parentKey := parent.cloud()
 	key := appendChildName(parentKey, name)
 	root := parent
@@ -1721,8 +2432,11 @@ func (parent *Inode) LookUp(name string, doSlurp bool) (*Inode, error) {
 	if loaded {
 		parent.mu.Lock()
 		inode := parent.findChildUnlocked(name)
+		lazyEvicted := parent.dir.lazyEvicted
 		parent.mu.Unlock()
-		return inode, nil
+		if inode != nil || !lazyEvicted {
+			return inode, nil
+		}
 	}
 	if doSlurp {
 		// 99% of time it's impractical to do 2 HEAD requests per file when looking it up
@@ -1829,25 +2543,39 @@ func (parent *Inode) LookUpInodeMaybeDir(name string) (*BlobItemOutput, error) {
 		break
 	}
 
-	for n > 0 {
-		n--
-		if !cloud.Capabilities().DirBlob && !parent.fs.flags.Cheap {
-			<- results
-		}
-		if object != nil {
-			return &object.BlobItemOutput, nil
-		}
+	dirResult := func() *BlobItemOutput {
 		if dirObject != nil {
-			return &dirObject.BlobItemOutput, nil
+			return &dirObject.BlobItemOutput
 		}
 		if prefixList != nil && (len(prefixList.Prefixes) != 0 || len(prefixList.Items) != 0) {
 			if len(prefixList.Items) != 0 && (*prefixList.Items[0].Key == key ||
 				(*prefixList.Items[0].Key)[0 : len(key)+1] == key+"/") {
-				return &prefixList.Items[0], nil
+				return &prefixList.Items[0]
 			}
 			return &BlobItemOutput{
 				Key: aws.String(key+"/"),
-			}, nil
+			}
+		}
+		return nil
+	}
+	// Return early only when other checks can't change the result
+	// according to the file/directory collision policy. With the default
+	// "file" policy a found file is returned as soon as its HEAD succeeds
+	preferFile := parent.fs.flags.FileDirCollision == "file"
+	// Cheap mode and backends with directory blobs check everything in turn
+	objectDone := cloud.Capabilities().DirBlob || parent.fs.flags.Cheap
+	for n > 0 {
+		n--
+		if !cloud.Capabilities().DirBlob && !parent.fs.flags.Cheap {
+			if <- results == 1 {
+				objectDone = true
+			}
+		}
+		if object != nil && (preferFile || n == 0 && dirResult() == nil) {
+			return &object.BlobItemOutput, nil
+		}
+		if dir := dirResult(); dir != nil && (!preferFile || n == 0 || objectDone) {
+			return dir, nil
 		}
 	}
 
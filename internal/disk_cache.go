@@ -0,0 +1,287 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Disk cache reuse across restarts. With --validate-disk-cache, every cache
+// file remembers the ETag and size of the object and the ranges of it saved
+// on disk in its xattrs. On startup, files matching the server are kept and
+// used to warm the cache, all other files are removed.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DISK_CACHE_ETAG_XATTR = "user.geesefs.etag"
+	DISK_CACHE_SIZE_XATTR = "user.geesefs.size"
+	DISK_CACHE_RANGES_XATTR = "user.geesefs.ranges"
+	DISK_CACHE_DIRTY_XATTR = "user.geesefs.dirty"
+)
+
+type DiskCacheEntry struct {
+	ETag   string
+	Size   uint64
+	// offset and length pairs
+	Ranges []uint64
+}
+
+// Add a range to a sorted list of non-overlapping ranges
+func addRange(ranges []uint64, offset, length uint64) []uint64 {
+	end := offset+length
+	var res []uint64
+	i := 0
+	for ; i < len(ranges) && ranges[i]+ranges[i+1] < offset; i += 2 {
+		res = append(res, ranges[i], ranges[i+1])
+	}
+	for ; i < len(ranges) && ranges[i] <= end; i += 2 {
+		if ranges[i] < offset {
+			offset = ranges[i]
+		}
+		if ranges[i]+ranges[i+1] > end {
+			end = ranges[i]+ranges[i+1]
+		}
+	}
+	res = append(res, offset, end-offset)
+	return append(res, ranges[i:]...)
+}
+
+// Ranges are saved as comma-separated start-end pairs, end is exclusive
+func formatRanges(ranges []uint64) string {
+	s := make([]string, 0, len(ranges)/2)
+	for i := 0; i < len(ranges); i += 2 {
+		s = append(s, fmt.Sprintf("%v-%v", ranges[i], ranges[i]+ranges[i+1]))
+	}
+	return strings.Join(s, ",")
+}
+
+func parseRanges(s string) (ranges []uint64, err error) {
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(r, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid range %v", r)
+		}
+		start, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if end < start {
+			return nil, fmt.Errorf("invalid range %v", r)
+		}
+		ranges = addRange(ranges, start, end-start)
+	}
+	return
+}
+
+func getStrXattr(path, name string) string {
+	buf := make([]byte, 65536)
+	n, err := unix.Getxattr(path, name, buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[0:n])
+}
+
+// Remember that the buffer is saved to the cache file
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) recordDiskCache(buf *FileBuffer) {
+	if !inode.fs.flags.ValidateDiskCache || inode.DiskCacheFD == nil {
+		return
+	}
+	fd := int(inode.DiskCacheFD.Fd())
+	if inode.diskCacheETag != inode.knownETag || inode.knownETag == "" {
+		// Object changed since the previous save, older ranges may be stale
+		inode.diskCacheETag = inode.knownETag
+		inode.diskCacheRanges = nil
+		inode.diskCacheDirty = false
+		unix.Fremovexattr(fd, DISK_CACHE_DIRTY_XATTR)
+		unix.Fsetxattr(fd, DISK_CACHE_ETAG_XATTR, []byte(inode.knownETag), 0)
+		unix.Fsetxattr(fd, DISK_CACHE_SIZE_XATTR, []byte(strconv.FormatUint(inode.knownSize, 10)), 0)
+	}
+	if buf.dirtyID != 0 {
+		// Data not yet committed to the server can't be verified after restart
+		if !inode.diskCacheDirty {
+			inode.diskCacheDirty = true
+			unix.Fsetxattr(fd, DISK_CACHE_DIRTY_XATTR, []byte("1"), 0)
+		}
+		return
+	}
+	inode.diskCacheRanges = addRange(inode.diskCacheRanges, buf.offset, buf.length)
+	err := unix.Fsetxattr(fd, DISK_CACHE_RANGES_XATTR, []byte(formatRanges(inode.diskCacheRanges)), 0)
+	if err != nil {
+		log.Debugf("Couldn't save disk cache ranges of %v: %v", inode.FullName(), err)
+	}
+}
+
+// Index files in the disk cache saved before restart. Files without a valid
+// saved state are removed at once. Entries are compared with the object when
+// they're attached to inodes, so checking them against the server isn't
+// required before mounting and is done in the background, see checkDiskCache()
+func (fs *Goofys) validateDiskCache() (names []string) {
+	index := make(map[string]*DiskCacheEntry)
+	discarded := 0
+	cacheDir := filepath.Clean(fs.flags.CachePath)
+	filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		name, _ := filepath.Rel(cacheDir, path)
+		name = filepath.ToSlash(name)
+		reason := ""
+		entry := &DiskCacheEntry{
+			ETag: getStrXattr(path, DISK_CACHE_ETAG_XATTR),
+		}
+		size, sizeErr := strconv.ParseUint(getStrXattr(path, DISK_CACHE_SIZE_XATTR), 10, 64)
+		entry.Size = size
+		ranges := getStrXattr(path, DISK_CACHE_RANGES_XATTR)
+		if entry.ETag == "" || sizeErr != nil || ranges == "" {
+			reason = "no saved state"
+		} else if getStrXattr(path, DISK_CACHE_DIRTY_XATTR) != "" {
+			reason = "contains unverifiable modified data"
+		} else if entry.Ranges, err = parseRanges(ranges); err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			log.Infof("Discarding disk cache of %v: %v", name, reason)
+			os.Remove(path)
+			discarded++
+		} else {
+			index[name] = entry
+			names = append(names, name)
+		}
+		return nil
+	})
+	log.Infof("Disk cache indexed: %v files, discarded %v files", len(names), discarded)
+
+	fs.diskCacheMu.Lock()
+	fs.diskCacheIndex = index
+	fs.diskCacheMu.Unlock()
+	return
+}
+
+// Remove indexed cache files of objects changed or deleted on the server.
+// Objects are checked in parallel, up to --max-flushers at once
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) checkDiskCache(names []string) {
+	fs.mu.RLock()
+	root := fs.inodes[fuseops.RootInodeID]
+	fs.mu.RUnlock()
+	root.mu.Lock()
+	cloud, prefix := root.cloud()
+	root.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var kept, discarded int64
+	sem := make(chan struct{}, fs.flags.MaxFlushers)
+	for _, name := range names {
+		fs.diskCacheMu.Lock()
+		entry := fs.diskCacheIndex[name]
+		fs.diskCacheMu.Unlock()
+		if entry == nil {
+			// Already attached to an inode
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(name string, entry *DiskCacheEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			reason := ""
+			resp, err := cloud.HeadBlob(&HeadBlobInput{Key: appendChildName(prefix, name)})
+			if err != nil {
+				reason = fmt.Sprintf("HEAD failed: %v", mapAwsError(err))
+			} else if resp.ETag == nil || *resp.ETag != entry.ETag || resp.Size != entry.Size {
+				reason = fmt.Sprintf("object changed: ETag %v size %v, cached ETag %v size %v",
+					NilStr(resp.ETag), resp.Size, entry.ETag, entry.Size)
+			}
+			if reason == "" {
+				log.Debugf("Keeping disk cache of %v: %v", name, formatRanges(entry.Ranges))
+				atomic.AddInt64(&kept, 1)
+				return
+			}
+			fs.diskCacheMu.Lock()
+			// The file is in use if the entry is already attached to an inode
+			if fs.diskCacheIndex[name] == entry {
+				delete(fs.diskCacheIndex, name)
+				log.Infof("Discarding disk cache of %v: %v", name, reason)
+				os.Remove(fs.flags.CachePath+"/"+name)
+				atomic.AddInt64(&discarded, 1)
+			}
+			fs.diskCacheMu.Unlock()
+		}(name, entry)
+	}
+	wg.Wait()
+	log.Infof("Disk cache validated: kept %v files, discarded %v files", kept, discarded)
+}
+
+// Reuse disk cache saved before restart if it matches the object
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) attachDiskCache() {
+	fs := inode.fs
+	if inode.isDir() || inode.knownETag == "" || len(inode.buffers) > 0 {
+		return
+	}
+	name := inode.FullName()
+	fs.diskCacheMu.Lock()
+	if fs.diskCacheIndex == nil {
+		fs.diskCacheMu.Unlock()
+		return
+	}
+	entry := fs.diskCacheIndex[name]
+	delete(fs.diskCacheIndex, name)
+	fs.diskCacheMu.Unlock()
+	if entry == nil {
+		return
+	}
+	if entry.ETag != inode.knownETag || entry.Size != inode.knownSize || inode.Attributes.Size != entry.Size {
+		// Object is changed after validation
+		os.Remove(fs.flags.CachePath+"/"+name)
+		return
+	}
+	for i := 0; i < len(entry.Ranges); i += 2 {
+		end := entry.Ranges[i]+entry.Ranges[i+1]
+		if end > entry.Size {
+			end = entry.Size
+		}
+		for off := entry.Ranges[i]; off < end; off += MAX_BUF {
+			l := end-off
+			if l > MAX_BUF {
+				l = MAX_BUF
+			}
+			inode.buffers = append(inode.buffers, &FileBuffer{
+				offset: off,
+				length: l,
+				state: BUF_CLEAN,
+				onDisk: true,
+			})
+		}
+	}
+	inode.OnDisk = true
+	inode.diskCacheETag = entry.ETag
+	inode.diskCacheRanges = entry.Ranges
+}
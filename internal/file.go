@@ -16,8 +16,14 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"path"
 	"sort"
@@ -26,17 +32,37 @@ import (
 	"syscall"
 	"time"
 
+	. "github.com/yandex-cloud/geesefs/api/common"
+
 	"github.com/jacobsa/fuse"
 )
 
 type FileHandle struct {
 	inode *Inode
+	writer bool
+	// Opened with O_DIRECT: reads go to the server. With --direct-sync-writes
+	// every write is also flushed before returning. So every write completes
+	// an upload of the whole file: small files are uploaded again, and large
+	// ones copy unmodified parts on the server and upload modified parts
+	// after reading them back
+	direct bool
 	lastReadEnd uint64
 	seqReadSize uint64
 	lastReadCount uint64
 	lastReadTotal uint64
 	lastReadSizes []uint64
 	lastReadIdx int
+
+	// Server response used to stream long sequential reads
+	streamMu sync.Mutex
+	stream io.ReadCloser
+	streamOffset uint64
+	streamETag string
+
+	// Data loaded ahead of the current read position, accounted in fs.readAheadBytes
+	readAheadPos uint64
+	readAheadEnd uint64
+	readAhead uint64
 }
 
 // On Linux and MacOS, IOV_MAX = 1024
@@ -53,10 +79,10 @@ func NewFileHandle(inode *Inode) *FileHandle {
 	return fh
 }
 
-func (fs *Goofys) partNum(offset uint64) uint64 {
+func partNum(partSizes []PartSizeConfig, offset uint64) uint64 {
 	n := uint64(0)
 	start := uint64(0)
-	for _, s := range fs.flags.PartSizes {
+	for _, s := range partSizes {
 		p := (offset - start) / s.PartSize
 		if p < s.PartCount {
 			return n + p
@@ -70,10 +96,10 @@ func (fs *Goofys) partNum(offset uint64) uint64 {
 	))
 }
 
-func (fs *Goofys) partRange(num uint64) (offset uint64, size uint64) {
+func partRange(partSizes []PartSizeConfig, num uint64) (offset uint64, size uint64) {
 	n := uint64(0)
 	start := uint64(0)
-	for _, s := range fs.flags.PartSizes {
+	for _, s := range partSizes {
 		if num < n + s.PartCount {
 			return start + (num-n)*s.PartSize, s.PartSize
 		}
@@ -83,13 +109,72 @@ func (fs *Goofys) partRange(num uint64) (offset uint64, size uint64) {
 	panic(fmt.Sprintf("Part number too large: %v", num))
 }
 
-func (fs *Goofys) getMaxFileSize() (size uint64) {
-	for _, s := range fs.flags.PartSizes {
+func maxFileSize(partSizes []PartSizeConfig) (size uint64) {
+	for _, s := range partSizes {
 		size += s.PartSize * s.PartCount
 	}
 	return size
 }
 
+// Part layout for a file of the given size. Leading steps of the part size
+// ladder are skipped while the file doesn't fit into the rest of it, their
+// part count is given to the last step
+func (fs *Goofys) partSizesFor(size uint64) []PartSizeConfig {
+	ladder := fs.flags.PartSizes
+	if size <= maxFileSize(ladder) {
+		return ladder
+	}
+	var layout []PartSizeConfig
+	for skip := 1; skip < len(ladder); skip++ {
+		layout = append([]PartSizeConfig(nil), ladder[skip:]...)
+		for _, s := range ladder[0 : skip] {
+			layout[len(layout)-1].PartCount += s.PartCount
+		}
+		if size <= maxFileSize(layout) {
+			break
+		}
+	}
+	if layout == nil {
+		return ladder
+	}
+	return layout
+}
+
+// Largest file size supported by any part layout
+func (fs *Goofys) getMaxFileSize() uint64 {
+	return maxFileSize(fs.partSizesFor(math.MaxUint64))
+}
+
+// Part layout of the file: the one of the current multipart upload,
+// or the one that would be chosen for its current size
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) partSizes() []PartSizeConfig {
+	if inode.mpuPartSizes != nil {
+		return inode.mpuPartSizes
+	}
+	return inode.fs.partSizesFor(inode.Attributes.Size)
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) partNum(offset uint64) uint64 {
+	return partNum(inode.partSizes(), offset)
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) partRange(num uint64) (offset uint64, size uint64) {
+	return partRange(inode.partSizes(), num)
+}
+
+// Largest size the file may grow to. It's limited by the part layout
+// of the current multipart upload, if there is one
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) maxFileSize() uint64 {
+	if inode.mpuPartSizes != nil {
+		return maxFileSize(inode.mpuPartSizes)
+	}
+	return inode.fs.getMaxFileSize()
+}
+
 func locateBuffer(buffers []*FileBuffer, offset uint64) int {
 	return sort.Search(len(buffers), func(i int) bool {
 		return buffers[i].offset + buffers[i].length > offset
@@ -135,21 +220,24 @@ func (inode *Inode) insertOrAppendBuffer(pos int, offset uint64, data []byte, st
 	dirtyID := uint64(0)
 	if state == BUF_DIRTY {
 		dirtyID = atomic.AddUint64(&inode.fs.bufferPool.curDirtyID, 1)
+		inode.fs.addDirty(int64(len(data)))
 	}
+	// The new buffer is inserted between buffers[pos-1] and buffers[pos]
 	if pos > 0 && (inode.buffers[pos-1].offset+inode.buffers[pos-1].length) > offset ||
-		pos < len(inode.buffers)-1 && (offset+uint64(len(data))) > inode.buffers[pos+1].offset {
+		pos < len(inode.buffers) && (offset+uint64(len(data))) > inode.buffers[pos].offset {
 		s := fmt.Sprintf("Tried to insert out of order: %x+%x", offset, len(data))
 		if pos > 0 {
 			s += fmt.Sprintf(" after %x+%x (s%v)", inode.buffers[pos-1].offset, inode.buffers[pos-1].length, inode.buffers[pos-1].state)
 		}
-		if pos < len(inode.buffers)-1 {
-			s += fmt.Sprintf(" before %x+%x (s%v)", inode.buffers[pos+1].offset, inode.buffers[pos+1].length, inode.buffers[pos+1].state)
+		if pos < len(inode.buffers) {
+			s += fmt.Sprintf(" before %x+%x (s%v)", inode.buffers[pos].offset, inode.buffers[pos].length, inode.buffers[pos].state)
 		}
 		panic(s)
 	}
-	partStart, _ := inode.fs.partRange(inode.fs.partNum(offset))
+	partStart, _ := inode.partRange(inode.partNum(offset))
 	if copyData && pos > 0 &&
 		inode.buffers[pos-1].data != nil &&
+		!inode.buffers[pos-1].compressed &&
 		(inode.buffers[pos-1].offset + inode.buffers[pos-1].length) == offset &&
 		offset != partStart &&
 		state == BUF_DIRTY &&
@@ -242,6 +330,13 @@ func (inode *Inode) addBuffer(offset uint64, data []byte, state int16, copyData
 	return allocated
 }
 
+// Modified locally and not uploaded yet. Only such buffers are counted in
+// dirty bytes: parts flushed to an unfinished multipart upload aren't, so
+// writers blocked by --max-dirty-bytes don't wait for the upload to complete
+func (b *FileBuffer) unflushed() bool {
+	return b.dirtyID != 0 && b.state == BUF_DIRTY
+}
+
 // Remove buffers in range (offset..size)
 func (inode *Inode) removeRange(offset, size uint64, state int16) (allocated int64) {
 	start := locateBuffer(inode.buffers, offset)
@@ -257,6 +352,9 @@ func (inode *Inode) removeRange(offset, size uint64, state int16) (allocated int
 			if offset <= b.offset {
 				if endOffset >= bufEnd {
 					// whole buffer
+					if b.unflushed() {
+						inode.fs.addDirty(-int64(b.length))
+					}
 					if b.data != nil {
 						b.ptr.refs--
 						if b.ptr.refs == 0 {
@@ -269,6 +367,10 @@ func (inode *Inode) removeRange(offset, size uint64, state int16) (allocated int
 					pos--
 				} else {
 					// beginning
+					inode.inflateBuffer(b)
+					if b.unflushed() {
+						inode.fs.addDirty(-int64(endOffset-b.offset))
+					}
 					if b.data != nil {
 						b.data = b.data[endOffset - b.offset : ]
 					}
@@ -277,12 +379,20 @@ func (inode *Inode) removeRange(offset, size uint64, state int16) (allocated int
 				}
 			} else if endOffset >= bufEnd {
 				// end
+				inode.inflateBuffer(b)
+				if b.unflushed() {
+					inode.fs.addDirty(-int64(bufEnd-offset))
+				}
 				if b.data != nil {
 					b.data = b.data[0 : offset - b.offset]
 				}
 				b.length = offset - b.offset
 			} else {
 				// middle
+				inode.inflateBuffer(b)
+				if b.unflushed() {
+					inode.fs.addDirty(-int64(size))
+				}
 				startBuf := &FileBuffer{
 					offset: b.offset,
 					dirtyID: b.dirtyID,
@@ -345,6 +455,7 @@ func (inode *Inode) zeroRange(offset, size uint64) (bool, int64) {
 		data: nil,
 		ptr: nil,
 	})
+	inode.fs.addDirty(int64(size))
 
 	return true, allocated
 }
@@ -383,6 +494,9 @@ func (inode *Inode) ResizeUnlocked(newSize uint64, zeroFill bool, finalizeFlushe
 					b.ptr = nil
 					b.data = nil
 				}
+				if b.unflushed() {
+					inode.fs.addDirty(-int64(b.length))
+				}
 				end--
 			}
 			if pauseAndFlush {
@@ -392,16 +506,17 @@ func (inode *Inode) ResizeUnlocked(newSize uint64, zeroFill bool, finalizeFlushe
 				inode.mu.Unlock()
 				inode.SyncFile()
 				inode.mu.Lock()
-				inode.pauseWriters--
-				if inode.readCond != nil {
-					inode.readCond.Broadcast()
-				}
+				inode.resumeWriters()
 			}
 		}
 		inode.buffers = inode.buffers[0 : end]
 		if end > 0 {
 			buf := inode.buffers[end-1]
 			if buf.offset + buf.length > newSize {
+				inode.inflateBuffer(buf)
+				if buf.unflushed() {
+					inode.fs.addDirty(-int64(buf.offset + buf.length - newSize))
+				}
 				buf.length = newSize - buf.offset
 				if buf.data != nil {
 					buf.data = buf.data[0 : buf.length]
@@ -411,6 +526,7 @@ func (inode *Inode) ResizeUnlocked(newSize uint64, zeroFill bool, finalizeFlushe
 	}
 	if zeroFill && inode.Attributes.Size < newSize {
 		// Zero fill extended region
+		inode.fs.addDirty(int64(newSize - inode.Attributes.Size))
 		inode.buffers = append(inode.buffers, &FileBuffer{
 			offset: inode.Attributes.Size,
 			dirtyID: atomic.AddUint64(&inode.fs.bufferPool.curDirtyID, 1),
@@ -422,8 +538,19 @@ func (inode *Inode) ResizeUnlocked(newSize uint64, zeroFill bool, finalizeFlushe
 		})
 	}
 	inode.Attributes.Size = newSize
+	inode.updateUsedBlocks()
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) resumeWriters() {
+	inode.pauseWriters--
+	if inode.readCond != nil {
+		inode.readCond.Broadcast()
+	}
 }
 
+// Wait while a reader or truncate flushes the file
+// LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) checkPauseWriters() {
 	for inode.pauseWriters > 0 {
 		if inode.readCond == nil {
@@ -436,6 +563,11 @@ func (inode *Inode) checkPauseWriters() {
 func (fh *FileHandle) WriteFile(offset int64, data []byte, copyData bool) (err error) {
 	fh.inode.logFuse("WriteFile", offset, len(data))
 
+	if fh.inode.isVirtual() {
+		// Metadata sidecars and control files are read-only
+		return syscall.EROFS
+	}
+
 	end := uint64(offset)+uint64(len(data))
 
 	if end > fh.inode.fs.getMaxFileSize() {
@@ -447,23 +579,36 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte, copyData bool) (err e
 		return syscall.EFBIG
 	}
 
+	fh.inode.fs.waitDirtyMemory()
+
 	// Try to reserve space without the inode lock
 	err = fh.inode.fs.bufferPool.Use(int64(len(data)), false)
 	if err != nil {
 		return err
 	}
 
-	fh.inode.fs.lfru.Hit(fh.inode.Id, 0)
+	fh.inode.fs.cachePolicy.Hit(fh.inode.Id, 0)
 
 	fh.inode.mu.Lock()
 
-	if fh.inode.CacheState == ST_DELETED || fh.inode.CacheState == ST_DEAD {
+	if (fh.inode.CacheState == ST_DELETED || fh.inode.CacheState == ST_DEAD) && !fh.inode.openUnlinked {
 		// Oops, it's a deleted file. We don't support changing invisible files
 		fh.inode.fs.bufferPool.Use(-int64(len(data)), false)
 		fh.inode.mu.Unlock()
 		return fuse.ENOENT
 	}
 
+	if end > fh.inode.maxFileSize() {
+		// Part layout of the current multipart upload doesn't allow it
+		log.Warnf(
+			"Maximum file size of the current upload exceeded when writing %v bytes at offset %v to %v",
+			len(data), offset, fh.inode.FullName(),
+		)
+		fh.inode.fs.bufferPool.Use(-int64(len(data)), false)
+		fh.inode.mu.Unlock()
+		return syscall.EFBIG
+	}
+
 	fh.inode.checkPauseWriters()
 
 	if fh.inode.Attributes.Size < end {
@@ -482,9 +627,9 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte, copyData bool) (err e
 	fh.inode.Attributes.Mtime = time.Now()
 	fh.inode.Attributes.Ctime = fh.inode.Attributes.Mtime
 	if fh.inode.fs.flags.EnableMtime && fh.inode.userMetadata != nil &&
-		fh.inode.userMetadata[fh.inode.fs.flags.MtimeAttr] != nil {
-		delete(fh.inode.userMetadata, fh.inode.fs.flags.MtimeAttr)
-		fh.inode.userMetadataDirty = 2
+		fh.inode.metadataAttr(fh.inode.fs.flags.MtimeAttr) != nil {
+		fh.inode.resetMetadataAttr(fh.inode.fs.flags.MtimeAttr,
+			[]byte(fmt.Sprintf("%d", fh.inode.Attributes.Mtime.Unix())))
 	}
 
 	fh.inode.mu.Unlock()
@@ -494,6 +639,12 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte, copyData bool) (err e
 		err = fh.inode.fs.bufferPool.Use(allocated-int64(len(data)), true)
 	}
 
+	if fh.direct && fh.inode.fs.flags.DirectSyncWrites && err == nil {
+		// O_DIRECT writes don't stay in the write-back cache. It's slow,
+		// each write makes a new version of the object on the server
+		err = fh.inode.SyncFile()
+	}
+
 	return
 }
 
@@ -600,11 +751,41 @@ func (inode *Inode) OpenCacheFD() error {
 	return nil
 }
 
+// Write buffer data to the cache file
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) saveToDiskCache(buf *FileBuffer) error {
+	err := inode.OpenCacheFD()
+	if err != nil {
+		return err
+	}
+	_, err = inode.DiskCacheFD.WriteAt(buf.data, int64(buf.offset))
+	if err != nil {
+		log.Errorf("Couldn't write %v bytes at offset %v to %v: %v",
+			len(buf.data), buf.offset, inode.fs.flags.CachePath+"/"+inode.FullName(), err)
+		return err
+	}
+	buf.onDisk = true
+	inode.recordDiskCache(buf)
+	return nil
+}
+
 // Load some inode data into memory
 // Must be called with inode.mu taken
 // Loaded range should be guarded against eviction by adding it into inode.readRanges
 func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64, ignoreMemoryLimit bool) (miss bool, requestErr error) {
 
+	if inode.fs.flags.VerifyChecksums && inode.userMetadata == nil && inode.knownETag != "" {
+		// Checksums are saved in the metadata, so it's required before reading
+		requestErr = inode.fillXattr()
+		if requestErr != nil {
+			return
+		}
+	}
+
+	if offset >= inode.Attributes.Size {
+		// Nothing to load past EOF
+		return
+	}
 	end := offset+readAheadSize
 	if size > readAheadSize {
 		end = offset+size
@@ -614,6 +795,7 @@ func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64,
 	}
 
 	// Collect requests to the server and disk
+	gen := inode.cacheGen
 	requests := []uint64(nil)
 	diskRequests := []uint64(nil)
 	start := locateBuffer(inode.buffers, offset)
@@ -705,6 +887,24 @@ func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64,
 		requests = splitRequests
 	}
 
+	compressed := inode.uncompressedSize != 0
+	compression := ""
+	if compressed {
+		compression = inode.compression
+	}
+	if !compressed && len(requests) > 0 && inode.hasChecksums() {
+		// Checksums can only be verified for whole units
+		requests = inode.alignToChecksums(requests)
+	}
+	if compressed && len(requests) > 0 {
+		// Compressed objects can only be loaded as a whole
+		size := inode.uncompressedSize
+		if size > inode.Attributes.Size {
+			size = inode.Attributes.Size
+		}
+		requests = []uint64{0, size}
+	}
+
 	// Mark new ranges as being loaded from the server
 	for i := 0; i < len(requests); i += 2 {
 		offset := requests[i]
@@ -750,22 +950,22 @@ func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64,
 		for i := 0; i < len(requests); i += 2 {
 			requestOffset := requests[i]
 			requestSize := requests[i+1]
-			go inode.sendRead(cloud, key, requestOffset, requestSize, ignoreMemoryLimit)
+			go inode.sendRead(cloud, key, requestOffset, requestSize, gen, compression, ignoreMemoryLimit)
 		}
 	}
 
 	if len(diskRequests) > 0 {
-		if err := inode.OpenCacheFD(); err != nil {
-			return true, err
-		}
+		fdErr := inode.OpenCacheFD()
 		loadedFromDisk := uint64(0)
+		var refetch []uint64
+		var diskErr error
 		for i := 0; i < len(diskRequests); i += 2 {
 			requestOffset := diskRequests[i]
 			requestSize := diskRequests[i+1]
 			data := make([]byte, requestSize)
-			_, err := inode.DiskCacheFD.ReadAt(data, int64(requestOffset))
-			if err != nil {
-				return true, err
+			err := fdErr
+			if err == nil {
+				_, err = inode.DiskCacheFD.ReadAt(data, int64(requestOffset))
 			}
 			pos := locateBuffer(inode.buffers, requestOffset)
 			var ib *FileBuffer
@@ -775,6 +975,21 @@ func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64,
 			if ib == nil || ib.offset != requestOffset || ib.length != requestSize || !ib.loading {
 				panic("BUG: Disk read buffer was modified by someone else in meantime")
 			}
+			if err != nil {
+				log.Errorf("Error reading %v bytes at %v of %v from disk cache: %v",
+					requestSize, requestOffset, inode.FullName(), err)
+				ib.onDisk = false
+				if ib.state == BUF_CLEAN {
+					// Clean data is still on the server, load it from there.
+					// The buffer stays marked as loading and is filled by sendRead
+					refetch = append(refetch, requestOffset, requestSize)
+				} else {
+					// The only copy of unflushed data is lost
+					ib.loading = false
+					diskErr = syscall.EIO
+				}
+				continue
+			}
 			ib.loading = false
 			ib.data = data
 			ib.ptr = &BufferPointer{
@@ -791,6 +1006,31 @@ func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64,
 		inode.fs.bufferPool.Use(int64(loadedFromDisk), true)
 		inode.mu.Lock()
 		toLoad -= loadedFromDisk
+		if len(refetch) > 0 {
+			if compressed {
+				// Compressed objects can only be loaded as a whole
+				size := inode.uncompressedSize
+				if size > inode.Attributes.Size {
+					size = inode.Attributes.Size
+				}
+				inode.addLoadingBuffers(0, size)
+				refetch = []uint64{0, size}
+			}
+			if inode.readCond == nil {
+				inode.readCond = sync.NewCond(&inode.mu)
+			}
+			cloud, key := inode.cloud()
+			if inode.oldParent != nil {
+				_, key = inode.oldParent.cloud()
+				key = appendChildName(key, inode.oldName)
+			}
+			for i := 0; i < len(refetch); i += 2 {
+				go inode.sendRead(cloud, key, refetch[i], refetch[i+1], gen, compression, ignoreMemoryLimit)
+			}
+		}
+		if diskErr != nil {
+			return true, diskErr
+		}
 	}
 
 	if toLoad == 0 {
@@ -800,6 +1040,11 @@ func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64,
 	miss = true
 	end = offset+size
 	for {
+		if inode.cacheGen != gen {
+			// Cache is dropped due to a remote change, the caller should start over
+			requestErr = syscall.ESTALE
+			return
+		}
 		// Check if all buffers are loaded or if there is a read error
 		pos := offset
 		start := locateBuffer(inode.buffers, offset)
@@ -841,7 +1086,7 @@ func (inode *Inode) LoadRange(offset uint64, size uint64, readAheadSize uint64,
 	return
 }
 
-func (inode *Inode) sendRead(cloud StorageBackend, key string, offset, size uint64, ignoreMemoryLimit bool) {
+func (inode *Inode) sendRead(cloud StorageBackend, key string, offset, size uint64, gen uint64, compression string, ignoreMemoryLimit bool) {
 	// Maybe free some buffers first
 	origOffset := offset
 	origSize := size
@@ -849,27 +1094,69 @@ func (inode *Inode) sendRead(cloud StorageBackend, key string, offset, size uint
 	if err != nil {
 		log.Errorf("Error reading %v +%v of %v: %v", offset, size, key, err)
 		inode.mu.Lock()
-		inode.readError = err
-		inode.removeLoadingBuffers(offset, size)
+		if inode.cacheGen == gen {
+			inode.readError = err
+			inode.removeLoadingBuffers(offset, size)
+		}
 		inode.mu.Unlock()
 		inode.readCond.Broadcast()
 		return
 	}
 	inode.mu.Lock()
 	inode.LockRange(offset, size, false)
+	var crc uint32
+	verify := false
+	if compression == "" && inode.hasChecksums() {
+		crc, verify = inode.checksumFor(offset, size)
+	}
 	inode.mu.Unlock()
-	resp, err := cloud.GetBlob(&GetBlobInput{
+	get := &GetBlobInput{
 		Key:   key,
 		Start: offset,
 		Count: size,
-	})
+	}
+	if compression != "" {
+		// Read the whole object and decompress it
+		get = &GetBlobInput{Key: key}
+	}
+	resp, err := cloud.GetBlob(get)
+	var body io.Reader
+	if err == nil {
+		resp.Body = inode.fs.downloadThrottle.ReadCloser(resp.Body)
+		body = resp.Body
+		if compression != "" {
+			var dec io.ReadCloser
+			dec, err = decompressReader(resp.Body, compression)
+			if err != nil {
+				resp.Body.Close()
+			} else {
+				resp.Body = dec
+				body = dec
+			}
+		}
+	}
+	if err == nil && verify {
+		// Read the whole unit and check it before caching any of its data
+		data := make([]byte, size)
+		_, err = io.ReadFull(body, data)
+		if err == nil && crc32.Checksum(data, crc32cTable) != crc {
+			log.Errorf("Checksum mismatch in %v +%v of %v, the object is corrupted", offset, size, inode.FullName())
+			err = syscall.EIO
+		}
+		if err != nil {
+			resp.Body.Close()
+		}
+		body = bytes.NewReader(data)
+	}
 	if err != nil {
 		log.Errorf("Error reading %v +%v of %v: %v", offset, size, key, err)
 		inode.fs.bufferPool.Use(-int64(size), false)
 		inode.mu.Lock()
 		inode.UnlockRange(origOffset, origSize, false)
-		inode.removeLoadingBuffers(offset, size)
-		inode.readError = err
+		if inode.cacheGen == gen {
+			inode.removeLoadingBuffers(offset, size)
+			inode.readError = err
+		}
 		inode.mu.Unlock()
 		inode.readCond.Broadcast()
 		return
@@ -885,13 +1172,17 @@ func (inode *Inode) sendRead(cloud StorageBackend, key string, offset, size uint
 		buf := make([]byte, bs)
 		done := uint64(0)
 		for done < bs {
-			n, err := resp.Body.Read(buf[done :])
+			n, err := body.Read(buf[done :])
 			done += uint64(n)
+			atomic.AddUint64(&inode.bytesRead, uint64(n))
+			atomic.AddUint64(&inode.fs.metrics.backend(cloud).downloadedBytes, uint64(n))
 			if err != nil && (err != io.EOF || done < bs) {
 				log.Errorf("Error reading %v +%v of %v: %v", offset, bs, key, err)
 				inode.mu.Lock()
-				inode.readError = err
-				inode.removeLoadingBuffers(offset, left)
+				if inode.cacheGen == gen {
+					inode.readError = err
+					inode.removeLoadingBuffers(offset, left)
+				}
 				inode.UnlockRange(origOffset, origSize, false)
 				inode.mu.Unlock()
 				if allocated != size {
@@ -903,20 +1194,46 @@ func (inode *Inode) sendRead(cloud StorageBackend, key string, offset, size uint
 		}
 		// Cache part of the result
 		inode.mu.Lock()
+		if inode.cacheGen != gen {
+			// Cache is dropped while we were reading, the data may belong
+			// to another version of the object, so throw it away
+			inode.UnlockRange(origOffset, origSize, false)
+			inode.mu.Unlock()
+			resp.Body.Close()
+			inode.fs.bufferPool.Use(int64(allocated)-int64(size), true)
+			return
+		}
 		if inode.userMetadata == nil {
 			// Cache xattrs
 			inode.fillXattrFromHead(&(*resp).HeadBlobOutput)
 		}
-		added := inode.addBuffer(offset, buf, BUF_CLEAN, false)
+		data := buf
+		if offset+uint64(len(data)) > inode.Attributes.Size {
+			// The file was truncated while we were reading. Data beyond
+			// the new size is stale and mustn't appear after a later extension
+			if offset >= inode.Attributes.Size {
+				data = nil
+			} else {
+				data = data[0 : inode.Attributes.Size-offset]
+			}
+		}
+		added := int64(0)
+		if len(data) > 0 {
+			added = inode.addBuffer(offset, data, BUF_CLEAN, false)
+		}
 		inode.mu.Unlock()
 		left -= done
 		offset += done
 		if added != 0 {
-			allocated += bs
+			allocated += uint64(len(data))
 		}
 		// Notify waiting readers
 		inode.readCond.Broadcast()
 	}
+	if compression != "" {
+		// Also frees the decoder
+		resp.Body.Close()
+	}
 	// Correct memory usage
 	if allocated != size {
 		inode.fs.bufferPool.Use(int64(allocated)-int64(size), true)
@@ -956,6 +1273,10 @@ func (inode *Inode) IsRangeLocked(offset uint64, size uint64, onlyFlushing bool)
 
 func (inode *Inode) CheckLoadRange(offset, size, readAheadSize uint64, ignoreMemoryLimit bool) (bool, error) {
 	miss, err := inode.LoadRange(offset, size, readAheadSize, ignoreMemoryLimit)
+	for err == syscall.ESTALE {
+		// Cache is dropped in the meantime, load again from the new version
+		miss, err = inode.LoadRange(offset, size, readAheadSize, ignoreMemoryLimit)
+	}
 	if err == syscall.ESPIPE {
 		// Finalize multipart upload to get some flushed data back
 		// We have to flush all parts that extend the file up until the last flushed part
@@ -970,19 +1291,21 @@ func (inode *Inode) CheckLoadRange(offset, size, readAheadSize uint64, ignoreMem
 		// WILL BECOME  [2222211111122222222    ]
 		// FLUSH LATER  [     22            2222]
 		//
-		// But... simpler way is, in fact, to just block writers and flush the whole file
-		inode.pauseWriters++
-		for err == syscall.ESPIPE {
-			inode.mu.Unlock()
-			err = inode.SyncFile()
-			inode.mu.Lock()
-			if err == nil {
-				_, err = inode.LoadRange(offset, size, readAheadSize, ignoreMemoryLimit)
+		// But... simpler way is, in fact, to just block writers and flush the whole file.
+		// New writes anywhere could delay the flush, so all of them wait for it,
+		// but they don't have to wait until the data is read back
+		for err == syscall.ESPIPE || err == syscall.ESTALE {
+			if err == syscall.ESPIPE {
+				inode.pauseWriters++
+				inode.mu.Unlock()
+				err = inode.SyncFile()
+				inode.mu.Lock()
+				inode.resumeWriters()
+				if err != nil {
+					break
+				}
 			}
-		}
-		inode.pauseWriters--
-		if inode.readCond != nil {
-			inode.readCond.Broadcast()
+			_, err = inode.LoadRange(offset, size, readAheadSize, ignoreMemoryLimit)
 		}
 	}
 	return miss, err
@@ -1013,10 +1336,33 @@ func (fh *FileHandle) ReadFile(sOffset int64, sLen int64) (data [][]byte, bytesR
 		}
 	}()
 
+	if fh.inode.versionOf != nil {
+		// Versions are read without the inode lock and without caching
+		return fh.inode.readVersion(offset, size)
+	}
+
+	if fh.direct {
+		return fh.readDirect(offset, size)
+	}
+
 	// Lock inode
 	fh.inode.mu.Lock()
 	defer fh.inode.mu.Unlock()
 
+	if fh.inode.sidecarOf != nil {
+		data, bytesRead = fh.inode.readSidecar(offset, size)
+		return
+	}
+
+	if fh.inode == fh.inode.fs.changeLogFile {
+		buf := fh.inode.fs.changeLog.Read(offset, size)
+		if len(buf) > 0 {
+			data = [][]byte{buf}
+		}
+		bytesRead = len(buf)
+		return
+	}
+
 	if offset >= fh.inode.Attributes.Size {
 		// nothing to read
 		err = io.EOF
@@ -1042,7 +1388,7 @@ func (fh *FileHandle) ReadFile(sOffset int64, sLen int64) (data [][]byte, bytesR
 	} else if offset == fh.lastReadEnd {
 		fh.seqReadSize += size
 		if fh.lastReadCount == 0 && fh.lastReadEnd == 0 {
-			fh.inode.fs.lfru.Hit(fh.inode.Id, 1)
+			fh.inode.fs.cachePolicy.Hit(fh.inode.Id, 1)
 		}
 	} else {
 		// Track sizes of last N read requests
@@ -1057,10 +1403,30 @@ func (fh *FileHandle) ReadFile(sOffset int64, sLen int64) (data [][]byte, bytesR
 			fh.lastReadIdx = (fh.lastReadIdx+1) % len(fh.lastReadSizes)
 		}
 		fh.seqReadSize = size
-		fh.inode.fs.lfru.Hit(fh.inode.Id, 1)
+		fh.inode.fs.cachePolicy.Hit(fh.inode.Id, 1)
 	}
 	fh.lastReadEnd = end
 
+	streamCutoff := fh.inode.fs.flags.StreamReadCutoffKB*1024
+	if streamCutoff > 0 && fh.seqReadSize >= streamCutoff && fh.inode.uncompressedSize == 0 &&
+		fh.inode.CacheState == ST_CACHED && !fh.inode.hasBuffersIn(offset, end-offset) {
+		// Pass long linear reads directly to the caller without caching them
+		// so memory usage stays bounded regardless of the file size
+		etag, gen := fh.inode.knownETag, fh.inode.cacheGen
+		buf, streamErr := fh.streamRead(offset, end-offset)
+		// inode.mu is released while streaming, so a write to the range may
+		// complete in between. Return the data only if the range is still
+		// unmodified, a flush changes the ETag even if the buffers are gone
+		if streamErr == nil && fh.inode.CacheState == ST_CACHED && fh.inode.cacheGen == gen &&
+			fh.inode.knownETag == etag && fh.inode.Attributes.Size >= end &&
+			!fh.inode.hasBuffersIn(offset, end-offset) {
+			data = [][]byte{buf}
+			bytesRead = len(buf)
+			return
+		}
+		// Fall back to the usual read path which also handles errors
+	}
+
 	// Guard buffers against eviction
 	fh.inode.LockRange(offset, end-offset, false)
 	defer fh.inode.UnlockRange(offset, end-offset, false)
@@ -1078,22 +1444,58 @@ func (fh *FileHandle) ReadFile(sOffset int64, sLen int64) (data [][]byte, bytesR
 			ra = fh.inode.fs.flags.ReadAheadSmallKB*1024
 		}
 	}
+	if fh.inode.fs.flags.ReadCachePolicy == "sparse" {
+		// Only cache accessed ranges, without readahead
+		ra = 0
+	}
 	if ra+end > maxFileSize {
 		ra = 0
 	}
+	ra = fh.limitReadAhead(offset, end, ra)
 	miss, requestErr := fh.inode.CheckLoadRange(offset, end-offset, ra, false)
 	if !miss {
 		atomic.AddInt64(&fh.inode.fs.stats.readHits, 1)
 	}
 	mappedErr := mapAwsError(requestErr)
+	zeroFill := false
+	partialRead := false
 	if requestErr != nil {
 		err = requestErr
-		if mappedErr == fuse.ENOENT || mappedErr == syscall.ERANGE {
-			// Object is deleted or resized remotely (416). Discard local version
-			log.Warnf("File %v is deleted or resized remotely, discarding local changes", fh.inode.FullName())
-			fh.inode.resetCache()
+		if mappedErr == fuse.ENOENT && fh.inode.CacheState == ST_CACHED {
+			// Object is deleted remotely while we were reading it. There are no
+			// local changes, so keep already cached ranges readable
+			if fh.inode.fs.flags.RemoteDeleteDuringRead == "zero-fill" {
+				log.Warnf("File %v is deleted remotely during read, returning zeroes for uncached ranges",
+					fh.inode.FullName())
+				zeroFill = true
+				err = nil
+			} else {
+				log.Warnf("File %v is deleted remotely during read, uncached ranges can't be read",
+					fh.inode.FullName())
+				err = syscall.EIO
+				return
+			}
+		} else if fh.inode.fs.flags.PartialReadOnError && mappedErr != fuse.ENOENT &&
+			mappedErr != syscall.ERANGE && mappedErr != syscall.ESTALE {
+			// Return cached data up to the first range which failed to load
+			partialRead = true
+			err = nil
+		} else {
+			if mappedErr == fuse.ENOENT || mappedErr == syscall.ERANGE {
+				// Object is deleted or resized remotely (416). Discard local version
+				log.Warnf("File %v is deleted or resized remotely, discarding local changes", fh.inode.FullName())
+				fh.inode.resetCache()
+			}
+			return
 		}
-		return
+	}
+	if end > fh.inode.Attributes.Size {
+		// File is changed remotely and truncated while we were loading it
+		if offset >= fh.inode.Attributes.Size {
+			err = io.EOF
+			return
+		}
+		end = fh.inode.Attributes.Size
 	}
 
 	// return cached buffers directly without copying
@@ -1104,9 +1506,12 @@ func (fh *FileHandle) ReadFile(sOffset int64, sLen int64) (data [][]byte, bytesR
 		if b.offset >= end {
 			break
 		}
+		if partialRead && (b.offset > pos || b.loading) {
+			break
+		}
 		if b.offset > pos {
 			// How is this possible? We should've just received it from the server!
-			if fh.inode.CacheState == ST_CREATED {
+			if fh.inode.CacheState == ST_CREATED || zeroFill {
 				// It's okay if the file is just created
 				// Zero empty ranges in this case
 				data = appendZero(data, fh.inode.fs.zeroBuf, int(b.offset-pos))
@@ -1128,17 +1533,23 @@ func (fh *FileHandle) ReadFile(sOffset int64, sLen int64) (data [][]byte, bytesR
 		} else if b.zero {
 			data = appendZero(data, fh.inode.fs.zeroBuf, int(readEnd-pos))
 		} else {
+			fh.inode.inflateBuffer(b)
 			data = append(data, b.data[pos-b.offset : readEnd-b.offset])
 		}
 		pos = readEnd
 	}
 	if pos < end {
 		// How is this possible? We should've just received it from the server!
-		if fh.inode.CacheState == ST_CREATED {
+		if fh.inode.CacheState == ST_CREATED || zeroFill {
 			// It's okay if the file is just created
 			// Zero empty ranges in this case
 			data = appendZero(data, fh.inode.fs.zeroBuf, int(end-pos))
 			pos = end
+		} else if partialRead && pos > offset {
+			// Short read
+			log.Warnf("Returning %v of %v requested bytes at %v of %v after a read error: %v",
+				pos-offset, end-offset, offset, fh.inode.FullName(), requestErr)
+			end = pos
 		} else {
 			err = requestErr
 			if err == nil {
@@ -1162,12 +1573,195 @@ func (fh *FileHandle) ReadFile(sOffset int64, sLen int64) (data [][]byte, bytesR
 	return
 }
 
+// Limit readahead of the handle by --max-readahead-per-handle and
+// readahead of all handles together by --max-readahead-total.
+// Returns the allowed readahead size counted from offset.
+// LOCKS_REQUIRED(fh.inode.mu)
+func (fh *FileHandle) limitReadAhead(offset, end, ra uint64) uint64 {
+	fs := fh.inode.fs
+	if offset < fh.readAheadPos || fh.readAheadEnd < end {
+		// Random read or the reader has consumed everything loaded ahead
+		fh.readAheadEnd = end
+	}
+	fh.readAheadPos = end
+	newEnd := offset+ra
+	if newEnd < end {
+		newEnd = end
+	}
+	if fs.flags.MaxReadAheadPerHandleKB > 0 && newEnd > end+fs.flags.MaxReadAheadPerHandleKB*1024 {
+		newEnd = end+fs.flags.MaxReadAheadPerHandleKB*1024
+	}
+	if fs.flags.MaxReadAheadTotalKB > 0 {
+		others := atomic.LoadInt64(&fs.readAheadBytes) - int64(fh.readAhead)
+		budget := int64(fs.flags.MaxReadAheadTotalKB*1024) - others
+		if budget < 0 {
+			budget = 0
+		}
+		if newEnd > end+uint64(budget) {
+			newEnd = end+uint64(budget)
+		}
+	}
+	if newEnd > fh.readAheadEnd {
+		fh.readAheadEnd = newEnd
+	}
+	if fh.readAheadEnd > fh.inode.Attributes.Size {
+		fh.readAheadEnd = fh.inode.Attributes.Size
+	}
+	readAhead := uint64(0)
+	if fh.readAheadEnd > end {
+		readAhead = fh.readAheadEnd-end
+	}
+	atomic.AddInt64(&fs.readAheadBytes, int64(readAhead)-int64(fh.readAhead))
+	fh.readAhead = readAhead
+	return newEnd-offset
+}
+
+// Read data from the server response stream, opening it if required.
+// Data is not cached and is returned to the caller directly.
+// LOCKS_REQUIRED(fh.inode.mu)
+func (fh *FileHandle) streamRead(offset uint64, size uint64) (data []byte, err error) {
+	inode := fh.inode
+	cloud, key := inode.cloud()
+	if inode.oldParent != nil {
+		_, key = inode.oldParent.cloud()
+		key = appendChildName(key, inode.oldName)
+	}
+	fileSize := inode.Attributes.Size
+	etag := inode.knownETag
+	inode.mu.Unlock()
+	defer inode.mu.Lock()
+
+	fh.streamMu.Lock()
+	defer fh.streamMu.Unlock()
+	if fh.stream != nil && (fh.streamOffset != offset || fh.streamETag != etag) {
+		fh.stream.Close()
+		fh.stream = nil
+	}
+	if fh.stream == nil {
+		resp, err := cloud.GetBlob(&GetBlobInput{
+			Key:   key,
+			Start: offset,
+			Count: fileSize-offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.ETag != nil && etag != "" && *resp.ETag != etag {
+			// Object is changed remotely, let the usual read path handle it
+			resp.Body.Close()
+			return nil, fuse.EIO
+		}
+		fh.stream = fh.inode.fs.downloadThrottle.ReadCloser(resp.Body)
+		fh.streamOffset = offset
+		fh.streamETag = etag
+	}
+	data = make([]byte, size)
+	n, err := io.ReadFull(fh.stream, data)
+	fh.streamOffset += uint64(n)
+	atomic.AddUint64(&fh.inode.bytesRead, uint64(n))
+	atomic.AddUint64(&fh.inode.fs.metrics.backend(cloud).downloadedBytes, uint64(n))
+	if err != nil {
+		log.Errorf("Error streaming %v +%v of %v: %v", offset, size, key, err)
+		fh.stream.Close()
+		fh.stream = nil
+		return nil, err
+	}
+	return data, nil
+}
+
+// Read straight from the server for O_DIRECT handles without caching anything.
+// Local modifications are flushed first, so the result is what the server has
+// LOCKS_EXCLUDED(fh.inode.mu)
+func (fh *FileHandle) readDirect(offset uint64, size uint64) (data [][]byte, bytesRead int, err error) {
+	inode := fh.inode
+	inode.mu.Lock()
+	dirty := inode.CacheState == ST_CREATED || inode.CacheState == ST_MODIFIED
+	inode.mu.Unlock()
+	if dirty {
+		err = inode.SyncFile()
+		if err != nil {
+			return
+		}
+	}
+
+	if size == 0 {
+		return
+	}
+	inode.mu.Lock()
+	cloud, key := inode.cloud()
+	inode.mu.Unlock()
+
+	// The object may be resized on the server, so the cached size isn't used
+	resp, err := cloud.GetBlob(&GetBlobInput{
+		Key:   key,
+		Start: offset,
+		Count: size,
+	})
+	if err != nil {
+		err = mapAwsError(err)
+		if err == syscall.ERANGE {
+			// Offset is past the end of the object (416)
+			err = io.EOF
+		}
+		return nil, 0, err
+	}
+	body := inode.fs.downloadThrottle.ReadCloser(resp.Body)
+	defer body.Close()
+	if resp.Size < size {
+		size = resp.Size
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(body, buf)
+	atomic.AddUint64(&inode.bytesRead, uint64(n))
+	atomic.AddUint64(&inode.fs.metrics.backend(cloud).downloadedBytes, uint64(n))
+	if err != nil {
+		log.Errorf("Error reading %v bytes at %v of %v: %v", size, offset, key, err)
+		return nil, 0, syscall.EIO
+	}
+	return [][]byte{buf}, n, nil
+}
+
+func (fh *FileHandle) closeStream() {
+	fh.streamMu.Lock()
+	if fh.stream != nil {
+		fh.stream.Close()
+		fh.stream = nil
+	}
+	fh.streamMu.Unlock()
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) hasBuffersIn(offset uint64, size uint64) bool {
+	pos := locateBuffer(inode.buffers, offset)
+	return pos < len(inode.buffers) && inode.buffers[pos].offset < offset+size
+}
+
 func (fh *FileHandle) Release() {
+	fh.closeStream()
+	fh.inode.mu.Lock()
+	atomic.AddInt64(&fh.inode.fs.readAheadBytes, -int64(fh.readAhead))
+	fh.readAhead = 0
+	if fh.writer {
+		fh.inode.writeHandles--
+	}
+	fh.inode.mu.Unlock()
 	// LookUpInode accesses fileHandles without mutex taken, so use atomics for now
 	n := atomic.AddInt32(&fh.inode.fileHandles, -1)
 	if n == -1 {
 		panic(fmt.Sprintf("Released more file handles than acquired, n = %v", n))
 	}
+	if n == 0 {
+		fh.inode.mu.Lock()
+		if fh.inode.openUnlinked {
+			// Last handle of the unlinked file is closed, drop the data
+			// and let the flusher delete the object
+			fh.inode.openUnlinked = false
+			fh.inode.resetCache()
+			fh.inode.Attributes.Size = 0
+			fh.inode.updateUsedBlocks()
+		}
+		fh.inode.mu.Unlock()
+	}
 	if n == 0 && atomic.LoadInt32(&fh.inode.CacheState) <= ST_DEAD {
 		fh.inode.Parent.addModified(-1)
 	}
@@ -1176,6 +1770,7 @@ func (fh *FileHandle) Release() {
 
 func (inode *Inode) splitBuffer(i int, size uint64) {
 	b := inode.buffers[i]
+	inode.inflateBuffer(b)
 	endBuf := &FileBuffer{
 		offset: b.offset+size,
 		dirtyID: b.dirtyID,
@@ -1228,6 +1823,7 @@ func (inode *Inode) GetMultiReader(offset uint64, size uint64) (reader *MultiRea
 			if b.zero {
 				reader.AddZero(end-b.offset)
 			} else {
+				inode.inflateBuffer(b)
 				reader.AddBuffer(b.data[0 : end-b.offset])
 			}
 			break
@@ -1235,6 +1831,7 @@ func (inode *Inode) GetMultiReader(offset uint64, size uint64) (reader *MultiRea
 			if b.zero {
 				reader.AddZero(b.length)
 			} else {
+				inode.inflateBuffer(b)
 				reader.AddBuffer(b.data)
 			}
 		}
@@ -1246,40 +1843,135 @@ func (inode *Inode) GetMultiReader(offset uint64, size uint64) (reader *MultiRea
 	return
 }
 
+// A successful request only clears the error. The failure count is reset
+// when the inode is fully flushed, see SetCacheState(), so that the retry
+// delay still grows if, for example, only the multipart upload completion fails
+// LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) recordFlushError(err error) {
+	if err != nil && (inode.flushError == nil || time.Since(inode.flushErrorTime) >= inode.flushRetryDelay()) {
+		// Parallel requests failing in the same attempt count once
+		if inode.flushErrors == 0 {
+			inode.flushFailingSince = time.Now()
+		}
+		inode.flushErrors++
+		inode.flushJitter = rand.Float64()
+	}
+	if err != nil {
+		if cloud, _ := inode.cloud(); cloud != nil {
+			atomic.AddUint64(&inode.fs.metrics.backend(cloud).flushErrors, 1)
+		}
+	}
 	inode.flushError = err
 	inode.flushErrorTime = time.Now()
-	inode.fs.ScheduleRetryFlush()
+	if err != nil {
+		inode.fs.ScheduleRetryFlush(inode.flushRetryDelay())
+	}
+}
+
+// Delay before retrying a failed flush. It starts at --retry-interval and
+// doubles after each consecutive failure up to --retry-interval-max.
+// Then it's shortened by a random part of --retry-jitter percent, so that
+// files failed at once aren't retried at once
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) flushRetryDelay() time.Duration {
+	delay := inode.fs.flags.RetryInterval
+	max := inode.fs.flags.RetryIntervalMax
+	for i := 1; i < inode.flushErrors && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max && max >= inode.fs.flags.RetryInterval {
+		delay = max
+	}
+	if jitter := inode.fs.flags.RetryJitter; jitter > 0 {
+		delay -= time.Duration(float64(delay) * float64(jitter) / 100 * inode.flushJitter)
+	}
+	return delay
+}
+
+// Check if the flush error should be returned to the user. Errors which
+// can't be fixed by retrying are returned at once, the rest only after
+// --flush-retries failed attempts or --flush-retry-timeout. The flusher
+// keeps retrying in both cases
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) flushErrorFinal() bool {
+	if inode.flushError == nil {
+		return false
+	}
+	if !isRetryableError(inode.flushError) || inode.flushErrors >= inode.fs.flags.FlushRetries {
+		return true
+	}
+	timeout := inode.fs.flags.FlushRetryTimeout
+	return timeout > 0 && time.Since(inode.flushFailingSince) >= timeout
 }
 
 func (inode *Inode) TryFlush() bool {
 	overDeleted := false
+	superseded := false
 	parent := inode.Parent
 	if parent != nil {
 		parent.mu.Lock()
 		if parent.dir.DeletedChildren != nil {
-			_, overDeleted = parent.dir.DeletedChildren[inode.Name]
+			var deleted *Inode
+			deleted, overDeleted = parent.dir.DeletedChildren[inode.Name]
+			if overDeleted && deleted != inode && inode.fs.flags.DeleteOnClose {
+				// A file unlinked while open is only deleted when it's closed,
+				// so a file recreated with the same name takes priority over it,
+				// like when logrotate moves a log away and creates a new one
+				deleted.mu.Lock()
+				overDeleted = !deleted.openUnlinked
+				deleted.mu.Unlock()
+			} else if overDeleted && deleted == inode && inode.fs.flags.DeleteOnClose {
+				superseded = inode.recreatedOnServer(parent)
+				if superseded {
+					delete(parent.dir.DeletedChildren, inode.Name)
+				}
+			}
 		}
+		// Lock the inode before releasing the parent so that the unlinked file
+		// can't be closed and deleted between the check above and our flush
+		inode.mu.Lock()
 		parent.mu.Unlock()
+	} else {
+		inode.mu.Lock()
 	}
-	inode.mu.Lock()
 	defer inode.mu.Unlock()
 	if inode.Parent != parent {
 		return false
 	}
-	if inode.flushError != nil && time.Now().Sub(inode.flushErrorTime) < inode.fs.flags.RetryInterval {
-		inode.fs.ScheduleRetryFlush()
+	if atomic.LoadInt32(&inode.fs.flushPaused) != 0 {
+		return false
+	}
+	if inode.flushError != nil && time.Now().Sub(inode.flushErrorTime) < inode.flushRetryDelay() {
+		inode.fs.ScheduleRetryFlush(inode.flushRetryDelay() - time.Now().Sub(inode.flushErrorTime))
 		return false
 	}
 	if inode.CacheState == ST_DELETED {
-		if inode.IsFlushing == 0 && (!inode.isDir() || atomic.LoadInt64(&inode.dir.ModifiedChildren) == 0) {
+		if inode.openUnlinked {
+			// Deleted when the last handle is closed
+			return false
+		}
+		if superseded {
+			// The object now belongs to the recreated file
+			inode.SetCacheState(ST_DEAD)
+			if atomic.LoadInt64(&inode.refcnt) == 0 {
+				inode.DeRef(0)
+			}
+			inode.fs.WakeupFlusher()
+			return false
+		}
+		if inode.IsFlushing == 0 && (!inode.isDir() || atomic.LoadInt64(&inode.dir.ModifiedChildren) == 0) &&
+			(!inode.isTreeOp() || inode.fs.startTreeOp()) {
 			inode.SendDelete()
 			return true
 		}
 	} else if (inode.CacheState == ST_CREATED || inode.CacheState == ST_MODIFIED) && inode.isDir() {
 		if inode.IsFlushing == 0 && !overDeleted {
-			inode.SendMkDir()
-			return true
+			if inode.dirObjectDirty() {
+				inode.SendMkDir()
+			} else {
+				inode.sendMtimeMarker()
+			}
+			return true
 		}
 	} else if inode.CacheState == ST_CREATED || inode.CacheState == ST_MODIFIED {
 		if overDeleted {
@@ -1290,6 +1982,31 @@ func (inode *Inode) TryFlush() bool {
 	return false
 }
 
+// Check if a file closed after unlinking with --delete-on-close was recreated
+// and the new file is already sent to the server, so the object mustn't be deleted
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) recreatedOnServer(parent *Inode) bool {
+	inode.mu.Lock()
+	closed := !inode.openUnlinked && inode.CacheState == ST_DELETED
+	inode.mu.Unlock()
+	if !closed {
+		return false
+	}
+	child := parent.findChildUnlocked(inode.Name)
+	if child == nil || child == inode || child.isDir() {
+		return false
+	}
+	child.mu.Lock()
+	defer child.mu.Unlock()
+	if child.oldParent != nil {
+		// A renamed file takes the object over as soon as it's being copied,
+		// it waits for the deletion otherwise
+		return child.IsFlushing > 0
+	}
+	return child.CacheState != ST_CREATED || child.IsFlushing > 0
+}
+
 func (inode *Inode) SendUpload() bool {
 
 	cloud, key := inode.cloud()
@@ -1297,10 +2014,16 @@ func (inode *Inode) SendUpload() bool {
 		key += "/"
 	}
 
-	if inode.oldParent != nil && inode.IsFlushing == 0 && inode.mpu == nil {
+	if inode.oldParent != nil && inode.IsFlushing == 0 && inode.mpu == nil && !inode.putRenamed() {
+		treeOp := inode.isTreeOp()
+		if treeOp && !inode.fs.startTreeOp() {
+			return false
+		}
 		// Send rename
 		inode.IsFlushing += inode.fs.flags.MaxParallelParts
-		atomic.AddInt64(&inode.fs.activeFlushers, 1)
+		if !treeOp {
+			atomic.AddInt64(&inode.fs.activeFlushers, 1)
+		}
 		_, from := inode.oldParent.cloud()
 		from = appendChildName(from, inode.oldName)
 		oldParent := inode.oldParent
@@ -1313,6 +2036,16 @@ func (inode *Inode) SendUpload() bool {
 			from += "/"
 			skipRename = true
 		}
+		copyIn := &CopyBlobInput{
+			Source:      from,
+			Destination: key,
+		}
+		if !inode.isDir() && inode.knownETag != "" {
+			// Copy the object we know without an additional HEAD and keep its storage class
+			copyIn.Size = PUInt64(inode.knownSize)
+			copyIn.ETag = PString(inode.knownETag)
+			copyIn.StorageClass = inode.copyStorageClass()
+		}
 		go func() {
 			var err error
 			if !inode.isDir() || !inode.fs.flags.NoDirObject {
@@ -1321,10 +2054,8 @@ func (inode *Inode) SendUpload() bool {
 				// a parallel read could hit a non-existing name. So, with S3, we do it in 2 passes.
 				// First we copy the object, change the inode name, and then we delete the old copy.
 				inode.fs.addInflightChange(key)
-				_, err = cloud.CopyBlob(&CopyBlobInput{
-					Source:      from,
-					Destination: key,
-				})
+				var resp *CopyBlobOutput
+				resp, err = cloud.CopyBlob(copyIn)
 				inode.fs.completeInflightChange(key)
 				notFoundIgnore := false
 				if err != nil {
@@ -1356,9 +2087,22 @@ func (inode *Inode) SendUpload() bool {
 							oldParent.mu.Unlock()
 						}
 					} else {
-						log.Debugf("Failed to copy %v to %v (rename): %v", from, key, err)
+						flushErr := err
+						if mappedErr == syscall.ESTALE {
+							// The source is changed remotely after we've seen it. Refresh it
+							// like a listing would, then the rename is retried with the new ETag
+							s3Log.Warnf("Conflict detected (inode %v): %v is changed remotely while renaming it to %v",
+								inode.Id, from, key)
+							var head *HeadBlobOutput
+							head, flushErr = cloud.HeadBlob(&HeadBlobInput{Key: from})
+							if flushErr == nil {
+								inode.SetFromBlobItem(&head.BlobItemOutput)
+							}
+						} else {
+							log.Debugf("Failed to copy %v to %v (rename): %v", from, key, err)
+						}
 						inode.mu.Lock()
-						inode.recordFlushError(err)
+						inode.recordFlushError(flushErr)
 						if inode.Parent == oldParent && inode.Name == oldName {
 							// Someone renamed the inode back to the original name
 							// ...while we failed to copy it :)
@@ -1382,29 +2126,22 @@ func (inode *Inode) SendUpload() bool {
 					delName := oldName
 					inode.mu.Lock()
 					// Now we know that the object is accessible by the new name
-					if inode.Parent == newParent && inode.Name == newName {
-						// Just clear the old path
-						inode.oldParent = nil
-						inode.oldName = ""
-					} else if inode.Parent == oldParent && inode.Name == oldName {
+					if inode.finishRename(oldParent, oldName, newParent, newName) {
 						// Someone renamed the inode back to the original name(!)
-						inode.oldParent = nil
-						inode.oldName = ""
 						// Delete the new key instead of the old one (?)
 						delKey = key
 						delParent = newParent
 						delName = newName
-					} else {
-						// Someone renamed the inode again(!)
-						inode.oldParent = newParent
-						inode.oldName = newName
+					} else if !inode.isDir() && resp != nil && resp.ETag != nil {
+						// Multipart copies get a new ETag, remember it so that
+						// the next listing doesn't look like a remote change
+						inode.updateFromMetadataCopy(resp.ETag, resp.LastModified)
 					}
 					if (inode.CacheState == ST_MODIFIED || inode.CacheState == ST_CREATED) &&
 						!inode.isStillDirty() {
 						inode.SetCacheState(ST_CACHED)
 						inode.AttrTime = time.Now()
 					}
-					inode.renamingTo = false
 					inode.mu.Unlock()
 					// Now delete the old key
 					if !notFoundIgnore {
@@ -1416,33 +2153,23 @@ func (inode *Inode) SendUpload() bool {
 					}
 					if err != nil {
 						log.Debugf("Failed to delete %v during rename, will retry later", delKey)
-						// Emulate a deleted file
-						delParent.mu.Lock()
-						delParent.fs.mu.Lock()
-						tomb := NewInode(delParent.fs, delParent, delName)
-						tomb.Id = delParent.fs.allocateInodeId()
-						tomb.fs.inodes[tomb.Id] = tomb
-						tomb.userMetadata = make(map[string][]byte)
-						tomb.CacheState = ST_DELETED
-						tomb.recordFlushError(err)
-						delParent.dir.DeletedChildren[delName] = tomb
-						delParent.fs.mu.Unlock()
-						delParent.mu.Unlock()
 					} else {
 						log.Debugf("Deleted %v - rename completed", from)
-						// Remove from DeletedChildren of the old parent
-						delParent.mu.Lock()
-						delete(delParent.dir.DeletedChildren, delName)
-						delParent.mu.Unlock()
-						// And track ModifiedChildren because rename is special - it takes two parents
-						delParent.addModified(-1)
 					}
+					forgetRenamedKey(delParent, delName, delKey, err)
 				}
 			}
 			inode.mu.Lock()
 			inode.IsFlushing -= inode.fs.flags.MaxParallelParts
-			atomic.AddInt64(&inode.fs.activeFlushers, -1)
-			inode.fs.WakeupFlusher()
+			if err == nil {
+				inode.treeOp = false
+			}
+			if treeOp {
+				inode.fs.finishTreeOp()
+			} else {
+				atomic.AddInt64(&inode.fs.activeFlushers, -1)
+				inode.fs.WakeupFlusher()
+			}
 			inode.mu.Unlock()
 		}()
 		return true
@@ -1469,14 +2196,44 @@ func (inode *Inode) SendUpload() bool {
 				Destination: key,
 				Size:        PUInt64(inode.knownSize),
 				ETag:        PString(inode.knownETag),
-				Metadata:    escapeMetadata(inode.userMetadata),
+				Metadata:    inode.uploadMetadata(inode.uncompressedSize, inode.compression),
+				WebsiteRedirect: inode.websiteRedirect(),
+				StorageClass: inode.copyStorageClass(),
+				ContentType: inode.uploadContentType(key),
+			}
+			if copyIn.Metadata == nil && inode.contentType != "" {
+				// Content-Type is only replaced along with metadata
+				copyIn.Metadata = make(map[string]*string)
+			}
+			if inode.uncompressedSize != 0 {
+				copyIn.ContentEncoding = PString(inode.compression)
+			}
+			if inode.partManifest != "" && !inode.partManifestUnsaved {
+				if copyIn.Metadata == nil {
+					copyIn.Metadata = make(map[string]*string)
+				}
+				copyIn.Metadata[PART_MANIFEST_ATTR] = PString(inode.partManifest)
+			}
+			if inode.checksums != nil {
+				if copyIn.Metadata == nil {
+					copyIn.Metadata = make(map[string]*string)
+				}
+				copyIn.Metadata[CHECKSUM_ATTR] = PString(formatChecksums(inode.checksums))
 			}
 			go func() {
 				inode.fs.addInflightChange(key)
-				_, err := cloud.CopyBlob(copyIn)
+				resp, err := cloud.CopyBlob(copyIn)
 				inode.fs.completeInflightChange(key)
 				inode.mu.Lock()
 				inode.recordFlushError(err)
+				if err == nil && resp.ETag != nil {
+					// The copy gets a new ETag even though the content is the same.
+					// Remember it so that the next listing doesn't look like a remote change
+					inode.updateFromMetadataCopy(resp.ETag, resp.LastModified)
+				}
+				if err == nil && copyIn.StorageClass != nil {
+					inode.s3Metadata["storage-class"] = []byte(*copyIn.StorageClass)
+				}
 				if err != nil {
 					mappedErr := mapAwsError(err)
 					inode.userMetadataDirty = 2
@@ -1499,7 +2256,7 @@ func (inode *Inode) SendUpload() bool {
 		}
 	}
 
-	if inode.Attributes.Size <= inode.fs.flags.SinglePartMB*1024*1024 && inode.mpu == nil {
+	if inode.Attributes.Size <= inode.fs.singlePartLimit() && inode.mpu == nil || inode.compressWhole() {
 		// Don't flush small files with active file handles (if not under memory pressure)
 		if inode.IsFlushing == 0 && (inode.fileHandles == 0 || inode.forceFlush || atomic.LoadInt32(&inode.fs.wantFree) > 0) {
 			// Don't accidentally trigger a parallel multipart flush
@@ -1515,17 +2272,51 @@ func (inode *Inode) SendUpload() bool {
 		return false
 	}
 
+	if inode.mpu == nil && inode.fileHandles != 0 && !inode.forceFlush &&
+		atomic.LoadInt32(&inode.fs.wantFree) == 0 && inode.shouldCompress(inode.Attributes.Size) {
+		// Wait until the file is closed to compress it as a whole, see compressWhole()
+		return false
+	}
+
 	// Initiate multipart upload, if not yet
 	if inode.mpu == nil {
 		inode.IsFlushing += inode.fs.flags.MaxParallelParts
 		atomic.AddInt64(&inode.fs.activeFlushers, 1)
 		go func() {
+			inode.mu.Lock()
+			if inode.uncompressedSize != 0 {
+				err := inode.dirtyCompressedData()
+				if err != nil {
+					log.Errorf("Failed to load compressed object %v to reupload it: %v", key, err)
+					inode.recordFlushError(err)
+					inode.IsFlushing -= inode.fs.flags.MaxParallelParts
+					atomic.AddInt64(&inode.fs.activeFlushers, -1)
+					inode.fs.WakeupFlusher()
+					inode.mu.Unlock()
+					return
+				}
+			}
+			err := inode.loadMetadataForOverwrite()
+			if err != nil {
+				log.Errorf("Failed to load metadata of %v to preserve it: %v", key, err)
+				inode.recordFlushError(err)
+				inode.IsFlushing -= inode.fs.flags.MaxParallelParts
+				atomic.AddInt64(&inode.fs.activeFlushers, -1)
+				inode.fs.WakeupFlusher()
+				inode.mu.Unlock()
+				return
+			}
+			gen := inode.cacheGen
+			storageClass := inode.uploadStorageClass()
+			inode.mu.Unlock()
 			params := &MultipartBlobBeginInput{
 				Key: key,
-				ContentType: inode.fs.flags.GetMimeType(key),
+				ContentType: inode.uploadContentType(key),
+				// Completed upload replaces metadata, so always send it
+				Metadata: escapeMetadata(inode.userMetadata),
+				StorageClass: storageClass,
 			}
 			if inode.userMetadataDirty != 0 {
-				params.Metadata = escapeMetadata(inode.userMetadata)
 				// userMetadataDirty == 1 indicates that metadata wasn't changed
 				// since the multipart upload was initiated
 				inode.userMetadataDirty = 1
@@ -1535,9 +2326,25 @@ func (inode *Inode) SendUpload() bool {
 			inode.recordFlushError(err)
 			if err != nil {
 				log.Errorf("Failed to initiate multipart upload for %v: %v", key, err)
+			} else if inode.cacheGen != gen || inode.CacheState == ST_DELETED || inode.CacheState == ST_DEAD {
+				// File was deleted or changed remotely while we were initiating the upload.
+				// Don't leave an orphaned upload behind
+				log.Debugf("Aborting multi-part upload of deleted object %v", key)
+				go func(mpu *MultipartBlobCommitInput) {
+					_, abortErr := cloud.MultipartBlobAbort(mpu)
+					if abortErr != nil {
+						log.Errorf("Failed to abort multi-part upload of object %v: %v", key, abortErr)
+					}
+				}(resp)
 			} else {
 				log.Debugf("Started multi-part upload of object %v", key)
 				inode.mpu = resp
+				// All parts of the upload use the same layout, even if the file is resized
+				inode.mpuPartSizes = inode.fs.partSizesFor(inode.Attributes.Size)
+				inode.mpuContentType = params.ContentType
+				atomic.AddInt64(&inode.fs.metrics.backend(cloud).multipartUploads, 1)
+				inode.mergedPart = 0
+				inode.partChecksums = nil
 			}
 			inode.IsFlushing -= inode.fs.flags.MaxParallelParts
 			atomic.AddInt64(&inode.fs.activeFlushers, -1)
@@ -1547,6 +2354,8 @@ func (inode *Inode) SendUpload() bool {
 		return true
 	}
 
+	inode.checkMergedPart()
+
 	// Pick part(s) to flush
 	initiated := false
 	lastPart := uint64(0)
@@ -1568,8 +2377,16 @@ func (inode *Inode) SendUpload() bool {
 		} else if partDirty && !partEvicted {
 			canComplete = false
 			// Don't write out the last part that's still written to (if not under memory pressure)
-			if flushInode || lastPart != inode.fs.partNum(inode.lastWriteEnd) {
-				partOffset, partSize := inode.fs.partRange(lastPart)
+			if flushInode || lastPart != inode.partNum(inode.lastWriteEnd) {
+				flushPart := lastPart
+				if p, ok := inode.mergedLastPart(); ok && lastPart == p+1 {
+					// Tiny last part is uploaded with the previous one
+					flushPart = p
+				}
+				partOffset, partSize := inode.uploadRange(flushPart)
+				if flushPart != lastPart && inode.IsRangeLocked(partOffset, partSize, true) {
+					return false
+				}
 				// Guard part against eviction
 				inode.LockRange(partOffset, partSize, true)
 				inode.IsFlushing++
@@ -1582,7 +2399,7 @@ func (inode *Inode) SendUpload() bool {
 					inode.mu.Unlock()
 					atomic.AddInt64(&inode.fs.activeFlushers, -1)
 					inode.fs.WakeupFlusher()
-				}(lastPart, partOffset, partSize)
+				}(flushPart, partOffset, partSize)
 				initiated = true
 				if atomic.LoadInt64(&inode.fs.activeFlushers) >= inode.fs.flags.MaxFlushers ||
 					inode.IsFlushing >= inode.fs.flags.MaxParallelParts {
@@ -1596,8 +2413,8 @@ func (inode *Inode) SendUpload() bool {
 	}
 	for i := 0; i < len(inode.buffers); i++ {
 		buf := inode.buffers[i]
-		startPart := inode.fs.partNum(buf.offset)
-		endPart := inode.fs.partNum(buf.offset + buf.length - 1)
+		startPart := inode.partNum(buf.offset)
+		endPart := inode.partNum(buf.offset + buf.length - 1)
 		if i == 0 || startPart != lastPart {
 			if i > 0 {
 				if processPart() {
@@ -1648,6 +2465,152 @@ func (inode *Inode) SendUpload() bool {
 	return initiated
 }
 
+// Forget the old location after the object is stored at newParent/newName.
+// Returns true if the inode was renamed back to the old location in between,
+// in that case the new key should be deleted instead of the old one.
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) finishRename(oldParent *Inode, oldName string, newParent *Inode, newName string) (renamedBack bool) {
+	if inode.Parent == newParent && inode.Name == newName {
+		// Just clear the old path
+		inode.oldParent = nil
+		inode.oldName = ""
+	} else if inode.Parent == oldParent && inode.Name == oldName {
+		inode.oldParent = nil
+		inode.oldName = ""
+		renamedBack = true
+	} else {
+		// Someone renamed the inode again(!)
+		inode.oldParent = newParent
+		inode.oldName = newName
+	}
+	inode.renamingTo = false
+	if inode.tagsDirty {
+		// Tags changed during the rename are sent to the new key
+		inode.resendTags()
+	}
+	return
+}
+
+// Track deletion of the old key of a renamed object
+// LOCKS_EXCLUDED(delParent.mu)
+func forgetRenamedKey(delParent *Inode, delName string, delKey string, err error) {
+	if err != nil {
+		// Emulate a deleted file
+		delParent.mu.Lock()
+		delParent.fs.mu.Lock()
+		tomb := NewInode(delParent.fs, delParent, delName)
+		tomb.Id = delParent.fs.allocateInodeId()
+		tomb.fs.inodes[tomb.Id] = tomb
+		tomb.userMetadata = make(map[string][]byte)
+		tomb.CacheState = ST_DELETED
+		tomb.fs.metrics.cacheStateChanged(ST_CACHED, ST_DELETED)
+		tomb.recordFlushError(err)
+		delParent.dir.DeletedChildren[delName] = tomb
+		delParent.fs.mu.Unlock()
+		delParent.mu.Unlock()
+	} else {
+		// Remove from DeletedChildren of the old parent
+		delParent.mu.Lock()
+		delete(delParent.dir.DeletedChildren, delName)
+		delParent.mu.Unlock()
+		// And track ModifiedChildren because rename is special - it takes two parents
+		delParent.addModified(-1)
+		// Don't let stale listings resurrect the old key
+		delParent.fs.addRenamedKey(delKey)
+	}
+}
+
+// Files up to this size are uploaded with a single PUT
+func (fs *Goofys) singlePartLimit() uint64 {
+	return fs.flags.SinglePartMB*1024*1024 + fs.flags.MergeLastPartKB*1024
+}
+
+// With --merge-last-part-kb, the last part of a closed file smaller than
+// that is uploaded together with the previous part. Returns the previous part
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) mergedLastPart() (part uint64, ok bool) {
+	size := inode.Attributes.Size
+	if inode.fs.flags.MergeLastPartKB == 0 || size == 0 || inode.fileHandles != 0 || inode.mpu == nil {
+		return 0, false
+	}
+	last := inode.partNum(size-1)
+	lastOffset, _ := inode.partRange(last)
+	// All uploaded parts must be used on completion, so it's only
+	// possible if the last part isn't uploaded on its own yet. The previous
+	// part must not be uploaded yet either, its data may be already evicted
+	if last == 0 || size-lastOffset >= inode.fs.flags.MergeLastPartKB*1024 ||
+		inode.mpu.Parts[last] != nil || inode.mpu.Parts[last-1] != nil {
+		return 0, false
+	}
+	prevOffset, _ := inode.partRange(last-1)
+	if !inode.rangeInMemory(prevOffset, size) {
+		return 0, false
+	}
+	return last-1, true
+}
+
+// Check that all data in the range is in memory and isn't uploaded yet
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) rangeInMemory(offset, end uint64) bool {
+	last := offset
+	for i := locateBuffer(inode.buffers, offset); i < len(inode.buffers) && inode.buffers[i].offset < end; i++ {
+		b := inode.buffers[i]
+		if b.state != BUF_DIRTY && b.state != BUF_CLEAN || b.loading || b.ptr == nil && !b.zero ||
+			// Ranges without buffers are zeroes only in new files
+			b.offset > last && inode.CacheState != ST_CREATED {
+			return false
+		}
+		last = b.offset+b.length
+	}
+	return last >= end || inode.CacheState == ST_CREATED
+}
+
+// Range of the file uploaded as the part
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) uploadRange(part uint64) (offset uint64, size uint64) {
+	offset, size = inode.partRange(part)
+	if p, ok := inode.mergedLastPart(); ok && p == part {
+		size = inode.Attributes.Size-offset
+	}
+	return
+}
+
+// The file is resized after uploading the last part together with the previous
+// one, so the previous part has to be uploaded again
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) checkMergedPart() {
+	if inode.mergedPart == 0 || inode.mergedEnd == inode.Attributes.Size {
+		return
+	}
+	part := inode.mergedPart-1
+	partOffset, _ := inode.partRange(part)
+	for _, b := range inode.buffers {
+		if b.offset < inode.mergedEnd && b.offset+b.length > partOffset &&
+			b.state == BUF_FLUSHED_CUT {
+			b.state = BUF_DIRTY
+			inode.fs.addDirty(int64(b.length))
+		}
+	}
+	inode.mpu.Parts[part] = nil
+	inode.mergedPart = 0
+}
+
+// Renamed small file with modified data is uploaded to the new key as a whole,
+// so it doesn't need to be copied from the old key first
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) putRenamed() bool {
+	if inode.isDir() || inode.mpu != nil ||
+		inode.Attributes.Size > inode.fs.singlePartLimit() {
+		return false
+	}
+	for _, b := range inode.buffers {
+		if b.dirtyID != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (inode *Inode) isStillDirty() bool {
 	if inode.userMetadataDirty != 0 || inode.oldParent != nil {
 		return true
@@ -1661,8 +2624,40 @@ func (inode *Inode) isStillDirty() bool {
 	return false
 }
 
+// Drop buffers with unmodified data, keeping local changes. Buffers being
+// loaded or read are skipped
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) dropCleanBuffers() {
+	j := 0
+	for _, b := range inode.buffers {
+		if b.dirtyID == 0 && b.state == BUF_CLEAN && !b.loading &&
+			!inode.IsRangeLocked(b.offset, b.length, false) {
+			if b.data != nil {
+				b.ptr.refs--
+				if b.ptr.refs == 0 {
+					inode.fs.bufferPool.Use(-int64(len(b.ptr.mem)), false)
+				}
+				b.ptr = nil
+				b.data = nil
+			}
+			continue
+		}
+		inode.buffers[j] = b
+		j++
+	}
+	for i := j; i < len(inode.buffers); i++ {
+		inode.buffers[i] = nil
+	}
+	inode.buffers = inode.buffers[0 : j]
+}
+
 func (inode *Inode) resetCache() {
 	// Drop all buffers including dirty ones
+	inode.cacheGen++
+	if inode.readCond != nil {
+		// Wake up readers so they restart against the new state
+		inode.readCond.Broadcast()
+	}
 	for _, b := range inode.buffers {
 		if b.data != nil {
 			b.ptr.refs--
@@ -1672,6 +2667,9 @@ func (inode *Inode) resetCache() {
 			b.ptr = nil
 			b.data = nil
 		}
+		if b.unflushed() {
+			inode.fs.addDirty(-int64(b.length))
+		}
 	}
 	inode.buffers = nil
 	// Also remove the cache file from disk, if present
@@ -1699,6 +2697,9 @@ func (inode *Inode) resetCache() {
 			}
 		}(inode.mpu)
 		inode.mpu = nil
+		inode.mpuPartSizes = nil
+		inode.mpuContentType = nil
+		atomic.AddInt64(&inode.fs.metrics.backend(cloud).multipartUploads, -1)
 	}
 	inode.userMetadataDirty = 0
 	inode.SetCacheState(ST_CACHED)
@@ -1706,11 +2707,110 @@ func (inode *Inode) resetCache() {
 	inode.AttrTime = time.Time{}
 }
 
+// Base64-encoded MD5 of the upload body for the Content-MD5 header
+func contentMD5(body io.ReadSeeker) (*string, error) {
+	hash := md5.New()
+	_, err := io.Copy(hash, body)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return PString(base64.StdEncoding.EncodeToString(hash.Sum(nil))), nil
+}
+
+// Load user metadata of an existing object if it isn't known yet, i.e. if the
+// object was only seen in a listing. Uploads replace all metadata of the object,
+// so metadata set out-of-band would be lost otherwise.
+// The file is modified locally, so its mtime is newer than the one saved in
+// the metadata. It's kept and the old mtime attribute is dropped. Uid, gid and
+// mode can't differ: changing them sets user metadata, so it isn't loaded at all
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) loadMetadataForOverwrite() error {
+	if inode.CacheState != ST_MODIFIED || inode.userMetadata != nil {
+		return nil
+	}
+	return inode.headMetadata(func(resp *HeadBlobOutput) {
+		mtime, ctime := inode.Attributes.Mtime, inode.Attributes.Ctime
+		inode.fillXattrFromHead(resp)
+		inode.Attributes.Mtime, inode.Attributes.Ctime = mtime, ctime
+		if inode.metadataAttr(inode.fs.flags.MtimeAttr) != nil {
+			inode.resetMetadataAttr(inode.fs.flags.MtimeAttr, []byte(fmt.Sprintf("%d", mtime.Unix())))
+		}
+	})
+}
+
+// Upload the body of a PUT request which doesn't fit into a single part
+// using a multipart upload, parts are cut from the body sequentially
+func (inode *Inode) putMultipart(cloud StorageBackend, params *PutBlobInput) (*PutBlobOutput, error) {
+	mpu, err := cloud.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:             params.Key,
+		Metadata:        params.Metadata,
+		ContentType:     params.ContentType,
+		ContentEncoding: params.ContentEncoding,
+		StorageClass:    params.StorageClass,
+	})
+	if err != nil {
+		return nil, err
+	}
+	size := *params.Size
+	layout := inode.fs.partSizesFor(size)
+	for part := uint64(0); err == nil; part++ {
+		offset, partSize := partRange(layout, part)
+		if offset >= size {
+			break
+		}
+		if offset+partSize > size {
+			partSize = size-offset
+		}
+		data := make([]byte, partSize)
+		_, err = io.ReadFull(params.Body, data)
+		if err != nil {
+			break
+		}
+		partInput := MultipartBlobAddInput{
+			Commit:     mpu,
+			PartNumber: uint32(part+1),
+			Body:       bytes.NewReader(data),
+			Size:       partSize,
+			Offset:     offset,
+		}
+		if inode.fs.flags.SendContentMD5 {
+			partInput.ContentMD5, _ = contentMD5(partInput.Body)
+		}
+		var partResp *MultipartBlobAddOutput
+		partResp, err = cloud.MultipartBlobAdd(&partInput)
+		if err == nil {
+			mpu.Parts[part] = partResp.PartId
+			mpu.NumParts = uint32(part+1)
+		}
+	}
+	var commitResp *MultipartBlobCommitOutput
+	if err == nil {
+		commitResp, err = cloud.MultipartBlobCommit(mpu)
+	}
+	if err != nil {
+		_, abortErr := cloud.MultipartBlobAbort(mpu)
+		if abortErr != nil {
+			log.Errorf("Failed to abort multi-part upload of object %v: %v", params.Key, abortErr)
+		}
+		return nil, err
+	}
+	return &PutBlobOutput{
+		ETag:         commitResp.ETag,
+		LastModified: commitResp.LastModified,
+		StorageClass: commitResp.StorageClass,
+	}, nil
+}
+
 func (inode *Inode) FlushSmallObject() {
 
 	inode.mu.Lock()
 
-	if inode.CacheState != ST_CREATED && inode.CacheState != ST_MODIFIED {
+	if inode.CacheState != ST_CREATED && inode.CacheState != ST_MODIFIED ||
+		// The file has grown in the meantime or can't be compressed as a whole anymore
+		inode.Attributes.Size > inode.fs.singlePartLimit() && !inode.compressWhole() {
 		inode.IsFlushing -= inode.fs.flags.MaxParallelParts
 		atomic.AddInt64(&inode.fs.activeFlushers, -1)
 		inode.fs.WakeupFlusher()
@@ -1736,12 +2836,29 @@ func (inode *Inode) FlushSmallObject() {
 		}
 	}
 
+	err := inode.loadMetadataForOverwrite()
+	if err != nil {
+		log.Errorf("Failed to load metadata of %v to preserve it: %v", inode.FullName(), err)
+		inode.recordFlushError(err)
+		inode.UnlockRange(0, sz, true)
+		inode.IsFlushing -= inode.fs.flags.MaxParallelParts
+		atomic.AddInt64(&inode.fs.activeFlushers, -1)
+		inode.fs.WakeupFlusher()
+		inode.mu.Unlock()
+		return
+	}
+
 	// Key may have been changed in between (if it was moved)
+	// The whole object is uploaded, so it's written to the current key directly
+	// and the old key is deleted afterwards, or before with --rename-flush-order=delete-first
 	cloud, key := inode.cloud()
-	if inode.oldParent != nil {
-		// In this case, modify it in the old place and move when we're done with modifications
-		_, key = inode.oldParent.cloud()
-		key = appendChildName(key, inode.oldName)
+	oldParent, oldName := inode.oldParent, inode.oldName
+	newParent, newName := inode.Parent, inode.Name
+	var oldKey string
+	if oldParent != nil {
+		_, oldKey = oldParent.cloud()
+		oldKey = appendChildName(oldKey, oldName)
+		inode.renamingTo = true
 	}
 	// File size may have been changed in between
 	bufReader, bufIds := inode.GetMultiReader(0, inode.Attributes.Size)
@@ -1749,12 +2866,21 @@ func (inode *Inode) FlushSmallObject() {
 		Key:         key,
 		Body:        bufReader,
 		Size:        PUInt64(uint64(bufReader.Len())),
-		ContentType: inode.fs.flags.GetMimeType(inode.FullName()),
-	}
-	if inode.userMetadataDirty != 0 {
-		params.Metadata = escapeMetadata(inode.userMetadata)
-		inode.userMetadataDirty = 0
+		ContentType: inode.uploadContentType(key),
+		WebsiteRedirect: inode.websiteRedirect(),
+		StorageClass: inode.uploadStorageClass(),
+	}
+	// PUT replaces metadata of the object, so always send it, even if
+	// it wasn't changed, or it would be lost
+	metadataDirty := inode.userMetadataDirty != 0
+	params.Metadata = escapeMetadata(inode.userMetadata)
+	compress := inode.shouldCompress(sz)
+	if compress {
+		// The real size must always be saved along with compressed data
+		params.Metadata = inode.uploadMetadata(sz, inode.fs.flags.UploadCompression)
+		params.ContentEncoding = PString(inode.fs.flags.UploadCompression)
 	}
+	inode.userMetadataDirty = 0
 
 	if inode.mpu != nil {
 		// Abort and forget abort multipart upload, because otherwise we may
@@ -1766,17 +2892,98 @@ func (inode *Inode) FlushSmallObject() {
 			}
 		}(inode.mpu)
 		inode.mpu = nil
+		inode.mpuPartSizes = nil
+		inode.mpuContentType = nil
+		atomic.AddInt64(&inode.fs.metrics.backend(cloud).multipartUploads, -1)
 	}
 	inode.mu.Unlock()
-	inode.fs.addInflightChange(key)
-	resp, err := cloud.PutBlob(params)
-	inode.fs.completeInflightChange(key)
+	if compress {
+		data, err := compressData(bufReader, inode.fs.flags.UploadCompression, inode.fs.flags.UploadCompressionLevel)
+		if err == nil {
+			params.Body = bytes.NewReader(data)
+			params.Size = PUInt64(uint64(len(data)))
+		} else {
+			log.Errorf("Failed to compress %v, uploading it as is: %v", key, err)
+			bufReader.Seek(0, io.SeekStart)
+			params.ContentEncoding = nil
+			delete(params.Metadata, UNCOMPRESSED_SIZE_ATTR)
+			delete(params.Metadata, COMPRESSION_ATTR)
+			compress = false
+		}
+	}
+	var checksums []checksumUnit
+	if inode.fs.flags.VerifyChecksums && !compress {
+		crc, err := bodyCRC32C(params.Body)
+		if err == nil {
+			checksums = []checksumUnit{{offset: 0, size: *params.Size, crc: crc}}
+			if params.Metadata == nil {
+				params.Metadata = make(map[string]*string)
+			}
+			params.Metadata[CHECKSUM_ATTR] = PString(formatChecksums(checksums))
+		}
+	}
+	// A large file compressed as a whole may still not fit into a single part
+	multipart := *params.Size > inode.fs.singlePartLimit()
+	if inode.fs.flags.SendContentMD5 && !multipart {
+		// Failure to read the body will also fail the upload itself
+		params.ContentMD5, _ = contentMD5(params.Body)
+	}
+	params.Body = inode.fs.uploadThrottle.ReadSeeker(params.Body)
+	var resp *PutBlobOutput
+	deletedFirst := false
+	if oldParent != nil && inode.fs.flags.RenameFlushOrder == "delete-first" {
+		// Both keys never exist at the same time, but the data is
+		// only kept in memory until the upload succeeds
+		inode.fs.addInflightChange(oldKey)
+		_, err = cloud.DeleteBlob(&DeleteBlobInput{
+			Key: oldKey,
+		})
+		inode.fs.completeInflightChange(oldKey)
+		if mapAwsError(err) == fuse.ENOENT {
+			err = nil
+		}
+		deletedFirst = err == nil
+	}
+	if err == nil {
+		inode.fs.addInflightChange(key)
+		if multipart {
+			resp, err = inode.putMultipart(cloud, params)
+		} else {
+			resp, err = cloud.PutBlob(params)
+		}
+		inode.fs.completeInflightChange(key)
+	}
+	if err == nil {
+		atomic.AddUint64(&inode.bytesWritten, *params.Size)
+		atomic.AddUint64(&inode.fs.metrics.backend(cloud).uploadedBytes, *params.Size)
+		inode.fs.flushStats.AddBytes(*params.Size)
+	}
 	inode.mu.Lock()
 
 	inode.recordFlushError(err)
+	renamedBack := false
+	if oldParent != nil {
+		if err == nil {
+			renamedBack = inode.finishRename(oldParent, oldName, newParent, newName)
+		} else {
+			inode.renamingTo = false
+			if inode.Parent == oldParent && inode.Name == oldName {
+				// Someone renamed the inode back to the original name
+				inode.oldParent = nil
+				inode.oldName = ""
+				inode.Parent.addModified(-1)
+			}
+		}
+	}
 	if err != nil {
 		log.Errorf("Failed to flush small file %v: %v", key, err)
-		if params.Metadata != nil {
+		if metadataDirty {
+			inode.userMetadataDirty = 2
+		}
+	} else if renamedBack {
+		// The new data went to the key that isn't used anymore, upload it again
+		log.Debugf("Flushed small file %v (inode %v), but it was renamed back to %v", key, inode.Id, oldKey)
+		if metadataDirty {
 			inode.userMetadataDirty = 2
 		}
 	} else {
@@ -1787,6 +2994,9 @@ func (inode *Inode) FlushSmallObject() {
 			if b.dirtyID != 0 {
 				if bufIds[b.dirtyID] {
 					// OK, not dirty anymore
+					if b.state == BUF_DIRTY {
+						inode.fs.addDirty(-int64(b.length))
+					}
 					b.dirtyID = 0
 					b.state = BUF_CLEAN
 				} else {
@@ -1801,10 +3011,39 @@ func (inode *Inode) FlushSmallObject() {
 				inode.SetCacheState(ST_MODIFIED)
 			}
 		}
-		inode.updateFromFlush(sz, resp.ETag, resp.LastModified, resp.StorageClass)
+		inode.uncompressedSize = 0
+		inode.compression = ""
+		if compress {
+			inode.uncompressedSize = sz
+			inode.compression = inode.fs.flags.UploadCompression
+		}
+		inode.updateFromFlush(*params.Size, resp.ETag, resp.LastModified, resp.StorageClass, params.ContentType)
+		inode.checksums = checksums
 	}
 
 	inode.UnlockRange(0, sz, true)
+	if oldParent != nil && err == nil {
+		// Delete the old key, or the new one if the file was moved back
+		delKey, delParent, delName := oldKey, oldParent, oldName
+		if renamedBack {
+			delKey, delParent, delName = key, newParent, newName
+		}
+		inode.mu.Unlock()
+		if !deletedFirst || renamedBack {
+			inode.fs.addInflightChange(delKey)
+			_, err = cloud.DeleteBlob(&DeleteBlobInput{
+				Key: delKey,
+			})
+			inode.fs.completeInflightChange(delKey)
+		}
+		if err != nil {
+			log.Debugf("Failed to delete %v during rename, will retry later", delKey)
+		} else {
+			log.Debugf("Deleted %v - rename completed", delKey)
+		}
+		forgetRenamedKey(delParent, delName, delKey, err)
+		inode.mu.Lock()
+	}
 	inode.IsFlushing -= inode.fs.flags.MaxParallelParts
 	atomic.AddInt64(&inode.fs.activeFlushers, -1)
 	inode.fs.WakeupFlusher()
@@ -1819,7 +3058,7 @@ func (inode *Inode) copyUnmodifiedParts(numParts uint64) (err error) {
 	var startPart, endPart uint64
 	var startOffset, endOffset uint64
 	for i := uint64(0); i < numParts; i++ {
-		partOffset, partSize := inode.fs.partRange(i)
+		partOffset, partSize := inode.partRange(i)
 		partEnd := partOffset+partSize
 		if partEnd > inode.Attributes.Size {
 			partEnd = inode.Attributes.Size
@@ -1895,8 +3134,10 @@ func (inode *Inode) copyUnmodifiedParts(numParts uint64) (err error) {
 
 func (inode *Inode) FlushPart(part uint64) {
 
-	partOffset, partSize := inode.fs.partRange(part)
+	partOffset, partSize := inode.uploadRange(part)
 	partFullSize := partSize
+	_, normalSize := inode.partRange(part)
+	merged := partFullSize > normalSize
 
 	cloud, key := inode.cloud()
 	if inode.oldParent != nil {
@@ -1942,29 +3183,63 @@ func (inode *Inode) FlushPart(part uint64) {
 		}
 	}
 
-	if inode.mpu == nil {
-		// Multipart upload was canceled in the meantime => don't flush
-		return
-	}
-
 	// Finally upload it
-	bufReader, bufIds := inode.GetMultiReader(partOffset, partSize)
-	bufLen := bufReader.Len()
-	partInput := MultipartBlobAddInput{
-		Commit:     inode.mpu,
-		PartNumber: uint32(part+1),
-		Body:       bufReader,
-		Size:       bufLen,
-		Offset:     partOffset,
+	var resp *MultipartBlobAddOutput
+	var bufIds map[uint64]bool
+	var bufLen uint64
+	var err error
+	var crc uint32
+	var crcErr error
+	for attempt := 0; ; attempt++ {
+		if inode.mpu == nil {
+			// Multipart upload was canceled in the meantime => don't flush
+			return
+		}
+		// Re-read part data from buffers on every attempt so that a retry
+		// never sends a stale body or checksum
+		if inode.Attributes.Size <= partOffset {
+			return
+		}
+		partSize = partFullSize
+		if inode.Attributes.Size < partOffset+partSize {
+			partSize = inode.Attributes.Size-partOffset
+		}
+		var bufReader *MultiReader
+		bufReader, bufIds = inode.GetMultiReader(partOffset, partSize)
+		bufLen = bufReader.Len()
+		partInput := MultipartBlobAddInput{
+			Commit:     inode.mpu,
+			PartNumber: uint32(part+1),
+			Body:       bufReader,
+			Size:       bufLen,
+			Offset:     partOffset,
+		}
+		inode.mu.Unlock()
+		if inode.fs.flags.VerifyChecksums {
+			crc, crcErr = bodyCRC32C(bufReader)
+		}
+		if inode.fs.flags.SendContentMD5 {
+			partInput.ContentMD5, _ = contentMD5(bufReader)
+		}
+		partInput.Body = inode.fs.uploadThrottle.ReadSeeker(bufReader)
+		resp, err = cloud.MultipartBlobAdd(&partInput)
+		if err == nil {
+			atomic.AddUint64(&inode.bytesWritten, bufLen)
+			atomic.AddUint64(&inode.fs.metrics.backend(cloud).uploadedBytes, bufLen)
+			inode.fs.flushStats.AddBytes(bufLen)
+		}
+		inode.mu.Lock()
+		if inode.CacheState == ST_DELETED {
+			// File was deleted while we were flushing it
+			return
+		}
+		if err == nil || attempt >= inode.fs.flags.PartRetries ||
+			inode.CacheState != ST_CREATED && inode.CacheState != ST_MODIFIED {
+			break
+		}
+		log.Warnf("Failed to flush part %v of object %v, retrying: %v", part, key, err)
 	}
-	inode.mu.Unlock()
-	resp, err := cloud.MultipartBlobAdd(&partInput)
-	inode.mu.Lock()
 
-	if inode.CacheState == ST_DELETED {
-		// File was deleted while we were flushing it
-		return
-	}
 	inode.recordFlushError(err)
 	if err != nil {
 		log.Errorf("Failed to flush part %v of object %v: %v", part, key, err)
@@ -1972,11 +3247,29 @@ func (inode *Inode) FlushPart(part uint64) {
 		if inode.mpu != nil {
 			// It could become nil if the file was deleted remotely in the meantime
 			inode.mpu.Parts[part] = resp.PartId
+			if inode.fs.flags.VerifyChecksums {
+				if crcErr == nil {
+					if inode.partChecksums == nil {
+						inode.partChecksums = make(map[uint64]checksumUnit)
+					}
+					inode.partChecksums[part] = checksumUnit{offset: partOffset, size: bufLen, crc: crc}
+				} else {
+					delete(inode.partChecksums, part)
+				}
+			}
 		}
 		doneState := BUF_FLUSHED_FULL
 		if bufLen < partFullSize {
 			doneState = BUF_FLUSHED_CUT
 		}
+		if merged {
+			// Keep the data in memory, the part is uploaded again if the file is resized
+			doneState = BUF_FLUSHED_CUT
+			inode.mergedPart = part+1
+			inode.mergedEnd = partOffset+bufLen
+		} else if inode.mergedPart == part+1 {
+			inode.mergedPart = 0
+		}
 		log.Debugf("Flushed part %v of object %v", part, key)
 		for i := 0; i < len(inode.buffers); i++ {
 			b := inode.buffers[i]
@@ -1984,6 +3277,9 @@ func (inode *Inode) FlushPart(part uint64) {
 				if bufIds[b.dirtyID] {
 					// Still dirty because the upload is not completed yet,
 					// but flushed to the server
+					if b.state == BUF_DIRTY {
+						inode.fs.addDirty(-int64(b.length))
+					}
 					b.state = doneState
 				}
 			}
@@ -1995,11 +3291,15 @@ func (inode *Inode) FlushPart(part uint64) {
 func (inode *Inode) completeMultipart() {
 	// Server-side copy unmodified parts
 	finalSize := inode.Attributes.Size
-	numParts := inode.fs.partNum(finalSize)
-	numPartOffset, _ := inode.fs.partRange(numParts)
+	numParts := inode.partNum(finalSize)
+	numPartOffset, _ := inode.partRange(numParts)
 	if numPartOffset < finalSize {
 		numParts++
 	}
+	if inode.mergedPart != 0 && inode.mergedEnd == finalSize {
+		// The last part is uploaded together with the previous one
+		numParts = inode.mergedPart
+	}
 	err := inode.copyUnmodifiedParts(numParts)
 	if !(inode.CacheState == ST_CREATED || inode.CacheState == ST_MODIFIED) {
 		// State changed, abort this flush (even if we get ENOENT)
@@ -2034,13 +3334,23 @@ func (inode *Inode) completeMultipart() {
 				if inode.mpu.Metadata != nil {
 					inode.userMetadataDirty = 2
 				}
+				if rejected, ok := err.(*MultipartPartsRejectedError); ok {
+					inode.resendRejectedParts(rejected.Parts)
+				}
 			} else {
 				log.Debugf("Finalized multi-part upload of object %v: etag=%v, size=%v", key, NilStr(resp.ETag), finalSize)
 				if inode.mpu.Metadata != nil && inode.userMetadataDirty == 1 {
 					inode.userMetadataDirty = 0
 				}
+				mpu := inode.mpu
 				inode.mpu = nil
-				inode.updateFromFlush(finalSize, resp.ETag, resp.LastModified, resp.StorageClass)
+				atomic.AddInt64(&inode.fs.metrics.backend(cloud).multipartUploads, -1)
+				inode.mergedPart = 0
+				inode.updateFromFlush(finalSize, resp.ETag, resp.LastModified, resp.StorageClass, inode.mpuContentType)
+				inode.recordPartManifest(mpu, finalSize)
+				inode.recordPartChecksums(mpu, finalSize)
+				inode.mpuPartSizes = nil
+				inode.mpuContentType = nil
 				stillDirty := inode.userMetadataDirty != 0 || inode.oldParent != nil || inode.Attributes.Size != inode.knownSize
 				for i := 0; i < len(inode.buffers); {
 					if inode.buffers[i].state == BUF_FL_CLEARED {
@@ -2072,7 +3382,43 @@ func (inode *Inode) completeMultipart() {
 	}
 }
 
-func (inode *Inode) updateFromFlush(size uint64, etag *string, lastModified *time.Time, storageClass *string) {
+// Mark parts rejected by the server during completion as not uploaded, so that
+// they're uploaded again instead of restarting the whole multipart upload
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) resendRejectedParts(parts []MPUPart) {
+	for _, p := range parts {
+		part := uint64(p.Num-1)
+		if inode.mpu == nil || p.Num == 0 || part >= uint64(len(inode.mpu.Parts)) {
+			continue
+		}
+		partOffset, partSize := inode.partRange(part)
+		partEnd := partOffset+partSize
+		evicted := false
+		for _, b := range inode.buffers {
+			if b.offset < partEnd && b.offset+b.length > partOffset && b.state == BUF_FL_CLEARED {
+				evicted = true
+				break
+			}
+		}
+		if evicted {
+			log.Errorf("Part %v of object %v is rejected by the server, but its data is already evicted from memory",
+				p.Num, inode.FullName())
+			continue
+		}
+		log.Warnf("Part %v of object %v is rejected by the server, uploading it again", p.Num, inode.FullName())
+		for _, b := range inode.buffers {
+			if b.offset < partEnd && b.offset+b.length > partOffset &&
+				(b.state == BUF_FLUSHED_FULL || b.state == BUF_FLUSHED_CUT) {
+				b.state = BUF_DIRTY
+				inode.fs.addDirty(int64(b.length))
+			}
+		}
+		// Unmodified parts are copied again
+		inode.mpu.Parts[part] = nil
+	}
+}
+
+func (inode *Inode) updateFromFlush(size uint64, etag *string, lastModified *time.Time, storageClass *string, contentType *string) {
 	if etag != nil {
 		inode.s3Metadata["etag"] = []byte(*etag)
 	}
@@ -2083,8 +3429,83 @@ func (inode *Inode) updateFromFlush(size uint64, etag *string, lastModified *tim
 		inode.Attributes.Ctime = *lastModified
 	}
 	inode.knownSize = size
-	inode.knownETag = *etag
+	// Content is replaced, so the old part manifest and checksums are no longer valid
+	inode.partManifest = ""
+	inode.partManifestUnsaved = false
+	inode.checksums = nil
+	if etag != nil {
+		inode.knownETag = *etag
+	} else {
+		inode.knownETag = ""
+	}
+	if inode.fs.flags.ConsistentRead > 0 {
+		// Listings may still return the previous version for some time
+		inode.etagTime = time.Now()
+		inode.etagFlushed = true
+	}
+	// Time and checksum of the new object are only known after the next HEAD or listing
+	inode.knownMtime = time.Time{}
+	inode.knownChecksum = ""
 	inode.AttrTime = time.Now()
+	// The new object has no tags and has the Content-Type sent with it
+	inode.resendTags()
+	inode.knownContentType = NilStr(contentType)
+	if inode.fs.flags.SymlinkCacheTTL > 0 {
+		inode.fs.forgetSymlink(inode)
+	}
+}
+
+// Content-Type set with the s3.content-type xattr, or guessed from the
+// extension with --auto-content-type, or the one the object already has
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) uploadContentType(key string) *string {
+	if inode.contentType != "" {
+		return PString(inode.contentType)
+	}
+	if guessed := inode.fs.flags.GetMimeType(key); guessed != nil {
+		return guessed
+	}
+	if inode.knownContentType != "" {
+		return PString(inode.knownContentType)
+	}
+	return nil
+}
+
+// Storage class requested with the s3.storage-class xattr, nil for the default one
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) uploadStorageClass() *string {
+	if inode.storageClass == "" {
+		return nil
+	}
+	return PString(inode.storageClass)
+}
+
+// Copies keep the current storage class unless another one is requested
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) copyStorageClass() *string {
+	if inode.storageClass != "" {
+		return PString(inode.storageClass)
+	}
+	if sc, ok := inode.s3Metadata["storage-class"]; ok {
+		return PString(string(sc))
+	}
+	return nil
+}
+
+// Content isn't changed by a metadata update, but the object gets a new ETag
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) updateFromMetadataCopy(etag *string, lastModified *time.Time) {
+	inode.s3Metadata["etag"] = []byte(*etag)
+	inode.knownETag = *etag
+	if inode.fs.flags.ConsistentRead > 0 {
+		inode.etagTime = time.Now()
+		inode.etagFlushed = true
+	}
+	if lastModified != nil {
+		inode.knownMtime = *lastModified
+	} else {
+		inode.knownMtime = time.Time{}
+	}
 }
 
 func (inode *Inode) SyncFile() (err error) {
@@ -2096,7 +3517,7 @@ func (inode *Inode) SyncFile() (err error) {
 			inode.mu.Unlock()
 			break
 		}
-		if inode.flushError != nil {
+		if inode.flushErrorFinal() {
 			// Return the error to user
 			err = inode.flushError
 			inode.mu.Unlock()
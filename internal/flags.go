@@ -21,7 +21,9 @@ import (
 
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"syscall"
@@ -34,6 +36,10 @@ import (
 
 const GEESEFS_VERSION = "0.35.1"
 
+// Uploads of other instances writing the same prefix can't be told apart
+// from orphaned ones, so --abort-stale-mpu only aborts uploads older than this
+const MIN_ABORT_STALE_MPU_AGE = 24*time.Hour
+
 var flagCategories map[string]string
 
 // Set up custom help text for goofys; in particular the usage section.
@@ -120,6 +126,13 @@ func NewApp() (app *cli.App) {
 			Usage: "Permission bits for disk cache files. (default: 0644)",
 		},
 
+		cli.BoolFlag{
+			Name:  "validate-disk-cache",
+			Usage: "Keep the disk cache across restarts: remember object versions of cached data" +
+				" in xattrs of cache files and check them against the server in the background after startup." +
+				" Files which don't match the server are removed, the remaining ones warm the cache",
+		},
+
 		cli.IntFlag{
 			Name:  "uid",
 			Value: uid,
@@ -143,6 +156,11 @@ func NewApp() (app *cli.App) {
 			Value: gid,
 			Usage: "Drop root group and change to this group ID (defaults to --gid).",
 		},
+
+		cli.BoolFlag{
+			Name:  "create-bucket",
+			Usage: "Create the bucket if it doesn't exist instead of failing to mount",
+		},
 	}
 
 	s3Flags := []cli.Flag{
@@ -183,7 +201,8 @@ func NewApp() (app *cli.App) {
 		cli.StringFlag{
 			Name:  "region",
 			Value: s3Default.Region,
-			Usage: "The region to connect to. Usually this is auto-detected." +
+			Usage: "The region to connect to. Usually this is auto-detected, also when" +
+				" the bucket redirects requests to another region. Setting it disables detection." +
 				" Possible values: us-east-1, us-west-1, us-west-2, eu-west-1, " +
 				"eu-central-1, ap-southeast-1, ap-southeast-2, ap-northeast-1, " +
 				"sa-east-1, cn-north-1",
@@ -212,8 +231,21 @@ func NewApp() (app *cli.App) {
 		},
 
 		cli.BoolFlag{
-			Name:  "use-content-type",
-			Usage: "Set Content-Type according to file extension and /etc/mime.types (default: off)",
+			Name:  "anonymous",
+			Usage: "Access a public bucket without credentials by sending unsigned requests." +
+				" The bucket is mounted read-only",
+		},
+
+		cli.BoolFlag{
+			Name:  "use-content-type, auto-content-type",
+			Usage: "Set Content-Type according to file extension and /etc/mime.types (default: off)." +
+				" It may be overridden per file with the s3.content-type xattr",
+		},
+
+		cli.StringFlag{
+			Name:  "user-agent",
+			Value: "geesefs/"+GEESEFS_VERSION,
+			Usage: "User-Agent to send with all backend requests, useful to find GeeseFS requests in bucket access logs",
 		},
 
 		/// http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectPUT.html
@@ -230,8 +262,9 @@ func NewApp() (app *cli.App) {
 		},
 
 		cli.StringFlag{
-			Name:  "sse-c",
-			Usage: "Enable server-side encryption using this base64-encoded key (default: off)",
+			Name:  "sse-c, sse-c-key",
+			Usage: "Enable server-side encryption with a customer-provided key (SSE-C) using this" +
+				" base64-encoded 32-byte key. The key is required to read the objects back (default: off)",
 			Value: "",
 		},
 
@@ -252,6 +285,15 @@ func NewApp() (app *cli.App) {
 			Value: "48h",
 		},
 
+		cli.DurationFlag{
+			Name:  "abort-stale-mpu",
+			Usage: "On start, abort multipart uploads under the mounted prefix older than this value and log" +
+				" each of them, instead of using --multipart-age for the whole bucket (default: off)." +
+				" Uploads of other instances can't be told apart, so it must exceed the longest upload time" +
+				" and it can't be less than 24h",
+			Value: 0,
+		},
+
 		cli.IntFlag{
 			Name:  "multipart-copy-threshold",
 			Usage: "Threshold for switching from single-part to multipart object copy in MB. Maximum for AWS S3 is 5 GB",
@@ -288,6 +330,47 @@ func NewApp() (app *cli.App) {
 			Value: 250,
 		},
 
+		cli.BoolFlag{
+			Name:  "compress-buffers",
+			Usage: "Compress modified data buffers which weren't used recently instead of waiting" +
+				" for them to be flushed when memory limit is reached. Trades CPU for memory",
+		},
+
+		cli.IntFlag{
+			Name:  "max-inodes",
+			Usage: "Maximum number of inodes to keep in memory. When exceeded, least used" +
+				" clean inodes without open handles are forgotten (default: unlimited)",
+			Value: 0,
+		},
+
+		cli.BoolFlag{
+			Name:  "lazy-dir-inodes",
+			Usage: "Forget inodes of listed directory entries right after returning them to readdir" +
+				" if they aren't looked up. Keeps memory bounded when listing huge directories," +
+				" but makes subsequent lookups in them go to the server",
+		},
+
+		cli.IntFlag{
+			Name:  "statfs-block-size",
+			Usage: "Block size reported by statfs, a power of 2 from 512 to 1 GB. S3 has no real block size or capacity," +
+				" so this and --statfs-total-blocks are synthetic values for applications checking free space",
+			Value: 4096,
+		},
+
+		cli.Uint64Flag{
+			Name:  "statfs-total-blocks",
+			Usage: "Total and free block count reported by statfs (default: 1 PB worth of blocks)",
+			Value: 0,
+		},
+
+		cli.Uint64Flag{
+			Name:  "fs-total-size",
+			Usage: "Quota in MB reported as the total size by statfs. Used space is then the total size" +
+				" of files known to the mount, i.e. looked up or listed and not forgotten yet, not of the whole bucket." +
+				" It includes modifications not flushed yet. Overrides --statfs-total-blocks",
+			Value: 0,
+		},
+
 		cli.BoolFlag{
 			Name:  "cheap",
 			Usage: "Reduce S3 operation costs at the expense of some performance (default: off)",
@@ -309,6 +392,37 @@ func NewApp() (app *cli.App) {
 			Usage: "How much parallel requests should be used for flushing changes to server",
 		},
 
+		cli.Uint64Flag{
+			Name:  "max-dirty-bytes",
+			Usage: "Block writes while modified data not yet uploaded to the server exceeds this number of bytes," +
+				" until the flusher uploads it below 75% of the limit (default: unlimited)." +
+				" Parts already uploaded to an unfinished multipart upload aren't counted." +
+				" Writes also block at the limit while flushing is paused with geesefs.pause-flush." +
+				" The current amount is returned by the geesefs.dirty-bytes xattr of the mount root",
+			Value: 0,
+		},
+
+		cli.Uint64Flag{
+			Name:  "max-upload-bytes-per-sec",
+			Usage: "Limit total upload bandwidth of all flushes, in bytes per second (default: unlimited)",
+			Value: 0,
+		},
+
+		cli.Uint64Flag{
+			Name:  "max-download-bytes-per-sec",
+			Usage: "Limit total download bandwidth of all reads, in bytes per second (default: unlimited)",
+			Value: 0,
+		},
+
+		cli.IntFlag{
+			Name:  "tree-op-concurrency",
+			Value: 64,
+			Usage: "How much parallel delete and rename requests should be used for removing and renaming"+
+				" directory trees, in addition to max-flushers. They're only used for entries of directories"+
+				" renamed as a whole or removed while their children are still being deleted, like with rm -r."+
+				" 0 makes them regular flushes limited by max-flushers",
+		},
+
 		cli.IntFlag{
 			Name:  "max-parallel-parts",
 			Value: 8,
@@ -365,6 +479,42 @@ func NewApp() (app *cli.App) {
 			Usage: "Larger readahead will be triggered in parallel chunks of this size in KB",
 		},
 
+		cli.IntFlag{
+			Name:  "max-readahead-per-handle",
+			Value: 0,
+			Usage: "Maximum amount of data in KB loaded ahead of the read position of a single file handle (0 = unlimited)",
+		},
+
+		cli.IntFlag{
+			Name:  "max-readahead-total",
+			Value: 0,
+			Usage: "Maximum amount of data in KB loaded ahead of the read position of all file handles together." +
+				" Readahead is paused when this limit is reached until readers consume the loaded data (0 = unlimited)",
+		},
+
+		cli.IntFlag{
+			Name:  "stream-read-cutoff",
+			Value: 0,
+			Usage: "Amount of linear read in KB after which data is streamed directly from the server" +
+				" to the reader without caching it, so reading huge files doesn't use more memory (default: off)",
+		},
+
+		cli.StringFlag{
+			Name:  "prefetch-on-readdir",
+			Value: "off",
+			Usage: "Prefetch files in the background after listing a directory: metadata - load their" +
+				" metadata (xattrs), content - load their beginning up to --read-ahead-large KB into the cache" +
+				" if there is enough free memory, off - don't prefetch",
+		},
+
+		cli.IntFlag{
+			Name:  "xattr-prefetch",
+			Value: 0,
+			Usage: "Load metadata (xattrs) of files and directories returned by a directory listing in the" +
+				" background using this number of parallel HEAD requests. Only used with backends where" +
+				" listings don't return metadata, but HEAD requests are cheap (S3, Azure Blob). 0 = disabled",
+		},
+
 		cli.IntFlag{
 			Name:  "read-merge",
 			Value: 512,
@@ -379,12 +529,23 @@ func NewApp() (app *cli.App) {
 				" Can't be less than 5 MB",
 		},
 
+		cli.IntFlag{
+			Name:  "merge-last-part-kb",
+			Value: 0,
+			Usage: "Upload the last part of a multipart upload together with the previous part" +
+				" when it's smaller than this size in KB, and upload objects only this much larger" +
+				" than --single-part with a single PUT (default: off)",
+		},
+
 		cli.StringFlag{
-			Name:  "part-sizes",
+			Name:  "part-sizes, part-size",
 			Value: "5:1000,25:1000,125",
-			Usage: "Part sizes in MB. Total part count is always 10000 in S3."+
+			Usage: "Part size ladder: <size>:<count>,...,<size>. Sizes are in MB or with K, M or G suffix," +
+				" the count may be omitted for the last size. Total part count is always 10000 in S3."+
 				" Default is 1000 5 MB parts, then 1000 25 MB parts" +
-				" and then 125 MB for the rest of parts",
+				" and then 125 MB for the rest of parts. When a file goes multipart, leading sizes" +
+				" are skipped while the file doesn't fit into the rest of the ladder, and the part" +
+				" layout is kept until the upload is completed",
 		},
 
 		cli.IntFlag{
@@ -400,6 +561,24 @@ func NewApp() (app *cli.App) {
 			Usage: "Do not wait until changes are persisted to the server on fsync() call (default: off)",
 		},
 
+		cli.BoolFlag{
+			Name:  "direct-sync-writes",
+			Usage: "Flush every write to a file opened with O_DIRECT before returning. It's slow: each write" +
+				" completes an upload of the whole file. Otherwise O_DIRECT only applies to reads (default: off)",
+		},
+
+		cli.BoolFlag{
+			Name:  "exclusive-writer",
+			Usage: "Allow only one handle opened for writing per file at a time." +
+				" Other opens for writing fail with EBUSY, opens for reading are always allowed (default: off)",
+		},
+
+		cli.BoolFlag{
+			Name:  "delete-on-close",
+			Usage: "Files unlinked while open stay readable and writable through open handles and are only" +
+				" deleted from the server when the last handle is closed, like in POSIX (default: off)",
+		},
+
 		cli.BoolFlag{
 			Name:  "enable-perms",
 			Usage: "Enable permissions, user and group ID." +
@@ -423,6 +602,21 @@ func NewApp() (app *cli.App) {
 				" Only works correctly if your S3 returns UserMetadata in listings (default: off)",
 		},
 
+		cli.BoolFlag{
+			Name:  "dir-mtime-marker",
+			Usage: "Save modification time of directories changed by creating, removing and renaming" +
+				" their entries in hidden empty <dir>/.mtime objects, so that it's kept after remounting." +
+				" The .mtime name is reserved then (default: off)",
+		},
+
+		cli.StringFlag{
+			Name:  "root-mtime",
+			Value: "mount",
+			Usage: "Modification time of the mount root: mount - the mount time," +
+				" marker - modification time of the directory object of the mounted prefix" +
+				" (bucket:prefix/), or the mount time if there's no such object",
+		},
+
 		cli.StringFlag{
 			Name:  "uid-attr",
 			Value: "uid",
@@ -435,6 +629,18 @@ func NewApp() (app *cli.App) {
 			Usage: "Group ID metadata attribute name",
 		},
 
+		cli.StringFlag{
+			Name:  "uid-map",
+			Usage: "Translate user IDs saved in metadata to local ones, for buckets shared between hosts" +
+				" with different IDs (only with --enable-perms). Comma-separated stored:local:count ranges," +
+				" for example 1000:1001:1. IDs outside of ranges are not changed. chown saves the reverse mapping",
+		},
+
+		cli.StringFlag{
+			Name:  "gid-map",
+			Usage: "Translate group IDs saved in metadata to local ones, same syntax as --uid-map",
+		},
+
 		cli.StringFlag{
 			Name:  "mode-attr",
 			Value: "mode",
@@ -453,6 +659,14 @@ func NewApp() (app *cli.App) {
 			Usage: "File modification time (UNIX time) metadata attribute name",
 		},
 
+		cli.StringFlag{
+			Name:  "metadata-prefix",
+			Usage: "Prefix for names of all metadata attributes managed by GeeseFS (uid, gid, mode, rdev," +
+				" mtime and symlink target) to avoid collisions with application metadata." +
+				" Attributes without the prefix are still read from existing objects when the prefixed ones" +
+				" are absent, but they're never changed or removed",
+		},
+
 		cli.StringFlag{
 			Name:  "symlink-attr",
 			Value: "--symlink-target",
@@ -460,6 +674,191 @@ func NewApp() (app *cli.App) {
 				" Only works correctly if your S3 returns UserMetadata in listings",
 		},
 
+		cli.BoolFlag{
+			Name:  "stable-inode-on-rename",
+			Usage: "Keep the inode number of the destination file when renaming over an existing file." +
+				" Useful for applications tracking files by inode numbers." +
+				" The number changes anyway if the destination is open at the moment of the rename",
+		},
+
+		cli.BoolFlag{
+			Name:  "website-redirect-symlinks",
+			Usage: "Present objects with x-amz-website-redirect-location as symbolic links and set" +
+				" this header when creating symbolic links to absolute paths or URLs (S3 only)",
+		},
+
+		cli.BoolFlag{
+			Name:  "changelog",
+			Usage: "Log local changes (created, modified, renamed and deleted files) since the mount" +
+				" as JSON lines to the virtual read-only file .geesefs/changelog (default: off)",
+		},
+
+		cli.StringSliceFlag{
+			Name:  "hide-pattern",
+			Usage: "Don't list files and directories with names matching this glob pattern, for example" +
+				" \".DS_Store\". They're still accessible by name. May be specified multiple times",
+		},
+
+		cli.BoolFlag{
+			Name:  "version-history-dirs",
+			Usage: "Allow to open a read-only virtual \"<name>.versions\" directory of every file with one" +
+				" file per version of the object. Only works with versioned S3 buckets",
+		},
+
+		cli.BoolFlag{
+			Name:  "metadata-sidecar",
+			Usage: "Show a read-only \"<name>.meta\" file next to every file with all its" +
+				" metadata (xattrs, size and modification time) as JSON. Real objects with such names take precedence",
+		},
+
+		cli.BoolFlag{
+			Name:  "send-content-md5",
+			Usage: "Send Content-MD5 header with every uploaded object and part so the server" +
+				" rejects corrupted uploads. Requires reading data twice (S3 only)",
+		},
+
+		cli.IntFlag{
+			Name:  "max-key-length",
+			Value: 0,
+			Usage: "Maximum object key length in bytes (including the prefix) supported by the server. Creating" +
+				" or renaming files with longer keys fails with ENAMETOOLONG. 0 means the limit of the storage" +
+				" backend (1024 for S3 and Azure Blob), -1 means unlimited",
+		},
+
+		cli.StringFlag{
+			Name:  "read-cache-policy",
+			Value: "full",
+			Usage: "Read caching policy: full (use readahead) or sparse (only cache accessed ranges" +
+				" without any readahead, suitable for random access to large structured files)",
+		},
+
+		cli.StringFlag{
+			Name:  "remote-delete-during-read",
+			Value: "fail",
+			Usage: "What to return when reading uncached ranges of a file deleted remotely while it's open:" +
+				" fail (EIO) or zero-fill. Already cached ranges are always returned",
+		},
+
+		cli.BoolFlag{
+			Name:  "partial-read-on-error",
+			Usage: "When loading a part of the requested range from the server fails, return cached data" +
+				" up to the failed range as a short read instead of failing the whole read",
+		},
+
+		cli.BoolFlag{
+			Name:  "part-manifest",
+			Usage: "Save sizes and ETags of all parts in the object metadata after completing a multipart" +
+				" upload, so parts can be verified individually (readable as geesefs.part-manifest xattr)." +
+				" Requires an additional metadata update request. Manifests larger than --max-metadata-size" +
+				" are only kept in memory and marked as not saved in the xattr value",
+		},
+
+		cli.StringFlag{
+			Name:  "trash",
+			Value: "",
+			Usage: "Move removed files into <trash>/<time>/<path> with a server-side copy instead of deleting them." +
+				" Trashed files are listed by the geesefs.trash xattr of the mount root and restored by setting" +
+				" its geesefs.restore xattr to one of the listed entries. Removals inside the trash are real",
+		},
+
+		cli.BoolFlag{
+			Name:  "verify-checksums",
+			Usage: "Save CRC32C of uploaded objects and parts in the object metadata and verify data read" +
+				" from the server against it, failing reads of corrupted data with EIO. Reads are extended" +
+				" to whole parts, and multipart uploads require an additional metadata update request",
+		},
+
+		cli.StringFlag{
+			Name:  "upload-compression",
+			Value: "",
+			Usage: "Compress uploaded objects and set Content-Encoding: gzip, zstd or empty (default: off)." +
+				" Files larger than --single-part are compressed as a whole when they're closed and" +
+				" then uploaded in parts, open files are uploaded uncompressed under memory pressure." +
+				" Compressed objects are always read from the server as a whole",
+		},
+
+		cli.IntFlag{
+			Name:  "upload-compression-level",
+			Value: -1,
+			Usage: "Compression level for --upload-compression, from 1 (fastest) to 9 (best) for gzip" +
+				" or to 22 for zstd, -1 is the default level",
+		},
+
+		cli.IntFlag{
+			Name:  "upload-compression-min-size",
+			Value: 4,
+			Usage: "Don't compress objects smaller than this size in KB",
+		},
+
+		cli.StringFlag{
+			Name:  "upload-compression-skip",
+			Value: ".gz,.tgz,.bz2,.xz,.zst,.lz4,.zip,.7z,.rar,.jpg,.jpeg,.png,.gif,.webp,.mp3,.mp4,.mkv,.avi,.mov,.webm,.parquet",
+			Usage: "Comma-separated list of file extensions which are already compressed and shouldn't be compressed again",
+		},
+
+		cli.StringFlag{
+			Name:  "xattr-namespaces",
+			Value: "",
+			Usage: "Comma-separated list of additional xattr namespaces to store in object metadata" +
+				" along with user.*, in the form namespace[:metadata-key-prefix]." +
+				" For example, security:security. allows to store SELinux labels. Prefixes must be non-empty" +
+				" and none of them may start with another one (default: off)",
+		},
+
+		cli.BoolFlag{
+			Name:  "lazy-xattr-list",
+			Usage: "Don't load object metadata from the server to list xattrs, only list the already known ones." +
+				" Speeds up enumerating xattrs of many files, values are still loaded when read",
+		},
+
+		cli.IntFlag{
+			Name:  "max-metadata-size",
+			Value: 0,
+			Usage: "Maximum total size of user metadata (escaped xattr names and values) supported by the server." +
+				" Setting xattrs beyond this size fails with E2BIG. 0 means the backend default" +
+				" (2 KB for S3, 8 KB for GCS and Azure), -1 means unlimited",
+		},
+
+		cli.IntFlag{
+			Name:  "max-xattr-value-size",
+			Value: 0,
+			Usage: "Maximum size of a single escaped xattr value. Setting larger values fails with E2BIG." +
+				" 0 means the backend default (2 KB for S3, 8 KB for GCS and Azure), -1 means unlimited",
+		},
+
+		cli.StringFlag{
+			Name:  "file-dir-collision",
+			Value: "file",
+			Usage: "What to do when both file \"foo\" and directory \"foo/\" exist in the bucket:" +
+				" file - show only the file, dir - show only the directory," +
+				" escape - show the directory as \"foo\" and the file as \"foo\" + --collision-suffix." +
+				" With dir and escape, looking up an uncached file also waits for the directory checks",
+		},
+
+		cli.StringFlag{
+			Name:  "collision-suffix",
+			Value: ".~file",
+			Usage: "Name suffix for files colliding with directories in --file-dir-collision=escape mode",
+		},
+
+		cli.StringFlag{
+			Name:  "conflict-detect",
+			Value: "etag",
+			Usage: "How to detect remote changes of objects when the server doesn't return ETag:" +
+				" etag - only compare size, mtime - compare size and modification time," +
+				" checksum - compare size and the checksum returned by HEAD (x-amz-checksum-* or Content-MD5)." +
+				" ETag is always used when the server returns it",
+		},
+
+		cli.StringFlag{
+			Name:  "conflict-policy",
+			Value: "drop-local",
+			Usage: "What to do with local changes of a file changed remotely:" +
+				" drop-local - discard them, keep-local - ignore the remote change and overwrite it," +
+				" rename-remote - also save the remote version as <name>.conflict-<etag>." +
+				" Ranges not changed locally are taken from the remote version",
+		},
+
 		cli.StringFlag{
 			Name:  "refresh-attr",
 			Value: ".invalidate",
@@ -470,7 +869,55 @@ func NewApp() (app *cli.App) {
 		cli.DurationFlag{
 			Name:  "stat-cache-ttl",
 			Value: time.Minute,
-			Usage: "How long to cache file metadata.",
+			Usage: "How long to cache file metadata. Can be overridden for a directory subtree until unmount" +
+				" with the geesefs.ttl xattr.",
+		},
+
+		cli.DurationFlag{
+			Name:  "neg-cache-ttl",
+			Value: 0,
+			Usage: "How long to remember that a looked up name doesn't exist on the server. Creating a file" +
+				" with this name or listing it in the parent directory invalidates it. 0 means disabled",
+		},
+
+		cli.DurationFlag{
+			Name:  "symlink-cache-ttl",
+			Value: 0,
+			Usage: "How long to remember symlink targets after reading them. Symlinks listed again during this" +
+				" time stay symlinks without loading their metadata, if the object's ETag and modification time" +
+				" are the same. 0 means disabled",
+		},
+
+		cli.DurationFlag{
+			Name:  "rename-list-grace",
+			Value: 0,
+			Usage: "How long to hide old keys of renamed objects from listings. Useful with" +
+				" eventually consistent servers which may still list the old key right after rename. 0 means disabled",
+		},
+
+		cli.DurationFlag{
+			Name:  "consistent-read",
+			Value: 0,
+			Usage: "For eventually consistent servers: for this time after learning a new ETag of a file, don't" +
+				" trust the first response. Opening the file polls the server until its ETag and size stop changing," +
+				" and different ETags returned by listings are ignored instead of being treated as conflicts." +
+				" Not needed with Amazon S3 which is strongly consistent. 0 means disabled",
+		},
+
+		cli.StringFlag{
+			Name:  "rename-flush-order",
+			Value: "copy-first",
+			Usage: "Order of operations when flushing a renamed and modified file: copy-first (upload" +
+				" the new key, then delete the old one, both keys may exist for a moment) or delete-first" +
+				" (delete the old key first, the data is only in memory until the upload succeeds)." +
+				" Unmodified files are always renamed with copy-first",
+		},
+
+		cli.DurationFlag{
+			Name:  "prefix-stats-ttl",
+			Value: 5 * time.Minute,
+			Usage: "How long to cache the number and total size of objects returned in" +
+				" geesefs.prefix-stats xattr of directories. It requires listing all objects under the prefix",
 		},
 
 		cli.DurationFlag{
@@ -485,6 +932,57 @@ func NewApp() (app *cli.App) {
 			Usage: "Retry unsuccessful flushes after this amount of time",
 		},
 
+		cli.DurationFlag{
+			Name:  "flush-wakeup-debounce",
+			Value: 0,
+			Usage: "Coalesce flusher wakeups happening more often than this interval to reduce CPU usage" +
+				" under high write rates, for example 1ms. The first change after an idle period always" +
+				" wakes it up immediately. 0 (default) disables coalescing",
+		},
+
+		cli.DurationFlag{
+			Name:  "retry-interval-max",
+			Value: 5 * time.Minute,
+			Usage: "Delay between retries of unsuccessful flushes of the same file doubles after each" +
+				" failure, starting from --retry-interval, until it reaches this value",
+		},
+
+		cli.IntFlag{
+			Name:  "retry-jitter",
+			Value: 20,
+			Usage: "Shorten each flush retry delay by a random amount of up to this percent," +
+				" so that files failed at the same time aren't retried all at once",
+		},
+
+		cli.IntFlag{
+			Name:  "flush-retries",
+			Value: 3,
+			Usage: "Return temporary flush errors (server errors, throttling, connection failures) to fsync" +
+				" and close only after this number of failed attempts. Other errors like access denied are" +
+				" returned at once. Failed flushes are retried in the background anyway (0 = return at once)",
+		},
+
+		cli.DurationFlag{
+			Name:  "flush-retry-timeout",
+			Value: 2 * time.Minute,
+			Usage: "Also return temporary flush errors when a file fails to flush for this amount of time" +
+				" (0 = only use --flush-retries)",
+		},
+
+		cli.DurationFlag{
+			Name:  "unmount-flush-timeout",
+			Value: 0,
+			Usage: "Stop waiting for modified files to be flushed after this amount of time when unmounting." +
+				" Files not flushed in time are reported in the log (default: wait forever)",
+		},
+
+		cli.IntFlag{
+			Name:  "part-retries",
+			Value: 2,
+			Usage: "Retry failed multipart part uploads immediately this number of times." +
+				" Part data is re-read from the buffers on every attempt",
+		},
+
 		cli.IntFlag{
 			Name:  "cache-popular-threshold",
 			Value: 3,
@@ -509,6 +1007,36 @@ func NewApp() (app *cli.App) {
 			Usage: "Decrement amount",
 		},
 
+		cli.IntFlag{
+			Name:  "cache-recency-limit",
+			Value: 1 << 30,
+			Usage: "Renumber recency counters of cached files preserving their order when they reach this value," +
+				" so that eviction stays well-behaved on long-lived mounts. 0 disables renumbering",
+		},
+
+		cli.StringFlag{
+			Name:  "cache-eviction",
+			Value: "lfru",
+			Usage: "Order in which cached files are evicted from memory, the disk cache and the inode table:" +
+				" lfru - least recently used files are evicted first, but files read more than" +
+				" --cache-popular-threshold times are kept longer, lru - least recently used first," +
+				" fifo - in the order they were first read",
+		},
+
+		cli.IntFlag{
+			Name:  "cache-high-watermark",
+			Value: 0,
+			Usage: "Start evicting clean cached data in the background when memory usage exceeds this" +
+				" percentage of --memory-limit, instead of evicting it only when new memory can't be allocated." +
+				" 0 = disabled. Current usage is returned by the geesefs.cache-occupancy xattr of the root directory",
+		},
+
+		cli.IntFlag{
+			Name:  "cache-low-watermark",
+			Value: 0,
+			Usage: "Stop background eviction when memory usage drops below this percentage of --memory-limit",
+		},
+
 		cli.IntFlag{
 			Name:  "cache-to-disk-hits",
 			Value: 2,
@@ -548,6 +1076,13 @@ func NewApp() (app *cli.App) {
 			Value: "",
 		},
 
+		cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "Specify port or host:port to serve Prometheus metrics on /metrics: inodes," +
+				" modified data, uploaded and downloaded bytes, flush errors and evictions",
+			Value: "",
+		},
+
 		cli.BoolFlag{
 			Name:  "f",
 			Usage: "Run geesefs in foreground.",
@@ -642,7 +1177,7 @@ func parsePartSizes(s string) (result []PartSizeConfig) {
 	totalCount := uint64(0)
 	for pi, ps := range partSizes {
 		a := strings.Split(ps, ":")
-		size, err := strconv.ParseUint(a[0], 10, 32)
+		size, err := parsePartSize(a[0])
 		if err != nil {
 			panic("Incorrect syntax for --part-sizes")
 		}
@@ -663,20 +1198,106 @@ func parsePartSizes(s string) (result []PartSizeConfig) {
 		if totalCount > 10000 {
 			panic("Total part count must be 10000")
 		}
-		if size < 5 {
+		if size < 5*1024*1024 {
 			panic("Minimum part size is 5 MB")
 		}
-		if size > 5*1024 {
+		if size > 5*1024*1024*1024 {
 			panic("Maximum part size is 5 GB")
 		}
 		result = append(result, PartSizeConfig{
-			PartSize: size*1024*1024,
+			PartSize: size,
 			PartCount: count,
 		})
 	}
 	return
 }
 
+// Part size in bytes: a number of MB or a number with K, M or G suffix
+func parsePartSize(s string) (uint64, error) {
+	mult := uint64(1024*1024)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			mult, s = 1024, s[0 : n-1]
+		case 'M', 'm':
+			s = s[0 : n-1]
+		case 'G', 'g':
+			mult, s = 1024*1024*1024, s[0 : n-1]
+		}
+	}
+	size, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return size*mult, nil
+}
+
+func parseIdMap(s string, name string) (result []IdMapRange) {
+	if s == "" {
+		return nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		a := strings.Split(strings.Trim(r, " "), ":")
+		if len(a) != 3 {
+			panic("Incorrect syntax for --"+name)
+		}
+		var n [3]uint64
+		for i := range a {
+			var err error
+			n[i], err = strconv.ParseUint(a[i], 10, 32)
+			if err != nil {
+				panic("Incorrect syntax for --"+name)
+			}
+		}
+		if n[2] == 0 || n[0]+n[2] > 1<<32 || n[1]+n[2] > 1<<32 {
+			panic("Invalid range in --"+name+": "+r)
+		}
+		result = append(result, IdMapRange{
+			Stored: uint32(n[0]),
+			Local: uint32(n[1]),
+			Count: uint32(n[2]),
+		})
+	}
+	return
+}
+
+func parseXattrNamespaces(s string) (result map[string]string) {
+	if s == "" {
+		return nil
+	}
+	result = make(map[string]string)
+	for _, ns := range strings.Split(s, ",") {
+		a := strings.SplitN(ns, ":", 2)
+		name := strings.Trim(a[0], " ")
+		if name == "" || strings.Index(name, ".") != -1 {
+			panic("Incorrect syntax for --xattr-namespaces")
+		}
+		if name == "user" {
+			panic("user. xattr namespace is always enabled and can't be remapped")
+		}
+		prefix := name+"."
+		if len(a) > 1 {
+			prefix = a[1]
+		}
+		if prefix == "" {
+			panic("Empty metadata key prefix for "+name+". in --xattr-namespaces")
+		}
+		if _, ok := result[name]; ok {
+			panic("Duplicate namespace "+name+". in --xattr-namespaces")
+		}
+		// Metadata keys are case-insensitive. A key must map back to exactly
+		// one namespace, so no prefix may start with another one
+		for other, otherPrefix := range result {
+			if strings.HasPrefix(strings.ToLower(prefix), strings.ToLower(otherPrefix)) ||
+				strings.HasPrefix(strings.ToLower(otherPrefix), strings.ToLower(prefix)) {
+				panic("Metadata key prefixes of "+other+". and "+name+". overlap in --xattr-namespaces")
+			}
+		}
+		result[name] = prefix
+	}
+	return
+}
+
 // PopulateFlags adds the flags accepted by run to the supplied flag set, returning the
 // variables into which the flags will parse.
 func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
@@ -694,19 +1315,44 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		Gid:                    uint32(c.Int("gid")),
 		Setuid:                 c.Int("setuid"),
 		Setgid:                 c.Int("setgid"),
+		CreateBucket:           c.Bool("create-bucket"),
 
 		// Tuning,
 		MemoryLimit:            uint64(1024*1024*c.Int("memory-limit")),
 		GCInterval:             uint64(1024*1024*c.Int("gc-interval")),
+		CompressBuffers:        c.Bool("compress-buffers"),
+		MaxInodes:              uint64(c.Int("max-inodes")),
+		LazyDirInodes:          c.Bool("lazy-dir-inodes"),
+		StatfsBlockSize:        uint32(c.Int("statfs-block-size")),
+		StatfsTotalBlocks:      c.Uint64("statfs-total-blocks"),
+		FsTotalSize:            c.Uint64("fs-total-size") * 1024 * 1024,
 		Cheap:                  c.Bool("cheap"),
 		ExplicitDir:            c.Bool("no-implicit-dir"),
 		NoDirObject:            c.Bool("no-dir-object"),
 		MaxFlushers:            int64(c.Int("max-flushers")),
+		MaxDirtyBytes:          c.Uint64("max-dirty-bytes"),
+		AbortStaleMPU:          c.Duration("abort-stale-mpu"),
+		MaxUploadBytesPerSec:   c.Uint64("max-upload-bytes-per-sec"),
+		MaxDownloadBytesPerSec: c.Uint64("max-download-bytes-per-sec"),
+		TreeOpConcurrency:      c.Int("tree-op-concurrency"),
 		MaxParallelParts:       c.Int("max-parallel-parts"),
 		MaxParallelCopy:        c.Int("max-parallel-copy"),
 		StatCacheTTL:           c.Duration("stat-cache-ttl"),
+		NegCacheTTL:            c.Duration("neg-cache-ttl"),
+		SymlinkCacheTTL:        c.Duration("symlink-cache-ttl"),
+		RenameListGrace:        c.Duration("rename-list-grace"),
+		ConsistentRead:         c.Duration("consistent-read"),
+		RenameFlushOrder:       c.String("rename-flush-order"),
+		PrefixStatsTTL:         c.Duration("prefix-stats-ttl"),
 		HTTPTimeout:            c.Duration("http-timeout"),
 		RetryInterval:          c.Duration("retry-interval"),
+		RetryIntervalMax:       c.Duration("retry-interval-max"),
+		RetryJitter:            c.Int("retry-jitter"),
+		FlushRetries:           c.Int("flush-retries"),
+		FlushRetryTimeout:      c.Duration("flush-retry-timeout"),
+		FlushWakeupDebounce:    c.Duration("flush-wakeup-debounce"),
+		PartRetries:            c.Int("part-retries"),
+		UnmountFlushTimeout:    c.Duration("unmount-flush-timeout"),
 		ReadAheadKB:            uint64(c.Int("read-ahead")),
 		SmallReadCount:         uint64(c.Int("small-read-count")),
 		SmallReadCutoffKB:      uint64(c.Int("small-read-cutoff")),
@@ -714,32 +1360,74 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		LargeReadCutoffKB:      uint64(c.Int("large-read-cutoff")),
 		ReadAheadLargeKB:       uint64(c.Int("read-ahead-large")),
 		ReadAheadParallelKB:    uint64(c.Int("read-ahead-parallel")),
+		MaxReadAheadPerHandleKB: uint64(c.Int("max-readahead-per-handle")),
+		MaxReadAheadTotalKB:    uint64(c.Int("max-readahead-total")),
 		ReadMergeKB:            uint64(c.Int("read-merge")),
+		StreamReadCutoffKB:     uint64(c.Int("stream-read-cutoff")),
+		PrefetchOnReaddir:      c.String("prefetch-on-readdir"),
+		XattrPrefetch:          c.Int("xattr-prefetch"),
 		SinglePartMB:           uint64(singlePart),
+		MergeLastPartKB:        uint64(c.Int("merge-last-part-kb")),
 		MaxMergeCopyMB:         uint64(c.Int("max-merge-copy")),
 		IgnoreFsync:            c.Bool("ignore-fsync"),
+		DirectSyncWrites:       c.Bool("direct-sync-writes"),
+		ExclusiveWriter:        c.Bool("exclusive-writer"),
+		DeleteOnClose:          c.Bool("delete-on-close"),
 		EnablePerms:            c.Bool("enable-perms"),
 		EnableSpecials:         c.Bool("enable-specials"),
 		EnableMtime:            c.Bool("enable-mtime"),
+		DirMtimeMarker:         c.Bool("dir-mtime-marker"),
+		RootMtime:              c.String("root-mtime"),
 		UidAttr:                c.String("uid-attr"),
 		GidAttr:                c.String("gid-attr"),
 		FileModeAttr:           c.String("mode-attr"),
 		RdevAttr:               c.String("rdev-attr"),
 		MtimeAttr:              c.String("mtime-attr"),
 		SymlinkAttr:            c.String("symlink-attr"),
+		MetadataPrefix:         strings.ToLower(c.String("metadata-prefix")),
+		WebsiteRedirectSymlinks: c.Bool("website-redirect-symlinks"),
+		MetadataSidecar:        c.Bool("metadata-sidecar"),
+		HidePatterns:           c.StringSlice("hide-pattern"),
+		VersionHistoryDirs:     c.Bool("version-history-dirs"),
+		ChangeLog:              c.Bool("changelog"),
+		StableInodeOnRename:    c.Bool("stable-inode-on-rename"),
 		RefreshAttr:            c.String("refresh-attr"),
+		MaxMetadataSize:        c.Int("max-metadata-size"),
+		LazyXattrList:          c.Bool("lazy-xattr-list"),
+		MaxXattrValueSize:      c.Int("max-xattr-value-size"),
+		MaxKeyLength:           c.Int("max-key-length"),
+		FileDirCollision:       c.String("file-dir-collision"),
+		SendContentMD5:         c.Bool("send-content-md5"),
+		PartManifest:           c.Bool("part-manifest"),
+		VerifyChecksums:        c.Bool("verify-checksums"),
+		Trash:                  strings.Trim(c.String("trash"), "/"),
+		RemoteDeleteDuringRead: c.String("remote-delete-during-read"),
+		PartialReadOnError:     c.Bool("partial-read-on-error"),
+		ReadCachePolicy:        c.String("read-cache-policy"),
+		UploadCompression:      c.String("upload-compression"),
+		UploadCompressionLevel: c.Int("upload-compression-level"),
+		UploadCompressionMinKB: uint64(c.Int("upload-compression-min-size")),
+		CollisionSuffix:        c.String("collision-suffix"),
+		ConflictDetect:         c.String("conflict-detect"),
+		ConflictPolicy:         c.String("conflict-policy"),
 		CachePopularThreshold:  int64(c.Int("cache-popular-threshold")),
 		CacheMaxHits:           int64(c.Int("cache-max-hits")),
 		CacheAgeInterval:       int64(c.Int("cache-age-interval")),
 		CacheAgeDecrement:      int64(c.Int("cache-age-decrement")),
+		CacheRecencyLimit:      uint64(c.Int("cache-recency-limit")),
+		CacheEviction:          c.String("cache-eviction"),
+		CacheLowWatermark:      c.Int("cache-low-watermark"),
+		CacheHighWatermark:     c.Int("cache-high-watermark"),
 		CacheToDiskHits:        int64(c.Int("cache-to-disk-hits")),
 		CachePath:              c.String("cache"),
 		MaxDiskCacheFD:         int64(c.Int("max-disk-cache-fd")),
 		CacheFileMode:          os.FileMode(c.Int("cache-file-mode")),
+		ValidateDiskCache:      c.Bool("validate-disk-cache"),
 
 		// Common Backend Config
 		Endpoint:               c.String("endpoint"),
 		UseContentType:         c.Bool("use-content-type"),
+		UserAgent:              c.String("user-agent"),
 
 		// Debugging,
 		DebugMain:              c.Bool("debug"),
@@ -749,9 +1437,88 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		LogFile:                c.String("log-file"),
 		StatsInterval:          c.Duration("print-stats"),
 		PProf:                  c.String("pprof"),
+		MetricsAddr:            c.String("metrics-addr"),
 	}
 
 	flags.PartSizes = parsePartSizes(c.String("part-sizes"))
+	if flags.MetadataPrefix != "" {
+		for _, attr := range []*string{&flags.UidAttr, &flags.GidAttr, &flags.FileModeAttr,
+			&flags.RdevAttr, &flags.MtimeAttr, &flags.SymlinkAttr} {
+			*attr = flags.MetadataPrefix + *attr
+		}
+	}
+	flags.XattrNamespaces = parseXattrNamespaces(c.String("xattr-namespaces"))
+	flags.UidMap = parseIdMap(c.String("uid-map"), "uid-map")
+	flags.GidMap = parseIdMap(c.String("gid-map"), "gid-map")
+	maxLevel := 9
+	if flags.UploadCompression == "zstd" {
+		maxLevel = 22
+	} else if flags.UploadCompression != "" && flags.UploadCompression != "gzip" {
+		panic("Unknown --upload-compression: "+flags.UploadCompression)
+	}
+	if flags.UploadCompressionLevel < -1 || flags.UploadCompressionLevel > maxLevel || flags.UploadCompressionLevel == 0 {
+		panic("Invalid --upload-compression-level: "+fmt.Sprintf("%v", flags.UploadCompressionLevel))
+	}
+	if flags.RetryJitter < 0 || flags.RetryJitter > 100 {
+		panic("Invalid --retry-jitter: "+fmt.Sprintf("%v", flags.RetryJitter))
+	}
+	flags.UploadCompressionSkip = make(map[string]bool)
+	for _, ext := range strings.Split(c.String("upload-compression-skip"), ",") {
+		ext = strings.ToLower(strings.Trim(ext, " "))
+		if ext != "" {
+			flags.UploadCompressionSkip[ext] = true
+		}
+	}
+	if flags.FileDirCollision != "dir" && flags.FileDirCollision != "file" && flags.FileDirCollision != "escape" {
+		panic("Unknown --file-dir-collision: "+flags.FileDirCollision)
+	}
+	for _, pattern := range flags.HidePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic("Bad --hide-pattern: "+pattern)
+		}
+	}
+	if flags.PrefetchOnReaddir != "off" && flags.PrefetchOnReaddir != "metadata" && flags.PrefetchOnReaddir != "content" {
+		panic("Unknown --prefetch-on-readdir: "+flags.PrefetchOnReaddir)
+	}
+	if flags.CacheEviction != "lfru" && flags.CacheEviction != "lru" && flags.CacheEviction != "fifo" {
+		panic("Unknown --cache-eviction: "+flags.CacheEviction)
+	}
+	if flags.CacheHighWatermark < 0 || flags.CacheHighWatermark > 100 || flags.CacheLowWatermark < 0 ||
+		flags.CacheHighWatermark > 0 && flags.CacheLowWatermark >= flags.CacheHighWatermark {
+		panic(fmt.Sprintf("Invalid --cache-low-watermark %v and --cache-high-watermark %v: should be percents, low < high",
+			flags.CacheLowWatermark, flags.CacheHighWatermark))
+	}
+	if flags.RootMtime != "mount" && flags.RootMtime != "marker" {
+		panic("Unknown --root-mtime: "+flags.RootMtime)
+	}
+	if flags.ConflictDetect != "etag" && flags.ConflictDetect != "mtime" && flags.ConflictDetect != "checksum" {
+		panic("Unknown --conflict-detect: "+flags.ConflictDetect)
+	}
+	if flags.AbortStaleMPU != 0 && flags.AbortStaleMPU < MIN_ABORT_STALE_MPU_AGE {
+		panic(fmt.Sprintf("Invalid --abort-stale-mpu %v: must be at least %v", flags.AbortStaleMPU, MIN_ABORT_STALE_MPU_AGE))
+	}
+	if flags.ConflictPolicy != "drop-local" && flags.ConflictPolicy != "keep-local" &&
+		flags.ConflictPolicy != "rename-remote" {
+		panic("Unknown --conflict-policy: "+flags.ConflictPolicy)
+	}
+	if flags.RemoteDeleteDuringRead != "fail" && flags.RemoteDeleteDuringRead != "zero-fill" {
+		panic("Unknown --remote-delete-during-read: "+flags.RemoteDeleteDuringRead)
+	}
+	if flags.ReadCachePolicy != "full" && flags.ReadCachePolicy != "sparse" {
+		panic("Unknown --read-cache-policy: "+flags.ReadCachePolicy)
+	}
+	if flags.RenameFlushOrder != "copy-first" && flags.RenameFlushOrder != "delete-first" {
+		panic("Unknown --rename-flush-order: "+flags.RenameFlushOrder)
+	}
+	if flags.FileDirCollision == "escape" && (flags.CollisionSuffix == "" || strings.Index(flags.CollisionSuffix, "/") != -1) {
+		panic("Invalid --collision-suffix: "+flags.CollisionSuffix)
+	}
+	if bs := c.Int("statfs-block-size"); bs < 512 || bs > 1024*1024*1024 || bs&(bs-1) != 0 {
+		panic(fmt.Sprintf("Invalid --statfs-block-size %v: must be a power of 2 from 512 to 1 GB", bs))
+	}
+	if flags.StatfsTotalBlocks > math.MaxUint64/uint64(flags.StatfsBlockSize) {
+		panic(fmt.Sprintf("Invalid --statfs-total-blocks %v: total size doesn't fit into 64 bits", flags.StatfsTotalBlocks))
+	}
 
 	// S3 by default, if not initialized in api/api.go
 	if flags.Backend == nil {
@@ -763,6 +1530,7 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		config.StorageClass  = c.String("storage-class")
 		config.Profile       = c.String("profile")
 		config.SharedConfig  = c.StringSlice("shared-config")
+		config.Anonymous     = c.Bool("anonymous")
 		config.UseSSE        = c.Bool("sse")
 		config.UseKMS        = c.IsSet("sse-kms")
 		config.KMSKeyID      = c.String("sse-kms")
@@ -810,6 +1578,11 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		parseOptions(flags.MountOptions, o)
 	}
 
+	if config, ok := flags.Backend.(*S3Config); ok && config.Anonymous {
+		// Writes would be rejected by the server anyway
+		flags.MountOptions["ro"] = ""
+	}
+
 	if syscall.Getuid() == 0 && !c.IsSet("setuid") && flags.Uid != 0 {
 		flags.Setuid = int(flags.Uid)
 	}
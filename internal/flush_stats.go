@@ -0,0 +1,81 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Seconds used to calculate the current upload throughput
+const FLUSH_STATS_WINDOW = 10
+
+// Flusher counters. Unlike OpStats, they're never reset
+type FlushStats struct {
+	mu sync.Mutex
+	// uploaded bytes and completed flushes since mount
+	bytes uint64
+	flushes uint64
+	// total time between the first modification and the end of the flush
+	flushTime time.Duration
+	// bytes uploaded during each of the last FLUSH_STATS_WINDOW seconds
+	window [FLUSH_STATS_WINDOW]uint64
+	windowSec int64
+}
+
+// LOCKS_REQUIRED(stats.mu)
+func (stats *FlushStats) advance(sec int64) {
+	if sec-stats.windowSec >= FLUSH_STATS_WINDOW {
+		stats.window = [FLUSH_STATS_WINDOW]uint64{}
+	} else {
+		for s := stats.windowSec+1; s <= sec; s++ {
+			stats.window[s % FLUSH_STATS_WINDOW] = 0
+		}
+	}
+	if sec > stats.windowSec {
+		stats.windowSec = sec
+	}
+}
+
+func (stats *FlushStats) AddBytes(size uint64) {
+	stats.mu.Lock()
+	sec := time.Now().Unix()
+	stats.advance(sec)
+	stats.window[sec % FLUSH_STATS_WINDOW] += size
+	stats.bytes += size
+	stats.mu.Unlock()
+}
+
+func (stats *FlushStats) AddFlush(duration time.Duration) {
+	stats.mu.Lock()
+	stats.flushes++
+	stats.flushTime += duration
+	stats.mu.Unlock()
+}
+
+// Upload throughput in bytes per second and average time to flush a modified inode
+func (stats *FlushStats) Get() (throughput uint64, avgFlushTime time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.advance(time.Now().Unix())
+	for _, b := range stats.window {
+		throughput += b
+	}
+	throughput /= FLUSH_STATS_WINDOW
+	if stats.flushes > 0 {
+		avgFlushTime = stats.flushTime / time.Duration(stats.flushes)
+	}
+	return
+}
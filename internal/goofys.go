@@ -72,6 +72,7 @@ type Goofys struct {
 	flusherMu sync.Mutex
 	flusherCond *sync.Cond
 	flushPending int32
+	flushPaused int32
 
 	// The next inode ID to hand out. We assume that this will never overflow,
 	// since even if we were handing out inode IDs at 4 GHz, it would still take
@@ -96,6 +97,11 @@ type Goofys struct {
 	inflightListingId int
 	inflightListings map[int]map[string]bool
 	inflightChanges map[string]int
+	// Old keys of renamed objects are also skipped for --rename-list-grace
+	// because eventually consistent listings may still return them
+	renamedKeys map[string]time.Time
+	// Lookups of expired inodes are shared by concurrent callers
+	inflightLookups map[inflightLookupKey]*inflightLookup
 
 	nextHandleID fuseops.HandleID
 	dirHandles   map[fuseops.HandleID]*DirHandle
@@ -103,18 +109,64 @@ type Goofys struct {
 	fileHandles map[fuseops.HandleID]*FileHandle
 
 	activeFlushers int64
-	flushRetrySet int32
+	activeTreeOps int64
+	flushWakeupSet int32
+	flushThrottleSet int32
+	// time of the last immediate flusher wakeup, in nanoseconds
+	flushWakeupTime int64
+	// clock and timer of the flusher wakeup debounce, replaced in tests
+	flushWakeupNow func() time.Time
+	flushWakeupAfter func(time.Duration, func())
+	// time of the earliest scheduled flush retry, in nanoseconds
+	flushRetryTime int64
 	memRecency uint64
+	// incremented when inode keys may change (renames and mounts),
+	// invalidates paths cached by Inode.cloud()
+	cloudGen uint64
+	// incremented when entries are created or moved locally, see DirHandle.listGen
+	linkGen uint64
 
 	forgotCnt uint32
+	// blocks of files known to the mount for --fs-total-size, atomic
+	usedBlocks int64
+	evictInodes chan struct{}
+	// closed when the sync started by FlushOnUnmount finishes
+	unmountSync chan struct{}
 
 	zeroBuf []byte
-	lfru *LFRU
+	cachePolicy CachePolicy
 	diskFdMu sync.Mutex
 	diskFdCond *sync.Cond
 	diskFdCount int64
+	// symlink targets by object key, for --symlink-cache-ttl
+	symlinkCacheMu sync.Mutex
+	symlinkCache map[string]*symlinkCacheEntry
+	// disk cache files kept after startup validation
+	diskCacheMu sync.Mutex
+	diskCacheIndex map[string]*DiskCacheEntry
+	// data loaded ahead of read positions of all file handles
+	readAheadBytes int64
+	// writers waiting for dirty data to drop below --max-dirty-bytes
+	dirtyMu sync.Mutex
+	dirtyCond *sync.Cond
+	dirtyWaiters int32
+	// set after the first object without ETag is seen
+	noETagLogged int32
+	// local modifications and the virtual directory to read them
+	changeLog *ChangeLog
+	controlDir *Inode
+	changeLogFile *Inode
+	// limits concurrent requests of --prefetch-on-readdir
+	prefetchSlots chan struct{}
+	// limits concurrent HEAD requests of --xattr-prefetch
+	xattrPrefetchSlots chan struct{}
+	// --max-upload-bytes-per-sec and --max-download-bytes-per-sec, nil if unlimited
+	uploadThrottle *Throttle
+	downloadThrottle *Throttle
 
 	stats OpStats
+	flushStats FlushStats
+	metrics Metrics
 }
 
 type OpStats struct {
@@ -125,6 +177,7 @@ type OpStats struct {
 	metadataReads int64
 	metadataWrites int64
 	noops int64
+	flusherWakeups int64
 	ts time.Time
 }
 
@@ -197,6 +250,27 @@ func ParseBucketSpec(bucket string) (spec BucketSpec, err error) {
 	return
 }
 
+// Initialize the backend and check that the bucket is accessible.
+// HEAD of a random object alone doesn't distinguish a missing bucket
+// from a missing object, so also probe the listing
+func initBucket(cloud StorageBackend, prefix string, randomObjectName string) error {
+	err := cloud.Init(randomObjectName)
+	if err != nil {
+		return err
+	}
+	_, err = cloud.ListBlobs(&ListBlobsInput{
+		Prefix:  &prefix,
+		MaxKeys: PUInt32(1),
+	})
+	return err
+}
+
+func isBucketMissing(err error) bool {
+	err = mapAwsError(err)
+	// Azure returns ENODEV for missing containers
+	return err == syscall.ENXIO || err == syscall.ENODEV
+}
+
 func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 	return newGoofys(ctx, bucket, flags, NewBackend)
 }
@@ -208,14 +282,24 @@ func newGoofys(ctx context.Context, bucket string, flags *FlagStorage,
 		bucket: bucket,
 		flags:  flags,
 		umask:  0122,
-		lfru:   NewLFRU(flags.CachePopularThreshold, flags.CacheMaxHits, flags.CacheAgeInterval, flags.CacheAgeDecrement),
+		cachePolicy: NewCachePolicy(flags),
 		zeroBuf: make([]byte, 1048576),
 		inflightChanges: make(map[string]int),
+		inflightLookups: make(map[inflightLookupKey]*inflightLookup),
 		inflightListings: make(map[int]map[string]bool),
+		renamedKeys: make(map[string]time.Time),
+		prefetchSlots: make(chan struct{}, PREFETCH_CONCURRENCY),
+		uploadThrottle: NewThrottle(flags.MaxUploadBytesPerSec),
+		downloadThrottle: NewThrottle(flags.MaxDownloadBytesPerSec),
+		flushWakeupNow: time.Now,
+		flushWakeupAfter: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
 		stats: OpStats{
 			ts: time.Now(),
 		},
 	}
+	if flags.XattrPrefetch > 0 {
+		fs.xattrPrefetchSlots = make(chan struct{}, flags.XattrPrefetch)
+	}
 
 	var prefix string
 	colon := strings.Index(bucket, ":")
@@ -242,12 +326,22 @@ func newGoofys(ctx context.Context, bucket string, flags *FlagStorage,
 	_, fs.gcs = cloud.Delegate().(*GCS3)
 
 	randomObjectName := prefix + (RandStringBytesMaskImprSrc(32))
-	err = cloud.Init(randomObjectName)
+	err = initBucket(cloud, prefix, randomObjectName)
+	if isBucketMissing(err) && flags.CreateBucket {
+		log.Infof("Bucket '%v' does not exist, creating it", bucket)
+		_, err = cloud.MakeBucket(&MakeBucketInput{})
+		if err == nil {
+			err = initBucket(cloud, prefix, randomObjectName)
+		}
+	}
 	if err != nil {
-		log.Errorf("Unable to access '%v': %v", bucket, err)
+		if isBucketMissing(err) {
+			log.Errorf("Bucket '%v' does not exist, use --create-bucket to create it", bucket)
+		} else {
+			log.Errorf("Unable to access '%v': %v", bucket, err)
+		}
 		return nil
 	}
-	cloud.MultipartExpire(&MultipartExpireInput{})
 
 	now := time.Now()
 	fs.rootAttrs = InodeAttributes{
@@ -255,6 +349,14 @@ func newGoofys(ctx context.Context, bucket string, flags *FlagStorage,
 		Ctime: now,
 		Mtime: now,
 	}
+	if flags.RootMtime == "marker" && prefix != "" {
+		// Bucket root can't have a marker, but a prefix can
+		resp, err := cloud.HeadBlob(&HeadBlobInput{Key: prefix})
+		if err == nil && resp.LastModified != nil {
+			fs.rootAttrs.Mtime = *resp.LastModified
+			fs.rootAttrs.Ctime = *resp.LastModified
+		}
+	}
 
 	if os.Getenv("GOGC") == "" {
 		// Set garbage collection ratio to 20 instead of 100 by default.
@@ -265,6 +367,7 @@ func newGoofys(ctx context.Context, bucket string, flags *FlagStorage,
 	fs.bufferPool.FreeSomeCleanBuffers = func(size int64) (int64, bool) {
 		return fs.FreeSomeCleanBuffers(size)
 	}
+	fs.bufferPool.StartEvictor(flags.CacheLowWatermark, flags.CacheHighWatermark)
 
 	fs.nextInodeID = fuseops.RootInodeID + 1
 	fs.inodes = make(map[fuseops.InodeID]*Inode)
@@ -281,12 +384,28 @@ func newGoofys(ctx context.Context, bucket string, flags *FlagStorage,
 	fs.inodes[fuseops.RootInodeID] = root
 	fs.addDotAndDotDot(root)
 
+	expire := &MultipartExpireInput{}
+	if flags.AbortStaleMPU > 0 {
+		// Only uploads of this mount which nobody could still be writing
+		expire = &MultipartExpireInput{
+			Prefix: prefix,
+			Age:    flags.AbortStaleMPU,
+			Keep:   fs.tracksUpload,
+		}
+	}
+	cloud.MultipartExpire(expire)
+
+	if fs.flags.ChangeLog {
+		fs.enableChangeLog()
+	}
+
 	fs.nextHandleID = 1
 	fs.dirHandles = make(map[fuseops.HandleID]*DirHandle)
 
 	fs.fileHandles = make(map[fuseops.HandleID]*FileHandle)
 
 	fs.flusherCond = sync.NewCond(&fs.flusherMu)
+	fs.dirtyCond = sync.NewCond(&fs.dirtyMu)
 	go fs.Flusher()
 	if fs.flags.StatsInterval > 0 {
 		go fs.StatPrinter()
@@ -297,6 +416,15 @@ func newGoofys(ctx context.Context, bucket string, flags *FlagStorage,
 		go fs.FDCloser()
 	}
 
+	if fs.flags.CachePath != "" && fs.flags.ValidateDiskCache {
+		go fs.checkDiskCache(fs.validateDiskCache())
+	}
+
+	if fs.flags.MaxInodes > 0 {
+		fs.evictInodes = make(chan struct{}, 1)
+		go fs.InodeEvictor()
+	}
+
 	return fs
 }
 
@@ -359,14 +487,22 @@ func (fs *Goofys) StatPrinter() {
 		metadataReads := atomic.SwapInt64(&fs.stats.metadataReads, 0)
 		metadataWrites := atomic.SwapInt64(&fs.stats.metadataWrites, 0)
 		noops := atomic.SwapInt64(&fs.stats.noops, 0)
+		flusherWakeups := atomic.SwapInt64(&fs.stats.flusherWakeups, 0)
 		fs.stats.ts = now
+		fs.mu.RLock()
+		inodes := len(fs.inodes)
+		root := fs.inodes[fuseops.RootInodeID]
+		fs.mu.RUnlock()
+		readAhead := atomic.LoadInt64(&fs.readAheadBytes)
+		queued := atomic.LoadInt64(&root.dir.ModifiedChildren)
+		throughput, avgFlushTime := fs.flushStats.Get()
 		readsOr1 := float64(reads)
 		if reads == 0 {
 			readsOr1 = 1
 		}
 		fmt.Fprintf(
 			os.Stderr,
-			"%v I/O: %.2f read/s, %.2f %% hits, %.2f write/s; metadata: %.2f read/s, %.2f write/s; %.2f noop/s; %.2f flush/s\n",
+			"%v I/O: %.2f read/s, %.2f %% hits, %.2f write/s; metadata: %.2f read/s, %.2f write/s; %.2f noop/s; %.2f flush/s, %.2f flusher wakeup/s; %v inodes; %.2f MB readahead; %v modified, %.2f MB/s upload, %.2f s to flush\n",
 			now.Format("2006/01/02 15:04:05.000000"),
 			float64(reads) / d,
 			float64(readHits)/readsOr1*100,
@@ -375,6 +511,12 @@ func (fs *Goofys) StatPrinter() {
 			float64(metadataWrites) / d,
 			float64(noops) / d,
 			float64(flushes) / d,
+			float64(flusherWakeups) / d,
+			inodes,
+			float64(readAhead) / 1024 / 1024,
+			queued,
+			float64(throughput) / 1024 / 1024,
+			avgFlushTime.Seconds(),
 		)
 	}
 }
@@ -383,7 +525,7 @@ func (fs *Goofys) StatPrinter() {
 func (fs *Goofys) FDCloser() {
 	fs.diskFdMu.Lock()
 	for {
-		rmFdItem := fs.lfru.Pick(nil)
+		rmFdItem := fs.cachePolicy.Pick(nil)
 		for fs.flags.MaxDiskCacheFD > 0 && fs.diskFdCount > fs.flags.MaxDiskCacheFD && rmFdItem != nil {
 			fs.diskFdMu.Unlock()
 			fs.mu.RLock()
@@ -404,13 +546,107 @@ func (fs *Goofys) FDCloser() {
 			} else {
 				fs.diskFdMu.Lock()
 			}
-			rmFdItem = fs.lfru.Pick(rmFdItem)
+			rmFdItem = fs.cachePolicy.Pick(rmFdItem)
 		}
 		fs.diskFdCond.Wait()
 	}
 	fs.diskFdMu.Unlock()
 }
 
+// Forget least used inodes when there are more than MaxInodes of them
+func (fs *Goofys) InodeEvictor() {
+	for range fs.evictInodes {
+		fs.EvictInodes()
+	}
+}
+
+// Forget clean inodes without open handles until the inode count drops
+// below 90% of MaxInodes. Inodes never opened are evicted first, then
+// the least used ones according to the cache policy.
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) EvictInodes() (evicted int) {
+	target := fs.flags.MaxInodes - fs.flags.MaxInodes/10
+	fs.mu.RLock()
+	count := uint64(len(fs.inodes))
+	var candidates []*Inode
+	if count > target {
+		for _, inode := range fs.inodes {
+			if fs.cachePolicy.GetHits(inode.Id) < 0 {
+				candidates = append(candidates, inode)
+			}
+		}
+	}
+	fs.mu.RUnlock()
+	if count <= target {
+		return
+	}
+	log.Infof("Inode limit exceeded (%v inodes of %v), evicting least used inodes", count, fs.flags.MaxInodes)
+	for _, inode := range candidates {
+		if count <= target {
+			break
+		}
+		if fs.evictInode(inode) {
+			count--
+			evicted++
+		}
+	}
+	var item CacheItem
+	for count > target {
+		item = fs.cachePolicy.Pick(item)
+		if item == nil {
+			break
+		}
+		fs.mu.RLock()
+		inode := fs.inodes[item.Id()]
+		fs.mu.RUnlock()
+		if inode != nil && fs.evictInode(inode) {
+			count--
+			evicted++
+		}
+	}
+	log.Infof("Evicted %v inodes, %v inodes left", evicted, count)
+	return
+}
+
+// Remove an inode from its parent if it's clean, has no open handles
+// and isn't referenced by the kernel
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(inode.mu)
+// LOCKS_EXCLUDED(inode.Parent.mu)
+func (fs *Goofys) evictInode(inode *Inode) bool {
+	parent := inode.Parent
+	if parent == nil || inode.Id == fuseops.RootInodeID {
+		return false
+	}
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+	if inode.Parent != parent || !inode.isEvictable() {
+		return false
+	}
+	// Parent listing is now incomplete
+	parent.dir.listDone = false
+	parent.dir.DirTime = time.Time{}
+	parent.removeChildUnlocked(inode)
+	return true
+}
+
+// Check if the inode is only referenced by its parent and may be forgotten
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) isEvictable() bool {
+	if inode.CacheState != ST_CACHED || inode.isVirtual() ||
+		atomic.LoadInt64(&inode.refcnt) != 1 || atomic.LoadInt32(&inode.fileHandles) != 0 ||
+		inode.userMetadataDirty != 0 || inode.IsFlushing != 0 || inode.oldParent != nil {
+		return false
+	}
+	if inode.dir != nil && (len(inode.dir.Children) > 2 ||
+		len(inode.dir.handles) > 0 || inode.dir.ModifiedChildren != 0) {
+		return false
+	}
+	return true
+}
+
 // Try to reclaim some clean buffers
 func (fs *Goofys) FreeSomeCleanBuffers(size int64) (int64, bool) {
 	freed := int64(0)
@@ -426,14 +662,14 @@ func (fs *Goofys) FreeSomeCleanBuffers(size int64) (int64, bool) {
 	} else {
 		skipRecent = 0
 	}
-	var cacheItem *LFRUItem
+	var cacheItem CacheItem
 	for {
-		cacheItem = fs.lfru.Pick(cacheItem)
+		cacheItem = fs.cachePolicy.Pick(cacheItem)
 		if cacheItem == nil {
 			if skipRecent != 0 {
 				// Rescan without "skipRecent"
 				skipRecent = 0
-				cacheItem = fs.lfru.Pick(cacheItem)
+				cacheItem = fs.cachePolicy.Pick(cacheItem)
 				if cacheItem == nil {
 					break
 				}
@@ -462,27 +698,17 @@ func (fs *Goofys) FreeSomeCleanBuffers(size int64) (int64, bool) {
 				if buf.ptr != nil && !inode.IsRangeLocked(buf.offset, buf.length, false) &&
 					// Skip recent buffers when possible
 					(skipRecent == 0 || buf.recency <= skipRecent) {
-					if fs.flags.CachePath != "" && !buf.onDisk {
+					if fs.flags.CachePath != "" && !buf.onDisk && !buf.compressed {
 						if toFs == -1 {
 							toFs = 0
-							if fs.lfru.GetHits(inode.Id) >= fs.flags.CacheToDiskHits {
+							if fs.cachePolicy.GetHits(inode.Id) >= fs.flags.CacheToDiskHits {
 								toFs = 1
 							}
 						}
 						if toFs > 0 {
 							// Evict to disk
-							err := inode.OpenCacheFD()
-							if err != nil {
+							if inode.saveToDiskCache(buf) != nil {
 								toFs = 0
-							} else {
-								_, err := inode.DiskCacheFD.WriteAt(buf.data, int64(buf.offset))
-								if err != nil {
-									toFs = 0
-									log.Errorf("Couldn't write %v bytes at offset %v to %v: %v",
-										len(buf.data), buf.offset, fs.flags.CachePath+"/"+inode.FullName(), err)
-								} else {
-									buf.onDisk = true
-								}
 							}
 						}
 					}
@@ -494,6 +720,7 @@ func (fs *Goofys) FreeSomeCleanBuffers(size int64) (int64, bool) {
 					}
 					buf.ptr = nil
 					buf.data = nil
+					atomic.AddInt64(&fs.metrics.evictions, 1)
 					if buf.dirtyID == 0 && !buf.onDisk {
 						if del == -1 {
 							del = i
@@ -521,6 +748,9 @@ func (fs *Goofys) FreeSomeCleanBuffers(size int64) (int64, bool) {
 				}
 			} else {
 				haveDirty = true
+				if fs.flags.CompressBuffers {
+					freed += inode.compressBuffer(buf, skipRecent)
+				}
 			}
 			if del >= 0 {
 				inode.buffers = append(inode.buffers[0 : del], inode.buffers[i : ]...)
@@ -560,15 +790,152 @@ func (fs *Goofys) WakeupFlusherAndWait(wait bool) {
 	fs.flusherMu.Unlock()
 }
 
+// Check if the multipart upload is in progress in one of the inodes
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) tracksUpload(key, uploadId string) bool {
+	fs.mu.RLock()
+	all := make([]*Inode, 0, len(fs.inodes))
+	for _, inode := range fs.inodes {
+		all = append(all, inode)
+	}
+	fs.mu.RUnlock()
+	for _, inode := range all {
+		inode.mu.Lock()
+		tracked := inode.mpu != nil && inode.mpu.UploadId != nil && *inode.mpu.UploadId == uploadId
+		inode.mu.Unlock()
+		if tracked {
+			return true
+		}
+	}
+	return false
+}
+
+// Writers blocked by --max-dirty-bytes resume when modified data drops
+// below this percentage of the limit
+const DIRTY_LOW_WATERMARK = 75
+
+// Account modified data not yet uploaded to the server.
+// Writers blocked by --max-dirty-bytes are woken up when it decreases
+func (fs *Goofys) addDirty(size int64) {
+	fs.metrics.addDirty(size)
+	if size < 0 && atomic.LoadInt32(&fs.dirtyWaiters) > 0 {
+		fs.dirtyMu.Lock()
+		fs.dirtyCond.Broadcast()
+		fs.dirtyMu.Unlock()
+	}
+}
+
+// Block a writer while modified data exceeds --max-dirty-bytes, until the
+// flusher uploads it below DIRTY_LOW_WATERMARK percent of the limit.
+// Only new writes wait here, flushes and reads never do, so they can't deadlock.
+// Writers also wait while flushing is paused by the user, until it's resumed
+// LOCKS_EXCLUDED(inode.mu)
+func (fs *Goofys) waitDirtyMemory() {
+	limit := int64(fs.flags.MaxDirtyBytes)
+	if limit <= 0 || atomic.LoadInt64(&fs.metrics.dirtyBytes) < limit {
+		return
+	}
+	low := limit / 100 * DIRTY_LOW_WATERMARK
+	fs.dirtyMu.Lock()
+	atomic.AddInt32(&fs.dirtyWaiters, 1)
+	// Open files are flushed too, like under memory pressure
+	atomic.AddInt32(&fs.wantFree, 1)
+	for atomic.LoadInt64(&fs.metrics.dirtyBytes) > low {
+		fs.WakeupFlusher()
+		fs.dirtyCond.Wait()
+	}
+	atomic.AddInt32(&fs.wantFree, -1)
+	atomic.AddInt32(&fs.dirtyWaiters, -1)
+	fs.dirtyMu.Unlock()
+}
+
+// Drop paths cached by Inode.cloud() after a rename or a mount change
+func (fs *Goofys) invalidateCloudPaths() {
+	atomic.AddUint64(&fs.cloudGen, 1)
+}
+
+// Wake up the flusher. Wakeups more frequent than --flush-wakeup-debounce
+// are coalesced into one delayed wakeup
 func (fs *Goofys) WakeupFlusher() {
-	fs.WakeupFlusherAndWait(false)
+	if fs.debounceFlusherWakeup() {
+		fs.WakeupFlusherAndWait(false)
+	}
+}
+
+// Check if the flusher should be woken up immediately. Otherwise a delayed
+// wakeup is scheduled, unless it's already scheduled
+func (fs *Goofys) debounceFlusherWakeup() bool {
+	debounce := int64(fs.flags.FlushWakeupDebounce)
+	if debounce <= 0 {
+		return true
+	}
+	now := fs.flushWakeupNow().UnixNano()
+	last := atomic.LoadInt64(&fs.flushWakeupTime)
+	if now-last < debounce {
+		if atomic.CompareAndSwapInt32(&fs.flushWakeupSet, 0, 1) {
+			fs.flushWakeupAfter(time.Duration(last+debounce-now), func() {
+				atomic.StoreInt64(&fs.flushWakeupTime, fs.flushWakeupNow().UnixNano())
+				atomic.StoreInt32(&fs.flushWakeupSet, 0)
+				fs.WakeupFlusherAndWait(false)
+			})
+		}
+		return false
+	}
+	atomic.StoreInt64(&fs.flushWakeupTime, now)
+	return true
+}
+
+// Take a slot for one more delete or rename of a subtree entry, or return
+// false if there are no free slots. They don't count as flushers and run in
+// parallel with them, up to --tree-op-concurrency. The slot is released
+// by finishTreeOp
+func (fs *Goofys) startTreeOp() bool {
+	limit := int64(fs.flags.TreeOpConcurrency)
+	for {
+		active := atomic.LoadInt64(&fs.activeTreeOps)
+		if active >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&fs.activeTreeOps, active, active+1) {
+			return true
+		}
+	}
+}
+
+func (fs *Goofys) finishTreeOp() {
+	atomic.AddInt64(&fs.activeTreeOps, -1)
+	// Operations skipped due to the limit should be retried
+	fs.WakeupFlusher()
+}
+
+func (fs *Goofys) treeOpSlotsFree() bool {
+	return atomic.LoadInt64(&fs.activeTreeOps) < int64(fs.flags.TreeOpConcurrency)
 }
 
-func (fs *Goofys) ScheduleRetryFlush() {
-	if atomic.CompareAndSwapInt32(&fs.flushRetrySet, 0, 1) {
-		time.AfterFunc(fs.flags.RetryInterval, func() {
-			atomic.StoreInt32(&fs.flushRetrySet, 0)
-			// Wakeup flusher after retry interval
+// Wake up the flusher after `delay` unless it's already woken up earlier.
+// Retries due later than the scheduled wakeup are rescheduled by TryFlush
+func (fs *Goofys) ScheduleRetryFlush(delay time.Duration) {
+	at := time.Now().Add(delay).UnixNano()
+	for {
+		prev := atomic.LoadInt64(&fs.flushRetryTime)
+		if prev != 0 && prev <= at {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&fs.flushRetryTime, prev, at) {
+			break
+		}
+	}
+	time.AfterFunc(delay, func() {
+		atomic.CompareAndSwapInt64(&fs.flushRetryTime, at, 0)
+		fs.WakeupFlusher()
+	})
+}
+
+// Wake up the flusher when the upload throttle is out of debt
+func (fs *Goofys) scheduleThrottledFlush(delay time.Duration) {
+	if atomic.CompareAndSwapInt32(&fs.flushThrottleSet, 0, 1) {
+		time.AfterFunc(delay, func() {
+			atomic.StoreInt32(&fs.flushThrottleSet, 0)
 			fs.WakeupFlusher()
 		})
 	}
@@ -601,13 +968,22 @@ func (fs *Goofys) Flusher() {
 			fs.flusherMu.Lock()
 			if fs.flushPending == 0 {
 				fs.flusherCond.Wait()
+				atomic.AddInt64(&fs.stats.flusherWakeups, 1)
 			}
 			fs.flushPending = 0
 			fs.flusherMu.Unlock()
 			// Repeat one more time after wakeup to scan all inodes
 			again = true
 		}
-		if atomic.LoadInt64(&fs.activeFlushers) < fs.flags.MaxFlushers {
+		if atomic.LoadInt32(&fs.flushPaused) != 0 {
+			// Flushing is paused by the user, wait until it's resumed
+			again = false
+		} else if delay := fs.uploadThrottle.Delay(); delay > 0 {
+			// Upload bandwidth is used up. Don't start new flushes until the throttle
+			// refills, running ones are slowed down by the throttle itself
+			again = false
+			fs.scheduleThrottledFlush(delay)
+		} else if atomic.LoadInt64(&fs.activeFlushers) < fs.flags.MaxFlushers || fs.treeOpSlotsFree() {
 			if len(inodes) == 0 {
 				again = false
 				fs.mu.RLock()
@@ -625,11 +1001,15 @@ func (fs *Goofys) Flusher() {
 				inode := fs.inodes[id]
 				fs.mu.RUnlock()
 				if inode != nil {
+					if atomic.LoadInt64(&fs.activeFlushers) >= fs.flags.MaxFlushers && !inode.pendingTreeOp() {
+						// Only subtree deletes and renames may be started
+						continue
+					}
 					sent := inode.TryFlush()
 					if sent {
 						atomic.AddInt64(&fs.stats.flushes, 1)
 					}
-					if atomic.LoadInt64(&fs.activeFlushers) >= fs.flags.MaxFlushers {
+					if atomic.LoadInt64(&fs.activeFlushers) >= fs.flags.MaxFlushers && !fs.treeOpSlotsFree() {
 						break
 					}
 				}
@@ -691,6 +1071,7 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 		mountInode.ToDir()
 		mountInode.dir.cloud = b.cloud
 		mountInode.dir.mountPrefix = b.prefix
+		fs.invalidateCloudPaths()
 		mountInode.AttrTime = TIME_MAX
 		mountInode.userMetadata = make(map[string][]byte)
 
@@ -710,6 +1091,7 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 		defer prev.mu.Unlock()
 		prev.dir.cloud = b.cloud
 		prev.dir.mountPrefix = b.prefix
+		fs.invalidateCloudPaths()
 		prev.AttrTime = TIME_MAX
 
 	}
@@ -762,20 +1144,40 @@ func (fs *Goofys) StatFS(
 
 	atomic.AddInt64(&fs.stats.metadataReads, 1)
 
-	const BLOCK_SIZE = 4096
+	// S3 has no real capacity, so report synthetic but consistent values
 	const TOTAL_SPACE = 1 * 1024 * 1024 * 1024 * 1024 * 1024 // 1PB
-	const TOTAL_BLOCKS = TOTAL_SPACE / BLOCK_SIZE
 	const INODES = 1 * 1000 * 1000 * 1000 // 1 billion
-	op.BlockSize = BLOCK_SIZE
-	op.Blocks = TOTAL_BLOCKS
-	op.BlocksFree = TOTAL_BLOCKS
-	op.BlocksAvailable = TOTAL_BLOCKS
+	blockSize := fs.statfsBlockSize()
+	totalBlocks := fs.flags.StatfsTotalBlocks
+	if totalBlocks == 0 {
+		totalBlocks = TOTAL_SPACE / uint64(blockSize)
+	}
+	freeBlocks := totalBlocks
+	if fs.flags.FsTotalSize != 0 {
+		totalBlocks = fs.flags.FsTotalSize / uint64(blockSize)
+		usedBlocks := atomic.LoadInt64(&fs.usedBlocks)
+		freeBlocks = 0
+		if usedBlocks >= 0 && uint64(usedBlocks) < totalBlocks {
+			freeBlocks = totalBlocks-uint64(usedBlocks)
+		}
+	}
+	op.BlockSize = blockSize
+	op.Blocks = totalBlocks
+	op.BlocksFree = freeBlocks
+	op.BlocksAvailable = freeBlocks
 	op.IoSize = 1 * 1024 * 1024 // 1MB
 	op.Inodes = INODES
 	op.InodesFree = INODES
 	return
 }
 
+func (fs *Goofys) statfsBlockSize() uint32 {
+	if fs.flags.StatfsBlockSize == 0 {
+		return 4096
+	}
+	return fs.flags.StatfsBlockSize
+}
+
 func (fs *Goofys) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
@@ -791,11 +1193,20 @@ func (fs *Goofys) GetInodeAttributes(
 		return syscall.ESTALE
 	}
 
+	if inode == fs.changeLogFile {
+		// Don't let the kernel cache the size of a growing file
+		op.Attributes = inode.controlAttributes()
+		return
+	}
+
+	// The object may be replaced by a compressed one in a listing
+	fs.fillListedAttrs(inode)
+
 	attr, err := inode.GetAttributes()
 	err = mapAwsError(err)
 	if err == nil {
 		op.Attributes = *attr
-		op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+		op.AttributesExpiration = time.Now().Add(inode.attrTTL())
 	}
 
 	return
@@ -883,6 +1294,11 @@ func (fs *Goofys) RemoveXattr(ctx context.Context,
 		return syscall.ESTALE
 	}
 
+	if inode.isVirtual() {
+		// Metadata sidecars and control files are read-only
+		return syscall.EROFS
+	}
+
 	err = inode.RemoveXattr(op.Name)
 	err = mapAwsError(err)
 	if err == syscall.EPERM {
@@ -906,6 +1322,11 @@ func (fs *Goofys) SetXattr(ctx context.Context,
 		return syscall.ESTALE
 	}
 
+	if inode.isVirtual() {
+		// Metadata sidecars and control files are read-only
+		return syscall.EROFS
+	}
+
 	if op.Name == fs.flags.RefreshAttr {
 		// Setting xattr with special name (.invalidate) refreshes the inode's cache
 		inode.mu.Lock()
@@ -1009,11 +1430,20 @@ func (fs *Goofys) CreateSymlink(ctx context.Context,
 		return syscall.ESTALE
 	}
 
+	if fs.isControlPath(parent, op.Name) {
+		return syscall.EROFS
+	}
+
+	err = parent.checkKeyLength(op.Name, false)
+	if err != nil {
+		return
+	}
+
 	inode := parent.CreateSymlink(op.Name, op.Target)
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.attrTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.attrTTL())
 	return
 }
 
@@ -1049,6 +1479,9 @@ func mapHttpError(status int) error {
 		return syscall.ENOTSUP
 	case http.StatusConflict:
 		return syscall.EINTR
+	case http.StatusPreconditionFailed:
+		// The object doesn't have the expected ETag anymore
+		return syscall.ESTALE
 	case http.StatusRequestedRangeNotSatisfiable:
 		return syscall.ERANGE
 	case 429:
@@ -1060,6 +1493,33 @@ func mapHttpError(status int) error {
 	}
 }
 
+// Check if a failed request may succeed when retried. Server errors,
+// throttling and network failures are retryable, access denied, missing
+// objects and other client errors are not
+func isRetryableError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		status := reqErr.StatusCode()
+		mapped := mapHttpError(status)
+		return mapped == syscall.EAGAIN || mapped == syscall.EINTR ||
+			mapped == nil && (status >= 500 || status == http.StatusRequestTimeout)
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "NoSuchBucket", "InvalidObjectState", "BucketRegionError":
+			return false
+		}
+		// No response from the server, i.e. a connection failure
+		return true
+	}
+	switch err {
+	case syscall.EACCES, syscall.EPERM, syscall.ENOENT, syscall.EINVAL, syscall.ENOTSUP,
+		syscall.ENXIO, syscall.EROFS, syscall.EEXIST, syscall.EFBIG, syscall.E2BIG,
+		syscall.ENAMETOOLONG, syscall.ENOSPC, syscall.EDQUOT, syscall.ERANGE:
+		return false
+	}
+	return true
+}
+
 func mapAwsError(err error) error {
 	if err == nil {
 		return nil
@@ -1074,6 +1534,9 @@ func mapAwsError(err error) error {
 			return syscall.ENXIO
 		case "BucketAlreadyOwnedByYou":
 			return fuse.EEXIST
+		case "InvalidObjectState":
+			// The object is archived and has to be restored first, see s3.restore
+			return syscall.EAGAIN
 		}
 
 		if reqErr, ok := err.(awserr.RequestFailure); ok {
@@ -1125,6 +1588,34 @@ func (fs *Goofys) LookUpInode(
 
 	atomic.AddInt64(&fs.stats.metadataReads, 1)
 
+	if handled, err := fs.lookUpControl(op); handled {
+		return err
+	}
+	if fs.isMtimeMarker(op.Name) {
+		return fuse.ENOENT
+	}
+	if fs.flags.VersionHistoryDirs {
+		fs.mu.RLock()
+		parent := fs.getInodeOrDie(op.Parent)
+		fs.mu.RUnlock()
+		if parent.versionsOf != nil {
+			return fs.lookUpVersion(parent, op)
+		}
+	}
+	err = fs.lookUpInode(ctx, op)
+	if err == fuse.ENOENT && fs.flags.MetadataSidecar && strings.HasSuffix(op.Name, METADATA_SIDECAR_SUFFIX) {
+		err = fs.lookUpSidecar(ctx, op)
+	}
+	if err == fuse.ENOENT && fs.flags.VersionHistoryDirs && strings.HasSuffix(op.Name, VERSIONS_DIR_SUFFIX) {
+		err = fs.lookUpVersionsDir(ctx, op)
+	}
+	return
+}
+
+func (fs *Goofys) lookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+
 	var inode *Inode
 	var ok bool
 	defer func() { fuseLog.Debugf("<-- LookUpInode %v %v %v", op.Parent, op.Name, err) }()
@@ -1137,7 +1628,7 @@ func (fs *Goofys) LookUpInode(
 	inode = parent.findChildUnlocked(op.Name)
 	if inode != nil {
 		ok = true
-		if expired(inode.AttrTime, fs.flags.StatCacheTTL) {
+		if expired(inode.AttrTime, inode.attrTTL()) {
 			ok = false
 			if inode.CacheState != ST_CACHED ||
 				inode.isDir() && atomic.LoadInt64(&inode.dir.ModifiedChildren) > 0 {
@@ -1160,7 +1651,12 @@ func (fs *Goofys) LookUpInode(
 				return fuse.ENOENT
 			}
 		}
-		if !expired(parent.dir.DirTime, fs.flags.StatCacheTTL) {
+		if parent.isNegCached(op.Name) {
+			// Recently not found on the server
+			parent.mu.Unlock()
+			return fuse.ENOENT
+		}
+		if !expired(parent.dir.DirTime, parent.attrTTL()) && !parent.dir.lazyEvicted {
 			// Don't recheck from the server if directory cache is actual
 			parent.mu.Unlock()
 			return fuse.ENOENT
@@ -1171,32 +1667,87 @@ func (fs *Goofys) LookUpInode(
 	if !ok {
 		inode, err = fs.recheckInode(parent, inode, op.Name)
 		err = mapAwsError(err)
+		if err == fuse.ENOENT || err == nil && inode == nil {
+			parent.mu.Lock()
+			// Don't cache names created while we were looking them up
+			if parent.findChildUnlocked(op.Name) == nil {
+				parent.addNegCache(op.Name)
+			}
+			parent.mu.Unlock()
+			return fuse.ENOENT
+		}
 		if err != nil {
 			return
 		}
-		if inode == nil {
-			return fuse.ENOENT
-		}
 	}
 
+	fs.fillListedAttrs(inode)
+
 	inode.Ref()
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.attrTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.attrTTL())
 
 	return
 }
 
+// Only HEAD tells the real size of compressed objects. Listings also don't
+// return website redirects, and redirects are empty objects
+// LOCKS_EXCLUDED(inode.mu)
+func (fs *Goofys) fillListedAttrs(inode *Inode) {
+	if fs.flags.UploadCompression == "" && !fs.flags.WebsiteRedirectSymlinks || inode.isDir() {
+		return
+	}
+	inode.mu.Lock()
+	if inode.userMetadata == nil && inode.CacheState == ST_CACHED &&
+		(fs.flags.UploadCompression != "" || inode.Attributes.Size == 0) {
+		inode.fillXattr()
+	}
+	inode.mu.Unlock()
+}
+
+type inflightLookupKey struct {
+	parent *Inode
+	name string
+}
+
+type inflightLookup struct {
+	done chan struct{}
+	inode *Inode
+	err error
+}
+
+// Only the first of concurrent callers refreshes the inode from the server,
+// others wait for it and share its result
+// LOCKS_EXCLUDED(fs.mu)
 func (fs *Goofys) recheckInode(parent *Inode, inode *Inode, name string) (newInode *Inode, err error) {
+	key := inflightLookupKey{parent, name}
+	fs.mu.Lock()
+	lookup := fs.inflightLookups[key]
+	if lookup != nil {
+		fs.mu.Unlock()
+		<-lookup.done
+		return lookup.inode, lookup.err
+	}
+	lookup = &inflightLookup{done: make(chan struct{})}
+	fs.inflightLookups[key] = lookup
+	fs.mu.Unlock()
+
 	newInode, err = parent.LookUp(name, inode == nil)
 	if err != nil {
 		if inode != nil {
 			parent.removeChild(inode)
 		}
-		return nil, err
+		newInode = nil
 	}
-	return newInode, nil
+
+	lookup.inode, lookup.err = newInode, err
+	fs.mu.Lock()
+	delete(fs.inflightLookups, key)
+	fs.mu.Unlock()
+	close(lookup.done)
+	return
 }
 
 // LOCKS_REQUIRED(parent.mu)
@@ -1221,6 +1772,14 @@ func (fs *Goofys) insertInode(parent *Inode, inode *Inode) {
 	parent.insertChildUnlocked(inode)
 	if addInode {
 		fs.inodes[inode.Id] = inode
+		// Not visible to other goroutines yet
+		inode.updateUsedBlocks()
+		if fs.evictInodes != nil && uint64(len(fs.inodes)) > fs.flags.MaxInodes {
+			select {
+			case fs.evictInodes <- struct{}{}:
+			default:
+			}
+		}
 		fs.mu.Unlock()
 
 		// if we are inserting a new directory, also create
@@ -1321,6 +1880,14 @@ func (fs *Goofys) ReadDir(
 	inode := dh.inode
 	inode.logFuse("ReadDir", op.Offset)
 
+	if inode == fs.controlDir {
+		fs.readControlDir(op)
+		return
+	}
+	if inode.versionsOf != nil {
+		return fs.readVersionsDir(inode, op)
+	}
+
 	dh.mu.Lock()
 
 	if op.Offset != 0 && op.Offset != dh.lastExternalOffset {
@@ -1347,9 +1914,28 @@ func (fs *Goofys) ReadDir(
 		dh.lastExternalOffset = 0
 		dh.lastInternalOffset = 0
 		dh.lastName = ""
+		dh.pendingSidecar = nil
+		releasePrefetch(dh.prefetch)
+		releasePrefetch(dh.xattrPrefetch)
+		dh.prefetch = nil
+		dh.xattrPrefetch = nil
 	}
 
+	var released []*Inode
 	for {
+		if dh.pendingSidecar != nil {
+			// Sidecar of the previous file didn't fit into the previous response
+			e := dh.pendingSidecar
+			e.Offset = dh.lastExternalOffset+1
+			n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], makeDirEntry(e))
+			if n == 0 {
+				break
+			}
+			op.BytesRead += n
+			dh.lastExternalOffset++
+			dh.pendingSidecar = nil
+		}
+
 		e, err := dh.ReadDir(dh.lastInternalOffset, dh.lastExternalOffset)
 		if err != nil {
 			dh.mu.Unlock()
@@ -1357,6 +1943,15 @@ func (fs *Goofys) ReadDir(
 			return err
 		}
 		if e == nil {
+			dh.startPrefetch()
+			if fs.flags.LazyDirInodes {
+				inode.mu.Lock()
+				if inode.dir.lazyEvicted {
+					// Cached listing is incomplete, the next one should go to the server
+					inode.dir.DirTime = time.Time{}
+				}
+				inode.mu.Unlock()
+			}
 			break
 		}
 
@@ -1364,6 +1959,15 @@ func (fs *Goofys) ReadDir(
 			panic(fmt.Sprintf("unset inode %v", e.Name))
 		}
 
+		if fs.isHidden(e.Name) {
+			// Skip the entry without using an external offset for it
+			if dh.lastInternalOffset >= 0 {
+				dh.lastInternalOffset++
+			}
+			dh.lastName = e.Name
+			continue
+		}
+
 		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], makeDirEntry(e))
 		if n == 0 {
 			break
@@ -1378,6 +1982,41 @@ func (fs *Goofys) ReadDir(
 		}
 		dh.lastExternalOffset++
 		dh.lastName = e.Name
+		prefetch := (fs.flags.PrefetchOnReaddir == "metadata" || fs.flags.PrefetchOnReaddir == "content") &&
+			e.Type == fuseutil.DT_File
+		xattrPrefetch := fs.flags.XattrPrefetch > 0 && e.Name != "." && e.Name != ".." &&
+			(e.Type == fuseutil.DT_Directory || e.Type == fuseutil.DT_File && fs.flags.PrefetchOnReaddir != "metadata")
+		if prefetch || xattrPrefetch {
+			fs.mu.RLock()
+			child := fs.inodes[e.Inode]
+			if child != nil && !child.isVirtual() {
+				// Released by releasePrefetch
+				if prefetch {
+					child.Ref()
+					dh.prefetch = append(dh.prefetch, child)
+				}
+				if xattrPrefetch {
+					child.Ref()
+					dh.xattrPrefetch = append(dh.xattrPrefetch, child)
+				}
+			}
+			fs.mu.RUnlock()
+		}
+		if fs.flags.MetadataSidecar {
+			dh.pendingSidecar = dh.sidecarEntry(e)
+		}
+		if fs.flags.LazyDirInodes && fs.flags.PrefetchOnReaddir != "metadata" && fs.flags.PrefetchOnReaddir != "content" &&
+			!xattrPrefetch && e.Name != "." && e.Name != ".." {
+			fs.mu.RLock()
+			child := fs.inodes[e.Inode]
+			fs.mu.RUnlock()
+			if child != nil {
+				released = append(released, child)
+			}
+		}
+	}
+	if len(released) > 0 {
+		dh.releaseListed(released)
 	}
 
 	dh.mu.Unlock()
@@ -1404,6 +2043,16 @@ func (fs *Goofys) completeInflightChange(key string) {
 	fs.mu.Unlock()
 }
 
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) addRenamedKey(key string) {
+	if fs.flags.RenameListGrace <= 0 {
+		return
+	}
+	fs.mu.Lock()
+	fs.renamedKeys[key] = time.Now().Add(fs.flags.RenameListGrace)
+	fs.mu.Unlock()
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *Goofys) addInflightListing() int {
 	fs.mu.Lock()
@@ -1413,6 +2062,16 @@ func (fs *Goofys) addInflightListing() int {
 	for k, _ := range fs.inflightChanges {
 		m[k] = true
 	}
+	if len(fs.renamedKeys) > 0 {
+		now := time.Now()
+		for k, until := range fs.renamedKeys {
+			if now.After(until) {
+				delete(fs.renamedKeys, k)
+			} else {
+				m[k] = true
+			}
+		}
+	}
 	fs.inflightListings[id] = m
 	fs.mu.Unlock()
 	return id
@@ -1465,11 +2124,12 @@ func (fs *Goofys) OpenFile(
 		return syscall.ESTALE
 	}
 
-	fh, err := in.OpenFile()
+	fh, err := in.Open(!op.OpenFlags.IsReadOnly())
 	if err != nil {
 		err = mapAwsError(err)
 		return
 	}
+	fh.direct = op.OpenFlags&syscall.O_DIRECT != 0 && !in.isVirtual()
 
 	fs.mu.Lock()
 
@@ -1582,6 +2242,15 @@ func (fs *Goofys) CreateFile(
 		return syscall.ESTALE
 	}
 
+	if fs.isControlPath(parent, op.Name) {
+		return syscall.EROFS
+	}
+
+	err = parent.checkKeyLength(op.Name, false)
+	if err != nil {
+		return
+	}
+
 	inode, fh := parent.Create(op.Name)
 
 	// Always take inode locks after fs lock if you need both...
@@ -1592,8 +2261,8 @@ func (fs *Goofys) CreateFile(
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.attrTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.attrTTL())
 
 	// Allocate a handle.
 	handleID := fs.nextHandleID
@@ -1632,6 +2301,15 @@ func (fs *Goofys) MkNode(
 		return syscall.ESTALE
 	}
 
+	if fs.isControlPath(parent, op.Name) {
+		return syscall.EROFS
+	}
+
+	err = parent.checkKeyLength(op.Name, (op.Mode & os.ModeDir) != 0)
+	if err != nil {
+		return
+	}
+
 	var inode *Inode
 	if (op.Mode & os.ModeDir) != 0 {
 		inode, err = parent.MkDir(op.Name)
@@ -1644,13 +2322,15 @@ func (fs *Goofys) MkNode(
 		inode, fh = parent.Create(op.Name)
 		fh.Release()
 	}
+	inode.mu.Lock()
 	inode.Attributes.Rdev = op.Rdev
 	inode.setFileMode(op.Mode)
+	op.Entry.Attributes = inode.InflateAttributes()
+	inode.mu.Unlock()
 
 	op.Entry.Child = inode.Id
-	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.attrTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.attrTTL())
 
 	return
 }
@@ -1670,6 +2350,15 @@ func (fs *Goofys) MkDir(
 		return syscall.ESTALE
 	}
 
+	if fs.isControlPath(parent, op.Name) {
+		return syscall.EROFS
+	}
+
+	err = parent.checkKeyLength(op.Name, true)
+	if err != nil {
+		return
+	}
+
 	// ignore op.Mode for now
 	inode, err := parent.MkDir(op.Name)
 	if err != nil {
@@ -1684,8 +2373,8 @@ func (fs *Goofys) MkDir(
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.attrTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.attrTTL())
 
 	return
 }
@@ -1705,6 +2394,10 @@ func (fs *Goofys) RmDir(
 		return syscall.ESTALE
 	}
 
+	if fs.isControlPath(parent, op.Name) {
+		return syscall.EROFS
+	}
+
 	err = parent.RmDir(op.Name)
 	err = mapAwsError(err)
 	parent.logFuse("<-- RmDir", op.Name, err)
@@ -1726,6 +2419,11 @@ func (fs *Goofys) SetInodeAttributes(
 		return syscall.ESTALE
 	}
 
+	if inode.isVirtual() {
+		// Metadata sidecars and control files are read-only
+		return syscall.EROFS
+	}
+
 	if inode.Parent == nil {
 		// chmod/chown on the root directory of mountpoint is not supported
 		return syscall.ENOTSUP
@@ -1743,7 +2441,7 @@ func (fs *Goofys) SetInodeAttributes(
 	modified := false
 
 	if op.Size != nil && inode.Attributes.Size != *op.Size {
-		if *op.Size > fs.getMaxFileSize() {
+		if *op.Size > inode.maxFileSize() {
 			// File size too large
 			log.Warnf(
 				"Maximum file size exceeded when trying to truncate %v to %v bytes",
@@ -1756,7 +2454,10 @@ func (fs *Goofys) SetInodeAttributes(
 		modified = true
 	}
 
-	if op.Mode != nil {
+	if op.Mode != nil && inode.isSymlink() {
+		// Symlink permissions aren't used, so chmod on a symlink is a no-op.
+		// Uid/gid and mtime are still saved in the symlink object metadata
+	} else if op.Mode != nil {
 		m, err := inode.setFileMode(*op.Mode)
 		if err != nil {
 			inode.mu.Unlock()
@@ -1774,9 +2475,9 @@ func (fs *Goofys) SetInodeAttributes(
 	if op.Uid != nil && fs.flags.EnablePerms && inode.Attributes.Uid != *op.Uid {
 		inode.Attributes.Uid = *op.Uid
 		if inode.Attributes.Uid != fs.flags.Uid {
-			inode.setUserMeta(fs.flags.UidAttr, []byte(fmt.Sprintf("%d", inode.Attributes.Uid)))
+			inode.setUserMeta(fs.flags.UidAttr, []byte(fmt.Sprintf("%d", mapIdToStored(fs.flags.UidMap, inode.Attributes.Uid))))
 		} else {
-			inode.setUserMeta(fs.flags.UidAttr, nil)
+			inode.resetMetadataAttr(fs.flags.UidAttr, []byte(fmt.Sprintf("%d", mapIdToStored(fs.flags.UidMap, fs.flags.Uid))))
 		}
 		modified = true
 	}
@@ -1784,9 +2485,9 @@ func (fs *Goofys) SetInodeAttributes(
 	if op.Gid != nil && fs.flags.EnablePerms && inode.Attributes.Gid != *op.Gid {
 		inode.Attributes.Gid = *op.Gid
 		if inode.Attributes.Gid != fs.flags.Gid {
-			inode.setUserMeta(fs.flags.GidAttr, []byte(fmt.Sprintf("%d", inode.Attributes.Gid)))
+			inode.setUserMeta(fs.flags.GidAttr, []byte(fmt.Sprintf("%d", mapIdToStored(fs.flags.GidMap, inode.Attributes.Gid))))
 		} else {
-			inode.setUserMeta(fs.flags.GidAttr, nil)
+			inode.resetMetadataAttr(fs.flags.GidAttr, []byte(fmt.Sprintf("%d", mapIdToStored(fs.flags.GidMap, fs.flags.Gid))))
 		}
 		modified = true
 	}
@@ -1800,11 +2501,14 @@ func (fs *Goofys) SetInodeAttributes(
 		inode.mu.Unlock()
 	}
 
+	// The object may be replaced by a compressed one in a listing
+	fs.fillListedAttrs(inode)
+
 	attr, err := inode.GetAttributes()
 	err = mapAwsError(err)
 	if err == nil {
 		op.Attributes = *attr
-		op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+		op.AttributesExpiration = time.Now().Add(inode.attrTTL())
 	}
 	return
 }
@@ -1848,6 +2552,10 @@ func (fs *Goofys) Unlink(
 		return syscall.ESTALE
 	}
 
+	if fs.isControlPath(parent, op.Name) {
+		return syscall.EROFS
+	}
+
 	err = parent.Unlink(op.Name)
 	err = mapAwsError(err)
 	return
@@ -1872,6 +2580,10 @@ func (fs *Goofys) Rename(
 		return syscall.ESTALE
 	}
 
+	if fs.isControlPath(parent, op.OldName) || fs.isControlPath(newParent, op.NewName) {
+		return syscall.EROFS
+	}
+
 	if op.OldParent == op.NewParent {
 		parent.mu.Lock()
 		defer parent.mu.Unlock()
@@ -1920,6 +2632,63 @@ func (fs *Goofys) SyncFS(parent *Inode) (err error) {
 	return
 }
 
+// Flush all changes before exiting, but give up after `timeout` (if it's not 0)
+// and report files which are not flushed yet. Returns true if everything is flushed.
+func (fs *Goofys) FlushOnUnmount(timeout time.Duration) bool {
+	if timeout <= 0 {
+		fs.SyncFS(nil)
+		return true
+	}
+	// Only one sync is started, repeated calls wait for the same sync
+	// instead of starting new goroutines on each timeout
+	fs.mu.Lock()
+	done := fs.unmountSync
+	if done == nil {
+		done = make(chan struct{})
+		fs.unmountSync = done
+		go func() {
+			fs.SyncFS(nil)
+			fs.mu.Lock()
+			fs.unmountSync = nil
+			fs.mu.Unlock()
+			close(done)
+		}()
+	}
+	fs.mu.Unlock()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	log.Errorf("Failed to flush all changes in %v, giving up", timeout)
+	fs.mu.RLock()
+	inodes := make([]*Inode, 0, len(fs.inodes))
+	for _, inode := range fs.inodes {
+		inodes = append(inodes, inode)
+	}
+	fs.mu.RUnlock()
+	for _, inode := range inodes {
+		inode.mu.Lock()
+		if inode.CacheState == ST_CREATED || inode.CacheState == ST_MODIFIED ||
+			inode.CacheState == ST_DELETED {
+			pending := uint64(0)
+			for _, b := range inode.buffers {
+				if b.dirtyID != 0 {
+					pending += b.length
+				}
+			}
+			log.Errorf("Not flushed: %v (%v bytes pending, last error: %v)",
+				inode.FullName(), pending, inode.flushError)
+			if inode.mpu != nil {
+				log.Errorf("Multipart upload %v of %v is left incomplete and will be removed"+
+					" after --multipart-age on next mount", NilStr(inode.mpu.UploadId), NilStr(inode.mpu.Key))
+			}
+		}
+		inode.mu.Unlock()
+	}
+	return false
+}
+
 const (
 	FALLOC_FL_KEEP_SIZE      = uint32(0x01)
 	FALLOC_FL_PUNCH_HOLE     = uint32(0x02)
@@ -1943,12 +2712,22 @@ func (fs *Goofys) Fallocate(
 		return syscall.ESTALE
 	}
 
+	if inode.isVirtual() {
+		// Metadata sidecars and control files are read-only
+		return syscall.EROFS
+	}
+
 	if op.Length == 0 {
 		return nil
 	}
 
 	inode.mu.Lock()
 
+	if (inode.CacheState == ST_DELETED || inode.CacheState == ST_DEAD) && !inode.openUnlinked {
+		inode.mu.Unlock()
+		return fuse.ENOENT
+	}
+
 	modified := false
 
 	if (op.Mode & (FALLOC_FL_COLLAPSE_RANGE | FALLOC_FL_INSERT_RANGE)) != 0 {
@@ -1967,7 +2746,7 @@ func (fs *Goofys) Fallocate(
 	if op.Offset+op.Length > inode.Attributes.Size {
 		if (op.Mode & FALLOC_FL_KEEP_SIZE) == 0 {
 			// Resize
-			if op.Offset+op.Length > fs.getMaxFileSize() {
+			if op.Offset+op.Length > inode.maxFileSize() {
 				// File size too large
 				log.Warnf(
 					"Maximum file size exceeded when trying to extend %v to %v bytes using fallocate",
@@ -1986,15 +2765,21 @@ func (fs *Goofys) Fallocate(
 		}
 	}
 
-	if (op.Mode & (FALLOC_FL_PUNCH_HOLE | FALLOC_FL_ZERO_RANGE)) != 0 {
-		// Zero fill
+	if (op.Mode & (FALLOC_FL_PUNCH_HOLE | FALLOC_FL_ZERO_RANGE)) != 0 && op.Length > 0 {
+		// Zero fill. It overwrites the range just like a write, so it also
+		// waits for readers flushing the file before reading it back
+		inode.checkPauseWriters()
 		mod, _ := inode.zeroRange(op.Offset, op.Length)
 		modified = modified || mod
 	}
 
-	if modified && inode.CacheState == ST_CACHED {
-		inode.SetCacheState(ST_MODIFIED)
+	if modified {
+		if inode.CacheState == ST_CACHED {
+			inode.SetCacheState(ST_MODIFIED)
+		}
 		inode.fs.WakeupFlusher()
+		inode.Attributes.Mtime = time.Now()
+		inode.Attributes.Ctime = inode.Attributes.Mtime
 	}
 
 	inode.mu.Unlock()
@@ -42,6 +42,12 @@ import (
 
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -56,6 +62,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -78,6 +85,8 @@ import (
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 
+	"github.com/klauspost/compress/zstd"
+
 	"github.com/pkg/xattr"
 
 	"github.com/sirupsen/logrus"
@@ -917,6 +926,145 @@ func (s *GoofysTest) readDirIntoCache(t *C, inode fuseops.InodeID) {
 	t.Assert(err, IsNil)
 }
 
+// Read the first page of the directory and return inode numbers of its entries
+func (s *GoofysTest) readDirInodes(t *C, inode fuseops.InodeID) map[string]fuseops.InodeID {
+	openDirOp := fuseops.OpenDirOp{Inode: inode}
+	err := s.fs.OpenDir(nil, &openDirOp)
+	t.Assert(err, IsNil)
+	defer s.fs.ReleaseDirHandle(nil, &fuseops.ReleaseDirHandleOp{Handle: openDirOp.Handle})
+	readDirOp := fuseops.ReadDirOp{
+		Inode:  inode,
+		Handle: openDirOp.Handle,
+		Dst:    make([]byte, 8*1024),
+	}
+	err = s.fs.ReadDir(nil, &readDirOp)
+	t.Assert(err, IsNil)
+	// struct fuse_dirent: ino, off, namelen, type, name padded to 8 bytes
+	res := make(map[string]fuseops.InodeID)
+	buf := readDirOp.Dst[0:readDirOp.BytesRead]
+	for len(buf) >= 24 {
+		ino := binary.LittleEndian.Uint64(buf)
+		namelen := int(binary.LittleEndian.Uint32(buf[16:]))
+		res[string(buf[24:24+namelen])] = fuseops.InodeID(ino)
+		buf = buf[(24+namelen+7)/8*8:]
+	}
+	return res
+}
+
+func (s *GoofysTest) TestReadDirSnapshot(t *C) {
+	env := map[string]*string{}
+	for i := 0; i < 40; i++ {
+		env[fmt.Sprintf("snapshot/file%02d", i)] = nil
+	}
+	s.setupBlobs(s.cloud, t, env)
+	dir, err := s.LookUpInode(t, "snapshot")
+	t.Assert(err, IsNil)
+
+	dh := dir.OpenDir()
+	defer dh.CloseDir()
+	// Same position handling as in Goofys.ReadDir()
+	readNext := func() *DirHandleEntry {
+		dh.mu.Lock()
+		defer dh.mu.Unlock()
+		en, err := dh.ReadDir(dh.lastInternalOffset, dh.lastExternalOffset)
+		t.Assert(err, IsNil)
+		if en != nil {
+			if dh.lastInternalOffset >= 0 {
+				dh.lastInternalOffset++
+			}
+			dh.lastExternalOffset++
+			dh.lastName = en.Name
+		}
+		return en
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 12; i++ {
+		en := readNext()
+		t.Assert(en, NotNil)
+		seen[en.Name] = true
+	}
+	t.Assert(seen["file09"], Equals, true)
+
+	// Modify the directory concurrently with the listing
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, fh := dir.Create(fmt.Sprintf("file%02dnew%v", i%40, i))
+			fh.Release()
+		}
+	}()
+	err = dir.Unlink("file20")
+	t.Assert(err, IsNil)
+	dir.mu.Lock()
+	err = dir.Rename("file25", dir, "file99")
+	dir.mu.Unlock()
+	t.Assert(err, IsNil)
+
+	for {
+		en := readNext()
+		if en == nil {
+			break
+		}
+		t.Assert(seen[en.Name], Equals, false)
+		seen[en.Name] = true
+	}
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		t.Assert(seen[name], Equals, i != 20 && i != 25)
+	}
+	for name := range seen {
+		t.Assert(strings.Contains(name, "new"), Equals, false)
+	}
+	// Renamed within the directory => still listed under the new name
+	t.Assert(seen["file99"], Equals, true)
+
+	// Changes are visible when listing again
+	dh2 := dir.OpenDir()
+	defer dh2.CloseDir()
+	names := nameMap(s.readDirFully(t, dh2))
+	t.Assert(names["file99"], Equals, true)
+	t.Assert(names["file00new0"], Equals, true)
+	t.Assert(names["file20"], Equals, false)
+
+	// A listing resumed at a non-zero offset uses the state at open
+	_, fh := dir.Create("zzbefore")
+	fh.Release()
+	dh3 := dir.OpenDir()
+	defer dh3.CloseDir()
+	_, fh = dir.Create("zzafter")
+	fh.Release()
+	seen = make(map[string]bool)
+	dh3.mu.Lock()
+	dh3.lastInternalOffset = 2
+	dh3.lastExternalOffset = 2
+	for {
+		en, err := dh3.ReadDir(dh3.lastInternalOffset, dh3.lastExternalOffset)
+		t.Assert(err, IsNil)
+		if en == nil {
+			break
+		}
+		seen[en.Name] = true
+		dh3.lastInternalOffset++
+		dh3.lastExternalOffset++
+		dh3.lastName = en.Name
+	}
+	dh3.mu.Unlock()
+	t.Assert(seen["zzbefore"], Equals, true)
+	t.Assert(seen["zzafter"], Equals, false)
+}
+
 func (s *GoofysTest) TestReadDirCacheLookup(t *C) {
 	s.fs.flags.StatCacheTTL = 1 * time.Minute
 
@@ -1353,6 +1501,90 @@ func (s *GoofysTest) TestReadRandom(t *C) {
 	}
 }
 
+func (s *GoofysTest) TestReadStreamingLargeFile(t *C) {
+	size := int64(30 * 1024 * 1024)
+
+	s.testWriteFile(t, "testLargeFile", size, 128*1024)
+	in, err := s.LookUpInode(t, "testLargeFile")
+	t.Assert(err, IsNil)
+
+	// Drop cached data and limit memory to much less than the file size
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+	s.fs.bufferPool.max = 10*1024*1024
+	s.fs.flags.StreamReadCutoffKB = 1
+
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	fr := &FileHandleReader{s.fs, fh, 0}
+	diff, err := CompareReader(io.LimitReader(fr, size), io.LimitReader(&SeqReader{}, size), 128*1024)
+	t.Assert(err, IsNil)
+	t.Assert(diff, Equals, -1)
+	t.Assert(fr.offset, Equals, size)
+
+	// Streamed data must not be cached
+	in.mu.Lock()
+	t.Assert(len(in.buffers), Equals, 0)
+	in.mu.Unlock()
+}
+
+func (s *GoofysTest) TestReadStreamingDuringWrite(t *C) {
+	size := int64(1024 * 1024)
+	s.testWriteFile(t, "testStreamWrite", size, 128*1024)
+	in, err := s.LookUpInode(t, "testStreamWrite")
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+	s.fs.flags.StreamReadCutoffKB = 1
+
+	// Hold the stream open until a write to the same range completes
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	var once sync.Once
+	cloud.get = func(param *GetBlobInput) (*GetBlobOutput, error) {
+		once.Do(func() {
+			close(started)
+			<-proceed
+		})
+		return cloud.StorageBackend.GetBlob(param)
+	}
+
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	var bufs [][]byte
+	var readErr error
+	readDone := make(chan struct{})
+	go func() {
+		bufs, _, readErr = fh.ReadFile(0, 64*1024)
+		close(readDone)
+	}()
+	<-started
+	wfh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	err = wfh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	wfh.Release()
+	close(proceed)
+	<-readDone
+
+	// The read must not return data older than the completed write
+	t.Assert(readErr, IsNil)
+	data := bytes.Join(bufs, nil)
+	t.Assert(len(data), Equals, 64*1024)
+	t.Assert(string(data[0:5]), Equals, "hello")
+	diff, err := CompareReader(bytes.NewReader(data[5:]), io.LimitReader(&SeqReader{5}, 64*1024-5), 0)
+	t.Assert(err, IsNil)
+	t.Assert(diff, Equals, -1)
+}
+
 func (s *GoofysTest) TestMkDir(t *C) {
 	dirName := "test_mkdir"
 	fileName := "file"
@@ -1415,6 +1647,102 @@ func (s *GoofysTest) TestRmDir(t *C) {
 	t.Assert(err, IsNil)
 }
 
+func (s *GoofysTest) TestRmDirImplicit(t *C) {
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"test_rmdir_impl/dir1/file1": nil,
+		"test_rmdir_impl/dir2/file2": nil,
+		"test_rmdir_impl/dir3/":      nil,
+	})
+
+	root, err := s.LookUpInode(t, "test_rmdir_impl")
+	t.Assert(err, IsNil)
+
+	// Implicit directory is removable after its only child is unlinked,
+	// even before the deletion of the child is flushed
+	dir1, err := s.LookUpInode(t, "test_rmdir_impl/dir1")
+	t.Assert(err, IsNil)
+	_, err = s.LookUpInode(t, "test_rmdir_impl/dir1/file1")
+	t.Assert(err, IsNil)
+	err = dir1.Unlink("file1")
+	t.Assert(err, IsNil)
+	err = root.RmDir("dir1")
+	t.Assert(err, IsNil)
+	// Nothing to delete for the directory itself
+	t.Assert(dir1.ImplicitDir, Equals, true)
+
+	// Child removed on the server, but still cached locally
+	_, err = s.LookUpInode(t, "test_rmdir_impl/dir2/file2")
+	t.Assert(err, IsNil)
+	_, err = s.cloud.DeleteBlob(&DeleteBlobInput{Key: "test_rmdir_impl/dir2/file2"})
+	t.Assert(err, IsNil)
+	err = root.RmDir("dir2")
+	t.Assert(err, IsNil)
+
+	// Not yet flushed children make the directory non-empty
+	dir3, err := s.LookUpInode(t, "test_rmdir_impl/dir3")
+	t.Assert(err, IsNil)
+	_, fh := dir3.Create("file3")
+	fh.Release()
+	err = root.RmDir("dir3")
+	t.Assert(err, Equals, fuse.ENOTEMPTY)
+	err = dir3.Unlink("file3")
+	t.Assert(err, IsNil)
+	err = root.RmDir("dir3")
+	t.Assert(err, IsNil)
+	t.Assert(dir3.ImplicitDir, Equals, false)
+
+	s.fs.SyncFS(nil)
+	resp, err := s.cloud.ListBlobs(&ListBlobsInput{Prefix: PString("test_rmdir_impl/")})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Items), Equals, 0)
+}
+
+func (s *GoofysTest) TestCloudPathCache(t *C) {
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"cloudpath_a/b/file": nil,
+	})
+	root := s.getRoot(t)
+	file, err := s.LookUpInode(t, "cloudpath_a/b/file")
+	t.Assert(err, IsNil)
+	_, key := file.cloud()
+	t.Assert(key, Equals, "cloudpath_a/b/file")
+
+	// Renaming a parent directory changes the key
+	err = root.Rename("cloudpath_a", root, "cloudpath_x")
+	t.Assert(err, IsNil)
+	_, key = file.cloud()
+	t.Assert(key, Equals, "cloudpath_x/b/file")
+	_, key = file.Parent.cloud()
+	t.Assert(key, Equals, "cloudpath_x/b")
+}
+
+func (s *GoofysTest) deepTree(t *C, depth int) *Inode {
+	in := s.getRoot(t)
+	for i := 0; i < depth; i++ {
+		dir := NewInode(s.fs, in, fmt.Sprintf("deep%v", i))
+		dir.ToDir()
+		in = dir
+	}
+	return NewInode(s.fs, in, "file")
+}
+
+func (s *GoofysTest) BenchmarkCloudDeepTree(t *C) {
+	file := s.deepTree(t, 64)
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		file.cloud()
+	}
+}
+
+func (s *GoofysTest) BenchmarkCloudDeepTreeUncached(t *C) {
+	file := s.deepTree(t, 64)
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		s.fs.invalidateCloudPaths()
+		file.cloud()
+	}
+}
+
 func (s *GoofysTest) TestRenamePreserveMetadata(t *C) {
 	if _, ok := s.cloud.(*ADLv1); ok {
 		t.Skip("ADLv1 doesn't support metadata")
@@ -1564,6 +1892,61 @@ func (s *GoofysTest) TestRenameOpenedUnmodified(t *C) {
 	t.Assert(err, IsNil)
 }
 
+func (s *GoofysTest) TestRenameThenModify(t *C) {
+	root := s.getRoot(t)
+
+	in, fh := root.Create("renamedirty1")
+	err := fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// Rename the file with unflushed changes and modify it again
+	err = fh.WriteFile(5, []byte(" world"), true)
+	t.Assert(err, IsNil)
+	err = root.Rename("renamedirty1", root, "renamedirty2")
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(11, []byte("!"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "renamedirty1"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "renamedirty2"})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "hello world!")
+}
+
+func (s *GoofysTest) TestStatFSBlockSize(t *C) {
+	op := &fuseops.StatFSOp{}
+	err := s.fs.StatFS(nil, op)
+	t.Assert(err, IsNil)
+	t.Assert(op.BlockSize, Equals, uint32(4096))
+	t.Assert(op.Blocks, Equals, uint64(1024*1024*1024*1024*1024/4096))
+
+	statfsBlockSize := s.fs.flags.StatfsBlockSize
+	statfsTotalBlocks := s.fs.flags.StatfsTotalBlocks
+	s.fs.flags.StatfsBlockSize = 65536
+	s.fs.flags.StatfsTotalBlocks = 1000
+	defer func() {
+		s.fs.flags.StatfsBlockSize = statfsBlockSize
+		s.fs.flags.StatfsTotalBlocks = statfsTotalBlocks
+	}()
+	op = &fuseops.StatFSOp{}
+	err = s.fs.StatFS(nil, op)
+	t.Assert(err, IsNil)
+	t.Assert(op.BlockSize, Equals, uint32(65536))
+	t.Assert(op.Blocks, Equals, uint64(1000))
+	t.Assert(op.BlocksFree, Equals, uint64(1000))
+	t.Assert(op.BlocksAvailable, Equals, uint64(1000))
+}
+
 func (s *GoofysTest) TestBackendListPagination(t *C) {
 	if _, ok := s.cloud.(*ADLv1); ok {
 		t.Skip("ADLv1 doesn't have pagination")
@@ -1875,7 +2258,7 @@ func (s *GoofysTest) TestRename(t *C) {
 		if !hasEnv("GCS") {
 			// not really rename but can be used by rename
 			from, to = s.fs.bucket+"/file2", "new_file"
-			_, err = s3.copyObjectMultipart(int64(len("file2")), from, to, "", nil, nil, nil)
+			_, _, err = s3.copyObjectMultipart(int64(len("file2")), from, to, "", nil, nil, nil, nil)
 			t.Assert(err, IsNil)
 		}
 	}
@@ -1924,6 +2307,81 @@ func (s *GoofysTest) TestConcurrentRefDeref(t *C) {
 	}
 }
 
+func (s *GoofysTest) TestConcurrentTruncateWrite(t *C) {
+	const size = 1024*1024
+	const newSize = 100*1024
+	const writeOffset = size + 512*1024
+	orig := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	tail := bytes.Repeat([]byte("x"), 100*1024)
+
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("truncwrite%v", i)
+		_, err := s.cloud.PutBlob(&PutBlobInput{
+			Key:  name,
+			Body: bytes.NewReader(orig),
+			Size: PUInt64(size),
+		})
+		t.Assert(err, IsNil)
+		in, err := s.LookUpInode(t, name)
+		t.Assert(err, IsNil)
+		fh, err := in.OpenFile()
+		t.Assert(err, IsNil)
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			// Loads the part of the file being truncated from the server
+			fh.ReadFile(size-200*1024, 200*1024)
+		}()
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				runtime.Gosched()
+			}
+			err := s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{
+				Inode: in.Id,
+				Size:  PUInt64(newSize),
+			})
+			t.Assert(err, IsNil)
+		}()
+		go func() {
+			defer wg.Done()
+			if i%3 == 0 {
+				runtime.Gosched()
+			}
+			err := fh.WriteFile(writeOffset, tail, true)
+			t.Assert(err, IsNil)
+		}()
+		wg.Wait()
+
+		// Buffers must not overlap or exceed the file size
+		in.mu.Lock()
+		pos := uint64(0)
+		for _, b := range in.buffers {
+			t.Assert(b.offset >= pos, Equals, true)
+			pos = b.offset + b.length
+		}
+		t.Assert(pos <= in.Attributes.Size, Equals, true)
+		in.mu.Unlock()
+
+		err = in.SyncFile()
+		t.Assert(err, IsNil)
+		fh.Release()
+
+		// Either write happened after truncate or truncate happened after write
+		afterTruncate := append(append(append([]byte{}, orig[0:newSize]...),
+			make([]byte, writeOffset-newSize)...), tail...)
+		afterWrite := orig[0:newSize]
+		resp, err := s.cloud.GetBlob(&GetBlobInput{Key: name})
+		t.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Assert(err, IsNil)
+		t.Assert(bytes.Equal(data, afterTruncate) || bytes.Equal(data, afterWrite), Equals, true)
+	}
+}
+
 func hasEnv(env string) bool {
 	v := os.Getenv(env)
 
@@ -2089,6 +2547,58 @@ func (s *GoofysTest) testExplicitDir(t *C) {
 	t.Assert(err, IsNil)
 }
 
+func (s *GoofysTest) testFileDirCollision(t *C, mode string) *Inode {
+	if s.cloud.Capabilities().DirBlob {
+		t.Skip("only for backends without dir blob")
+	}
+	s.fs.flags.FileDirCollision = mode
+	s.fs.flags.CollisionSuffix = ".~file"
+	prefix := "collision-"+mode
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		prefix+"/foo": nil,
+		prefix+"/foo/bar": nil,
+	})
+
+	// Lookup without a cached listing
+	in, err := s.LookUpInode(t, prefix+"/foo")
+	t.Assert(err, IsNil)
+	t.Assert(in.isDir(), Equals, mode != "file")
+
+	dir, err := s.LookUpInode(t, prefix)
+	t.Assert(err, IsNil)
+	return dir
+}
+
+func (s *GoofysTest) TestFileDirCollisionPreferDir(t *C) {
+	dir := s.testFileDirCollision(t, "dir")
+	s.assertEntries(t, dir, []string{"foo"})
+	t.Assert(dir.findChild("foo").isDir(), Equals, true)
+	s.assertEntries(t, dir.findChild("foo"), []string{"bar"})
+}
+
+func (s *GoofysTest) TestFileDirCollisionPreferFile(t *C) {
+	dir := s.testFileDirCollision(t, "file")
+	s.assertEntries(t, dir, []string{"foo"})
+	t.Assert(dir.findChild("foo").isDir(), Equals, false)
+}
+
+func (s *GoofysTest) TestFileDirCollisionEscape(t *C) {
+	dir := s.testFileDirCollision(t, "escape")
+	s.assertEntries(t, dir, []string{"foo", "foo.~file"})
+	t.Assert(dir.findChild("foo").isDir(), Equals, true)
+
+	file, err := s.LookUpInode(t, "collision-escape/foo.~file")
+	t.Assert(err, IsNil)
+	t.Assert(file.isDir(), Equals, false)
+	fh, err := file.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	bufs, nread, err := fh.ReadFile(0, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, len("collision-escape/foo"))
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "collision-escape/foo")
+}
+
 func (s *GoofysTest) TestBenchLs(t *C) {
 	s.fs.flags.StatCacheTTL = 1 * time.Minute
 	mountPoint := s.tmp + "/mnt" + s.fs.bucket
@@ -2271,6 +2781,60 @@ func (s *GoofysTest) TestBucketPrefixSlash(t *C) {
 	t.Assert(s.getRoot(t).dir.mountPrefix, Equals, "dir2/")
 }
 
+func (s *GoofysTest) TestMissingBucket(t *C) {
+	bucket := "goofys-test-" + RandStringBytesMaskImprSrc(16)
+	cloud := s.newBackend(t, bucket, false)
+	newBackend := func(string, *FlagStorage) (StorageBackend, error) {
+		return cloud, nil
+	}
+
+	// Mount fails right away
+	fs := newGoofys(context.Background(), bucket, s.fs.flags, newBackend)
+	t.Assert(fs, IsNil)
+
+	createBucket := s.fs.flags.CreateBucket
+	s.fs.flags.CreateBucket = true
+	defer func() { s.fs.flags.CreateBucket = createBucket }()
+	fs = newGoofys(context.Background(), bucket, s.fs.flags, newBackend)
+	t.Assert(fs, NotNil)
+	s.removeBucket = append(s.removeBucket, cloud)
+
+	_, err := cloud.ListBlobs(&ListBlobsInput{})
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestRootMtime(t *C) {
+	// Empty prefix without a directory object
+	before := time.Now()
+	s.fs = NewGoofys(context.Background(), s.fs.bucket+":emptyroot", s.fs.flags)
+	t.Assert(s.fs, NotNil)
+	attr := fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	err := s.fs.GetInodeAttributes(nil, &attr)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Attributes.Mtime.Before(before.Add(-time.Second)), Equals, false)
+	t.Assert(attr.Attributes.Ctime.Before(before.Add(-time.Second)), Equals, false)
+
+	// Modification time of the prefix directory object
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "rootmarker/",
+		Body: bytes.NewReader([]byte{}),
+		Size: PUInt64(0),
+	})
+	t.Assert(err, IsNil)
+	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "rootmarker/"})
+	t.Assert(err, IsNil)
+	rootMtime := s.fs.flags.RootMtime
+	s.fs.flags.RootMtime = "marker"
+	defer func() {
+		s.fs.flags.RootMtime = rootMtime
+	}()
+	s.fs = NewGoofys(context.Background(), s.fs.bucket+":rootmarker", s.fs.flags)
+	t.Assert(s.fs, NotNil)
+	err = s.fs.GetInodeAttributes(nil, &attr)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Attributes.Mtime.Equal(*resp.LastModified), Equals, true)
+}
+
 func (s *GoofysTest) TestFuseWithPrefix(t *C) {
 	mountPoint := s.tmp + "/mnt" + s.fs.bucket
 
@@ -2890,20 +3454,115 @@ func (s *GoofysTest) TestXAttrSet(t *C) {
 	t.Assert(err, Equals, syscall.EPERM)
 }
 
-func (s *GoofysTest) TestPythonCopyTree(t *C) {
-	s.clearPrefix(t, s.cloud, "dir5")
+func (s *GoofysTest) TestXAttrMetadataLimit(t *C) {
+	s.fs.flags.MaxMetadataSize = 32
+	in, fh := s.getRoot(t).Create("testMetaLimit")
+	defer fh.Release()
 
-	mountPoint := s.tmp + "/mnt" + s.fs.bucket
+	err := in.SetXattr("user.a", bytes.Repeat([]byte("x"), 20), 0)
+	t.Assert(err, IsNil)
+	err = in.SetXattr("user.b", bytes.Repeat([]byte("x"), 20), 0)
+	t.Assert(err, Equals, syscall.E2BIG)
+	// Old value of the replaced xattr isn't counted
+	err = in.SetXattr("user.a", bytes.Repeat([]byte("x"), 30), 0)
+	t.Assert(err, IsNil)
+	// Size is checked after escaping
+	err = in.SetXattr("user.a", bytes.Repeat([]byte("%"), 11), 0)
+	t.Assert(err, Equals, syscall.E2BIG)
 
-	s.runFuseTest(t, mountPoint, true, "python", "-c",
-		"import shutil; shutil.copytree('dir2', 'dir5')",
-		mountPoint)
+	value, err := in.GetXattr("user.a")
+	t.Assert(err, IsNil)
+	t.Assert(len(value), Equals, 30)
+	_, err = in.GetXattr("user.b")
+	t.Assert(err, Equals, syscall.ENODATA)
+
+	// 0 means the limit of the backend
+	s.fs.flags.MaxMetadataSize = 0
+	in.mu.Lock()
+	cloud, _ := in.cloud()
+	t.Assert(in.maxMetadataSize(), Equals, cloud.Capabilities().MaxMetadataSize)
+	in.mu.Unlock()
 }
 
-func (s *GoofysTest) TestCreateRenameBeforeCloseFuse(t *C) {
-	if s.azurite {
-		// Azurite returns 400 when copy source doesn't exist
-		// https://github.com/Azure/Azurite/issues/219
+func (s *GoofysTest) TestXAttrValueLimit(t *C) {
+	maxXattrValueSize := s.fs.flags.MaxXattrValueSize
+	s.fs.flags.MaxXattrValueSize = 16
+	defer func() { s.fs.flags.MaxXattrValueSize = maxXattrValueSize }()
+	in, fh := s.getRoot(t).Create("testXattrValueLimit")
+	defer fh.Release()
+
+	err := in.SetXattr("user.a", bytes.Repeat([]byte("x"), 16), 0)
+	t.Assert(err, IsNil)
+	err = in.SetXattr("user.b", bytes.Repeat([]byte("x"), 17), 0)
+	t.Assert(err, Equals, syscall.E2BIG)
+	// Size is checked after escaping
+	err = in.SetXattr("user.a", bytes.Repeat([]byte{1}, 6), 0)
+	t.Assert(err, Equals, syscall.E2BIG)
+
+	value, err := in.GetXattr("user.a")
+	t.Assert(err, IsNil)
+	t.Assert(len(value), Equals, 16)
+	_, err = in.GetXattr("user.b")
+	t.Assert(err, Equals, syscall.ENODATA)
+
+	// Backend default applies when the limit isn't set
+	s.fs.flags.MaxXattrValueSize = 0
+	if limit := s.cloud.Capabilities().MaxXattrValueSize; limit > 0 {
+		err = in.SetXattr("user.b", bytes.Repeat([]byte("x"), limit+1), 0)
+		t.Assert(err, Equals, syscall.E2BIG)
+	}
+}
+
+func (s *GoofysTest) TestXAttrNamespaces(t *C) {
+	if _, ok := s.cloud.(*ADLv1); ok {
+		t.Skip("ADLv1 doesn't support metadata")
+	}
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	// Other namespaces are forbidden by default
+	err = in.SetXattr("security.selinux", []byte("label"), 0)
+	t.Assert(err, Equals, syscall.EPERM)
+
+	s.fs.flags.XattrNamespaces = map[string]string{"security": "security."}
+
+	err = in.SetXattr("security.selinux", []byte("label"), 0)
+	t.Assert(err, IsNil)
+
+	value, err := in.GetXattr("security.selinux")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "label")
+
+	names, err := in.ListXattr()
+	t.Assert(err, IsNil)
+	t.Assert(names, includes{}, "security.selinux")
+
+	_, err = in.GetXattr("trusted.foo")
+	t.Assert(err, Equals, unix.ENOSYS)
+
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "file1"})
+	t.Assert(err, IsNil)
+	t.Assert(unescapeMetadata(resp.Metadata)["security.selinux"], DeepEquals, []byte("label"))
+}
+
+func (s *GoofysTest) TestPythonCopyTree(t *C) {
+	s.clearPrefix(t, s.cloud, "dir5")
+
+	mountPoint := s.tmp + "/mnt" + s.fs.bucket
+
+	s.runFuseTest(t, mountPoint, true, "python", "-c",
+		"import shutil; shutil.copytree('dir2', 'dir5')",
+		mountPoint)
+}
+
+func (s *GoofysTest) TestCreateRenameBeforeCloseFuse(t *C) {
+	if s.azurite {
+		// Azurite returns 400 when copy source doesn't exist
+		// https://github.com/Azure/Azurite/issues/219
 		// so our code to ignore ENOENT fails
 		t.Skip("https://github.com/Azure/Azurite/issues/219")
 	}
@@ -3765,7 +4424,7 @@ func (s *GoofysTest) TestVFS(t *C) {
 	defer resp.Body.Close()
 
 	err = s.getRoot(t).Rename("file1", in, "file2")
-	t.Assert(err, Equals, syscall.EINVAL)
+	t.Assert(err, Equals, syscall.EXDEV)
 
 	subdir, err := in.MkDir("subdir")
 	t.Assert(err, IsNil)
@@ -4396,6 +5055,428 @@ func (c includes) Check(params []interface{}, names []string) (res bool, error s
 	return
 }
 
+func (s *GoofysTest) TestPauseFlush(t *C) {
+	root := s.getRoot(t)
+
+	err := root.SetXattr("geesefs.pause-flush", []byte("1"), 0)
+	t.Assert(err, IsNil)
+
+	in, fh := root.Create("paused")
+	err = fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	s.fs.WakeupFlusher()
+	time.Sleep(time.Second)
+
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "paused"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+
+	value, err := root.GetXattr("geesefs.pause-flush")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "1")
+	value, err = root.GetXattr("geesefs.flush-pending")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "inodes=1 bytes=5")
+
+	err = root.SetXattr("geesefs.pause-flush", []byte("0"), 0)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "paused"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Size, Equals, uint64(5))
+}
+
+func (s *GoofysTest) TestFlushOnUnmountTimeout(t *C) {
+	root := s.getRoot(t)
+	s.fs.PauseFlush(true)
+
+	in, fh := root.Create("unmountTimeout")
+	err := fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	t.Assert(s.fs.FlushOnUnmount(500*time.Millisecond), Equals, false)
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "unmountTimeout"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+
+	// Repeated timeouts wait for the same sync
+	s.fs.mu.RLock()
+	sync1 := s.fs.unmountSync
+	s.fs.mu.RUnlock()
+	t.Assert(sync1, NotNil)
+	t.Assert(s.fs.FlushOnUnmount(100*time.Millisecond), Equals, false)
+	s.fs.mu.RLock()
+	sync2 := s.fs.unmountSync
+	s.fs.mu.RUnlock()
+	t.Assert(sync2 == sync1, Equals, true)
+
+	s.fs.PauseFlush(false)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.FlushOnUnmount(5*time.Second), Equals, true)
+	s.fs.mu.RLock()
+	t.Assert(s.fs.unmountSync, IsNil)
+	s.fs.mu.RUnlock()
+}
+
+func (s *GoofysTest) TestProgressXattrs(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+
+	value, err := in.GetXattr("geesefs.read-progress")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "cached=0 size=5")
+	_, _, err = fh.ReadFile(0, 5)
+	t.Assert(err, IsNil)
+	value, err = in.GetXattr("geesefs.read-progress")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "cached=5 size=5")
+
+	value, err = in.GetXattr(FLUSH_PROGRESS_XATTR)
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "0/0,state=cached,parts=0,flushing=false")
+	// Don't let the flusher start before checking the progress
+	s.fs.PauseFlush(true)
+	err = fh.WriteFile(5, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	value, err = in.GetXattr(FLUSH_PROGRESS_XATTR)
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "0/5,state=modified,parts=0,flushing=false")
+	s.fs.PauseFlush(false)
+	fh.Release()
+
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	value, err = in.GetXattr(FLUSH_PROGRESS_XATTR)
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "0/0,state=cached,parts=0,flushing=false")
+
+	// Flush progress is read-only and isn't object metadata
+	err = in.SetXattr(FLUSH_PROGRESS_XATTR, []byte("1/1"), 0)
+	t.Assert(err, Equals, syscall.EPERM)
+	err = in.RemoveXattr(FLUSH_PROGRESS_XATTR)
+	t.Assert(err, Equals, syscall.EPERM)
+	names, err := in.ListXattr()
+	t.Assert(err, IsNil)
+	for _, name := range names {
+		t.Assert(name, Not(Equals), FLUSH_PROGRESS_XATTR)
+	}
+	in.mu.Lock()
+	t.Assert(in.CacheState, Equals, ST_CACHED)
+	in.mu.Unlock()
+
+	_, err = s.getRoot(t).GetXattr("geesefs.read-progress")
+	t.Assert(err, Equals, syscall.ENODATA)
+	_, err = s.getRoot(t).GetXattr(FLUSH_PROGRESS_XATTR)
+	t.Assert(err, Equals, syscall.ENODATA)
+}
+
+func (s *GoofysTest) TestBytesTransferredXattrs(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+	_, _, err = fh.ReadFile(0, 5)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	value, err := in.GetXattr("geesefs.bytes-read")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "5")
+	value, err = in.GetXattr("geesefs.bytes-written")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "0")
+
+	in, fh = s.getRoot(t).Create("bytesWritten")
+	err = fh.WriteFile(0, []byte("hello world"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	value, err = in.GetXattr("geesefs.bytes-written")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "11")
+}
+
+func (s *GoofysTest) TestReadPastEOF(t *C) {
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+
+	// Read spanning EOF returns only the valid part
+	bufs, nread, err := fh.ReadFile(3, 100)
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, 2)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "e1")
+	t.Assert(len(cloud.Gets()) > 0, Equals, true)
+	for _, req := range cloud.Gets() {
+		t.Assert(req.Start+req.Count <= 5, Equals, true)
+	}
+
+	// Reads at and beyond EOF don't touch the server
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+	cloud.ResetCalls()
+	for _, offset := range []int64{5, 6, 4096} {
+		_, nread, err = fh.ReadFile(offset, 100)
+		t.Assert(err, IsNil)
+		t.Assert(nread, Equals, 0)
+	}
+	t.Assert(len(cloud.Gets()), Equals, 0)
+}
+
+func (s *GoofysTest) TestFlushPartRetry(t *C) {
+	s.fs.flags.PartRetries = 1
+	root := s.getRoot(t)
+	// Fail the first upload of part 2 after consuming a part of its body
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var failed bool
+	var retryMD5, retryETag string
+	cloud.mpuAdd = func(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+		if param.PartNumber != 2 {
+			return cloud.StorageBackend.MultipartBlobAdd(param)
+		}
+		if !failed {
+			failed = true
+			io.CopyN(ioutil.Discard, param.Body, 1024)
+			return nil, syscall.ECONNRESET
+		}
+		data, err := ioutil.ReadAll(param.Body)
+		if err != nil {
+			return nil, err
+		}
+		sum := md5.Sum(data)
+		retryMD5 = hex.EncodeToString(sum[:])
+		param.Body = bytes.NewReader(data)
+		resp, err := cloud.StorageBackend.MultipartBlobAdd(param)
+		if err == nil {
+			retryETag = strings.Trim(NilStr(resp.PartId), "\"")
+		}
+		return resp, err
+	}
+	root.dir.cloud = cloud
+
+	size := int64(12*1024*1024)
+	fh := s.testCreateAndWrite(t, "testFlushPartRetry", size, 128*1024, true)
+	err := fh.inode.SyncFile()
+	t.Assert(err, IsNil)
+	fh.Release()
+	t.Assert(failed, Equals, true)
+
+	// Part 2 is bytes 5-10 MB of SeqReader
+	expected, err := ioutil.ReadAll(io.LimitReader(&SeqReader{5*1024*1024}, 5*1024*1024))
+	t.Assert(err, IsNil)
+	sum := md5.Sum(expected)
+	t.Assert(retryMD5, Equals, hex.EncodeToString(sum[:]))
+	if _, ok := s.cloud.(*S3Backend); ok {
+		t.Assert(retryETag, Equals, retryMD5)
+	}
+
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "testFlushPartRetry"})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	t.Assert(resp.Size, Equals, uint64(size))
+	diff, err := CompareReader(resp.Body, io.LimitReader(&SeqReader{0}, size), 0)
+	t.Assert(err, IsNil)
+	t.Assert(diff, Equals, -1)
+}
+
+func (s *GoofysTest) TestMergeLastPart(t *C) {
+	s.fs.flags.MergeLastPartKB = 1024
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+
+	for _, c := range []struct {
+		size    int64
+		puts    int
+		uploads int
+	}{
+		// Barely over --single-part
+		{5*1024*1024 + 100*1024, 1, 0},
+		{5*1024*1024 + 1024*1024 + 1, 0, 2},
+		// Tiny last part is merged into the previous one
+		{10*1024*1024 + 100*1024, 0, 2},
+		{10*1024*1024 + 2*1024*1024, 0, 3},
+	} {
+		cloud.ResetCalls()
+		name := fmt.Sprintf("testMergeLastPart%v", c.size)
+		// Don't upload parts while the file is written
+		atomic.StoreInt32(&s.fs.flushPaused, 1)
+		fh := s.testCreateAndWrite(t, name, c.size, 128*1024, true)
+		atomic.StoreInt32(&s.fs.flushPaused, 0)
+		in := fh.inode
+		fh.Release()
+		err := in.SyncFile()
+		t.Assert(err, IsNil)
+		t.Assert(cloud.Calls("PutBlob"), Equals, c.puts)
+		t.Assert(cloud.Calls("MultipartBlobAdd"), Equals, c.uploads)
+
+		resp, err := s.cloud.GetBlob(&GetBlobInput{Key: name})
+		t.Assert(err, IsNil)
+		t.Assert(resp.Size, Equals, uint64(c.size))
+		diff, err := CompareReader(resp.Body, io.LimitReader(&SeqReader{0}, c.size), 0)
+		resp.Body.Close()
+		t.Assert(err, IsNil)
+		t.Assert(diff, Equals, -1)
+	}
+}
+
+func (s *GoofysTest) TestMergeLastPartUploaded(t *C) {
+	s.fs.flags.MergeLastPartKB = 1024
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+
+	// The previous part is uploaded while the file is open
+	size := int64(10*1024*1024)
+	fh := s.testCreateAndWrite(t, "testMergeLastPartUploaded", size, 128*1024, true)
+	in := fh.inode
+	for i := 0; ; i++ {
+		in.mu.Lock()
+		uploaded := in.mpu != nil && in.mpu.Parts[1] != nil
+		in.mu.Unlock()
+		if uploaded {
+			break
+		}
+		t.Assert(i < 100, Equals, true)
+		s.fs.WakeupFlusherAndWait(true)
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Assert(cloud.Calls("MultipartBlobAdd"), Equals, 2)
+
+	// The tiny last part is then uploaded on its own, not with the previous one again
+	data := make([]byte, 100*1024)
+	_, err := io.ReadFull(&SeqReader{size}, data)
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(size, data, true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(cloud.Calls("MultipartBlobAdd"), Equals, 3)
+
+	size += int64(len(data))
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "testMergeLastPartUploaded"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Size, Equals, uint64(size))
+	diff, err := CompareReader(resp.Body, io.LimitReader(&SeqReader{0}, size), 0)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(diff, Equals, -1)
+}
+
+func (s *GoofysTest) TestCompleteMultipartRejectedPart(t *C) {
+	root := s.getRoot(t)
+	// Reject part 2 during the first completion of the upload
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	uploads := make(map[uint32]int)
+	rejected := false
+	cloud.mpuAdd = func(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+		cloud.mu.Lock()
+		uploads[param.PartNumber]++
+		cloud.mu.Unlock()
+		return cloud.StorageBackend.MultipartBlobAdd(param)
+	}
+	cloud.mpuCommit = func(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+		if !rejected {
+			rejected = true
+			return nil, &MultipartPartsRejectedError{
+				Parts: []MPUPart{{Num: 2, ETag: NilStr(param.Parts[1])}},
+				Err:   fmt.Errorf("InvalidPart"),
+			}
+		}
+		return cloud.StorageBackend.MultipartBlobCommit(param)
+	}
+	root.dir.cloud = cloud
+
+	size := int64(12*1024*1024)
+	fh := s.testCreateAndWrite(t, "testRejectedPart", size, 128*1024, true)
+	in := fh.inode
+	fh.Release()
+	err := in.SyncFile()
+	t.Assert(err, NotNil)
+	t.Assert(rejected, Equals, true)
+
+	in.mu.Lock()
+	in.flushError = nil
+	in.mu.Unlock()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// Only the rejected part is uploaded again
+	t.Assert(uploads[1], Equals, 1)
+	t.Assert(uploads[2], Equals, 2)
+	t.Assert(uploads[3], Equals, 1)
+
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "testRejectedPart"})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	t.Assert(resp.Size, Equals, uint64(size))
+	diff, err := CompareReader(resp.Body, io.LimitReader(&SeqReader{0}, size), 0)
+	t.Assert(err, IsNil)
+	t.Assert(diff, Equals, -1)
+}
+
+func (s *GoofysTest) TestMaxInodes(t *C) {
+	env := map[string]*string{}
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		env["maxinodes/"+name] = nil
+		names = append(names, name)
+	}
+	s.setupBlobs(s.cloud, t, env)
+
+	dir, err := s.LookUpInode(t, "maxinodes")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir, names)
+
+	opened, err := s.LookUpInode(t, "maxinodes/file05")
+	t.Assert(err, IsNil)
+	fh, err := opened.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	s.fs.mu.RLock()
+	count := uint64(len(s.fs.inodes))
+	s.fs.mu.RUnlock()
+	s.fs.flags.MaxInodes = count-10
+	evicted := s.fs.EvictInodes()
+	t.Assert(evicted > 0, Equals, true)
+
+	s.fs.mu.RLock()
+	t.Assert(uint64(len(s.fs.inodes)) <= s.fs.flags.MaxInodes, Equals, true)
+	t.Assert(s.fs.inodes[dir.Id], Equals, dir)
+	t.Assert(s.fs.inodes[opened.Id], Equals, opened)
+	s.fs.mu.RUnlock()
+
+	// Evicted entries are listed from the server again
+	s.assertEntries(t, dir, names)
+}
+
 func (s *GoofysTest) TestWriteUnlinkFlush(t *C) {
 	root := s.getRoot(t)
 
@@ -4742,3 +5823,4650 @@ func (s *GoofysTest) testNotifyRefresh(t *C, testInSubdir bool, testRefreshDir b
 
 	t.Assert(containsFile(testdir, "testnotify"), Equals, false)
 }
+
+func (s *GoofysTest) TestReadDuringCacheDrop(t *C) {
+	oldData := bytes.Repeat([]byte("a"), 64*1024)
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "cachedrop",
+		Body: bytes.NewReader(oldData),
+		Size: PUInt64(uint64(len(oldData))),
+	})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	// Hold the first GET until released
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var blocked int32
+	cloud.get = func(param *GetBlobInput) (*GetBlobOutput, error) {
+		resp, err := cloud.StorageBackend.GetBlob(param)
+		if err != nil || !atomic.CompareAndSwapInt32(&blocked, 0, 1) {
+			return resp, err
+		}
+		// Read the data before signaling so it's definitely the old version
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		close(started)
+		<-release
+		return resp, nil
+	}
+	root.dir.cloud = cloud
+
+	in, err := s.LookUpInode(t, "cachedrop")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	type readResult struct {
+		data []byte
+		err  error
+	}
+	result := make(chan readResult)
+	go func() {
+		bufs, nread, err := fh.ReadFile(0, int64(len(oldData)))
+		data := bytes.Join(bufs, nil)
+		if err == nil && nread != len(data) {
+			err = fmt.Errorf("nread %v != %v", nread, len(data))
+		}
+		result <- readResult{data, err}
+	}()
+
+	// Change the object remotely while the first request is in flight
+	<-started
+	newData := bytes.Repeat([]byte("b"), 48*1024)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "cachedrop",
+		Body: bytes.NewReader(newData),
+		Size: PUInt64(uint64(len(newData))),
+	})
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "cachedrop"})
+	t.Assert(err, IsNil)
+	in.SetFromBlobItem(&head.BlobItemOutput)
+	close(release)
+
+	// The read must restart against the new version instead of mixing both
+	res := <-result
+	t.Assert(res.err, IsNil)
+	t.Assert(len(res.data), Equals, len(newData))
+	t.Assert(bytes.Equal(res.data, newData), Equals, true)
+
+	// Old data must not end up in the cache
+	bufs, _, err := fh.ReadFile(0, int64(len(newData)))
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(bytes.Join(bufs, nil), newData), Equals, true)
+}
+
+func (s *GoofysTest) TestWebsiteRedirectSymlinks(t *C) {
+	websiteRedirectSymlinks := s.fs.flags.WebsiteRedirectSymlinks
+	s.fs.flags.WebsiteRedirectSymlinks = true
+	defer func() {
+		s.fs.flags.WebsiteRedirectSymlinks = websiteRedirectSymlinks
+	}()
+	root := s.getRoot(t)
+
+	// Only absolute targets may be stored as redirects
+	link := NewInode(s.fs, root, "redirect_link")
+	link.userMetadata = map[string][]byte{
+		s.fs.flags.SymlinkAttr: []byte("/index.html"),
+	}
+	t.Assert(link.websiteRedirect(), NotNil)
+	t.Assert(*link.websiteRedirect(), Equals, "/index.html")
+	link.userMetadata[s.fs.flags.SymlinkAttr] = []byte("../index.html")
+	t.Assert(link.websiteRedirect(), IsNil)
+
+	// Redirects are presented as symlinks, but aren't saved as symlink attributes
+	s3b := &S3Backend{flags: s.fs.flags}
+	in := NewInode(s.fs, root, "redirect")
+	in.SetFromBlobItem(&BlobItemOutput{
+		Key: PString("redirect"),
+		ETag: PString("etag"),
+		Metadata: map[string]*string{},
+		WebsiteRedirect: s3b.websiteRedirect(PString("https://example.com/100%")),
+	})
+	target, err := in.ReadSymlink()
+	t.Assert(err, IsNil)
+	t.Assert(target, Equals, "https://example.com/100%")
+	t.Assert(in.InflateAttributes().Mode&os.ModeSymlink, Equals, os.ModeSymlink)
+	t.Assert(in.userMetadata[s.fs.flags.SymlinkAttr], IsNil)
+	// The redirect is kept when the object is updated
+	t.Assert(*in.websiteRedirect(), Equals, "https://example.com/100%")
+
+	// Symlink attribute of the object has priority
+	in.userMetadata[s.fs.flags.SymlinkAttr] = []byte("target")
+	target, err = in.ReadSymlink()
+	t.Assert(err, IsNil)
+	t.Assert(target, Equals, "target")
+
+	// Listings don't return redirects, so empty files are checked on lookup
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "redirect_listed",
+		Body: bytes.NewReader([]byte{}),
+		Size: PUInt64(0),
+	})
+	t.Assert(err, IsNil)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	cloud.head = func(param *HeadBlobInput) (*HeadBlobOutput, error) {
+		resp, err := cloud.StorageBackend.HeadBlob(param)
+		if err == nil && param.Key == "redirect_listed" {
+			resp.WebsiteRedirect = PString("/index.html")
+		}
+		return resp, err
+	}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+	s.readDirIntoCache(t, root.Id)
+	listed := root.findChild("redirect_listed")
+	t.Assert(listed, NotNil)
+	listed.mu.Lock()
+	t.Assert(listed.userMetadata, IsNil)
+	listed.mu.Unlock()
+	lookup := fuseops.LookUpInodeOp{Parent: root.Id, Name: "redirect_listed"}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	t.Assert(lookup.Entry.Attributes.Mode&os.ModeSymlink, Equals, os.ModeSymlink)
+	target, err = listed.ReadSymlink()
+	t.Assert(err, IsNil)
+	t.Assert(target, Equals, "/index.html")
+
+	s.fs.flags.WebsiteRedirectSymlinks = false
+	t.Assert(s3b.websiteRedirect(PString("/index.html")), IsNil)
+}
+
+func (s *GoofysTest) TestReadAheadLimit(t *C) {
+	maxReadAheadPerHandleKB := s.fs.flags.MaxReadAheadPerHandleKB
+	maxReadAheadTotalKB := s.fs.flags.MaxReadAheadTotalKB
+	s.fs.flags.MaxReadAheadPerHandleKB = 64
+	s.fs.flags.MaxReadAheadTotalKB = 96
+	defer func() {
+		s.fs.flags.MaxReadAheadPerHandleKB = maxReadAheadPerHandleKB
+		s.fs.flags.MaxReadAheadTotalKB = maxReadAheadTotalKB
+	}()
+
+	data := bytes.Repeat([]byte("x"), 1024*1024)
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "readahead",
+		Body: bytes.NewReader(data),
+		Size: PUInt64(uint64(len(data))),
+	})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+
+	in, err := s.LookUpInode(t, "readahead")
+	t.Assert(err, IsNil)
+	fh1, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	fh2, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh2.Release()
+
+	readAhead := func() string {
+		v, err := root.getControlXattr("readahead-bytes")
+		t.Assert(err, IsNil)
+		return string(v)
+	}
+
+	// The first handle is limited by the per-handle limit
+	_, _, err = fh1.ReadFile(0, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(len(cloud.Gets()), Equals, 1)
+	t.Assert(cloud.Gets()[0].Count, Equals, uint64(4096+64*1024))
+	t.Assert(readAhead(), Equals, "65536")
+
+	// The second one only gets what's left of the total limit
+	_, _, err = fh2.ReadFile(512*1024, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(len(cloud.Gets()), Equals, 2)
+	t.Assert(cloud.Gets()[1].Start, Equals, uint64(512*1024))
+	t.Assert(cloud.Gets()[1].Count, Equals, uint64(4096+32*1024))
+	t.Assert(readAhead(), Equals, "98304")
+
+	// Closing the first handle frees its share
+	fh1.Release()
+	t.Assert(readAhead(), Equals, "32768")
+}
+
+func (s *GoofysTest) TestStableInodeOnRename(t *C) {
+	stableInodeOnRename := s.fs.flags.StableInodeOnRename
+	s.fs.flags.StableInodeOnRename = true
+	defer func() {
+		s.fs.flags.StableInodeOnRename = stableInodeOnRename
+	}()
+	root := s.getRoot(t)
+
+	file1, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	file2, err := s.LookUpInode(t, "file2")
+	t.Assert(err, IsNil)
+	id1, id2 := file1.Id, file2.Id
+
+	err = s.fs.Rename(nil, &fuseops.RenameOp{
+		OldParent: root.Id,
+		NewParent: root.Id,
+		OldName:   "file1",
+		NewName:   "file2",
+	})
+	t.Assert(err, IsNil)
+
+	// The renamed file keeps the number of the replaced one
+	t.Assert(root.findChild("file1"), IsNil)
+	in := root.findChild("file2")
+	t.Assert(in, Equals, file1)
+	t.Assert(in.Id, Equals, id2)
+	s.fs.mu.RLock()
+	t.Assert(s.fs.inodes[id2], Equals, file1)
+	t.Assert(s.fs.inodes[id1], Equals, file2)
+	s.fs.mu.RUnlock()
+
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "file1"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "file2"})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "file1")
+}
+
+func (s *GoofysTest) TestStableInodeOnRenameOpen(t *C) {
+	s.fs.flags.StableInodeOnRename = true
+	defer func() {
+		s.fs.flags.StableInodeOnRename = false
+	}()
+	root := s.getRoot(t)
+
+	file1, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	file2, err := s.LookUpInode(t, "file2")
+	t.Assert(err, IsNil)
+	id1, id2 := file1.Id, file2.Id
+	fh, err := file2.OpenFile()
+	t.Assert(err, IsNil)
+
+	err = s.fs.Rename(nil, &fuseops.RenameOp{
+		OldParent: root.Id,
+		NewParent: root.Id,
+		OldName:   "file1",
+		NewName:   "file2",
+	})
+	t.Assert(err, IsNil)
+
+	// The open descriptor still refers to the replaced file by its number
+	t.Assert(root.findChild("file2"), Equals, file1)
+	t.Assert(file1.Id, Equals, id1)
+	t.Assert(file2.Id, Equals, id2)
+	s.fs.mu.RLock()
+	t.Assert(s.fs.inodes[id1], Equals, file1)
+	t.Assert(s.fs.inodes[id2], Equals, file2)
+	s.fs.mu.RUnlock()
+	fh.Release()
+}
+
+func (s *GoofysTest) TestUploadCompression(t *C) {
+	s.fs.flags.UploadCompression = "gzip"
+	s.fs.flags.UploadCompressionLevel = -1
+	s.fs.flags.UploadCompressionMinKB = 1
+	s.fs.flags.UploadCompressionSkip = map[string]bool{".gz": true}
+	data := bytes.Repeat([]byte("compressible text "), 4096)
+
+	// Small, skipped and compressed files
+	for _, name := range []string{"small.txt", "skipped.gz", "compressed.txt"} {
+		content := data
+		if name == "small.txt" {
+			content = data[0 : 100]
+		}
+		in, fh := s.getRoot(t).Create(name)
+		err := fh.WriteFile(0, content, true)
+		t.Assert(err, IsNil)
+		fh.Release()
+		err = in.SyncFile()
+		t.Assert(err, IsNil)
+	}
+
+	for _, name := range []string{"small.txt", "skipped.gz"} {
+		head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: name})
+		t.Assert(err, IsNil)
+		t.Assert(head.Metadata[UNCOMPRESSED_SIZE_ATTR], IsNil)
+	}
+
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "compressed.txt"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size < uint64(len(data)), Equals, true)
+	t.Assert(NilStr(head.Metadata[UNCOMPRESSED_SIZE_ATTR]), Equals, strconv.Itoa(len(data)))
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "compressed.txt"})
+	t.Assert(err, IsNil)
+	gz, err := gzip.NewReader(resp.Body)
+	t.Assert(err, IsNil)
+	stored, err := ioutil.ReadAll(gz)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(stored, data), Equals, true)
+
+	// Compressed object is presented with the real size and decompressed on read
+	in, err := s.LookUpInode(t, "compressed.txt")
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	in.resetCache()
+	t.Assert(in.Attributes.Size, Equals, uint64(len(data)))
+	in.mu.Unlock()
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	bufs, nread, err := fh.ReadFile(1000, 10000)
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, 10000)
+	t.Assert(bytes.Equal(bytes.Join(bufs, nil), data[1000 : 11000]), Equals, true)
+	// The metadata attribute isn't shown as an xattr
+	_, err = in.GetXattr("user."+UNCOMPRESSED_SIZE_ATTR)
+	t.Assert(err, Equals, syscall.ENODATA)
+}
+
+func (s *GoofysTest) TestUploadCompressionZstd(t *C) {
+	s.fs.flags.UploadCompression = "zstd"
+	s.fs.flags.UploadCompressionLevel = -1
+	s.fs.flags.UploadCompressionMinKB = 1
+	data := bytes.Repeat([]byte("compressible text "), 4096)
+
+	in, fh := s.getRoot(t).Create("compressed.txt")
+	err := fh.WriteFile(0, data, true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "compressed.txt"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size < uint64(len(data)), Equals, true)
+	t.Assert(NilStr(head.Metadata[UNCOMPRESSED_SIZE_ATTR]), Equals, strconv.Itoa(len(data)))
+	t.Assert(NilStr(head.Metadata[COMPRESSION_ATTR]), Equals, "zstd")
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "compressed.txt"})
+	t.Assert(err, IsNil)
+	dec, err := zstd.NewReader(resp.Body)
+	t.Assert(err, IsNil)
+	stored, err := ioutil.ReadAll(dec)
+	dec.Close()
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(stored, data), Equals, true)
+
+	// Replace the object by another compressed one, the listing only
+	// returns its compressed size, but stat must show the real one
+	data2 := bytes.Repeat([]byte("other compressible text "), 4096)
+	compressed, err := compressData(bytes.NewReader(data2), "zstd", -1)
+	t.Assert(err, IsNil)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "compressed.txt",
+		Body: bytes.NewReader(compressed),
+		Size: PUInt64(uint64(len(compressed))),
+		Metadata: map[string]*string{
+			UNCOMPRESSED_SIZE_ATTR: PString(strconv.Itoa(len(data2))),
+			COMPRESSION_ATTR: PString("zstd"),
+		},
+		ContentEncoding: PString("zstd"),
+	})
+	t.Assert(err, IsNil)
+	s.readDirIntoCache(t, fuseops.RootInodeID)
+	attr := fuseops.GetInodeAttributesOp{Inode: in.Id}
+	err = s.fs.GetInodeAttributes(nil, &attr)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Attributes.Size, Equals, uint64(len(data2)))
+
+	fh, err = in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	bufs, nread, err := fh.ReadFile(1000, 10000)
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, 10000)
+	t.Assert(bytes.Equal(bytes.Join(bufs, nil), data2[1000 : 11000]), Equals, true)
+}
+
+func (s *GoofysTest) TestUploadCompressionMultipart(t *C) {
+	s.fs.flags.UploadCompression = "gzip"
+	s.fs.flags.UploadCompressionLevel = -1
+	s.fs.flags.UploadCompressionMinKB = 1
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	// Half of the data is random, so it still takes more than one part when compressed
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 16*1024*1024)
+	for i := 0; i < len(data); i += 16 {
+		rnd.Read(data[i : i+8])
+	}
+
+	in, fh := root.Create("large.txt")
+	err := fh.WriteFile(0, data, true)
+	t.Assert(err, IsNil)
+	// Parts aren't uploaded while the file is open
+	s.fs.WakeupFlusherAndWait(true)
+	t.Assert(cloud.Calls("MultipartBlobBegin"), Equals, 0)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(cloud.Calls("PutBlob"), Equals, 0)
+	t.Assert(cloud.Calls("MultipartBlobAdd") > 1, Equals, true)
+
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "large.txt"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size < uint64(len(data)), Equals, true)
+	t.Assert(NilStr(head.Metadata[UNCOMPRESSED_SIZE_ATTR]), Equals, strconv.Itoa(len(data)))
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "large.txt"})
+	t.Assert(err, IsNil)
+	gz, err := gzip.NewReader(resp.Body)
+	t.Assert(err, IsNil)
+	stored, err := ioutil.ReadAll(gz)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(stored, data), Equals, true)
+}
+
+func (s *GoofysTest) TestCacheBalance(t *C) {
+	root := s.getRoot(t)
+	_, err := root.GetXattr("geesefs.cache-balance")
+	t.Assert(err, IsNil)
+	// Disk cache is required to move data
+	err = root.SetXattr("geesefs.cache-balance", []byte("spill=100"), 0)
+	t.Assert(err, Equals, syscall.ENOTSUP)
+
+	cacheDir, err := ioutil.TempDir("", "geesefs-cache")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(cacheDir)
+	cachePath := s.fs.flags.CachePath
+	s.fs.flags.CachePath = cacheDir
+	s.fs.flags.CacheFileMode = 0644
+	defer func() {
+		s.fs.flags.CachePath = cachePath
+	}()
+
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "balance",
+		Body: bytes.NewReader(data),
+		Size: PUInt64(uint64(len(data))),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "balance")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	_, _, err = fh.ReadFile(0, int64(len(data)))
+	t.Assert(err, IsNil)
+
+	value, err := root.GetXattr("geesefs.cache-balance")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, fmt.Sprintf("memory=%v disk=0", len(data)))
+	used := atomic.LoadInt64(&s.fs.bufferPool.cur)
+
+	err = root.SetXattr("geesefs.cache-balance", []byte("spill=100"), 0)
+	t.Assert(err, IsNil)
+	value, err = root.GetXattr("geesefs.cache-balance")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, fmt.Sprintf("memory=0 disk=%v", len(data)))
+	t.Assert(atomic.LoadInt64(&s.fs.bufferPool.cur), Equals, used-int64(len(data)))
+
+	err = root.SetXattr("geesefs.cache-balance", []byte("promote=100"), 0)
+	t.Assert(err, IsNil)
+	value, err = root.GetXattr("geesefs.cache-balance")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, fmt.Sprintf("memory=%v disk=%v", len(data), len(data)))
+	// Promoted data is accounted like data read from the disk cache
+	t.Assert(atomic.LoadInt64(&s.fs.bufferPool.cur), Equals, used)
+
+	bufs, _, err := fh.ReadFile(0, int64(len(data)))
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(bytes.Join(bufs, nil), data), Equals, true)
+
+	err = root.SetXattr("geesefs.cache-balance", []byte("spill=x"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+}
+
+func (s *GoofysTest) TestDiskCacheReadError(t *C) {
+	cacheDir, err := ioutil.TempDir("", "geesefs-cache")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(cacheDir)
+	cachePath := s.fs.flags.CachePath
+	s.fs.flags.CachePath = cacheDir
+	s.fs.flags.CacheFileMode = 0644
+	defer func() {
+		s.fs.flags.CachePath = cachePath
+	}()
+
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "diskcachebroken",
+		Body: bytes.NewReader(data),
+		Size: PUInt64(uint64(len(data))),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "diskcachebroken")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	_, _, err = fh.ReadFile(0, int64(len(data)))
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	err = root.SetXattr("geesefs.cache-balance", []byte("spill=100"), 0)
+	t.Assert(err, IsNil)
+
+	// Cache file is damaged behind our back
+	err = os.Truncate(cacheDir+"/diskcachebroken", 1000)
+	t.Assert(err, IsNil)
+
+	// Clean data is transparently loaded from the server again
+	bufs, _, err := fh.ReadFile(0, int64(len(data)))
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(bytes.Join(bufs, nil), data), Equals, true)
+	in.mu.Lock()
+	for _, b := range in.buffers {
+		t.Assert(b.loading, Equals, false)
+	}
+	in.mu.Unlock()
+}
+
+func (s *GoofysTest) TestConflictDetectWithoutETag(t *C) {
+	conflictDetect := s.fs.flags.ConflictDetect
+	defer func() {
+		s.fs.flags.ConflictDetect = conflictDetect
+	}()
+	in := NewInode(s.fs, s.getRoot(t), "noetag")
+	in.knownSize = 10
+	in.Attributes.Size = 10
+	t1 := time.Now().Add(-time.Hour).Round(time.Second)
+	t2 := t1.Add(time.Minute)
+
+	// Only size is compared by default
+	in.SetFromBlobItem(&BlobItemOutput{Size: 10, LastModified: &t1})
+	in.SetFromBlobItem(&BlobItemOutput{Size: 10, LastModified: &t2})
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 10, LastModified: &t1}), Equals, false)
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 11, LastModified: &t1}), Equals, true)
+
+	s.fs.flags.ConflictDetect = "mtime"
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 10, LastModified: &t2}), Equals, false)
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 10, LastModified: &t1}), Equals, true)
+	in.SetFromBlobItem(&BlobItemOutput{Size: 10, LastModified: &t1})
+	t.Assert(in.Attributes.Mtime.Equal(t1), Equals, true)
+	// ETag wins when it's present
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 10, ETag: PString("x"), LastModified: &t2}), Equals, true)
+
+	s.fs.flags.ConflictDetect = "checksum"
+	in.SetFromBlobItem(&BlobItemOutput{Size: 10, Checksum: PString("sha256:a")})
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 10, LastModified: &t2}), Equals, false)
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 10, Checksum: PString("sha256:a")}), Equals, false)
+	t.Assert(in.remoteChanged(&BlobItemOutput{Size: 10, Checksum: PString("sha256:b")}), Equals, true)
+}
+
+func (s *GoofysTest) TestExclusiveWriter(t *C) {
+	exclusiveWriter := s.fs.flags.ExclusiveWriter
+	s.fs.flags.ExclusiveWriter = true
+	defer func() {
+		s.fs.flags.ExclusiveWriter = exclusiveWriter
+	}()
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	fh1, err := in.Open(true)
+	t.Assert(err, IsNil)
+	_, err = in.Open(true)
+	t.Assert(err, Equals, syscall.EBUSY)
+
+	// Readers are always allowed
+	fh2, err := in.Open(false)
+	t.Assert(err, IsNil)
+	fh2.Release()
+
+	fh1.Release()
+	fh1, err = in.Open(true)
+	t.Assert(err, IsNil)
+	fh1.Release()
+}
+
+func (s *GoofysTest) TestFlushStats(t *C) {
+	root := s.getRoot(t)
+	in, fh := root.Create("flushstats")
+	err := fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	value, err := root.GetXattr("geesefs.flush-stats")
+	t.Assert(err, IsNil)
+	var inodes, dirty, throughput, avgFlushMs uint64
+	_, err = fmt.Sscanf(string(value), "inodes=%d bytes=%d throughput=%d avg-flush-ms=%d",
+		&inodes, &dirty, &throughput, &avgFlushMs)
+	t.Assert(err, IsNil)
+	t.Assert(inodes, Equals, uint64(0))
+	t.Assert(dirty, Equals, uint64(0))
+	t.Assert(throughput > 0, Equals, true)
+	t.Assert(s.fs.flushStats.flushes > 0, Equals, true)
+
+	_, err = in.GetXattr("geesefs.flush-stats")
+	t.Assert(err, Equals, syscall.ENODATA)
+}
+
+func (s *GoofysTest) TestMetadataSidecar(t *C) {
+	metadataSidecar := s.fs.flags.MetadataSidecar
+	s.fs.flags.MetadataSidecar = true
+	defer func() {
+		s.fs.flags.MetadataSidecar = metadataSidecar
+	}()
+
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:      "sidecar",
+		Body:     bytes.NewReader([]byte("hello")),
+		Size:     PUInt64(5),
+		Metadata: map[string]*string{"color": PString("blue")},
+	})
+	t.Assert(err, IsNil)
+	root := s.getRoot(t)
+
+	lookup := fuseops.LookUpInodeOp{Parent: root.Id, Name: "sidecar.meta"}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	s.fs.mu.RLock()
+	sidecar := s.fs.inodes[lookup.Entry.Child]
+	s.fs.mu.RUnlock()
+	t.Assert(sidecar.sidecarOf, NotNil)
+	t.Assert(sidecar.sidecarOf.Name, Equals, "sidecar")
+	// Sidecars aren't directory entries
+	t.Assert(root.findChild("sidecar.meta"), IsNil)
+	// Listings show sidecars with their own inode numbers
+	inodes := s.readDirInodes(t, root.Id)
+	t.Assert(inodes["sidecar.meta"], Equals, sidecar.Id)
+	t.Assert(inodes["sidecar"], Equals, sidecar.sidecarOf.Id)
+	t.Assert(inodes["file1.meta"] != 0, Equals, true)
+	t.Assert(inodes["file1.meta"] != inodes["file1"], Equals, true)
+
+	fh, err := sidecar.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	bufs, nread, err := fh.ReadFile(0, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(uint64(nread), Equals, lookup.Entry.Attributes.Size)
+	var meta sidecarContent
+	err = json.Unmarshal(bytes.Join(bufs, nil), &meta)
+	t.Assert(err, IsNil)
+	t.Assert(meta.Size, Equals, uint64(5))
+	t.Assert(meta.Xattrs["user.color"], Equals, "blue")
+
+	err = fh.WriteFile(0, []byte("x"), true)
+	t.Assert(err, Equals, syscall.EROFS)
+
+	// Directories and missing files don't have sidecars
+	lookup = fuseops.LookUpInodeOp{Parent: root.Id, Name: "missing.meta"}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestMetadataPrefix(t *C) {
+	enableMtime := s.fs.flags.EnableMtime
+	metadataPrefix := s.fs.flags.MetadataPrefix
+	mtimeAttr := s.fs.flags.MtimeAttr
+	s.fs.flags.EnableMtime = true
+	s.fs.flags.MetadataPrefix = "gfs-"
+	s.fs.flags.MtimeAttr = "gfs-mtime"
+	defer func() {
+		s.fs.flags.EnableMtime = enableMtime
+		s.fs.flags.MetadataPrefix = metadataPrefix
+		s.fs.flags.MtimeAttr = mtimeAttr
+	}()
+
+	// Objects written without the prefix are still understood
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:      "legacymeta",
+		Body:     bytes.NewReader([]byte("hello")),
+		Size:     PUInt64(5),
+		Metadata: map[string]*string{"mtime": PString("1600000000")},
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "legacymeta")
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	err = in.fillXattr()
+	in.mu.Unlock()
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mtime.Unix(), Equals, int64(1600000000))
+
+	// The unprefixed attribute is kept as is when metadata is updated
+	mtime := time.Unix(1650000000, 0)
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: in.Id, Mtime: &mtime})
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "legacymeta"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Metadata["gfs-mtime"], NotNil)
+	t.Assert(*head.Metadata["gfs-mtime"], Equals, "1650000000")
+	t.Assert(head.Metadata["mtime"], NotNil)
+	t.Assert(*head.Metadata["mtime"], Equals, "1600000000")
+
+	// Application metadata with the same name doesn't clash
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:      "prefixedmeta",
+		Body:     bytes.NewReader([]byte("hello")),
+		Size:     PUInt64(5),
+		Metadata: map[string]*string{"gfs-mtime": PString("1700000000"), "mtime": PString("5")},
+	})
+	t.Assert(err, IsNil)
+	in, err = s.LookUpInode(t, "prefixedmeta")
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	err = in.fillXattr()
+	in.mu.Unlock()
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mtime.Unix(), Equals, int64(1700000000))
+	t.Assert(string(in.userMetadata["mtime"]), Equals, "5")
+}
+
+func (s *GoofysTest) TestChangeLog(t *C) {
+	s.fs.enableChangeLog()
+	root := s.getRoot(t)
+
+	in, fh := root.Create("changelog1")
+	err := fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	err = root.Rename("changelog1", root, "changelog2")
+	t.Assert(err, IsNil)
+	err = root.Unlink("changelog2")
+	t.Assert(err, IsNil)
+
+	lookup := fuseops.LookUpInodeOp{Parent: root.Id, Name: CONTROL_DIR_NAME}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	lookup = fuseops.LookUpInodeOp{Parent: lookup.Entry.Child, Name: CHANGELOG_NAME}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	t.Assert(lookup.Entry.Attributes.Size, Equals, s.fs.changeLog.Size())
+	// The control directory isn't listed and can't be modified
+	t.Assert(root.findChild(CONTROL_DIR_NAME), IsNil)
+	err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: s.fs.controlDir.Id, Name: "x"})
+	t.Assert(err, Equals, syscall.EROFS)
+
+	fh, err = s.fs.changeLogFile.Open(false)
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	bufs, _, err := fh.ReadFile(0, 65536)
+	t.Assert(err, IsNil)
+	var ops []string
+	for _, line := range strings.Split(strings.TrimSpace(string(bytes.Join(bufs, nil))), "\n") {
+		var e changeLogEntry
+		err = json.Unmarshal([]byte(line), &e)
+		t.Assert(err, IsNil)
+		t.Assert(e.Time.IsZero(), Equals, false)
+		ops = append(ops, e.Op+" "+e.From+" "+e.Key)
+	}
+	t.Assert(ops, DeepEquals, []string{
+		"create  changelog1",
+		"rename changelog1 changelog2",
+		"delete  changelog2",
+	})
+}
+
+func (s *GoofysTest) TestDiskCacheRanges(t *C) {
+	ranges := addRange(nil, 100, 50)
+	ranges = addRange(ranges, 0, 10)
+	t.Assert(formatRanges(ranges), Equals, "0-10,100-150")
+	parsed, err := parseRanges("0-10,100-150")
+	t.Assert(err, IsNil)
+	t.Assert(parsed, DeepEquals, []uint64{0, 10, 100, 50})
+	_, err = parseRanges("150-100")
+	t.Assert(err, NotNil)
+}
+
+func (s *GoofysTest) TestValidateDiskCache(t *C) {
+	cacheDir, err := ioutil.TempDir("", "geesefs-cache")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(cacheDir)
+	err = unix.Setxattr(cacheDir, "user.test", []byte("1"), 0)
+	if err != nil {
+		t.Skip("Filesystem doesn't support user xattrs")
+	}
+	cachePath := s.fs.flags.CachePath
+	oldValidateDiskCache := s.fs.flags.ValidateDiskCache
+	s.fs.flags.CachePath = cacheDir
+	s.fs.flags.CacheFileMode = 0644
+	s.fs.flags.ValidateDiskCache = true
+	defer func() {
+		s.fs.flags.CachePath = cachePath
+		s.fs.flags.ValidateDiskCache = oldValidateDiskCache
+		s.fs.diskCacheIndex = nil
+	}()
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, key := range []string{"diskcache1", "diskcache2"} {
+		_, err = s.cloud.PutBlob(&PutBlobInput{
+			Key:  key,
+			Body: bytes.NewReader(data),
+			Size: PUInt64(uint64(len(data))),
+		})
+		t.Assert(err, IsNil)
+		in, err := s.LookUpInode(t, key)
+		t.Assert(err, IsNil)
+		fh, err := in.OpenFile()
+		t.Assert(err, IsNil)
+		_, _, err = fh.ReadFile(0, int64(len(data)))
+		t.Assert(err, IsNil)
+		fh.Release()
+	}
+	root := s.getRoot(t)
+	err = root.SetXattr("geesefs.cache-balance", []byte("spill=100"), 0)
+	t.Assert(err, IsNil)
+	err = ioutil.WriteFile(cacheDir+"/unknown", []byte("junk"), 0644)
+	t.Assert(err, IsNil)
+
+	// Second object is changed while we're "offline"
+	newData := bytes.Repeat([]byte("x"), len(data))
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "diskcache2",
+		Body: bytes.NewReader(newData),
+		Size: PUInt64(uint64(len(newData))),
+	})
+	t.Assert(err, IsNil)
+
+	names := s.fs.validateDiskCache()
+	t.Assert(len(names), Equals, 2)
+	_, err = os.Stat(cacheDir+"/unknown")
+	t.Assert(os.IsNotExist(err), Equals, true)
+	s.fs.checkDiskCache(names)
+	t.Assert(len(s.fs.diskCacheIndex), Equals, 1)
+	t.Assert(s.fs.diskCacheIndex["diskcache1"], NotNil)
+	_, err = os.Stat(cacheDir+"/diskcache1")
+	t.Assert(err, IsNil)
+	_, err = os.Stat(cacheDir+"/diskcache2")
+	t.Assert(os.IsNotExist(err), Equals, true)
+
+	// A new inode for the same object picks up the cached data
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "diskcache1"})
+	t.Assert(err, IsNil)
+	in := NewInode(s.fs, root, "diskcache1")
+	in.SetFromBlobItem(&head.BlobItemOutput)
+	t.Assert(len(in.buffers) > 0, Equals, true)
+	t.Assert(in.buffers[0].onDisk, Equals, true)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	bufs, _, err := fh.ReadFile(0, int64(len(data)))
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(bytes.Join(bufs, nil), data), Equals, true)
+	t.Assert(len(cloud.Gets()), Equals, 0)
+}
+
+func (s *GoofysTest) TestPrefetchOnReaddir(t *C) {
+	prefetchOnReaddir := s.fs.flags.PrefetchOnReaddir
+	s.fs.flags.PrefetchOnReaddir = "content"
+	defer func() { s.fs.flags.PrefetchOnReaddir = prefetchOnReaddir }()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"prefetch/file1": nil,
+		"prefetch/file2": nil,
+		"prefetch/subdir/file3": nil,
+	})
+	dir, err := s.LookUpInode(t, "prefetch")
+	t.Assert(err, IsNil)
+	s.readDirIntoCache(t, dir.Id)
+
+	for _, name := range []string{"file1", "file2"} {
+		in := dir.findChild(name)
+		t.Assert(in, NotNil)
+		var cached, size uint64
+		for i := 0; i < 100; i++ {
+			in.mu.Lock()
+			cached, size = in.readProgress()
+			in.mu.Unlock()
+			if cached == size {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Assert(size, Equals, uint64(len("prefetch/"+name)))
+		t.Assert(cached, Equals, size)
+		// The reference taken for the prefetch is released,
+		// but the inode with its data stays in memory
+		for i := 0; i < 100 && atomic.LoadInt64(&in.refcnt) != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Assert(atomic.LoadInt64(&in.refcnt), Equals, int64(0))
+		s.fs.mu.RLock()
+		t.Assert(s.fs.inodes[in.Id], Equals, in)
+		s.fs.mu.RUnlock()
+		in.mu.Lock()
+		cached, _ = in.readProgress()
+		in.mu.Unlock()
+		t.Assert(cached, Equals, size)
+	}
+}
+
+func (s *GoofysTest) TestPrefetchOnReaddirClosed(t *C) {
+	prefetchOnReaddir := s.fs.flags.PrefetchOnReaddir
+	s.fs.flags.PrefetchOnReaddir = "content"
+	defer func() { s.fs.flags.PrefetchOnReaddir = prefetchOnReaddir }()
+	// More files than parallel prefetch requests
+	count := PREFETCH_CONCURRENCY+2
+	blobs := make(map[string]*string)
+	for i := 0; i < count; i++ {
+		blobs[fmt.Sprintf("prefetch/file%v", i)] = nil
+	}
+	s.setupBlobs(s.cloud, t, blobs)
+	dir, err := s.LookUpInode(t, "prefetch")
+	t.Assert(err, IsNil)
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	unblock := make(chan struct{})
+	cloud.get = func(param *GetBlobInput) (*GetBlobOutput, error) {
+		<-unblock
+		return cloud.StorageBackend.GetBlob(param)
+	}
+	root.dir.cloud = cloud
+
+	// The handle is closed before the prefetch is done, like ls does
+	s.readDirInodes(t, dir.Id)
+	close(unblock)
+
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("file%v", i)
+		in := dir.findChild(name)
+		t.Assert(in, NotNil)
+		var cached, size uint64
+		for j := 0; j < 100; j++ {
+			in.mu.Lock()
+			cached, size = in.readProgress()
+			in.mu.Unlock()
+			if cached == size {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Assert(size, Equals, uint64(len("prefetch/"+name)))
+		t.Assert(cached, Equals, size)
+	}
+}
+
+func (s *GoofysTest) TestFlushRetryBackoff(t *C) {
+	retryInterval := s.fs.flags.RetryInterval
+	retryIntervalMax := s.fs.flags.RetryIntervalMax
+	s.fs.flags.RetryInterval = time.Second
+	s.fs.flags.RetryIntervalMax = 4*time.Second
+	defer func() {
+		s.fs.flags.RetryInterval = retryInterval
+		s.fs.flags.RetryIntervalMax = retryIntervalMax
+	}()
+	// Keep the real flush from resetting the error
+	s.fs.PauseFlush(true)
+	defer s.fs.PauseFlush(false)
+	root := s.getRoot(t)
+	in, fh := root.Create("backoff")
+	defer fh.Release()
+
+	_, err := in.getControlXattr("flush-error")
+	t.Assert(err, Equals, syscall.ENODATA)
+
+	fail := func() {
+		in.mu.Lock()
+		// Pretend that the previous retry delay has passed
+		in.flushErrorTime = in.flushErrorTime.Add(-time.Hour)
+		in.recordFlushError(fmt.Errorf("backoff test"))
+		in.mu.Unlock()
+	}
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		fail()
+		in.mu.Lock()
+		delays = append(delays, in.flushRetryDelay())
+		in.mu.Unlock()
+	}
+	t.Assert(delays, DeepEquals, []time.Duration{
+		time.Second, 2*time.Second, 4*time.Second, 4*time.Second, 4*time.Second,
+	})
+
+	// Parallel failures of the same attempt don't increase the delay
+	in.mu.Lock()
+	in.flushErrors = 1
+	in.recordFlushError(fmt.Errorf("backoff test"))
+	in.recordFlushError(fmt.Errorf("backoff test"))
+	t.Assert(in.flushRetryDelay(), Equals, time.Second)
+	in.mu.Unlock()
+
+	value, err := in.getControlXattr("flush-error")
+	t.Assert(err, IsNil)
+	t.Assert(strings.HasPrefix(string(value), "failures=1,delay=1s,retry-in="), Equals, true)
+	t.Assert(strings.HasSuffix(string(value), ",error=backoff test"), Equals, true)
+
+	// A successful part upload clears the error, but not the failure count
+	in.mu.Lock()
+	in.recordFlushError(nil)
+	t.Assert(in.flushErrors, Equals, 1)
+	in.mu.Unlock()
+	_, err = in.getControlXattr("flush-error")
+	t.Assert(err, Equals, syscall.ENODATA)
+	in.mu.Lock()
+	in.recordFlushError(fmt.Errorf("backoff test"))
+	t.Assert(in.flushErrors, Equals, 2)
+	t.Assert(in.flushRetryDelay(), Equals, 2*time.Second)
+	// It's reset when the file is flushed
+	in.SetCacheState(ST_CACHED)
+	t.Assert(in.flushErrors, Equals, 0)
+	in.mu.Unlock()
+}
+
+// Backend with fake previous versions of objects. Listing versions is an
+// optional interface, so it's not a HookBackend hook
+type VersionsBackend struct {
+	*HookBackend
+	versions map[string][]BlobVersionOutput
+}
+
+func (s *VersionsBackend) ListBlobVersions(key string) ([]BlobVersionOutput, error) {
+	return append([]BlobVersionOutput{}, s.versions[key]...), nil
+}
+
+func (s *GoofysTest) TestVersionHistoryDirs(t *C) {
+	versionHistoryDirs := s.fs.flags.VersionHistoryDirs
+	s.fs.flags.VersionHistoryDirs = true
+	defer func() { s.fs.flags.VersionHistoryDirs = versionHistoryDirs }()
+	s.setupBlobs(s.cloud, t, map[string]*string{"versioned": nil})
+	root := s.getRoot(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	versions := []BlobVersionOutput{
+		{VersionId: "v2", LastModified: now, Size: 9, IsLatest: true},
+		{VersionId: "v1", LastModified: now.Add(-time.Hour), Size: 11},
+	}
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	data := map[string][]byte{"v1": []byte("old content"), "v2": []byte("versioned")}
+	cloud.get = func(param *GetBlobInput) (*GetBlobOutput, error) {
+		if param.VersionId == nil {
+			return cloud.StorageBackend.GetBlob(param)
+		}
+		d, ok := data[*param.VersionId]
+		if !ok {
+			return nil, fuse.ENOENT
+		}
+		end := param.Start+param.Count
+		if end > uint64(len(d)) {
+			end = uint64(len(d))
+		}
+		return &GetBlobOutput{
+			Body: ioutil.NopCloser(bytes.NewReader(d[param.Start:end])),
+		}, nil
+	}
+	root.dir.cloud = &VersionsBackend{
+		HookBackend: cloud,
+		versions: map[string][]BlobVersionOutput{
+			"versioned": versions,
+			"deleted": versions[1:],
+		},
+	}
+
+	lookup := fuseops.LookUpInodeOp{Parent: root.Id, Name: "versioned"+VERSIONS_DIR_SUFFIX}
+	err := s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	t.Assert(lookup.Entry.Attributes.Mode.IsDir(), Equals, true)
+	dirId := lookup.Entry.Child
+	// The history directory isn't a child of the parent
+	t.Assert(root.findChild("versioned"+VERSIONS_DIR_SUFFIX), IsNil)
+
+	// Each version is listed with its own inode number
+	inodes := s.readDirInodes(t, dirId)
+	id0, id1 := inodes[versionFileName(&versions[0])], inodes[versionFileName(&versions[1])]
+	t.Assert(id0, Not(Equals), fuseops.InodeID(0))
+	t.Assert(id1, Not(Equals), fuseops.InodeID(0))
+	t.Assert(id0, Not(Equals), id1)
+	t.Assert(id1, Not(Equals), root.findChild("versioned").Id)
+
+	lookup = fuseops.LookUpInodeOp{Parent: dirId, Name: versionFileName(&versions[1])}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	t.Assert(lookup.Entry.Child, Equals, id1)
+	t.Assert(lookup.Entry.Attributes.Size, Equals, uint64(11))
+	t.Assert(lookup.Entry.Attributes.Mtime.Equal(versions[1].LastModified), Equals, true)
+	s.fs.mu.RLock()
+	in := s.fs.getInodeOrDie(lookup.Entry.Child)
+	s.fs.mu.RUnlock()
+	fh, err := in.Open(false)
+	t.Assert(err, IsNil)
+	bufs, _, err := fh.ReadFile(4, 100)
+	t.Assert(err, IsNil)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "content")
+	fh.Release()
+
+	// The version is dropped from the directory when the kernel forgets it
+	err = s.fs.ForgetInode(nil, &fuseops.ForgetInodeOp{Inode: id1, N: 1})
+	t.Assert(err, IsNil)
+	s.fs.mu.RLock()
+	dir := s.fs.getInodeOrDie(dirId)
+	_, ok := s.fs.inodes[id1]
+	s.fs.mu.RUnlock()
+	t.Assert(ok, Equals, false)
+	dir.mu.Lock()
+	t.Assert(dir.versionFiles[versionFileName(&versions[1])], IsNil)
+	dir.mu.Unlock()
+
+	// History is read-only
+	err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: dirId, Name: "x"})
+	t.Assert(err, Equals, syscall.EROFS)
+	lookup = fuseops.LookUpInodeOp{Parent: dirId, Name: "unknown"}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, Equals, fuse.ENOENT)
+	lookup = fuseops.LookUpInodeOp{Parent: root.Id, Name: "missing"+VERSIONS_DIR_SUFFIX}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	// Versions of a deleted file are available too
+	lookup = fuseops.LookUpInodeOp{Parent: root.Id, Name: "deleted"+VERSIONS_DIR_SUFFIX}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	t.Assert(lookup.Entry.Attributes.Mtime.Equal(versions[1].LastModified), Equals, true)
+	t.Assert(root.findChild("deleted"), IsNil)
+	inodes = s.readDirInodes(t, lookup.Entry.Child)
+	t.Assert(inodes[versionFileName(&versions[1])], Not(Equals), fuseops.InodeID(0))
+	lookup = fuseops.LookUpInodeOp{Parent: lookup.Entry.Child, Name: versionFileName(&versions[1])}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	s.fs.mu.RLock()
+	in = s.fs.getInodeOrDie(lookup.Entry.Child)
+	s.fs.mu.RUnlock()
+	fh, err = in.Open(false)
+	t.Assert(err, IsNil)
+	bufs, _, err = fh.ReadFile(0, 100)
+	t.Assert(err, IsNil)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "old content")
+	fh.Release()
+}
+
+func (s *GoofysTest) TestHidePattern(t *C) {
+	hidePatterns := s.fs.flags.HidePatterns
+	s.fs.flags.HidePatterns = []string{".DS_Store", "*.marker"}
+	defer func() { s.fs.flags.HidePatterns = hidePatterns }()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"hidden/.DS_Store": nil,
+		"hidden/a.marker": nil,
+		"hidden/file1": nil,
+		"hidden/file2": nil,
+	})
+	dir, err := s.LookUpInode(t, "hidden")
+	t.Assert(err, IsNil)
+
+	openDirOp := fuseops.OpenDirOp{Inode: dir.Id}
+	err = s.fs.OpenDir(nil, &openDirOp)
+	t.Assert(err, IsNil)
+	readDirOp := fuseops.ReadDirOp{
+		Inode:  dir.Id,
+		Handle: openDirOp.Handle,
+		Dst:    make([]byte, 8*1024),
+	}
+	err = s.fs.ReadDir(nil, &readDirOp)
+	t.Assert(err, IsNil)
+	listed := readDirOp.Dst[0:readDirOp.BytesRead]
+	t.Assert(bytes.Contains(listed, []byte("file1")), Equals, true)
+	t.Assert(bytes.Contains(listed, []byte("file2")), Equals, true)
+	t.Assert(bytes.Contains(listed, []byte(".DS_Store")), Equals, false)
+	t.Assert(bytes.Contains(listed, []byte("a.marker")), Equals, false)
+
+	err = s.fs.ReleaseDirHandle(nil, &fuseops.ReleaseDirHandleOp{Handle: openDirOp.Handle})
+	t.Assert(err, IsNil)
+
+	// Hidden entries are still accessible by name
+	_, err = s.LookUpInode(t, "hidden/.DS_Store")
+	t.Assert(err, IsNil)
+	_, err = s.LookUpInode(t, "hidden/a.marker")
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestLazyDirInodes(t *C) {
+	lazyDirInodes := s.fs.flags.LazyDirInodes
+	s.fs.flags.LazyDirInodes = true
+	defer func() { s.fs.flags.LazyDirInodes = lazyDirInodes }()
+	const numFiles = 2500
+	env := map[string]*string{}
+	for i := 0; i < numFiles; i++ {
+		env[fmt.Sprintf("lazydir/lazyfile%04d", i)] = nil
+	}
+	s.setupBlobs(s.cloud, t, env)
+	dir, err := s.LookUpInode(t, "lazydir")
+	t.Assert(err, IsNil)
+
+	listAll := func() (listed, maxChildren int) {
+		openDirOp := fuseops.OpenDirOp{Inode: dir.Id}
+		err := s.fs.OpenDir(nil, &openDirOp)
+		t.Assert(err, IsNil)
+		dh := s.fs.dirHandles[openDirOp.Handle]
+		for {
+			readDirOp := fuseops.ReadDirOp{
+				Inode:  dir.Id,
+				Handle: openDirOp.Handle,
+				Offset: dh.lastExternalOffset,
+				Dst:    make([]byte, 4*1024),
+			}
+			err = s.fs.ReadDir(nil, &readDirOp)
+			t.Assert(err, IsNil)
+			if readDirOp.BytesRead == 0 {
+				break
+			}
+			listed += bytes.Count(readDirOp.Dst[0:readDirOp.BytesRead], []byte("lazyfile"))
+			dir.mu.Lock()
+			if len(dir.dir.Children) > maxChildren {
+				maxChildren = len(dir.dir.Children)
+			}
+			dir.mu.Unlock()
+		}
+		err = s.fs.ReleaseDirHandle(nil, &fuseops.ReleaseDirHandleOp{Handle: openDirOp.Handle})
+		t.Assert(err, IsNil)
+		return
+	}
+	listed, maxChildren := listAll()
+
+	// All entries are listed, but only one listing page is kept in memory at most
+	t.Assert(listed, Equals, numFiles)
+	t.Assert(maxChildren <= 1000+2, Equals, true)
+	dir.mu.Lock()
+	t.Assert(len(dir.dir.Children) <= 2, Equals, true)
+	dir.mu.Unlock()
+
+	// Forgotten entries are still accessible by name
+	in, err := s.LookUpInode(t, "lazydir/lazyfile1234")
+	t.Assert(err, IsNil)
+	t.Assert(in.Name, Equals, "lazyfile1234")
+	_, err = s.LookUpInode(t, "lazydir/lazyfile9999")
+	t.Assert(err, Equals, fuse.ENOENT)
+	dir.mu.Lock()
+	t.Assert(dir.dir.lazyEvicted, Equals, true)
+	dir.mu.Unlock()
+
+	// Children are complete again after a listing which doesn't forget them
+	s.fs.flags.LazyDirInodes = false
+	listed, _ = listAll()
+	t.Assert(listed, Equals, numFiles)
+	dir.mu.Lock()
+	t.Assert(dir.dir.lazyEvicted, Equals, false)
+	t.Assert(len(dir.dir.Children), Equals, numFiles+2)
+	dir.mu.Unlock()
+}
+
+func (s *GoofysTest) TestSendContentMD5(t *C) {
+	sendContentMD5 := s.fs.flags.SendContentMD5
+	s.fs.flags.SendContentMD5 = true
+	defer func() { s.fs.flags.SendContentMD5 = sendContentMD5 }()
+	root := s.getRoot(t)
+	// Check Content-MD5 of all uploads
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var bad []string
+	check := func(what string, md5sum *string, body io.ReadSeeker) {
+		hash := md5.New()
+		io.Copy(hash, body)
+		body.Seek(0, io.SeekStart)
+		if md5sum == nil || *md5sum != base64.StdEncoding.EncodeToString(hash.Sum(nil)) {
+			cloud.mu.Lock()
+			bad = append(bad, what)
+			cloud.mu.Unlock()
+		}
+	}
+	cloud.put = func(param *PutBlobInput) (*PutBlobOutput, error) {
+		check(param.Key, param.ContentMD5, param.Body)
+		return cloud.StorageBackend.PutBlob(param)
+	}
+	cloud.mpuAdd = func(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+		check(fmt.Sprintf("%v part %v", NilStr(param.Commit.Key), param.PartNumber), param.ContentMD5, param.Body)
+		return cloud.StorageBackend.MultipartBlobAdd(param)
+	}
+	root.dir.cloud = cloud
+
+	for _, size := range []int64{1000, 12*1024*1024} {
+		fh := s.testCreateAndWrite(t, fmt.Sprintf("md5_%v", size), size, 128*1024, true)
+		in := fh.inode
+		fh.Release()
+		err := in.SyncFile()
+		t.Assert(err, IsNil)
+	}
+	// One PUT and 3 parts
+	t.Assert(cloud.Calls("PutBlob")+cloud.Calls("MultipartBlobAdd") >= 4, Equals, true)
+	t.Assert(bad, IsNil)
+}
+
+func (s *GoofysTest) TestDirMtime(t *C) {
+	enableMtime := s.fs.flags.EnableMtime
+	mtimeAttr := s.fs.flags.MtimeAttr
+	s.fs.flags.EnableMtime = true
+	s.fs.flags.MtimeAttr = "mtime"
+	defer func() {
+		s.fs.flags.EnableMtime = enableMtime
+		s.fs.flags.MtimeAttr = mtimeAttr
+	}()
+	root := s.getRoot(t)
+	dir, err := root.MkDir("dirmtime")
+	t.Assert(err, IsNil)
+	err = dir.SyncFile()
+	t.Assert(err, IsNil)
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	dir.mu.Lock()
+	dir.Attributes.Mtime = old
+	dir.mu.Unlock()
+	_, fh := dir.Create("file")
+	fh.Release()
+	dir.mu.Lock()
+	mtime := dir.Attributes.Mtime
+	dir.mu.Unlock()
+	t.Assert(mtime.After(old), Equals, true)
+
+	// The new mtime is saved in the directory object
+	err = dir.SyncFile()
+	t.Assert(err, IsNil)
+	key := "dirmtime/"
+	if s.cloud.Capabilities().DirBlob {
+		key = "dirmtime"
+	}
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: key})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["mtime"]), Equals, fmt.Sprintf("%d", mtime.Unix()))
+
+	dir.mu.Lock()
+	dir.Attributes.Mtime = old
+	dir.mu.Unlock()
+	err = dir.Unlink("file")
+	t.Assert(err, IsNil)
+	dir.mu.Lock()
+	t.Assert(dir.Attributes.Mtime.After(old), Equals, true)
+	dir.mu.Unlock()
+}
+
+func (s *GoofysTest) TestPrefixStats(t *C) {
+	prefixStatsTTL := s.fs.flags.PrefixStatsTTL
+	s.fs.flags.PrefixStatsTTL = time.Hour
+	defer func() { s.fs.flags.PrefixStatsTTL = prefixStatsTTL }()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"pstats/a": nil,
+		"pstats/b": nil,
+		"pstats/sub/c": nil,
+		"pstatsx": nil,
+	})
+	dir, err := s.LookUpInode(t, "pstats")
+	t.Assert(err, IsNil)
+	value, err := dir.getControlXattr("prefix-stats")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "objects=3 bytes=28 complete=true")
+
+	// The result is cached
+	s.setupBlobs(s.cloud, t, map[string]*string{"pstats/d": nil})
+	value, err = dir.getControlXattr("prefix-stats")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "objects=3 bytes=28 complete=true")
+
+	s.fs.flags.PrefixStatsTTL = 0
+	value, err = dir.getControlXattr("prefix-stats")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "objects=4 bytes=36 complete=true")
+
+	// Files don't have prefix stats
+	file, err := s.LookUpInode(t, "pstats/a")
+	t.Assert(err, IsNil)
+	_, err = file.getControlXattr("prefix-stats")
+	t.Assert(err, Equals, syscall.ENODATA)
+}
+
+func (s *GoofysTest) TestPrefixStatsConcurrent(t *C) {
+	prefixStatsTTL := s.fs.flags.PrefixStatsTTL
+	s.fs.flags.PrefixStatsTTL = 0
+	defer func() { s.fs.flags.PrefixStatsTTL = prefixStatsTTL }()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"pstatsc/a": nil,
+		"pstatsc/b": nil,
+	})
+	dir, err := s.LookUpInode(t, "pstatsc")
+	t.Assert(err, IsNil)
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	cloud.list = func(param *ListBlobsInput) (*ListBlobsOutput, error) {
+		listing <- struct{}{}
+		<-release
+		return cloud.StorageBackend.ListBlobs(param)
+	}
+
+	// Concurrent requests share one listing even with a zero TTL
+	results := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			value, err := dir.getControlXattr("prefix-stats")
+			t.Check(err, IsNil)
+			results <- string(value)
+		}()
+	}
+	<-listing
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		t.Assert(<-results, Equals, "objects=2 bytes=18 complete=true")
+	}
+	t.Assert(cloud.Calls("ListBlobs"), Equals, 1)
+}
+
+func (s *GoofysTest) TestDeleteOnClose(t *C) {
+	deleteOnClose := s.fs.flags.DeleteOnClose
+	s.fs.flags.DeleteOnClose = true
+	defer func() { s.fs.flags.DeleteOnClose = deleteOnClose }()
+	root := s.getRoot(t)
+	in, fh := root.Create("openunlink")
+	err := fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	err = root.Unlink("openunlink")
+	t.Assert(err, IsNil)
+	t.Assert(root.findChild("openunlink"), IsNil)
+
+	// The handle is still usable
+	err = fh.WriteFile(5, []byte(" world"), true)
+	t.Assert(err, IsNil)
+	bufs, _, err := fh.ReadFile(0, 100)
+	t.Assert(err, IsNil)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "hello world")
+
+	// The object isn't deleted while the file is open
+	s.fs.WakeupFlusher()
+	time.Sleep(200 * time.Millisecond)
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "openunlink"})
+	t.Assert(err, IsNil)
+
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "openunlink"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestDeleteOnCloseRecreate(t *C) {
+	deleteOnClose := s.fs.flags.DeleteOnClose
+	s.fs.flags.DeleteOnClose = true
+	defer func() { s.fs.flags.DeleteOnClose = deleteOnClose }()
+	root := s.getRoot(t)
+	in, fh := root.Create("rotated")
+	err := fh.WriteFile(0, []byte("old log"), true)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	err = root.Unlink("rotated")
+	t.Assert(err, IsNil)
+
+	// A new file with the same name is flushed while the old one is still open
+	newIn, newFh := root.Create("rotated")
+	err = newFh.WriteFile(0, []byte("new log"), true)
+	t.Assert(err, IsNil)
+	done := make(chan error)
+	go func() {
+		done <- newIn.SyncFile()
+	}()
+	select {
+	case err = <-done:
+		t.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fsync of the recreated file waits for the unlinked one")
+	}
+
+	// Closing the old file doesn't delete the new object
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	newFh.Release()
+	res, err := s.cloud.GetBlob(&GetBlobInput{Key: "rotated"})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "new log")
+	root.mu.Lock()
+	t.Assert(root.dir.DeletedChildren["rotated"], IsNil)
+	root.mu.Unlock()
+}
+
+func (s *GoofysTest) TestDeleteOnCloseRenameOver(t *C) {
+	deleteOnClose := s.fs.flags.DeleteOnClose
+	s.fs.flags.DeleteOnClose = true
+	defer func() { s.fs.flags.DeleteOnClose = deleteOnClose }()
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	in, fh := root.Create("renamedover")
+	err := fh.WriteFile(0, []byte("old data"), true)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	err = root.Unlink("renamedover")
+	t.Assert(err, IsNil)
+	src, srcFh := root.Create("renamesrc")
+	err = srcFh.WriteFile(0, []byte("new data"), true)
+	t.Assert(err, IsNil)
+	srcFh.Release()
+	err = src.SyncFile()
+	t.Assert(err, IsNil)
+
+	copying := make(chan struct{})
+	release := make(chan struct{})
+	cloud.copy = func(param *CopyBlobInput) (*CopyBlobOutput, error) {
+		close(copying)
+		<-release
+		return cloud.StorageBackend.CopyBlob(param)
+	}
+	var deleted []string
+	cloud.del = func(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+		cloud.mu.Lock()
+		deleted = append(deleted, param.Key)
+		cloud.mu.Unlock()
+		return cloud.StorageBackend.DeleteBlob(param)
+	}
+	err = root.Rename("renamesrc", root, "renamedover")
+	t.Assert(err, IsNil)
+	synced := make(chan error)
+	go func() {
+		synced <- src.SyncFile()
+	}()
+	<-copying
+
+	// The unlinked file is closed while the renamed one is being copied over it
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	close(release)
+	err = <-synced
+	t.Assert(err, IsNil)
+
+	res, err := s.cloud.GetBlob(&GetBlobInput{Key: "renamedover"})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "new data")
+	s.fs.WakeupFlusherAndWait(true)
+	cloud.mu.Lock()
+	for _, key := range deleted {
+		t.Assert(key, Not(Equals), "renamedover")
+	}
+	cloud.mu.Unlock()
+}
+
+// Rename a deep tree and check that no more than <concurrency> copy & delete
+// requests are in flight at once. Returns the time it took and the observed
+// maximum parallelism
+func (s *GoofysTest) renameDeepTree(t *C, concurrency int) (time.Duration, int) {
+	from := fmt.Sprintf("treeop%v", concurrency)
+	blobs := map[string]*string{}
+	path := from
+	for depth := 0; depth < 4; depth++ {
+		path += fmt.Sprintf("/d%v", depth)
+		for i := 0; i < 4; i++ {
+			blobs[fmt.Sprintf("%v/file%v", path, i)] = nil
+		}
+	}
+	s.setupBlobs(s.cloud, t, blobs)
+
+	treeOpConcurrency := s.fs.flags.TreeOpConcurrency
+	s.fs.flags.TreeOpConcurrency = concurrency
+	root := s.getRoot(t)
+	// Count parallel copy and delete requests, with a small delay to make them overlap
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	active, maxActive := 0, 0
+	enter := func() (exit func()) {
+		cloud.mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		cloud.mu.Unlock()
+		time.Sleep(20*time.Millisecond)
+		return func() {
+			cloud.mu.Lock()
+			active--
+			cloud.mu.Unlock()
+		}
+	}
+	cloud.copy = func(param *CopyBlobInput) (*CopyBlobOutput, error) {
+		defer enter()()
+		return cloud.StorageBackend.CopyBlob(param)
+	}
+	cloud.del = func(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+		defer enter()()
+		return cloud.StorageBackend.DeleteBlob(param)
+	}
+	root.dir.cloud = cloud
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.flags.TreeOpConcurrency = treeOpConcurrency
+	}()
+
+	_, err := s.LookUpInode(t, from)
+	t.Assert(err, IsNil)
+	start := time.Now()
+	err = root.Rename(from, root, from+"_renamed")
+	t.Assert(err, IsNil)
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+	elapsed := time.Since(start)
+
+	for key := range blobs {
+		_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: from+"_renamed"+key[len(from):]})
+		t.Assert(err, IsNil)
+		_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: key})
+		t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	}
+	t.Assert(maxActive <= concurrency, Equals, true)
+	return elapsed, maxActive
+}
+
+func (s *GoofysTest) TestTreeOpConcurrency(t *C) {
+	// Subtree operations don't count as flushers
+	maxFlushers := s.fs.flags.MaxFlushers
+	s.fs.flags.MaxFlushers = 2
+	defer func() { s.fs.flags.MaxFlushers = maxFlushers }()
+	serial, maxSerial := s.renameDeepTree(t, 1)
+	t.Assert(maxSerial, Equals, 1)
+	parallel, maxParallel := s.renameDeepTree(t, 8)
+	t.Assert(maxParallel > 2, Equals, true)
+	t.Logf("deep tree rename: %v with 1 request, %v with up to %v requests", serial, parallel, maxParallel)
+}
+
+func (s *GoofysTest) TestTreeOpConcurrencySingleFiles(t *C) {
+	treeOpConcurrency := s.fs.flags.TreeOpConcurrency
+	s.fs.flags.TreeOpConcurrency = 1
+	defer func() { s.fs.flags.TreeOpConcurrency = treeOpConcurrency }()
+	blobs := map[string]*string{}
+	for i := 0; i < 8; i++ {
+		blobs[fmt.Sprintf("treeopsingle/file%v", i)] = nil
+	}
+	s.setupBlobs(s.cloud, t, blobs)
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	active, maxActive := 0, 0
+	cloud.del = func(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+		cloud.mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		cloud.mu.Unlock()
+		time.Sleep(20*time.Millisecond)
+		cloud.mu.Lock()
+		active--
+		cloud.mu.Unlock()
+		return cloud.StorageBackend.DeleteBlob(param)
+	}
+	root.dir.cloud = cloud
+
+	// Deletes of single files aren't limited by --tree-op-concurrency
+	dir, err := s.LookUpInode(t, "treeopsingle")
+	t.Assert(err, IsNil)
+	s.readDirInodes(t, dir.Id)
+	s.fs.PauseFlush(true)
+	for i := 0; i < 8; i++ {
+		err = dir.Unlink(fmt.Sprintf("file%v", i))
+		t.Assert(err, IsNil)
+	}
+	s.fs.PauseFlush(false)
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+	t.Assert(maxActive > 1, Equals, true)
+}
+
+func (s *GoofysTest) TestMetadataCopyETag(t *C) {
+	root := s.getRoot(t)
+	in, fh := root.Create("metacopy")
+	err := fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// Metadata is updated using COPY which changes the ETag
+	err = in.SetXattr("user.foo", []byte("bar"), 0)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "metacopy"})
+	t.Assert(err, IsNil)
+	if head.ETag == nil {
+		t.Skip("Server doesn't return ETag")
+	}
+	in.mu.Lock()
+	t.Assert(in.knownETag, Equals, *head.ETag)
+	t.Assert(len(in.buffers) > 0, Equals, true)
+	in.mu.Unlock()
+
+	// Refresh must not drop the cached data
+	in.SetFromBlobItem(&head.BlobItemOutput)
+	in.mu.Lock()
+	t.Assert(len(in.buffers) > 0, Equals, true)
+	in.mu.Unlock()
+	fh, err = in.OpenFile()
+	t.Assert(err, IsNil)
+	data, n, err := fh.ReadFile(0, 5)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 5)
+	t.Assert(string(bytes.Join(data, nil)), Equals, "hello")
+	fh.Release()
+}
+
+func (s *GoofysTest) TestPartManifest(t *C) {
+	oldPartManifest := s.fs.flags.PartManifest
+	s.fs.flags.PartManifest = true
+	defer func() { s.fs.flags.PartManifest = oldPartManifest }()
+
+	fh := s.testCreateAndWrite(t, "manifest", 12*1024*1024, 128*1024, true)
+	in := fh.inode
+	fh.Release()
+	err := in.SyncFile()
+	t.Assert(err, IsNil)
+
+	check := func() {
+		value, err := in.GetXattr("geesefs.part-manifest")
+		t.Assert(err, IsNil)
+		lines := strings.Split(strings.TrimSpace(string(value)), "\n")
+		t.Assert(len(lines), Equals, 3)
+		offsets := []string{"1 0 5242880 ", "2 5242880 5242880 ", "3 10485760 2097152 "}
+		for i, line := range lines {
+			t.Assert(strings.HasPrefix(line, offsets[i]), Equals, true)
+			t.Assert(len(line) > len(offsets[i]), Equals, true)
+		}
+	}
+	check()
+
+	// The manifest is saved in the metadata and not shown as a user xattr
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "manifest"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Metadata[PART_MANIFEST_ATTR], NotNil)
+	_, err = in.GetXattr("user."+PART_MANIFEST_ATTR)
+	t.Assert(err, Equals, syscall.ENODATA)
+
+	// ...and is read back from it
+	in.mu.Lock()
+	in.partManifest = ""
+	in.setMetadata(head.Metadata)
+	in.mu.Unlock()
+	check()
+
+	// Overwriting the object invalidates the manifest
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: in.Id, Size: PUInt64(1000)})
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	_, err = in.GetXattr("geesefs.part-manifest")
+	t.Assert(err, Equals, syscall.ENODATA)
+}
+
+func (s *GoofysTest) TestPartManifestTooLarge(t *C) {
+	oldPartManifest := s.fs.flags.PartManifest
+	s.fs.flags.PartManifest = true
+	maxMetadataSize := s.fs.flags.MaxMetadataSize
+	s.fs.flags.MaxMetadataSize = 64
+	defer func() {
+		s.fs.flags.PartManifest = oldPartManifest
+		s.fs.flags.MaxMetadataSize = maxMetadataSize
+	}()
+
+	fh := s.testCreateAndWrite(t, "bigmanifest", 12*1024*1024, 128*1024, true)
+	in := fh.inode
+	fh.Release()
+	err := in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// The manifest isn't saved, but it's still readable and marked as unsaved
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "bigmanifest"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Metadata[PART_MANIFEST_ATTR], IsNil)
+	value, err := in.GetXattr("geesefs.part-manifest")
+	t.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(value)), "\n")
+	t.Assert(len(lines), Equals, 4)
+	t.Assert(strings.HasPrefix(lines[0], "1 0 5242880 "), Equals, true)
+	t.Assert(lines[3]+"\n", Equals, PART_MANIFEST_UNSAVED)
+}
+
+func (s *GoofysTest) TestRemoteDeleteDuringRead(t *C) {
+	data := make([]byte, 10*1024*1024)
+	for i := range data {
+		data[i] = byte(i%251)
+	}
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "rdel",
+		Body: bytes.NewReader(data),
+		Size: PUInt64(uint64(len(data))),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "rdel")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	buf, n, err := fh.ReadFile(0, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 4096)
+	t.Assert(bytes.Equal(bytes.Join(buf, nil), data[0:4096]), Equals, true)
+
+	_, err = s.cloud.DeleteBlob(&DeleteBlobInput{Key: "rdel"})
+	t.Assert(err, IsNil)
+
+	// Uncached range fails
+	_, _, err = fh.ReadFile(9*1024*1024, 4096)
+	t.Assert(err, Equals, syscall.EIO)
+
+	// Cached range is still readable
+	buf, n, err = fh.ReadFile(0, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 4096)
+	t.Assert(bytes.Equal(bytes.Join(buf, nil), data[0:4096]), Equals, true)
+
+	// Uncached range is returned as zeroes
+	remoteDeleteDuringRead := s.fs.flags.RemoteDeleteDuringRead
+	s.fs.flags.RemoteDeleteDuringRead = "zero-fill"
+	defer func() { s.fs.flags.RemoteDeleteDuringRead = remoteDeleteDuringRead }()
+	buf, n, err = fh.ReadFile(9*1024*1024, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 4096)
+	t.Assert(bytes.Equal(bytes.Join(buf, nil), make([]byte, 4096)), Equals, true)
+}
+
+func (s *GoofysTest) TestFlushWakeupDebounce(t *C) {
+	flushWakeupDebounce := s.fs.flags.FlushWakeupDebounce
+	flushWakeupNow, flushWakeupAfter := s.fs.flushWakeupNow, s.fs.flushWakeupAfter
+	flushWakeupTime := atomic.LoadInt64(&s.fs.flushWakeupTime)
+	defer func() {
+		s.fs.flags.FlushWakeupDebounce = flushWakeupDebounce
+		s.fs.flushWakeupNow, s.fs.flushWakeupAfter = flushWakeupNow, flushWakeupAfter
+		atomic.StoreInt64(&s.fs.flushWakeupTime, flushWakeupTime)
+	}()
+	// Fake clock and timers fired by the test
+	now := time.Now()
+	var delays []time.Duration
+	var timers []func()
+	s.fs.flushWakeupNow = func() time.Time { return now }
+	s.fs.flushWakeupAfter = func(d time.Duration, f func()) {
+		delays = append(delays, d)
+		timers = append(timers, f)
+	}
+
+	// Disabled by default
+	s.fs.flags.FlushWakeupDebounce = 0
+	for i := 0; i < 10; i++ {
+		t.Assert(s.fs.debounceFlusherWakeup(), Equals, true)
+	}
+	t.Assert(len(timers), Equals, 0)
+
+	s.fs.flags.FlushWakeupDebounce = 200*time.Millisecond
+	atomic.StoreInt64(&s.fs.flushWakeupTime, 0)
+	// The first wakeup after idle is immediate
+	t.Assert(s.fs.debounceFlusherWakeup(), Equals, true)
+
+	// Frequent wakeups are coalesced into one delayed wakeup...
+	now = now.Add(50*time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		t.Assert(s.fs.debounceFlusherWakeup(), Equals, false)
+	}
+	t.Assert(delays, DeepEquals, []time.Duration{150*time.Millisecond})
+
+	// ...which isn't lost
+	now = now.Add(150*time.Millisecond)
+	timers[0]()
+	t.Assert(atomic.LoadInt32(&s.fs.flushWakeupSet), Equals, int32(0))
+	t.Assert(atomic.LoadInt64(&s.fs.flushWakeupTime), Equals, now.UnixNano())
+
+	// Wakeups soon after the delayed one are coalesced again
+	now = now.Add(20*time.Millisecond)
+	t.Assert(s.fs.debounceFlusherWakeup(), Equals, false)
+	t.Assert(delays, DeepEquals, []time.Duration{150*time.Millisecond, 180*time.Millisecond})
+	now = now.Add(180*time.Millisecond)
+	timers[1]()
+
+	// And after an idle period they're immediate again
+	now = now.Add(time.Second)
+	t.Assert(s.fs.debounceFlusherWakeup(), Equals, true)
+	t.Assert(len(timers), Equals, 2)
+}
+
+// Write many small files rapidly and report flusher wakeups per file.
+// Run with -check.b -check.f 'BenchmarkSmallFiles.*'
+func (s *GoofysTest) benchmarkSmallFiles(t *C, debounce time.Duration) {
+	flushWakeupDebounce := s.fs.flags.FlushWakeupDebounce
+	s.fs.flags.FlushWakeupDebounce = debounce
+	defer func() { s.fs.flags.FlushWakeupDebounce = flushWakeupDebounce }()
+	root := s.getRoot(t)
+	atomic.StoreInt64(&s.fs.stats.flusherWakeups, 0)
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		_, fh := root.Create(fmt.Sprintf("bench_small_%v", i))
+		err := fh.WriteFile(0, []byte("x"), true)
+		t.Assert(err, IsNil)
+		fh.Release()
+	}
+	err := s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+	t.StopTimer()
+	t.Logf("%v files, %v flusher wakeups", t.N, atomic.LoadInt64(&s.fs.stats.flusherWakeups))
+}
+
+func (s *GoofysTest) BenchmarkSmallFilesNoDebounce(t *C) {
+	s.benchmarkSmallFiles(t, 0)
+}
+
+func (s *GoofysTest) BenchmarkSmallFilesDebounce(t *C) {
+	s.benchmarkSmallFiles(t, time.Millisecond)
+}
+
+func (s *GoofysTest) TestMaxKeyLength(t *C) {
+	root := s.getRoot(t)
+	dir, err := root.MkDir("keylen")
+	t.Assert(err, IsNil)
+	dir.mu.Lock()
+	_, prefix := dir.cloud()
+	dir.mu.Unlock()
+	maxKeyLength := s.fs.flags.MaxKeyLength
+	s.fs.flags.MaxKeyLength = len(prefix)+1+10
+	defer func() { s.fs.flags.MaxKeyLength = maxKeyLength }()
+
+	err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: dir.Id, Name: "0123456789"})
+	t.Assert(err, IsNil)
+	err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: dir.Id, Name: "0123456789a"})
+	t.Assert(err, Equals, syscall.ENAMETOOLONG)
+	// Directory keys end with a slash
+	err = s.fs.MkDir(nil, &fuseops.MkDirOp{Parent: dir.Id, Name: "012345678"})
+	t.Assert(err, IsNil)
+	err = s.fs.MkDir(nil, &fuseops.MkDirOp{Parent: dir.Id, Name: "abcdefghij"})
+	if s.cloud.Capabilities().DirBlob {
+		t.Assert(err, IsNil)
+	} else {
+		t.Assert(err, Equals, syscall.ENAMETOOLONG)
+	}
+
+	err = s.fs.Rename(nil, &fuseops.RenameOp{
+		OldParent: dir.Id,
+		NewParent: dir.Id,
+		OldName:   "0123456789",
+		NewName:   "0123456789a",
+	})
+	t.Assert(err, Equals, syscall.ENAMETOOLONG)
+
+	// Renaming a directory checks keys of all its children
+	s.fs.flags.MaxKeyLength = -1
+	sub, err := dir.MkDir("sub")
+	t.Assert(err, IsNil)
+	_, fh := sub.Create("child")
+	fh.Release()
+	s.fs.flags.MaxKeyLength = len(prefix)+1+len("sub/child")
+	err = s.fs.Rename(nil, &fuseops.RenameOp{
+		OldParent: dir.Id,
+		NewParent: dir.Id,
+		OldName:   "sub",
+		NewName:   "subdir",
+	})
+	t.Assert(err, Equals, syscall.ENAMETOOLONG)
+	err = s.fs.Rename(nil, &fuseops.RenameOp{
+		OldParent: dir.Id,
+		NewParent: dir.Id,
+		OldName:   "sub",
+		NewName:   "sud",
+	})
+	t.Assert(err, IsNil)
+
+	// By default, the limit of the backend is used
+	s.fs.flags.MaxKeyLength = 0
+	if limit := s.cloud.Capabilities().MaxKeyLength; limit > 0 {
+		name := strings.Repeat("x", limit-len(prefix))
+		err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: dir.Id, Name: name})
+		t.Assert(err, Equals, syscall.ENAMETOOLONG)
+		err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: dir.Id, Name: name[1:]})
+		t.Assert(err, IsNil)
+	}
+}
+
+func (s *GoofysTest) TestSparseReadCachePolicy(t *C) {
+	readCachePolicy := s.fs.flags.ReadCachePolicy
+	s.fs.flags.ReadCachePolicy = "sparse"
+	defer func() { s.fs.flags.ReadCachePolicy = readCachePolicy }()
+
+	data := make([]byte, 10*1024*1024)
+	for i := range data {
+		data[i] = byte(i%251)
+	}
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "sparse",
+		Body: bytes.NewReader(data),
+		Size: PUInt64(uint64(len(data))),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "sparse")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	offsets := []int64{9*1024*1024, 1024*1024, 5*1024*1024+100, 1024*1024+64*1024}
+	for _, off := range offsets {
+		buf, n, err := fh.ReadFile(off, 4096)
+		t.Assert(err, IsNil)
+		t.Assert(n, Equals, 4096)
+		t.Assert(bytes.Equal(bytes.Join(buf, nil), data[off:off+4096]), Equals, true)
+	}
+
+	// Only accessed ranges are cached
+	in.mu.Lock()
+	cached, _ := in.readProgress()
+	for _, b := range in.buffers {
+		inside := false
+		for _, off := range offsets {
+			if b.offset >= uint64(off) && b.offset+b.length <= uint64(off)+4096 {
+				inside = true
+			}
+		}
+		t.Assert(inside, Equals, true)
+	}
+	in.mu.Unlock()
+	t.Assert(cached, Equals, uint64(len(offsets)*4096))
+}
+
+func (s *GoofysTest) TestSetattrSymlink(t *C) {
+	enablePerms := s.fs.flags.EnablePerms
+	enableSpecials := s.fs.flags.EnableSpecials
+	uidAttr := s.fs.flags.UidAttr
+	gidAttr := s.fs.flags.GidAttr
+	fileModeAttr := s.fs.flags.FileModeAttr
+	s.fs.flags.EnablePerms = true
+	s.fs.flags.EnableSpecials = true
+	s.fs.flags.UidAttr = "uid"
+	s.fs.flags.GidAttr = "gid"
+	s.fs.flags.FileModeAttr = "mode"
+	defer func() {
+		s.fs.flags.EnablePerms = enablePerms
+		s.fs.flags.EnableSpecials = enableSpecials
+		s.fs.flags.UidAttr = uidAttr
+		s.fs.flags.GidAttr = gidAttr
+		s.fs.flags.FileModeAttr = fileModeAttr
+	}()
+	root := s.getRoot(t)
+	link := root.CreateSymlink("setattr_link", "target")
+	err := link.SyncFile()
+	t.Assert(err, IsNil)
+
+	// lchmod is a no-op
+	mode := os.FileMode(0600) | os.ModeSymlink
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: link.Id, Mode: &mode})
+	t.Assert(err, IsNil)
+	link.mu.Lock()
+	t.Assert(link.CacheState, Equals, ST_CACHED)
+	t.Assert(link.userMetadata["mode"], IsNil)
+	link.mu.Unlock()
+
+	// lchown updates uid/gid of the symlink itself
+	uid := s.fs.flags.Uid+1
+	gid := s.fs.flags.Gid+1
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: link.Id, Uid: &uid, Gid: &gid})
+	t.Assert(err, IsNil)
+	err = link.SyncFile()
+	t.Assert(err, IsNil)
+
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "setattr_link"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["uid"]), Equals, fmt.Sprintf("%d", uid))
+	t.Assert(NilStr(head.Metadata["gid"]), Equals, fmt.Sprintf("%d", gid))
+	t.Assert(head.Metadata["mode"], IsNil)
+
+	// The symlink is still intact after reloading its metadata
+	link.mu.Lock()
+	link.setMetadata(head.Metadata)
+	link.mu.Unlock()
+	target, err := link.ReadSymlink()
+	t.Assert(err, IsNil)
+	t.Assert(target, Equals, "target")
+	attr := link.InflateAttributes()
+	t.Assert(attr.Mode & os.ModeType, Equals, os.ModeSymlink)
+	t.Assert(attr.Uid, Equals, uid)
+	t.Assert(attr.Gid, Equals, gid)
+}
+
+func (s *GoofysTest) TestMknodSpecials(t *C) {
+	enableSpecials := s.fs.flags.EnableSpecials
+	fileModeAttr := s.fs.flags.FileModeAttr
+	rdevAttr := s.fs.flags.RdevAttr
+	s.fs.flags.EnableSpecials = true
+	s.fs.flags.FileModeAttr = "mode"
+	s.fs.flags.RdevAttr = "rdev"
+	defer func() {
+		s.fs.flags.EnableSpecials = enableSpecials
+		s.fs.flags.FileModeAttr = fileModeAttr
+		s.fs.flags.RdevAttr = rdevAttr
+	}()
+	root := s.getRoot(t)
+
+	specials := []struct {
+		name string
+		mode os.FileMode
+		rdev uint32
+	}{
+		{"mknod_chr", os.ModeDevice | os.ModeCharDevice | 0640, 0x0103},
+		{"mknod_blk", os.ModeDevice | 0600, 0x0801},
+		{"mknod_fifo", os.ModeNamedPipe | 0644, 0},
+		{"mknod_sock", os.ModeSocket | 0644, 0},
+	}
+	for _, sp := range specials {
+		op := fuseops.MkNodeOp{
+			Parent: root.Id,
+			Name:   sp.name,
+			Mode:   sp.mode,
+			Rdev:   sp.rdev,
+		}
+		err := s.fs.MkNode(nil, &op)
+		t.Assert(err, IsNil)
+		t.Assert(op.Entry.Attributes.Mode & os.ModeType, Equals, sp.mode & os.ModeType)
+		t.Assert(op.Entry.Attributes.Rdev, Equals, sp.rdev)
+	}
+	s.fs.SyncFS(nil)
+
+	for _, sp := range specials {
+		head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: sp.name})
+		t.Assert(err, IsNil)
+		t.Assert(head.Metadata["mode"], NotNil)
+		if sp.mode & os.ModeDevice != 0 {
+			t.Assert(NilStr(head.Metadata["rdev"]), Equals, fmt.Sprintf("%d", sp.rdev))
+		} else {
+			t.Assert(head.Metadata["rdev"], IsNil)
+		}
+	}
+
+	// Special files are reconstructed from metadata after a remount
+	s.fs = NewGoofys(context.Background(), s.fs.bucket, s.fs.flags)
+	t.Assert(s.fs, NotNil)
+	for _, sp := range specials {
+		in, err := s.LookUpInode(t, sp.name)
+		t.Assert(err, IsNil)
+		attr := in.InflateAttributes()
+		t.Assert(attr.Mode & os.ModeType, Equals, sp.mode & os.ModeType)
+		t.Assert(attr.Rdev, Equals, sp.rdev)
+	}
+
+	// Bogus types can't turn a file object into a directory or a symlink
+	in, err := s.LookUpInode(t, "mknod_fifo")
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	in.setMetadata(map[string]*string{
+		"mode": PString(fmt.Sprintf("%d", fuse.ConvertGolangMode(os.ModeDir | 0755))),
+	})
+	t.Assert(in.Attributes.Mode & os.ModeType, Equals, os.FileMode(0))
+	in.mu.Unlock()
+}
+
+func (s *GoofysTest) TestRefreshKeepsPendingChmod(t *C) {
+	enablePerms := s.fs.flags.EnablePerms
+	fileModeAttr := s.fs.flags.FileModeAttr
+	uidAttr := s.fs.flags.UidAttr
+	s.fs.flags.EnablePerms = true
+	s.fs.flags.FileModeAttr = "mode"
+	s.fs.flags.UidAttr = "uid"
+	defer func() {
+		s.fs.flags.EnablePerms = enablePerms
+		s.fs.flags.FileModeAttr = fileModeAttr
+		s.fs.flags.UidAttr = uidAttr
+	}()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"pending_chmod": PString("hello"),
+	})
+	in, err := s.LookUpInode(t, "pending_chmod")
+	t.Assert(err, IsNil)
+
+	// Don't let the flusher save the change before the refresh
+	in.mu.Lock()
+	in.IsFlushing += s.fs.flags.MaxParallelParts
+	in.mu.Unlock()
+	mode := os.FileMode(0600)
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: in.Id, Mode: &mode})
+	t.Assert(err, IsNil)
+
+	// The object is changed remotely and refreshed before the chmod is flushed
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:      "pending_chmod",
+		Body:     bytes.NewReader([]byte("world!")),
+		Size:     PUInt64(6),
+		Metadata: map[string]*string{"mode": PString("420"), "color": PString("blue")},
+	})
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "pending_chmod"})
+	t.Assert(err, IsNil)
+	in.SetFromBlobItem(&head.BlobItemOutput)
+
+	in.mu.Lock()
+	t.Assert(in.Attributes.Mode & os.ModePerm, Equals, os.FileMode(0600))
+	t.Assert(in.Attributes.Size, Equals, uint64(6))
+	t.Assert(string(in.userMetadata["color"]), Equals, "blue")
+	in.IsFlushing -= s.fs.flags.MaxParallelParts
+	in.mu.Unlock()
+
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	head, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "pending_chmod"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["mode"]), Equals, fmt.Sprintf("%d", fuse.ConvertGolangMode(0600)))
+	t.Assert(NilStr(head.Metadata["color"]), Equals, "blue")
+	t.Assert(head.Size, Equals, uint64(6))
+}
+
+func (s *GoofysTest) TestLazyXattrList(t *C) {
+	lazyXattrList := s.fs.flags.LazyXattrList
+	s.fs.flags.LazyXattrList = true
+	defer func() {
+		s.fs.flags.LazyXattrList = lazyXattrList
+	}()
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:      "lazy_xattr",
+		Body:     bytes.NewReader([]byte("hello")),
+		Size:     PUInt64(5),
+		Metadata: map[string]*string{"color": PString("blue")},
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "lazy_xattr")
+	t.Assert(err, IsNil)
+	// Forget metadata, as if the file was only seen in a listing
+	in.mu.Lock()
+	in.userMetadata = nil
+	in.mu.Unlock()
+
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+	}()
+
+	names, err := in.ListXattr()
+	t.Assert(err, IsNil)
+	t.Assert(cloud.Calls("HeadBlob"), Equals, 0)
+	for _, name := range names {
+		t.Assert(name, Not(Equals), "user.color")
+	}
+
+	// Values are still loaded on demand
+	value, err := in.GetXattr("user.color")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "blue")
+	t.Assert(cloud.Calls("HeadBlob"), Equals, 1)
+
+	names, err = in.ListXattr()
+	t.Assert(err, IsNil)
+	found := false
+	for _, name := range names {
+		found = found || name == "user.color"
+	}
+	t.Assert(found, Equals, true)
+	t.Assert(cloud.Calls("HeadBlob"), Equals, 1)
+}
+
+func (s *GoofysTest) TestOverwritePreservesMetadata(t *C) {
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:      "overwrite_meta",
+		Body:     bytes.NewReader([]byte("hello")),
+		Size:     PUInt64(5),
+		Metadata: map[string]*string{"color": PString("blue")},
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "overwrite_meta")
+	t.Assert(err, IsNil)
+	// Forget metadata, as if the file was only seen in a listing
+	in.mu.Lock()
+	in.userMetadata = nil
+	in.mu.Unlock()
+
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(0, []byte("world"), true)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "overwrite_meta"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["color"]), Equals, "blue")
+	t.Assert(head.Size, Equals, uint64(5))
+
+	// Explicitly changed metadata is uploaded along with new content
+	err = in.SetXattr("user.color", []byte("red"), 0)
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(5, []byte("!"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	head, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "overwrite_meta"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["color"]), Equals, "red")
+	t.Assert(head.Size, Equals, uint64(6))
+}
+
+func (s *GoofysTest) TestOverwritePreservesMetadataMtime(t *C) {
+	enableMtime := s.fs.flags.EnableMtime
+	s.fs.flags.EnableMtime = true
+	defer func() { s.fs.flags.EnableMtime = enableMtime }()
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "overwrite_mtime",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+		Metadata: map[string]*string{
+			"color":                 PString("blue"),
+			s.fs.flags.MtimeAttr: PString("1000000000"),
+		},
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "overwrite_mtime")
+	t.Assert(err, IsNil)
+	// Forget metadata, as if the file was only seen in a listing
+	in.mu.Lock()
+	in.userMetadata = nil
+	in.mu.Unlock()
+
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(0, []byte("world"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	in.mu.Lock()
+	mtime := in.Attributes.Mtime
+	in.mu.Unlock()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// The old mtime from the metadata doesn't replace the new one
+	in.mu.Lock()
+	t.Assert(in.Attributes.Mtime, Equals, mtime)
+	in.mu.Unlock()
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "overwrite_mtime"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["color"]), Equals, "blue")
+	t.Assert(NilStr(head.Metadata[s.fs.flags.MtimeAttr]) != "1000000000", Equals, true)
+}
+
+func (s *GoofysTest) TestSymlinkToDir(t *C) {
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"symdir_target/file": nil,
+	})
+	// Symlink to a directory stored by another client
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "symdir_link",
+		Body: bytes.NewReader([]byte{}),
+		Size: PUInt64(0),
+		Metadata: escapeMetadata(map[string][]byte{
+			s.fs.flags.SymlinkAttr: []byte("symdir_target"),
+		}),
+	})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	lookup := fuseops.LookUpInodeOp{
+		Parent: root.Id,
+		Name:   "symdir_link",
+	}
+	err = s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	t.Assert(lookup.Entry.Attributes.Mode & os.ModeType, Equals, os.ModeSymlink)
+
+	attr := fuseops.GetInodeAttributesOp{Inode: lookup.Entry.Child}
+	err = s.fs.GetInodeAttributes(nil, &attr)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Attributes.Mode & os.ModeType, Equals, os.ModeSymlink)
+	t.Assert(attr.Attributes.Nlink, Equals, uint32(1))
+
+	readlink := fuseops.ReadSymlinkOp{Inode: lookup.Entry.Child}
+	err = s.fs.ReadSymlink(nil, &readlink)
+	t.Assert(err, IsNil)
+	t.Assert(readlink.Target, Equals, "symdir_target")
+
+	// A symlink created through the filesystem stays a symlink too
+	link := root.CreateSymlink("symdir_link2", "symdir_target")
+	err = link.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(link.InflateAttributes().Mode & os.ModeType, Equals, os.ModeSymlink)
+	target, err := link.ReadSymlink()
+	t.Assert(err, IsNil)
+	t.Assert(target, Equals, "symdir_target")
+
+	// Directory objects are directories even with the symlink attribute
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "symdir_obj/",
+		Body: bytes.NewReader([]byte{}),
+		Size: PUInt64(0),
+		Metadata: escapeMetadata(map[string][]byte{
+			s.fs.flags.SymlinkAttr: []byte("symdir_target"),
+		}),
+	})
+	t.Assert(err, IsNil)
+	dir, err := s.LookUpInode(t, "symdir_obj")
+	t.Assert(err, IsNil)
+	t.Assert(dir.isDir(), Equals, true)
+	dir.mu.Lock()
+	t.Assert(dir.fillXattr(), IsNil)
+	t.Assert(dir.isSymlink(), Equals, false)
+	t.Assert(dir.InflateAttributes().Mode & os.ModeType, Equals, os.ModeDir)
+	dir.mu.Unlock()
+}
+
+func (s *GoofysTest) TestRenameListGrace(t *C) {
+	renameListGrace := s.fs.flags.RenameListGrace
+	s.fs.flags.RenameListGrace = time.Minute
+	defer func() { s.fs.flags.RenameListGrace = renameListGrace }()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"stalerename/a": nil,
+	})
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "stalerename/a"})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	// Return deleted objects in listings, like an eventually consistent server
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var stale []BlobItemOutput
+	cloud.list = func(param *ListBlobsInput) (*ListBlobsOutput, error) {
+		resp, err := cloud.StorageBackend.ListBlobs(param)
+		if err != nil {
+			return resp, err
+		}
+		for _, item := range stale {
+			key := *item.Key
+			if param.Prefix != nil {
+				if !strings.HasPrefix(key, *param.Prefix) {
+					continue
+				}
+				key = key[len(*param.Prefix):]
+			}
+			if param.Delimiter != nil && strings.Contains(key, *param.Delimiter) {
+				continue
+			}
+			resp.Items = append(resp.Items, item)
+		}
+		sort.Slice(resp.Items, func(i, j int) bool {
+			return *resp.Items[i].Key < *resp.Items[j].Key
+		})
+		return resp, nil
+	}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	dir, err := s.LookUpInode(t, "stalerename")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir, []string{"a"})
+	err = dir.Rename("a", dir, "b")
+	t.Assert(err, IsNil)
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+
+	// The server still lists the old key
+	stale = []BlobItemOutput{head.BlobItemOutput}
+	stale[0].Key = PString("stalerename/a")
+	dir.mu.Lock()
+	dir.dir.DirTime = time.Time{}
+	dir.mu.Unlock()
+	s.assertEntries(t, dir, []string{"b"})
+
+	// After the grace period the listing is trusted again
+	s.fs.mu.Lock()
+	t.Assert(s.fs.renamedKeys["stalerename/a"].IsZero(), Equals, false)
+	s.fs.renamedKeys["stalerename/a"] = time.Now().Add(-time.Second)
+	s.fs.mu.Unlock()
+	dir.mu.Lock()
+	dir.dir.DirTime = time.Time{}
+	dir.mu.Unlock()
+	s.assertEntries(t, dir, []string{"a", "b"})
+}
+
+// Rename a file and check which of the two keys exist after every
+// modification. Returns if data was missing from both or was in both
+func (s *GoofysTest) renameModified(t *C, order string, modify bool) (lost, both bool) {
+	renameFlushOrder := s.fs.flags.RenameFlushOrder
+	s.fs.flags.RenameFlushOrder = order
+	defer func() { s.fs.flags.RenameFlushOrder = renameFlushOrder }()
+	from := fmt.Sprintf("renameorder_from_%v_%v", order, modify)
+	to := fmt.Sprintf("renameorder_to_%v_%v", order, modify)
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  from,
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	check := func() {
+		_, errFrom := cloud.StorageBackend.HeadBlob(&HeadBlobInput{Key: from})
+		_, errTo := cloud.StorageBackend.HeadBlob(&HeadBlobInput{Key: to})
+		if errFrom != nil && errTo != nil {
+			lost = true
+		}
+		if errFrom == nil && errTo == nil {
+			both = true
+		}
+	}
+	cloud.put = func(param *PutBlobInput) (*PutBlobOutput, error) {
+		defer check()
+		return cloud.StorageBackend.PutBlob(param)
+	}
+	cloud.copy = func(param *CopyBlobInput) (*CopyBlobOutput, error) {
+		defer check()
+		return cloud.StorageBackend.CopyBlob(param)
+	}
+	cloud.del = func(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+		defer check()
+		return cloud.StorageBackend.DeleteBlob(param)
+	}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	in, err := s.LookUpInode(t, from)
+	t.Assert(err, IsNil)
+	if modify {
+		fh, err := in.OpenFile()
+		t.Assert(err, IsNil)
+		err = fh.WriteFile(5, []byte(" world"), true)
+		t.Assert(err, IsNil)
+		fh.Release()
+	}
+	err = root.Rename(from, root, to)
+	t.Assert(err, IsNil)
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: from})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: to})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	if modify {
+		t.Assert(string(data), Equals, "hello world")
+	} else {
+		t.Assert(string(data), Equals, "hello")
+	}
+	return
+}
+
+func (s *GoofysTest) TestRenameFlushOrder(t *C) {
+	// Data never disappears from both keys by default
+	lost, _ := s.renameModified(t, "copy-first", true)
+	t.Assert(lost, Equals, false)
+
+	// Both keys never exist at once with delete-first
+	_, both := s.renameModified(t, "delete-first", true)
+	t.Assert(both, Equals, false)
+
+	// Unmodified files are always copied first
+	lost, _ = s.renameModified(t, "delete-first", false)
+	t.Assert(lost, Equals, false)
+}
+
+func (s *GoofysTest) TestPartialReadOnError(t *C) {
+	readCachePolicy := s.fs.flags.ReadCachePolicy
+	partialReadOnError := s.fs.flags.PartialReadOnError
+	s.fs.flags.ReadCachePolicy = "sparse"
+	defer func() {
+		s.fs.flags.ReadCachePolicy = readCachePolicy
+		s.fs.flags.PartialReadOnError = partialReadOnError
+	}()
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i%251)
+	}
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "partialread",
+		Body: bytes.NewReader(data),
+		Size: PUInt64(uint64(len(data))),
+	})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	// Fail all reads when broken
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var broken int32
+	cloud.get = func(param *GetBlobInput) (*GetBlobOutput, error) {
+		if atomic.LoadInt32(&broken) != 0 {
+			return nil, syscall.EIO
+		}
+		return cloud.StorageBackend.GetBlob(param)
+	}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	in, err := s.LookUpInode(t, "partialread")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	// Cache two ranges with a gap between them
+	_, _, err = fh.ReadFile(0, 64*1024)
+	t.Assert(err, IsNil)
+	_, _, err = fh.ReadFile(512*1024, 64*1024)
+	t.Assert(err, IsNil)
+
+	atomic.StoreInt32(&broken, 1)
+	// Fail-fast by default
+	_, _, err = fh.ReadFile(0, 1024*1024)
+	t.Assert(err, NotNil)
+
+	// Cached prefix up to the first failed range
+	s.fs.flags.PartialReadOnError = true
+	buf, n, err := fh.ReadFile(0, 1024*1024)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 64*1024)
+	t.Assert(bytes.Equal(bytes.Join(buf, nil), data[0:64*1024]), Equals, true)
+	buf, n, err = fh.ReadFile(32*1024, 512*1024)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 32*1024)
+	t.Assert(bytes.Equal(bytes.Join(buf, nil), data[32*1024:64*1024]), Equals, true)
+
+	// Nothing to return if the read starts at the failed range
+	_, _, err = fh.ReadFile(128*1024, 4096)
+	t.Assert(err, NotNil)
+}
+
+const (
+	STITCH_UNCACHED = iota
+	STITCH_CLEAN
+	STITCH_DIRTY
+	STITCH_ZERO
+)
+
+func (s *GoofysTest) TestReadStitching(t *C) {
+	readCachePolicy := s.fs.flags.ReadCachePolicy
+	s.fs.flags.ReadCachePolicy = "sparse"
+	defer func() { s.fs.flags.ReadCachePolicy = readCachePolicy }()
+
+	const size = 64*1024
+	orig := make([]byte, size)
+	for i := range orig {
+		orig[i] = byte(i%251)
+	}
+	states := []int{STITCH_UNCACHED, STITCH_CLEAN, STITCH_DIRTY, STITCH_ZERO}
+	for _, s0 := range states {
+		for _, s1 := range states {
+			for _, s2 := range states {
+				layout := []int{s0, s1, s2}
+				name := fmt.Sprintf("stitch%v%v%v", s0, s1, s2)
+				_, err := s.cloud.PutBlob(&PutBlobInput{
+					Key:  name,
+					Body: bytes.NewReader(orig),
+					Size: PUInt64(size),
+				})
+				t.Assert(err, IsNil)
+				in, err := s.LookUpInode(t, name)
+				t.Assert(err, IsNil)
+				fh, err := in.OpenFile()
+				t.Assert(err, IsNil)
+
+				// Neighbouring regions partially overlap each other
+				model := append([]byte{}, orig...)
+				for k, state := range layout {
+					off := int64(4096 + k*6000 - 1000)
+					end := int64(4096 + (k+1)*6000 + 1000)
+					switch state {
+					case STITCH_CLEAN:
+						_, _, err = fh.ReadFile(off, end-off)
+						t.Assert(err, IsNil)
+					case STITCH_DIRTY:
+						data := bytes.Repeat([]byte{byte('A'+k)}, int(end-off))
+						err = fh.WriteFile(off, data, true)
+						t.Assert(err, IsNil)
+						copy(model[off:end], data)
+					case STITCH_ZERO:
+						err = s.fs.Fallocate(nil, &fuseops.FallocateOp{
+							Inode:  in.Id,
+							Offset: uint64(off),
+							Length: uint64(end-off),
+							Mode:   FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE,
+						})
+						t.Assert(err, IsNil)
+						for i := off; i < end; i++ {
+							model[i] = 0
+						}
+					}
+				}
+
+				// Reads crossing all region boundaries at different points
+				for _, r := range [][2]int64{{0, size}, {3000, 20000}, {6000, 9000}, {9000, 14000}, {15000, 23000}} {
+					bufs, n, err := fh.ReadFile(r[0], r[1]-r[0])
+					t.Assert(err, IsNil)
+					t.Assert(n, Equals, int(r[1]-r[0]))
+					if !bytes.Equal(bytes.Join(bufs, nil), model[r[0]:r[1]]) {
+						t.Fatalf("Wrong data in %v at %v-%v", name, r[0], r[1])
+					}
+				}
+
+				// And the flushed object is the same
+				err = in.SyncFile()
+				t.Assert(err, IsNil)
+				fh.Release()
+				resp, err := s.cloud.GetBlob(&GetBlobInput{Key: name})
+				t.Assert(err, IsNil)
+				data, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				t.Assert(err, IsNil)
+				if !bytes.Equal(data, model) {
+					t.Fatalf("Wrong data in flushed %v", name)
+				}
+			}
+		}
+	}
+}
+
+func (s *GoofysTest) TestWriteDuringSlowRead(t *C) {
+	// Write 2 parts and wait until they're flushed
+	fh := s.testCreateAndWrite(t, "slowread", 10*1024*1024, 128*1024, true)
+	defer fh.Release()
+	in := fh.inode
+	for {
+		in.mu.Lock()
+		dirty := false
+		for _, buf := range in.buffers {
+			if buf.state == BUF_DIRTY {
+				dirty = true
+				break
+			}
+		}
+		in.mu.Unlock()
+		if !dirty {
+			break
+		}
+		s.fs.flusherMu.Lock()
+		if s.fs.flushPending == 0 {
+			s.fs.flusherCond.Wait()
+		}
+		s.fs.flusherMu.Unlock()
+	}
+	// Evict the first part so that reading it requires to complete the upload
+	s.fs.FreeSomeCleanBuffers(10*1024*1024)
+	in.mu.Lock()
+	t.Assert(in.buffers[0].state, Equals, BUF_FL_CLEARED)
+	in.mu.Unlock()
+
+	root := s.getRoot(t)
+	// Hold GET requests until released
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	cloud.get = func(param *GetBlobInput) (*GetBlobOutput, error) {
+		started <- struct{}{}
+		<-release
+		return cloud.StorageBackend.GetBlob(param)
+	}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	// Read the evicted part back while the server is slow
+	readDone := make(chan []byte)
+	go func() {
+		buf, _, err := fh.ReadFile(0, 4096)
+		t.Assert(err, IsNil)
+		readDone <- bytes.Join(buf, nil)
+	}()
+	<-started
+
+	// Writers wait for the flush, but not for the following read
+	writeDone := make(chan error)
+	go func() {
+		writeDone <- fh.WriteFile(8*1024*1024, []byte("hello"), true)
+	}()
+	select {
+	case err := <-writeDone:
+		t.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		close(release)
+		<-readDone
+		t.Fatal("write waited for the slow read")
+	}
+
+	close(release)
+	read := <-readDone
+	expected := make([]byte, 4096)
+	_, err := io.ReadFull(&SeqReader{}, expected)
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(read, expected), Equals, true)
+}
+
+func (s *GoofysTest) TestDeleteDuringMultipartBegin(t *C) {
+	root := s.getRoot(t)
+	// Hold multipart upload initiation until released and track aborted uploads
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var begun, aborted []string
+	cloud.mpuBegin = func(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+		started <- struct{}{}
+		<-release
+		resp, err := cloud.StorageBackend.MultipartBlobBegin(param)
+		if err == nil {
+			cloud.mu.Lock()
+			begun = append(begun, NilStr(resp.UploadId))
+			cloud.mu.Unlock()
+		}
+		return resp, err
+	}
+	cloud.mpuAbort = func(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+		resp, err := cloud.StorageBackend.MultipartBlobAbort(param)
+		if err == nil {
+			cloud.mu.Lock()
+			aborted = append(aborted, NilStr(param.UploadId))
+			cloud.mu.Unlock()
+		}
+		return resp, err
+	}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	in, fh := root.Create("delete_mpu")
+	err := fh.WriteFile(0, make([]byte, 12*1024*1024), true)
+	t.Assert(err, IsNil)
+	// Closing the file starts the upload
+	fh.Release()
+	in.fs.WakeupFlusher()
+	<-started
+
+	err = root.Unlink("delete_mpu")
+	t.Assert(err, IsNil)
+	close(release)
+	s.fs.SyncFS(nil)
+
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "delete_mpu"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	// The upload initiated for the deleted file is aborted
+	for i := 0; i < 100; i++ {
+		cloud.mu.Lock()
+		done := len(aborted) == len(begun)
+		cloud.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	cloud.mu.Lock()
+	t.Assert(len(begun), Equals, 1)
+	t.Assert(aborted, DeepEquals, begun)
+	cloud.mu.Unlock()
+}
+
+func (s *GoofysTest) TestConcurrentRefreshSingleHead(t *C) {
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "refresh_herd",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "refresh_herd")
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	// Count HEADs by key and make them slow
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	heads := make(map[string]int)
+	cloud.head = func(param *HeadBlobInput) (*HeadBlobOutput, error) {
+		cloud.mu.Lock()
+		heads[param.Key]++
+		cloud.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		return cloud.StorageBackend.HeadBlob(param)
+	}
+	root.dir.cloud = cloud
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+	}()
+
+	// Expire the inode and the listing it was found in
+	in.mu.Lock()
+	in.AttrTime = time.Time{}
+	in.mu.Unlock()
+	root.mu.Lock()
+	root.dir.Gaps = nil
+	root.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	ids := make([]fuseops.InodeID, 16)
+	for i := 0; i < len(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			op := fuseops.LookUpInodeOp{Parent: root.Id, Name: "refresh_herd"}
+			errs[i] = s.fs.LookUpInode(nil, &op)
+			ids[i] = op.Entry.Child
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range errs {
+		t.Assert(errs[i], IsNil)
+		t.Assert(ids[i], Equals, in.Id)
+	}
+	cloud.mu.Lock()
+	t.Assert(heads["refresh_herd"], Equals, 1)
+	cloud.mu.Unlock()
+}
+
+func (s *GoofysTest) TestRenameServerSideCopy(t *C) {
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:      "ssc_from",
+		Body:     bytes.NewReader([]byte("hello")),
+		Size:     PUInt64(5),
+		Metadata: map[string]*string{"color": PString("blue")},
+	})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var copies []CopyBlobInput
+	cloud.copy = func(param *CopyBlobInput) (*CopyBlobOutput, error) {
+		cloud.mu.Lock()
+		copies = append(copies, *param)
+		cloud.mu.Unlock()
+		return cloud.StorageBackend.CopyBlob(param)
+	}
+	root.dir.cloud = cloud
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+	}()
+
+	in, err := s.LookUpInode(t, "ssc_from")
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	etag := in.knownETag
+	storageClass := in.s3Metadata["storage-class"]
+	in.mu.Unlock()
+
+	err = root.Rename("ssc_from", root, "ssc_to")
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// Data isn't transferred through the client
+	t.Assert(cloud.Calls("GetBlob")+cloud.Calls("PutBlob"), Equals, 0)
+	cloud.mu.Lock()
+	t.Assert(len(copies), Equals, 1)
+	copyIn := copies[0]
+	cloud.mu.Unlock()
+	t.Assert(copyIn.Source, Equals, "ssc_from")
+	t.Assert(copyIn.Destination, Equals, "ssc_to")
+	t.Assert(*copyIn.Size, Equals, uint64(5))
+	t.Assert(*copyIn.ETag, Equals, etag)
+	if storageClass != nil {
+		t.Assert(*copyIn.StorageClass, Equals, string(storageClass))
+	}
+
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "ssc_from"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "ssc_to"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Metadata["color"], NotNil)
+	t.Assert(*head.Metadata["color"], Equals, "blue")
+
+	// ETag of the copy is known, so it isn't a remote change
+	in.mu.Lock()
+	t.Assert(in.knownETag, Equals, *head.ETag)
+	t.Assert(in.CacheState, Equals, ST_CACHED)
+	in.mu.Unlock()
+}
+
+func (s *GoofysTest) TestRenameCopyPreconditionFailed(t *C) {
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "ssc412_from",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	root := s.getRoot(t)
+	_, err = s.LookUpInode(t, "ssc412_from")
+	t.Assert(err, IsNil)
+
+	// The object is replaced remotely, so the copy with the known ETag fails once
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "ssc412_from",
+		Body: bytes.NewReader([]byte("world!")),
+		Size: PUInt64(6),
+	})
+	t.Assert(err, IsNil)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	failed := false
+	cloud.copy = func(param *CopyBlobInput) (*CopyBlobOutput, error) {
+		if !failed {
+			failed = true
+			return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed",
+				"At least one of the pre-conditions you specified did not hold", nil), 412, "")
+		}
+		return cloud.StorageBackend.CopyBlob(param)
+	}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	err = root.Rename("ssc412_from", root, "ssc412_to")
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "ssc412_to")
+	t.Assert(err, IsNil)
+	done := make(chan error)
+	go func() {
+		done <- in.SyncFile()
+	}()
+	select {
+	case err = <-done:
+		t.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rename is retried forever after a failed precondition")
+	}
+	t.Assert(cloud.Calls("CopyBlob"), Equals, 2)
+
+	// The new version is renamed and the inode knows about it
+	res, err := s.cloud.GetBlob(&GetBlobInput{Key: "ssc412_to"})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "world!")
+	in.mu.Lock()
+	t.Assert(in.Attributes.Size, Equals, uint64(6))
+	in.mu.Unlock()
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "ssc412_from"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) conflictWithLocalWrite(t *C, key string) (*Inode, *BlobItemOutput) {
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  key,
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, key)
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(0, []byte("local!"), true)
+	t.Assert(err, IsNil)
+
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  key,
+		Body: bytes.NewReader([]byte("remote version")),
+		Size: PUInt64(14),
+	})
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: key})
+	t.Assert(err, IsNil)
+	// The open handle keeps the small file from being flushed before the refresh
+	in.SetFromBlobItem(&head.BlobItemOutput)
+	fh.Release()
+	return in, &head.BlobItemOutput
+}
+
+func (s *GoofysTest) readBlob(t *C, key string) string {
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: key})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	t.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *GoofysTest) TestConflictPolicy(t *C) {
+	conflictPolicy := s.fs.flags.ConflictPolicy
+	defer func() { s.fs.flags.ConflictPolicy = conflictPolicy }()
+
+	// Local changes are dropped by default
+	in, _ := s.conflictWithLocalWrite(t, "conflict_drop")
+	t.Assert(in.CacheState, Equals, ST_CACHED)
+	t.Assert(in.Attributes.Size, Equals, uint64(14))
+
+	s.fs.flags.ConflictPolicy = "keep-local"
+	in, _ = s.conflictWithLocalWrite(t, "conflict_keep")
+	t.Assert(in.CacheState, Equals, ST_MODIFIED)
+	err := in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(s.readBlob(t, "conflict_keep"), Equals, "local!")
+
+	s.fs.flags.ConflictPolicy = "rename-remote"
+	in, item := s.conflictWithLocalWrite(t, "conflict_rename")
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(s.readBlob(t, "conflict_rename"), Equals, "local!")
+	conflictKey := "conflict_rename.conflict-" + strings.Trim(*item.ETag, "\"")
+	t.Assert(s.readBlob(t, conflictKey), Equals, "remote version")
+}
+
+func (s *GoofysTest) TestConflictPolicyKeepLocalPartial(t *C) {
+	conflictPolicy := s.fs.flags.ConflictPolicy
+	s.fs.flags.ConflictPolicy = "keep-local"
+	defer func() { s.fs.flags.ConflictPolicy = conflictPolicy }()
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "conflict_partial",
+		Body: bytes.NewReader([]byte("0123456789")),
+		Size: PUInt64(10),
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "conflict_partial")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	bufs, _, err := fh.ReadFile(0, 10)
+	t.Assert(err, IsNil)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "0123456789")
+
+	// Only the start of the cached file is overwritten locally
+	s.fs.PauseFlush(true)
+	err = fh.WriteFile(0, []byte("AB"), true)
+	t.Assert(err, IsNil)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "conflict_partial",
+		Body: bytes.NewReader([]byte("abcdefghij")),
+		Size: PUInt64(10),
+	})
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "conflict_partial"})
+	t.Assert(err, IsNil)
+	in.SetFromBlobItem(&head.BlobItemOutput)
+
+	// The rest is taken from the new remote version, not from the stale cache
+	bufs, _, err = fh.ReadFile(0, 10)
+	t.Assert(err, IsNil)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "ABcdefghij")
+	s.fs.PauseFlush(false)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(s.readBlob(t, "conflict_partial"), Equals, "ABcdefghij")
+}
+
+func (s *GoofysTest) TestConflictPolicyListTwice(t *C) {
+	conflictPolicy := s.fs.flags.ConflictPolicy
+	s.fs.flags.ConflictPolicy = "rename-remote"
+	defer func() { s.fs.flags.ConflictPolicy = conflictPolicy }()
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "conflict_dir/file",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	dir, err := s.LookUpInode(t, "conflict_dir")
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "conflict_dir/file")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(0, []byte("local!"), true)
+	t.Assert(err, IsNil)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "conflict_dir/file",
+		Body: bytes.NewReader([]byte("remote version")),
+		Size: PUInt64(14),
+	})
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "conflict_dir/file"})
+	t.Assert(err, IsNil)
+
+	// Both listings return the remote version, but only the first one is a conflict
+	for i := 0; i < 2; i++ {
+		dir.mu.Lock()
+		dir.dir.DirTime = time.Time{}
+		dir.mu.Unlock()
+		s.readDirIntoCache(t, dir.Id)
+	}
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	t.Assert(cloud.Calls("CopyBlob"), Equals, 1)
+	t.Assert(s.readBlob(t, "conflict_dir/file"), Equals, "local!")
+	conflictKey := "conflict_dir/file.conflict-" + strings.Trim(*head.ETag, "\"")
+	t.Assert(s.readBlob(t, conflictKey), Equals, "remote version")
+}
+
+func (s *GoofysTest) TestConflictPolicyXattrOnly(t *C) {
+	conflictPolicy := s.fs.flags.ConflictPolicy
+	s.fs.flags.ConflictPolicy = "keep-local"
+	defer func() { s.fs.flags.ConflictPolicy = conflictPolicy }()
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "conflict_xattr",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "conflict_xattr")
+	t.Assert(err, IsNil)
+
+	s.fs.flags.MaxFlushers = 0
+	err = in.SetXattr("user.color", []byte("red"), 0)
+	t.Assert(err, IsNil)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "conflict_xattr",
+		Body: bytes.NewReader([]byte("remote version")),
+		Size: PUInt64(14),
+	})
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "conflict_xattr"})
+	t.Assert(err, IsNil)
+	in.SetFromBlobItem(&head.BlobItemOutput)
+	s.fs.flags.MaxFlushers = 16
+
+	// Remote data is taken, local xattrs are written over it
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(s.readBlob(t, "conflict_xattr"), Equals, "remote version")
+	head, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "conflict_xattr"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Metadata["color"], NotNil)
+	t.Assert(*head.Metadata["color"], Equals, "red")
+}
+
+func (s *GoofysTest) TestStorageClassXattr(t *C) {
+	if _, ok := s.cloud.Delegate().(*S3Backend); !ok {
+		t.Skip("only for S3")
+	}
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var classes []string
+	cloud.put = func(param *PutBlobInput) (*PutBlobOutput, error) {
+		cloud.mu.Lock()
+		classes = append(classes, NilStr(param.StorageClass))
+		cloud.mu.Unlock()
+		// Test servers may not support archival storage classes
+		p := *param
+		p.StorageClass = nil
+		return cloud.StorageBackend.PutBlob(&p)
+	}
+	root.dir.cloud = cloud
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+	}()
+
+	in, fh := root.Create("storage_class")
+	err := fh.WriteFile(0, []byte("cold data"), true)
+	t.Assert(err, IsNil)
+
+	err = in.SetXattr("s3.storage-class", []byte("COLD"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+	err = in.SetXattr("s3.storage-class", []byte("GLACIER"), 0)
+	t.Assert(err, IsNil)
+	// Other s3.* attributes are still read-only
+	err = in.SetXattr("s3.etag", []byte("x"), 0)
+	t.Assert(err, Equals, syscall.EPERM)
+
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	cloud.mu.Lock()
+	t.Assert(classes, DeepEquals, []string{"GLACIER"})
+	cloud.mu.Unlock()
+
+	names, err := in.ListXattr()
+	t.Assert(err, IsNil)
+	found := false
+	for _, name := range names {
+		found = found || name == "s3.storage-class"
+	}
+	t.Assert(found, Equals, true)
+}
+
+func (s *GoofysTest) TestCompressBuffers(t *C) {
+	root := s.getRoot(t)
+	in, fh := root.Create("compress_buffers")
+	data := bytes.Repeat([]byte("compressible data "), 64*1024)
+	s.fs.flags.MaxFlushers = 0
+	err := fh.WriteFile(0, data, true)
+	t.Assert(err, IsNil)
+
+	before := atomic.LoadInt64(&s.fs.bufferPool.cur)
+	freed := int64(0)
+	s.fs.bufferPool.mu.Lock()
+	in.mu.Lock()
+	for _, buf := range in.buffers {
+		freed += in.compressBuffer(buf, 0)
+		t.Assert(buf.compressed, Equals, true)
+	}
+	in.mu.Unlock()
+	s.fs.bufferPool.mu.Unlock()
+	t.Assert(freed > int64(len(data))/2, Equals, true)
+	t.Assert(atomic.LoadInt64(&s.fs.bufferPool.cur), Equals, before-freed)
+
+	// Reads and writes decompress buffers back
+	err = fh.WriteFile(5, []byte("X"), true)
+	t.Assert(err, IsNil)
+	data[5] = 'X'
+	bufs, nread, err := fh.ReadFile(0, int64(len(data)))
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, len(data))
+	t.Assert(bytes.Equal(bytes.Join(bufs, nil), data), Equals, true)
+
+	s.fs.flags.MaxFlushers = 16
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(s.readBlob(t, "compress_buffers") == string(data), Equals, true)
+}
+
+type OpaqueETagBackend struct {
+	StorageBackend
+}
+
+func (s *OpaqueETagBackend) Capabilities() *Capabilities {
+	caps := *s.StorageBackend.Capabilities()
+	caps.OpaqueETag = true
+	return &caps
+}
+
+func (s *GoofysTest) TestRemoteChangedOpaqueETag(t *C) {
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "opaque_etag",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "opaque_etag")
+	t.Assert(err, IsNil)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.knownMtime.IsZero() {
+		t.Skip("backend doesn't return modification time")
+	}
+	item := &BlobItemOutput{
+		Key:          PString("opaque_etag"),
+		ETag:         PString("\"another\""),
+		LastModified: &in.knownMtime,
+		Size:         5,
+	}
+	t.Assert(in.remoteChanged(item), Equals, true)
+
+	root := s.getRoot(t)
+	cloud := &OpaqueETagBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+	// Only modification time is reliable with opaque ETags
+	t.Assert(in.remoteChanged(item), Equals, false)
+	later := in.knownMtime.Add(time.Second)
+	item.LastModified = &later
+	t.Assert(in.remoteChanged(item), Equals, true)
+}
+
+func (s *GoofysTest) TestMetrics(t *C) {
+	m := &s.fs.metrics
+	dirty := atomic.LoadInt64(&m.dirtyBytes)
+	root := s.getRoot(t)
+	in, fh := root.Create("metrics_file")
+	err := fh.WriteFile(0, []byte("hello metrics"), true)
+	t.Assert(err, IsNil)
+	t.Assert(atomic.LoadInt64(&m.dirtyBytes), Equals, dirty+13)
+	t.Assert(atomic.LoadInt64(&m.cacheStates[ST_CREATED]) >= 1, Equals, true)
+
+	// Overwrites don't count twice
+	err = fh.WriteFile(6, []byte("METRICS"), true)
+	t.Assert(err, IsNil)
+	t.Assert(atomic.LoadInt64(&m.dirtyBytes), Equals, dirty+13)
+
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(atomic.LoadInt64(&m.dirtyBytes), Equals, dirty)
+
+	var out bytes.Buffer
+	s.fs.WriteMetrics(&out)
+	text := out.String()
+	t.Assert(strings.Contains(text, "# TYPE geesefs_inodes gauge\n"), Equals, true)
+	t.Assert(strings.Contains(text, "geesefs_inodes_by_state{state=\"created\"} 0\n"), Equals, true)
+	in.mu.Lock()
+	cloud, _ := in.cloud()
+	in.mu.Unlock()
+	label := fmt.Sprintf("{backend=%q,bucket=%q}", cloud.Capabilities().Name, cloud.Bucket())
+	t.Assert(strings.Contains(text, "geesefs_uploaded_bytes_total"+label+" 13\n"), Equals, true)
+}
+
+func (s *GoofysTest) TestNegativeLookupCache(t *C) {
+	negCacheTTL := s.fs.flags.NegCacheTTL
+	s.fs.flags.NegCacheTTL = time.Minute
+	defer func() { s.fs.flags.NegCacheTTL = negCacheTTL }()
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+	forgetListing := func() {
+		root.mu.Lock()
+		root.dir.Gaps = nil
+		root.dir.DirTime = time.Time{}
+		root.mu.Unlock()
+	}
+
+	forgetListing()
+	_, err := s.LookUpInode(t, "neg_missing")
+	t.Assert(err, Equals, fuse.ENOENT)
+	t.Assert(cloud.Calls("HeadBlob")+cloud.Calls("ListBlobs") > 0, Equals, true)
+
+	// The second lookup doesn't reach the server even without the listing cache
+	forgetListing()
+	cloud.ResetCalls()
+	_, err = s.LookUpInode(t, "neg_missing")
+	t.Assert(err, Equals, fuse.ENOENT)
+	t.Assert(cloud.Calls("HeadBlob")+cloud.Calls("ListBlobs"), Equals, 0)
+
+	// Creating the file invalidates the entry
+	_, fh := root.Create("neg_missing")
+	fh.Release()
+	in, err := s.LookUpInode(t, "neg_missing")
+	t.Assert(err, IsNil)
+	t.Assert(in, NotNil)
+
+	// A directory gaining children is found when the parent is listed again
+	_, err = s.LookUpInode(t, "neg_dir")
+	t.Assert(err, Equals, fuse.ENOENT)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "neg_dir/file",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	forgetListing()
+	_, err = s.LookUpInode(t, "neg_dir")
+	t.Assert(err, Equals, fuse.ENOENT)
+	dir, err := root.LookUp("neg_dir", true)
+	t.Assert(err, IsNil)
+	t.Assert(dir, NotNil)
+	t.Assert(dir.isDir(), Equals, true)
+	root.mu.Lock()
+	t.Assert(root.isNegCached("neg_dir"), Equals, false)
+	root.mu.Unlock()
+	in, err = s.LookUpInode(t, "neg_dir")
+	t.Assert(err, IsNil)
+	t.Assert(in, Equals, dir)
+}
+
+func (s *GoofysTest) TestXattrPrefetch(t *C) {
+	if !s.cloud.Capabilities().ParallelHead {
+		t.Skip("only for backends with cheap HEAD requests")
+	}
+	xattrPrefetch := s.fs.flags.XattrPrefetch
+	s.fs.flags.XattrPrefetch = 4
+	s.fs.xattrPrefetchSlots = make(chan struct{}, 4)
+	defer func() {
+		s.fs.flags.XattrPrefetch = xattrPrefetch
+		s.fs.xattrPrefetchSlots = nil
+	}()
+	names := []string{"file1", "file2", "file3"}
+	for _, name := range names {
+		_, err := s.cloud.PutBlob(&PutBlobInput{
+			Key:      "xattr_prefetch/"+name,
+			Body:     bytes.NewReader([]byte("hello")),
+			Size:     PUInt64(5),
+			Metadata: map[string]*string{"color": PString(name)},
+		})
+		t.Assert(err, IsNil)
+	}
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+
+	dir, err := s.LookUpInode(t, "xattr_prefetch")
+	t.Assert(err, IsNil)
+	s.readDirIntoCache(t, dir.Id)
+
+	for _, name := range names {
+		in := dir.findChild(name)
+		t.Assert(in, NotNil)
+		loaded := false
+		for i := 0; i < 100 && !loaded; i++ {
+			in.mu.Lock()
+			loaded = in.userMetadata != nil && in.xattrLoading == nil
+			in.mu.Unlock()
+			if !loaded {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		t.Assert(loaded, Equals, true)
+	}
+
+	// getxattr is served from the prefetched metadata
+	cloud.ResetCalls()
+	for _, name := range names {
+		value, err := dir.findChild(name).GetXattr("user.color")
+		t.Assert(err, IsNil)
+		t.Assert(string(value), Equals, name)
+	}
+	t.Assert(cloud.Calls("HeadBlob")+cloud.Calls("ListBlobs"), Equals, 0)
+}
+
+// Restoring archived objects is an optional interface, so it's not a HookBackend hook
+type RestoreRecorder struct {
+	*HookBackend
+	restored map[string]int64
+}
+
+func (s *RestoreRecorder) RestoreBlob(key string, days int64) error {
+	s.restored[key] = days
+	return nil
+}
+
+func (s *GoofysTest) TestRestoreXattr(t *C) {
+	if s.cloud.Capabilities().Name != "s3" {
+		t.Skip("only for S3")
+	}
+	t.Assert(restoreStatus(`ongoing-request="true"`), Equals, "ongoing")
+
+	root := s.getRoot(t)
+	cloud := &RestoreRecorder{
+		HookBackend: &HookBackend{StorageBackend: root.dir.cloud},
+		restored: make(map[string]int64),
+	}
+	cloud.head = func(param *HeadBlobInput) (*HeadBlobOutput, error) {
+		resp, err := cloud.StorageBackend.HeadBlob(param)
+		if err == nil && cloud.restored[param.Key] != 0 {
+			resp.Restore = PString(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+		}
+		return resp, err
+	}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	value, err := in.GetXattr("s3.restore")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "")
+
+	err = in.SetXattr("s3.restore", []byte("abc"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+	err = in.SetXattr("s3.restore", []byte("7"), 0)
+	t.Assert(err, IsNil)
+	t.Assert(cloud.restored["file1"], Equals, int64(7))
+
+	value, err = in.GetXattr("s3.restore")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "restored expires=Fri, 21 Dec 2012 00:00:00 GMT")
+}
+
+type TagRecorder struct {
+	StorageBackend
+	mu sync.Mutex
+	tags map[string]map[string]string
+	gets int
+}
+
+func (s *TagRecorder) GetBlobTags(key string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	tags := make(map[string]string)
+	for k, v := range s.tags[key] {
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+func (s *TagRecorder) PutBlobTags(key string, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[key] = tags
+	return nil
+}
+
+func (s *GoofysTest) TestTagXattrs(t *C) {
+	if s.cloud.Capabilities().Name != "s3" {
+		t.Skip("only for S3")
+	}
+	root := s.getRoot(t)
+	cloud := &TagRecorder{StorageBackend: root.dir.cloud, tags: make(map[string]map[string]string)}
+	cloud.tags["file1"] = map[string]string{"project": "x"}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	// Listing doesn't load tags
+	names, err := in.ListXattr()
+	t.Assert(err, IsNil)
+	for _, name := range names {
+		t.Assert(strings.HasPrefix(name, TAG_XATTR_PREFIX), Equals, false)
+	}
+	t.Assert(cloud.gets, Equals, 0)
+	value, err := in.GetXattr("s3.tag.project")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "x")
+	t.Assert(cloud.gets, Equals, 1)
+
+	err = in.SetXattr("s3.tag.cost", []byte("42"), 0)
+	t.Assert(err, IsNil)
+	t.Assert(cloud.tags["file1"], DeepEquals, map[string]string{"project": "x", "cost": "42"})
+	// Tags aren't user metadata
+	_, err = in.GetXattr("user.cost")
+	t.Assert(err, Equals, syscall.ENODATA)
+	names, err = in.ListXattr()
+	t.Assert(err, IsNil)
+	found := false
+	for _, name := range names {
+		found = found || name == "s3.tag.cost"
+	}
+	t.Assert(found, Equals, true)
+
+	err = in.RemoveXattr("s3.tag.project")
+	t.Assert(err, IsNil)
+	t.Assert(cloud.tags["file1"], DeepEquals, map[string]string{"cost": "42"})
+
+	// S3 limits
+	err = in.SetXattr("s3.tag."+strings.Repeat("k", 129), []byte("v"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+	for i := 0; i < 9; i++ {
+		err = in.SetXattr(fmt.Sprintf("s3.tag.t%v", i), []byte("v"), 0)
+		t.Assert(err, IsNil)
+	}
+	err = in.SetXattr("s3.tag.eleventh", []byte("v"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+
+	// Tags of new files are sent after the upload
+	newFile, fh := root.Create("tagged")
+	err = newFile.SetXattr("s3.tag.new", []byte("1"), 0)
+	t.Assert(err, IsNil)
+	t.Assert(cloud.tags["tagged"], IsNil)
+	err = fh.inode.SyncFile()
+	t.Assert(err, IsNil)
+	fh.Release()
+	for i := 0; i < 100; i++ {
+		cloud.mu.Lock()
+		tags := cloud.tags["tagged"]
+		cloud.mu.Unlock()
+		if tags != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cloud.mu.Lock()
+	t.Assert(cloud.tags["tagged"], DeepEquals, map[string]string{"new": "1"})
+	cloud.mu.Unlock()
+}
+
+func (s *GoofysTest) TestContentTypeXattr(t *C) {
+	if s.cloud.Capabilities().Name != "s3" {
+		t.Skip("only for S3")
+	}
+	useContentType := s.fs.flags.UseContentType
+	s.fs.flags.UseContentType = true
+	defer func() { s.fs.flags.UseContentType = useContentType }()
+	root := s.getRoot(t)
+
+	// Guessed from the extension
+	in, fh := root.Create("page.html")
+	err := fh.WriteFile(0, []byte("<html></html>"), true)
+	t.Assert(err, IsNil)
+	value, err := in.GetXattr("s3.content-type")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "text/html")
+	err = fh.inode.SyncFile()
+	t.Assert(err, IsNil)
+	fh.Release()
+	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "page.html"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(resp.ContentType), Equals, "text/html")
+	// The sent type is remembered as the one the object has
+	in.mu.Lock()
+	t.Assert(in.knownContentType, Equals, "text/html")
+	in.mu.Unlock()
+
+	// Overridden with the xattr
+	err = in.SetXattr("s3.content-type", []byte("not a type/"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+	err = in.SetXattr("s3.content-type", []byte("text/plain"), 0)
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	resp, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "page.html"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(resp.ContentType), Equals, "text/plain")
+	value, err = in.GetXattr("s3.content-type")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "text/plain")
+}
+
+func (s *GoofysTest) TestCacheOccupancy(t *C) {
+	root := s.getRoot(t)
+	s.testWriteFile(t, "occupancy", 1024*1024, 128)
+	value, err := root.GetXattr("geesefs.cache-occupancy")
+	t.Assert(err, IsNil)
+	var used, limit, low, high, files int64
+	_, err = fmt.Sscanf(string(value), "used=%d limit=%d low=%d high=%d files=%d", &used, &limit, &low, &high, &files)
+	t.Assert(err, IsNil)
+	t.Assert(limit, Equals, s.fs.bufferPool.max)
+	t.Assert(files > 0, Equals, true)
+}
+
+func (s *GoofysTest) TestFallocateExtend(t *C) {
+	root := s.getRoot(t)
+	in, fh := root.Create("fallocated")
+	defer fh.Release()
+	err := fh.WriteFile(0, []byte("hello"), true)
+	t.Assert(err, IsNil)
+
+	used := atomic.LoadInt64(&s.fs.bufferPool.cur)
+	err = s.fs.Fallocate(nil, &fuseops.FallocateOp{
+		Inode:  in.Id,
+		Offset: 0,
+		Length: 64*1024*1024,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(64*1024*1024))
+	// Preallocated space is represented by zero buffers
+	t.Assert(atomic.LoadInt64(&s.fs.bufferPool.cur), Equals, used)
+
+	bufs, n, err := fh.ReadFile(0, 10)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 10)
+	t.Assert(bytes.Join(bufs, nil), DeepEquals, []byte("hello\x00\x00\x00\x00\x00"))
+
+	// Deleted files can't be preallocated
+	err = root.Unlink("fallocated")
+	t.Assert(err, IsNil)
+	err = s.fs.Fallocate(nil, &fuseops.FallocateOp{
+		Inode:  in.Id,
+		Offset: 0,
+		Length: 128*1024*1024,
+	})
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestConsistentRead(t *C) {
+	consistentRead := s.fs.flags.ConsistentRead
+	s.fs.flags.ConsistentRead = time.Minute
+	defer func() { s.fs.flags.ConsistentRead = consistentRead }()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"consistent": nil,
+	})
+	old, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "consistent"})
+	t.Assert(err, IsNil)
+
+	root := s.getRoot(t)
+	// Return stale HEAD responses while there are any
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var stale []*HeadBlobOutput
+	cloud.head = func(param *HeadBlobInput) (*HeadBlobOutput, error) {
+		cloud.mu.Lock()
+		defer cloud.mu.Unlock()
+		if len(stale) > 0 {
+			resp := stale[0]
+			stale = stale[1:]
+			return resp, nil
+		}
+		return cloud.StorageBackend.HeadBlob(param)
+	}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+
+	in, err := s.LookUpInode(t, "consistent")
+	t.Assert(err, IsNil)
+	t.Assert(in.knownETag, Equals, *old.ETag)
+
+	// The object is overwritten, but the first HEAD still returns the old version
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "consistent",
+		Body: bytes.NewReader([]byte("hello world")),
+		Size: PUInt64(11),
+	})
+	t.Assert(err, IsNil)
+	cloud.ResetCalls()
+	cloud.mu.Lock()
+	stale = []*HeadBlobOutput{old}
+	cloud.mu.Unlock()
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	t.Assert(cloud.Calls("HeadBlob"), Equals, 3)
+	t.Assert(in.knownETag, Not(Equals), *old.ETag)
+	t.Assert(in.Attributes.Size, Equals, uint64(11))
+	bufs, _, err := fh.ReadFile(0, 1024)
+	t.Assert(err, IsNil)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "hello world")
+
+	// Different ETag learned right after a new one isn't a change
+	in.mu.Lock()
+	in.etagTime = time.Now()
+	in.mu.Unlock()
+	in.SetFromBlobItem(&old.BlobItemOutput)
+	t.Assert(in.knownETag, Not(Equals), *old.ETag)
+	t.Assert(in.Attributes.Size, Equals, uint64(11))
+}
+
+func (s *GoofysTest) TestStatFSQuota(t *C) {
+	fsTotalSize := s.fs.flags.FsTotalSize
+	s.fs.flags.FsTotalSize = 1024*1024
+	defer func() { s.fs.flags.FsTotalSize = fsTotalSize }()
+
+	op := &fuseops.StatFSOp{}
+	err := s.fs.StatFS(nil, op)
+	t.Assert(err, IsNil)
+	t.Assert(op.Blocks, Equals, uint64(256))
+	free := op.BlocksFree
+
+	// Unflushed data counts as used, rounded up to whole blocks
+	root := s.getRoot(t)
+	_, fh := root.Create("quota")
+	defer fh.Release()
+	err = fh.WriteFile(0, make([]byte, 5000), true)
+	t.Assert(err, IsNil)
+	op = &fuseops.StatFSOp{}
+	err = s.fs.StatFS(nil, op)
+	t.Assert(err, IsNil)
+	t.Assert(op.BlocksFree, Equals, free-2)
+	t.Assert(op.BlocksAvailable, Equals, free-2)
+
+	// Deleted files are not counted
+	err = root.Unlink("quota")
+	t.Assert(err, IsNil)
+	op = &fuseops.StatFSOp{}
+	err = s.fs.StatFS(nil, op)
+	t.Assert(err, IsNil)
+	t.Assert(op.BlocksFree, Equals, free)
+}
+
+func (s *GoofysTest) TestDirectIO(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	fh.direct = true
+
+	// Direct reads return what the server has and don't cache it
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "file1",
+		Body: bytes.NewReader([]byte("fresh")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	bufs, n, err := fh.ReadFile(0, 1024)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 5)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "fresh")
+	t.Assert(len(in.buffers), Equals, 0)
+
+	// Direct writes are cached by default
+	err = fh.WriteFile(0, []byte("Fresh"), true)
+	t.Assert(err, IsNil)
+	t.Assert(in.CacheState, Equals, ST_MODIFIED)
+
+	// And flushed before returning with --direct-sync-writes
+	s.fs.flags.DirectSyncWrites = true
+	defer func() { s.fs.flags.DirectSyncWrites = false }()
+	err = fh.WriteFile(0, []byte("FRESH"), true)
+	t.Assert(err, IsNil)
+	t.Assert(in.CacheState, Equals, ST_CACHED)
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "file1"})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(string(body), Equals, "FRESH")
+
+	// Reads are sized by the server response, not by the cached size
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:  "file1",
+		Body: bytes.NewReader([]byte("fresh and longer")),
+		Size: PUInt64(16),
+	})
+	t.Assert(err, IsNil)
+	bufs, n, err = fh.ReadFile(0, 1024)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 16)
+	t.Assert(string(bytes.Join(bufs, nil)), Equals, "fresh and longer")
+	_, n, err = fh.ReadFile(100, 1024)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 0)
+}
+
+func (s *GoofysTest) TestDirectIOWriteCost(t *C) {
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:  "directlarge",
+		Body: bytes.NewReader(make([]byte, 10*1024*1024)),
+		Size: PUInt64(10*1024*1024),
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "directlarge")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+	fh.direct = true
+	s.fs.flags.DirectSyncWrites = true
+	defer func() { s.fs.flags.DirectSyncWrites = false }()
+
+	root := s.getRoot(t)
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	root.dir.cloud = cloud
+	defer func() { root.dir.cloud = cloud.StorageBackend }()
+
+	// Every direct write completes an upload of the whole object:
+	// the modified part is read back and uploaded, the other one is copied
+	for i := 1; i <= 2; i++ {
+		err = fh.WriteFile(0, []byte("hello"), true)
+		t.Assert(err, IsNil)
+		t.Assert(cloud.Calls("MultipartBlobBegin"), Equals, i)
+		t.Assert(cloud.Calls("MultipartBlobAdd"), Equals, i)
+		t.Assert(cloud.Calls("MultipartBlobCopy"), Equals, i)
+		t.Assert(cloud.Calls("MultipartBlobCommit"), Equals, i)
+	}
+	t.Assert(cloud.Calls("PutBlob"), Equals, 0)
+}
+
+func (s *GoofysTest) TestDirAttrTTL(t *C) {
+	dir, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+	file, err := s.LookUpInode(t, "dir1/file3")
+	t.Assert(err, IsNil)
+	t.Assert(file.attrTTL(), Equals, s.fs.flags.StatCacheTTL)
+
+	err = dir.SetXattr("geesefs.ttl", []byte("1h"), 0)
+	t.Assert(err, IsNil)
+	value, err := dir.GetXattr("geesefs.ttl")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "1h0m0s")
+	t.Assert(file.attrTTL(), Equals, time.Hour)
+	lookup := &fuseops.LookUpInodeOp{
+		Parent: dir.Id,
+		Name:   "file3",
+	}
+	err = s.fs.LookUpInode(nil, lookup)
+	t.Assert(err, IsNil)
+	t.Assert(lookup.Entry.AttributesExpiration.After(time.Now().Add(59*time.Minute)), Equals, true)
+
+	// Zero TTL also overrides the default
+	err = dir.SetXattr("geesefs.ttl", []byte("0"), 0)
+	t.Assert(err, IsNil)
+	t.Assert(file.attrTTL(), Equals, time.Duration(0))
+
+	// Empty value restores the inherited TTL
+	err = dir.SetXattr("geesefs.ttl", []byte(""), 0)
+	t.Assert(err, IsNil)
+	t.Assert(file.attrTTL(), Equals, s.fs.flags.StatCacheTTL)
+
+	err = dir.SetXattr("geesefs.ttl", []byte("soon"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+	err = file.SetXattr("geesefs.ttl", []byte("1h"), 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+}
+
+func (s *GoofysTest) TestSymlinkCache(t *C) {
+	symlinkCacheTTL := s.fs.flags.SymlinkCacheTTL
+	s.fs.flags.SymlinkCacheTTL = time.Minute
+	defer func() { s.fs.flags.SymlinkCacheTTL = symlinkCacheTTL }()
+
+	root := s.getRoot(t)
+	link := root.CreateSymlink("cachedlink", "file1")
+	err := link.SyncFile()
+	t.Assert(err, IsNil)
+
+	_, key := link.cloud()
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: key})
+	t.Assert(err, IsNil)
+	link.SetFromBlobItem(&head.BlobItemOutput)
+
+	// Metadata is dropped and the symlink is listed again without it
+	listed := head.BlobItemOutput
+	listed.Metadata = nil
+	link.mu.Lock()
+	link.userMetadata = nil
+	link.symlinkTarget = ""
+	link.mu.Unlock()
+	link.SetFromBlobItem(&listed)
+	link.mu.Lock()
+	t.Assert(link.isSymlink(), Equals, true)
+	t.Assert(link.InflateAttributes().Mode&os.ModeSymlink, Equals, os.ModeSymlink)
+	link.mu.Unlock()
+	target, err := link.ReadSymlink()
+	t.Assert(err, IsNil)
+	t.Assert(target, Equals, "file1")
+
+	// Another version of the object isn't a symlink anymore
+	mtime := head.LastModified.Add(time.Second)
+	listed.LastModified = &mtime
+	link.SetFromBlobItem(&listed)
+	link.mu.Lock()
+	t.Assert(link.isSymlink(), Equals, false)
+	link.mu.Unlock()
+}
+
+// Flips the first byte of every read when corrupt
+func (s *GoofysTest) TestVerifyChecksums(t *C) {
+	verifyChecksums := s.fs.flags.VerifyChecksums
+	s.fs.flags.VerifyChecksums = true
+	defer func() { s.fs.flags.VerifyChecksums = verifyChecksums }()
+
+	fh := s.testCreateAndWrite(t, "checksummed", 12*1024*1024, 128*1024, true)
+	in := fh.inode
+	fh.Release()
+	err := in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// One checksum per part is saved in the metadata
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "checksummed"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Metadata[CHECKSUM_ATTR], NotNil)
+	units, err := parseChecksums(*head.Metadata[CHECKSUM_ATTR])
+	t.Assert(err, IsNil)
+	t.Assert(len(units), Equals, 3)
+	t.Assert(units[2].offset, Equals, uint64(10*1024*1024))
+	t.Assert(units[2].size, Equals, uint64(2*1024*1024))
+	_, err = in.GetXattr("user."+CHECKSUM_ATTR)
+	t.Assert(err, Equals, syscall.ENODATA)
+
+	root := s.getRoot(t)
+	// Corrupt data of GET responses when asked to
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var corrupt int32
+	cloud.get = func(param *GetBlobInput) (*GetBlobOutput, error) {
+		resp, err := cloud.StorageBackend.GetBlob(param)
+		if err != nil || atomic.LoadInt32(&corrupt) == 0 {
+			return resp, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			data[0] ^= 0xff
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return resp, nil
+	}
+	root.dir.cloud = cloud
+	s.fs.invalidateCloudPaths()
+	defer func() {
+		root.dir.cloud = cloud.StorageBackend
+		s.fs.invalidateCloudPaths()
+	}()
+
+	fh, err = in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	// Reads are extended to whole parts
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+	_, n, err := fh.ReadFile(6*1024*1024, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 4096)
+	t.Assert(len(cloud.Gets()) > 0, Equals, true)
+	t.Assert(cloud.Gets()[0].Start, Equals, uint64(5*1024*1024))
+	for _, req := range cloud.Gets() {
+		// Readahead may load the next part too
+		t.Assert(req.Start, Equals, units[req.Start/(5*1024*1024)].offset)
+		t.Assert(req.Count, Equals, units[req.Start/(5*1024*1024)].size)
+	}
+
+	// Corrupted data isn't returned
+	in.mu.Lock()
+	in.resetCache()
+	in.mu.Unlock()
+	atomic.StoreInt32(&corrupt, 1)
+	_, _, err = fh.ReadFile(0, 4096)
+	t.Assert(err, Equals, syscall.EIO)
+}
+
+func (s *GoofysTest) TestTrash(t *C) {
+	oldTrash := s.fs.flags.Trash
+	s.fs.flags.Trash = ".trash"
+	defer func() { s.fs.flags.Trash = oldTrash }()
+
+	root := s.getRoot(t)
+	in, fh := root.Create("trashed")
+	err := fh.WriteFile(0, []byte("hello trash"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	err = root.Unlink("trashed")
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "trashed"})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+
+	value, err := root.GetXattr("geesefs.trash")
+	t.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(value)), "\n")
+	t.Assert(len(lines), Equals, 1)
+	t.Assert(strings.HasSuffix(lines[0], "/trashed"), Equals, true)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: ".trash/"+lines[0]})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size, Equals, uint64(11))
+
+	// Restore it
+	err = root.SetXattr("geesefs.restore", []byte(lines[0]), 0)
+	t.Assert(err, IsNil)
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "trashed"})
+	t.Assert(err, IsNil)
+	value, err = root.GetXattr("geesefs.trash")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "")
+	// Existing files aren't overwritten
+	err = root.SetXattr("geesefs.restore", []byte(lines[0]), 0)
+	t.Assert(err, Equals, syscall.EEXIST)
+
+	// Removals inside the trash are real
+	in, err = s.LookUpInode(t, "trashed")
+	t.Assert(err, IsNil)
+	err = root.Unlink("trashed")
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	value, err = root.GetXattr("geesefs.trash")
+	t.Assert(err, IsNil)
+	lines = strings.Split(strings.TrimSpace(string(value)), "\n")
+	t.Assert(len(lines), Equals, 1)
+	trashDir, err := s.LookUpInode(t, ".trash/"+strings.Split(lines[0], "/")[0])
+	t.Assert(err, IsNil)
+	err = trashDir.Unlink("trashed")
+	t.Assert(err, IsNil)
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+	value, err = root.GetXattr("geesefs.trash")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "")
+}
+
+func (s *GoofysTest) TestMaxDirtyBytes(t *C) {
+	maxDirtyBytes := s.fs.flags.MaxDirtyBytes
+	s.fs.flags.MaxDirtyBytes = 1024*1024
+	defer func() { s.fs.flags.MaxDirtyBytes = maxDirtyBytes }()
+
+	root := s.getRoot(t)
+	in, fh := root.Create("dirty_limit")
+	defer fh.Release()
+	chunk := make([]byte, 256*1024)
+	for i := 0; i < 8; i++ {
+		err := fh.WriteFile(int64(i*len(chunk)), chunk, true)
+		t.Assert(err, IsNil)
+		// Writers wait until the open file is flushed
+		t.Assert(atomic.LoadInt64(&s.fs.metrics.dirtyBytes) <= int64(s.fs.flags.MaxDirtyBytes)+int64(len(chunk)), Equals, true)
+	}
+	value, err := root.GetXattr("geesefs.dirty-bytes")
+	t.Assert(err, IsNil)
+	t.Assert(strings.HasSuffix(string(value), " limit=1048576"), Equals, true)
+
+	// Writers still block at the limit while flushing is paused, until it's resumed
+	s.fs.PauseFlush(true)
+	written := make(chan error, 8)
+	go func() {
+		for i := 8; i < 16; i++ {
+			written <- fh.WriteFile(int64(i*len(chunk)), chunk, true)
+		}
+		close(written)
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&s.fs.dirtyWaiters) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Assert(atomic.LoadInt32(&s.fs.dirtyWaiters), Equals, int32(1))
+	t.Assert(atomic.LoadInt64(&s.fs.metrics.dirtyBytes) <= int64(s.fs.flags.MaxDirtyBytes)+int64(len(chunk)), Equals, true)
+	s.fs.PauseFlush(false)
+	for err := range written {
+		t.Assert(err, IsNil)
+	}
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestMaxDirtyBytesMultipart(t *C) {
+	maxDirtyBytes := s.fs.flags.MaxDirtyBytes
+	s.fs.flags.MaxDirtyBytes = 6*1024*1024
+	partSizes := s.fs.flags.PartSizes
+	s.fs.flags.PartSizes = parsePartSizes("5M")
+	defer func() {
+		s.fs.flags.MaxDirtyBytes = maxDirtyBytes
+		s.fs.flags.PartSizes = partSizes
+	}()
+
+	root := s.getRoot(t)
+	in, fh := root.Create("dirty_limit_mpu")
+	defer fh.Release()
+	// Flushed parts of the open file don't count towards the limit,
+	// so the writer doesn't wait for the upload to be completed
+	chunk := make([]byte, 1024*1024)
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			err := fh.WriteFile(int64(i*len(chunk)), chunk, true)
+			if err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	select {
+	case err := <-written:
+		t.Assert(err, IsNil)
+	case <-time.After(30*time.Second):
+		t.Fatal("writes are blocked by flushed parts")
+	}
+	t.Assert(atomic.LoadInt64(&s.fs.metrics.dirtyBytes) <= int64(s.fs.flags.MaxDirtyBytes)+int64(len(chunk)), Equals, true)
+	in.mu.Lock()
+	t.Assert(in.mpu, NotNil)
+	in.mu.Unlock()
+
+	err := in.SyncFile()
+	t.Assert(err, IsNil)
+	t.Assert(atomic.LoadInt64(&s.fs.metrics.dirtyBytes), Equals, int64(0))
+	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "dirty_limit_mpu"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Size, Equals, uint64(20*1024*1024))
+}
+
+func (s *GoofysTest) TestPartSizeLadder(t *C) {
+	partSizes := s.fs.flags.PartSizes
+	s.fs.flags.PartSizes = parsePartSizes("5M:2,10M:2,20M")
+	partManifest := s.fs.flags.PartManifest
+	s.fs.flags.PartManifest = true
+	defer func() {
+		s.fs.flags.PartSizes = partSizes
+		s.fs.flags.PartManifest = partManifest
+	}()
+	t.Assert(s.fs.flags.PartSizes[2].PartCount, Equals, uint64(9996))
+
+	// Small files use the whole ladder, larger ones skip its first steps
+	t.Assert(s.fs.partSizesFor(1024*1024), DeepEquals, s.fs.flags.PartSizes)
+	layout := s.fs.partSizesFor(maxFileSize(s.fs.flags.PartSizes)+1)
+	t.Assert(layout, DeepEquals, []PartSizeConfig{
+		{PartSize: 10*1024*1024, PartCount: 2},
+		{PartSize: 20*1024*1024, PartCount: 9998},
+	})
+	t.Assert(s.fs.getMaxFileSize(), Equals, uint64(20*1024*1024*10000))
+
+	s.fs.flags.PartSizes = parsePartSizes("5M:2,10M:2")
+	root := s.getRoot(t)
+	in, fh := root.Create("ladder")
+	err := s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: in.Id, Size: PUInt64(32*1024*1024)})
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(0, []byte("ladder"), true)
+	t.Assert(err, IsNil)
+	fh.Release()
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+
+	// 32 MB don't fit into 2 5 MB and 2 10 MB parts, so only 10 MB parts are used
+	value, err := in.GetXattr("geesefs.part-manifest")
+	t.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(value)), "\n")
+	t.Assert(len(lines), Equals, 4)
+	offsets := []string{"1 0 10485760 ", "2 10485760 10485760 ", "3 20971520 10485760 ", "4 31457280 2097152 "}
+	for i, line := range lines {
+		t.Assert(strings.HasPrefix(line, offsets[i]), Equals, true)
+	}
+}
+
+func (s *GoofysTest) TestAbortStaleMPU(t *C) {
+	s3, ok := s.cloud.Delegate().(*S3Backend)
+	if !ok {
+		t.Skip("only for S3")
+	}
+	uploads := make(map[string]*MultipartBlobCommitInput)
+	for _, key := range []string{"stale/aborted", "stale/tracked", "other/kept"} {
+		mpu, err := s.cloud.MultipartBlobBegin(&MultipartBlobBeginInput{Key: key})
+		t.Assert(err, IsNil)
+		uploads[key] = mpu
+	}
+	defer func() {
+		for _, mpu := range uploads {
+			s.cloud.MultipartBlobAbort(mpu)
+		}
+	}()
+
+	time.Sleep(10*time.Millisecond)
+	_, err := s3.MultipartExpire(&MultipartExpireInput{
+		Prefix: "stale/",
+		Age:    time.Nanosecond,
+		Keep: func(key, uploadId string) bool {
+			return uploadId == *uploads["stale/tracked"].UploadId
+		},
+	})
+	t.Assert(err, IsNil)
+
+	// Aborts are sent in the background
+	var left map[string]bool
+	for i := 0; i < 50; i++ {
+		resp, err := s3.ListMultipartUploads(&aws_s3.ListMultipartUploadsInput{Bucket: &s3.bucket})
+		t.Assert(err, IsNil)
+		left = make(map[string]bool)
+		for _, upload := range resp.Uploads {
+			left[*upload.Key] = true
+		}
+		if !left["stale/aborted"] {
+			break
+		}
+		time.Sleep(100*time.Millisecond)
+	}
+	t.Assert(left["stale/aborted"], Equals, false)
+	t.Assert(left["stale/tracked"], Equals, true)
+	t.Assert(left["other/kept"], Equals, true)
+}
+
+func (s *GoofysTest) TestUidGidMap(t *C) {
+	enablePerms := s.fs.flags.EnablePerms
+	uidAttr := s.fs.flags.UidAttr
+	gidAttr := s.fs.flags.GidAttr
+	uidMap := s.fs.flags.UidMap
+	gidMap := s.fs.flags.GidMap
+	s.fs.flags.EnablePerms = true
+	s.fs.flags.UidAttr = "uid"
+	s.fs.flags.GidAttr = "gid"
+	s.fs.flags.UidMap = []IdMapRange{{Stored: 1000, Local: 1001, Count: 2}}
+	s.fs.flags.GidMap = []IdMapRange{{Stored: 2000, Local: 3000, Count: 1}}
+	defer func() {
+		s.fs.flags.EnablePerms = enablePerms
+		s.fs.flags.UidAttr = uidAttr
+		s.fs.flags.GidAttr = gidAttr
+		s.fs.flags.UidMap = uidMap
+		s.fs.flags.GidMap = gidMap
+	}()
+	_, err := s.cloud.PutBlob(&PutBlobInput{
+		Key:      "mapped_owner",
+		Body:     bytes.NewReader([]byte("hello")),
+		Size:     PUInt64(5),
+		Metadata: map[string]*string{"uid": PString("1001"), "gid": PString("2001")},
+	})
+	t.Assert(err, IsNil)
+	in, err := s.LookUpInode(t, "mapped_owner")
+	t.Assert(err, IsNil)
+
+	// 1001 is inside of the uid range, 2001 is outside of the gid range
+	attr := in.InflateAttributes()
+	t.Assert(attr.Uid, Equals, uint32(1002))
+	t.Assert(attr.Gid, Equals, uint32(2001))
+
+	// chown saves ids mapped back
+	uid := uint32(1001)
+	gid := uint32(3000)
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: in.Id, Uid: &uid, Gid: &gid})
+	t.Assert(err, IsNil)
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "mapped_owner"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["uid"]), Equals, "1000")
+	t.Assert(NilStr(head.Metadata["gid"]), Equals, "2000")
+
+	in.mu.Lock()
+	in.setMetadata(head.Metadata)
+	in.mu.Unlock()
+	attr = in.InflateAttributes()
+	t.Assert(attr.Uid, Equals, uid)
+	t.Assert(attr.Gid, Equals, gid)
+}
+
+func (s *GoofysTest) TestPosixAcl(t *C) {
+	enablePerms := s.fs.flags.EnablePerms
+	fileModeAttr := s.fs.flags.FileModeAttr
+	s.fs.flags.EnablePerms = true
+	s.fs.flags.FileModeAttr = "mode"
+	defer func() {
+		s.fs.flags.EnablePerms = enablePerms
+		s.fs.flags.FileModeAttr = fileModeAttr
+	}()
+	s.setupBlobs(s.cloud, t, map[string]*string{
+		"acl_file": PString("hello"),
+	})
+	in, err := s.LookUpInode(t, "acl_file")
+	t.Assert(err, IsNil)
+
+	_, err = in.GetXattr(ACL_ACCESS_XATTR)
+	t.Assert(err, Equals, syscall.ENODATA)
+	err = in.SetXattr(ACL_ACCESS_XATTR, []byte{1, 2, 3}, 0)
+	t.Assert(err, Equals, syscall.EINVAL)
+	err = in.SetXattr(ACL_DEFAULT_XATTR, []byte{2, 0, 0, 0}, 0)
+	t.Assert(err, Equals, syscall.EACCES)
+
+	// u::rw-,u:1234:r--,g::r--,m::rw-,o::---
+	acl := []byte{
+		2, 0, 0, 0,
+		ACL_USER_OBJ, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+		ACL_USER, 0, 4, 0, 0xd2, 0x04, 0, 0,
+		ACL_GROUP_OBJ, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+		ACL_MASK, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+		ACL_OTHER, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	}
+	err = in.SetXattr(ACL_ACCESS_XATTR, acl, 0)
+	t.Assert(err, IsNil)
+	t.Assert(in.InflateAttributes().Mode & os.ModePerm, Equals, os.FileMode(0660))
+	names, err := in.ListXattr()
+	t.Assert(err, IsNil)
+	listed := false
+	for _, name := range names {
+		t.Assert(name, Not(Equals), "user."+ACL_ACCESS_ATTR)
+		listed = listed || name == ACL_ACCESS_XATTR
+	}
+	t.Assert(listed, Equals, true)
+
+	// The binary ACL survives metadata escaping
+	err = in.SyncFile()
+	t.Assert(err, IsNil)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "acl_file"})
+	t.Assert(err, IsNil)
+	in.mu.Lock()
+	in.setMetadata(head.Metadata)
+	in.mu.Unlock()
+	value, err := in.GetXattr(ACL_ACCESS_XATTR)
+	t.Assert(err, IsNil)
+	t.Assert(value, DeepEquals, acl)
+	t.Assert(in.InflateAttributes().Mode & os.ModePerm, Equals, os.FileMode(0660))
+
+	// chmod changes the mask
+	mode := os.FileMode(0640)
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: in.Id, Mode: &mode})
+	t.Assert(err, IsNil)
+	value, err = in.GetXattr(ACL_ACCESS_XATTR)
+	t.Assert(err, IsNil)
+	t.Assert(value[4+3*8+2], Equals, byte(4))
+	t.Assert(value[4+1*8+2], Equals, byte(4))
+	t.Assert(in.InflateAttributes().Mode & os.ModePerm, Equals, mode)
+
+	err = in.RemoveXattr(ACL_ACCESS_XATTR)
+	t.Assert(err, IsNil)
+	_, err = in.GetXattr(ACL_ACCESS_XATTR)
+	t.Assert(err, Equals, syscall.ENODATA)
+}
+
+func (s *GoofysTest) TestFlushRetryFinal(t *C) {
+	retryInterval := s.fs.flags.RetryInterval
+	retryIntervalMax := s.fs.flags.RetryIntervalMax
+	retryJitter := s.fs.flags.RetryJitter
+	flushRetries := s.fs.flags.FlushRetries
+	flushRetryTimeout := s.fs.flags.FlushRetryTimeout
+	s.fs.flags.RetryInterval = time.Second
+	s.fs.flags.RetryIntervalMax = 4*time.Second
+	s.fs.flags.RetryJitter = 50
+	s.fs.flags.FlushRetries = 2
+	s.fs.flags.FlushRetryTimeout = time.Minute
+	defer func() {
+		s.fs.flags.RetryInterval = retryInterval
+		s.fs.flags.RetryIntervalMax = retryIntervalMax
+		s.fs.flags.RetryJitter = retryJitter
+		s.fs.flags.FlushRetries = flushRetries
+		s.fs.flags.FlushRetryTimeout = flushRetryTimeout
+	}()
+	s.fs.PauseFlush(true)
+	defer s.fs.PauseFlush(false)
+	root := s.getRoot(t)
+	in, fh := root.Create("retry_final")
+	defer fh.Release()
+
+	fail := func(err error) {
+		in.mu.Lock()
+		in.flushErrorTime = in.flushErrorTime.Add(-time.Hour)
+		in.recordFlushError(err)
+		in.mu.Unlock()
+	}
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "")
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+	t.Assert(isRetryableError(slowDown), Equals, true)
+	t.Assert(isRetryableError(awserr.New("RequestError", "send request failed", syscall.ECONNRESET)), Equals, true)
+	t.Assert(isRetryableError(denied), Equals, false)
+	t.Assert(isRetryableError(syscall.ENOENT), Equals, false)
+
+	// Temporary errors are returned after --flush-retries attempts
+	fail(slowDown)
+	in.mu.Lock()
+	t.Assert(in.flushErrorFinal(), Equals, false)
+	delay := in.flushRetryDelay()
+	t.Assert(delay >= 500*time.Millisecond && delay <= time.Second, Equals, true, Commentf("delay: %v", delay))
+	in.mu.Unlock()
+	fail(slowDown)
+	in.mu.Lock()
+	t.Assert(in.flushErrorFinal(), Equals, true)
+	in.mu.Unlock()
+
+	// ...or after --flush-retry-timeout
+	in.mu.Lock()
+	in.recordFlushError(nil)
+	t.Assert(in.flushErrorFinal(), Equals, false)
+	// Pretend that the file was flushed in between
+	in.flushErrors = 0
+	in.mu.Unlock()
+	fail(slowDown)
+	in.mu.Lock()
+	t.Assert(in.flushErrorFinal(), Equals, false)
+	in.flushFailingSince = in.flushFailingSince.Add(-time.Hour)
+	t.Assert(in.flushErrorFinal(), Equals, true)
+	in.recordFlushError(nil)
+	in.flushErrors = 0
+	in.mu.Unlock()
+
+	// Other errors are returned at once
+	fail(denied)
+	in.mu.Lock()
+	t.Assert(in.flushErrorFinal(), Equals, true)
+	in.recordFlushError(nil)
+	t.Assert(in.flushError, IsNil)
+	in.mu.Unlock()
+}
+
+func (s *GoofysTest) TestDirMtimeMarker(t *C) {
+	dirMtimeMarker := s.fs.flags.DirMtimeMarker
+	mtimeAttr := s.fs.flags.MtimeAttr
+	retryInterval := s.fs.flags.RetryInterval
+	s.fs.flags.DirMtimeMarker = true
+	s.fs.flags.MtimeAttr = "mtime"
+	s.fs.flags.RetryInterval = 100*time.Millisecond
+	defer func() {
+		s.fs.flags.DirMtimeMarker = dirMtimeMarker
+		s.fs.flags.MtimeAttr = mtimeAttr
+		s.fs.flags.RetryInterval = retryInterval
+	}()
+	root := s.getRoot(t)
+	dir, err := root.MkDir("markerdir")
+	t.Assert(err, IsNil)
+	err = dir.SyncFile()
+	t.Assert(err, IsNil)
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	dir.mu.Lock()
+	dir.Attributes.Mtime = old
+	dir.mu.Unlock()
+	_, fh := dir.Create("file")
+	fh.Release()
+	mtime := dir.InflateAttributes().Mtime
+	t.Assert(mtime.After(old), Equals, true)
+	t.Assert(dir.CacheState, Equals, ST_MODIFIED)
+
+	// The marker is saved by the flusher and failed uploads are retried
+	cloud := &HookBackend{StorageBackend: root.dir.cloud}
+	var failed int32
+	cloud.put = func(param *PutBlobInput) (*PutBlobOutput, error) {
+		if param.Key == "markerdir/.mtime" && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return nil, syscall.EIO
+		}
+		return cloud.StorageBackend.PutBlob(param)
+	}
+	root.dir.cloud = cloud
+	err = dir.SyncFile()
+	root.dir.cloud = cloud.StorageBackend
+	t.Assert(err, IsNil)
+	t.Assert(atomic.LoadInt32(&failed), Equals, int32(1))
+	t.Assert(cloud.Calls("PutBlob") >= 2, Equals, true)
+	t.Assert(dir.CacheState, Equals, ST_CACHED)
+	head, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "markerdir/.mtime"})
+	t.Assert(err, IsNil)
+	t.Assert(NilStr(head.Metadata["mtime"]), Equals, fmt.Sprintf("%d", mtime.Unix()))
+
+	// The marker is hidden and its mtime is used after listing the directory again
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	_, err = s.cloud.PutBlob(&PutBlobInput{
+		Key:      "markerdir/.mtime",
+		Body:     bytes.NewReader([]byte{}),
+		Size:     PUInt64(0),
+		Metadata: map[string]*string{"mtime": PString(fmt.Sprintf("%d", future.Unix()))},
+	})
+	t.Assert(err, IsNil)
+	dir.mu.Lock()
+	dir.dir.DirTime = time.Time{}
+	dir.mu.Unlock()
+	s.assertEntries(t, dir, []string{"file"})
+	t.Assert(dir.InflateAttributes().Mtime.Equal(future), Equals, true)
+	_, err = s.LookUpInode(t, "markerdir/.mtime")
+	t.Assert(err, Equals, syscall.ENOENT)
+
+	// The marker doesn't keep the removed directory
+	err = dir.Unlink("file")
+	t.Assert(err, IsNil)
+	err = root.RmDir("markerdir")
+	t.Assert(err, IsNil)
+	err = s.fs.SyncFS(nil)
+	t.Assert(err, IsNil)
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "markerdir/.mtime"})
+	t.Assert(mapAwsError(err), Equals, syscall.ENOENT)
+}
@@ -17,6 +17,7 @@ package internal
 
 import (
 	"fmt"
+	"mime"
 	"os"
 	"sort"
 	"strconv"
@@ -27,6 +28,8 @@ import (
 	"time"
 	"net/url"
 
+	. "github.com/yandex-cloud/geesefs/api/common"
+
 	"github.com/aws/aws-sdk-go/aws"
 
 	"github.com/jacobsa/fuse"
@@ -95,6 +98,8 @@ type FileBuffer struct {
 	onDisk bool
 	// Chunk only contains zeroes, data and ptr are nil
 	zero bool
+	// Data is compressed with flate by --compress-buffers, length is still uncompressed
+	compressed bool
 	// Memory allocation recency counter
 	recency uint64
 	// Unmodified chunks (equal to the current server-side object state) have dirtyID = 0.
@@ -110,7 +115,12 @@ type FileBuffer struct {
 type Inode struct {
 	Id         fuseops.InodeID
 	Name       string
+	// Object name if it differs from Name (a file escaped because
+	// of a collision with a directory having the same name)
+	cloudName  string
 	fs         *Goofys
+	// *inodeCloudPath, see cloud()
+	cloudPath  atomic.Value
 	Attributes InodeAttributes
 	// It is generally safe to read `AttrTime` without locking because if some other
 	// operation is modifying `AttrTime`, in most cases the reader is okay with working with
@@ -123,6 +133,19 @@ type Inode struct {
 	AttrTime time.Time
 
 	mu sync.Mutex // everything below is protected by mu
+	// time when HEAD in fillXattr didn't find the object, for --neg-cache-ttl
+	headMissingTime time.Time
+	// time when knownETag was changed, for --consistent-read
+	etagTime time.Time
+	// knownETag is the result of our own flush, so it's not polled
+	etagFlushed bool
+	// symlink target remembered with --symlink-cache-ttl, used while userMetadata isn't loaded
+	symlinkTarget string
+	// website redirect of the object with --website-redirect-symlinks,
+	// presented as the symlink target if there's no symlink attribute
+	redirectTarget string
+	// closed when the HEAD of fillXattr in progress finishes
+	xattrLoading chan struct{}
 	readCond *sync.Cond
 	pauseWriters int
 
@@ -137,6 +160,7 @@ type Inode struct {
 	refreshed int32
 
 	fileHandles int32
+	writeHandles int32
 	lastWriteEnd uint64
 
 	// cached/buffered data
@@ -149,27 +173,106 @@ type Inode struct {
 	IsFlushing int
 	flushError error
 	flushErrorTime time.Time
+	// unlinked while open with --delete-on-close, the data is kept
+	// and the object is deleted when the last handle is closed
+	openUnlinked bool
+	// consecutive failed flush attempts, for the retry backoff
+	flushErrors int
+	// time of the first of them
+	flushFailingSince time.Time
+	// random part of --retry-jitter applied to the current retry delay
+	flushJitter float64
 	readError error
+	// incremented each time the cache is dropped so that reads started
+	// before it don't mix data from different versions of the object
+	cacheGen uint64
 	// renamed from: parent, name
 	oldParent *Inode
 	oldName string
 	// is already being renamed to the current name
 	renamingTo bool
+	// delete or rename is a part of removing or renaming a whole directory
+	treeOp bool
 
 	// multipart upload state
 	mpu *MultipartBlobCommitInput
+	// part+1 uploaded together with the last part up to mergedEnd, or 0
+	mergedPart uint64
+	mergedEnd uint64
+
+	// link generation of the local creation or rename into the current
+	// directory, used to hide the entry from listings started before it
+	linkGen uint64
+	// time of the first modification not yet flushed to the server
+	dirtySince time.Time
+
+	// metadata sidecar of this file, or the file this inode is a sidecar of
+	sidecar *Inode
+	sidecarOf *Inode
+	sidecarData []byte
+	// version history directory of this file, the file whose versions
+	// it lists, or the file and version this inode is a snapshot of
+	versionsDir *Inode
+	versionsOf *Inode
+	versions []BlobVersionOutput
+	versionFiles map[string]*Inode
+	versionOf *Inode
+	versionId string
+
+	// object version and ranges saved to the disk cache, for --validate-disk-cache
+	diskCacheETag string
+	diskCacheRanges []uint64
+	diskCacheDirty bool
 
 	userMetadataDirty int
 	userMetadata map[string][]byte
 	s3Metadata   map[string][]byte
+	// storage class set with the s3.storage-class xattr, sent with uploads
+	storageClass string
+	// Content-Type set with the s3.content-type xattr, sent with uploads
+	contentType string
+	// Content-Type of the object on the server, if known from a HEAD
+	knownContentType string
+	// object tags (s3.tag.* xattrs), nil until loaded
+	tags map[string][]byte
+	tagsDirty bool
+	tagsFlushing bool
 
 	// last known size and etag from the cloud
 	knownSize uint64
 	knownETag string
+	// last known modification time and checksum from the cloud, used
+	// to detect changes when the server doesn't return ETag
+	knownMtime time.Time
+	knownChecksum string
+	// size of the original data if the object is compressed, 0 otherwise
+	uncompressedSize uint64
+	// Content-Encoding of the compressed object, gzip or zstd
+	compression string
+	// part sizes and ETags of the last multipart upload, with --part-manifest
+	partManifest string
+	// the manifest doesn't fit into the metadata and is only kept in memory
+	partManifestUnsaved bool
+	// CRC32C of the object data, with --verify-checksums
+	checksums []checksumUnit
+	// CRC32C of the parts of the current multipart upload uploaded by us
+	partChecksums map[uint64]checksumUnit
+	// blocks counted in fs.usedBlocks
+	countedBlocks uint64
+	// removed from fs.inodes, so not counted in fs.usedBlocks anymore
+	forgotten bool
+	// part layout of the current multipart upload
+	mpuPartSizes []PartSizeConfig
+	// Content-Type sent with the start of the current multipart upload
+	mpuContentType *string
 
 	// the refcnt is an exception, it's protected with atomic access
 	// being part of parent.dir.Children increases refcnt by 1
 	refcnt int64
+
+	// bytes transferred from and to the server since mount, also atomic
+	bytesRead uint64
+	bytesWritten uint64
 }
 
 func NewInode(fs *Goofys, parent *Inode, name string) (inode *Inode) {
@@ -199,16 +302,38 @@ func (inode *Inode) SetFromBlobItem(item *BlobItemOutput) {
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
-	// We always just drop our local cache when inode size or etag changes remotely
+	// By default we just drop our local cache when inode size or etag changes remotely
 	// It's the simplest method of conflict resolution
 	// Otherwise we may not be able to make a correct object version
-	if item.ETag != nil && inode.knownETag != *item.ETag || item.Size != inode.knownSize {
-		if inode.CacheState != ST_CACHED && (inode.knownETag != "" || inode.knownSize > 0) {
-			s3Log.Warnf("Conflict detected (inode %v): server-side ETag or size of %v"+
-				" (%v, %v) differs from local (%v, %v). File is changed remotely, dropping cache",
-				inode.Id, inode.FullName(), NilStr(item.ETag), item.Size, inode.knownETag, inode.knownSize)
+	changed := inode.remoteChanged(item)
+	if changed && inode.etagSettling() {
+		// An eventually consistent server may still return the previous version
+		s3Log.Debugf("Ignoring possibly stale ETag %v of %v, known one is %v",
+			NilStr(item.ETag), inode.FullName(), inode.knownETag)
+		return
+	}
+	keepData, keepMetadata := false, false
+	inode.headMissingTime = time.Time{}
+	if changed && inode.CacheState != ST_CACHED && (inode.knownETag != "" || inode.knownSize > 0) {
+		keepData, keepMetadata = inode.resolveConflict(item)
+	}
+	if keepData {
+		// Local data overwrites the remote version with the next flush.
+		// Unmodified ranges are taken from the new remote version, so
+		// data cached from the previous one is dropped.
+		// Remember the remote version so that it isn't a conflict again
+		inode.dropCleanBuffers()
+		inode.knownSize = item.Size
+		inode.knownETag = NilStr(item.ETag)
+		if item.LastModified != nil {
+			inode.knownMtime = *item.LastModified
 		}
+		inode.knownChecksum = ""
+	} else if changed {
+		metadataDirty := inode.userMetadataDirty != 0
+		localMetadata := inode.userMetadata
 		inode.resetCache()
+		inode.knownChecksum = ""
 		inode.ResizeUnlocked(item.Size, false, false)
 		inode.knownSize = item.Size
 		if item.LastModified != nil {
@@ -218,22 +343,67 @@ func (inode *Inode) SetFromBlobItem(item *BlobItemOutput) {
 			inode.Attributes.Mtime = inode.fs.rootAttrs.Ctime
 			inode.Attributes.Ctime = inode.fs.rootAttrs.Ctime
 		}
-		if item.Metadata != nil {
-			inode.setMetadata(item.Metadata)
-			inode.userMetadataDirty = 0
+		inode.uncompressedSize = 0
+		inode.compression = ""
+		if keepMetadata {
+			// Only metadata is changed locally, write it over the remote data
+			inode.userMetadata = localMetadata
+			inode.userMetadataDirty = 2
+			inode.SetCacheState(ST_MODIFIED)
+			inode.fs.WakeupFlusher()
+		} else if item.Metadata != nil {
+			if metadataDirty {
+				inode.setMetadataKeepPerms(item.Metadata)
+			} else {
+				inode.setMetadata(item.Metadata)
+			}
+		} else if inode.fs.flags.UploadCompression != "" || inode.fs.flags.VerifyChecksums {
+			// Metadata should be loaded again to find out if the new object
+			// is compressed and to get its checksums
+			inode.userMetadata = nil
+			inode.checksums = nil
+		}
+		if !inode.tagsDirty {
+			// Tags of the new object are loaded again when needed
+			inode.tags = nil
+		}
+		if inode.symlinkTarget != "" {
+			inode.symlinkTarget = ""
+			inode.fs.forgetSymlink(inode)
 		}
+		inode.redirectTarget = NilStr(item.WebsiteRedirect)
 	}
 	if item.ETag != nil {
+		if inode.knownETag != *item.ETag && inode.fs.flags.ConsistentRead > 0 {
+			inode.etagTime = time.Now()
+			inode.etagFlushed = false
+		}
 		inode.s3Metadata["etag"] = []byte(*item.ETag)
 		inode.knownETag = *item.ETag
 	} else {
 		delete(inode.s3Metadata, "etag")
 	}
+	if item.LastModified != nil {
+		inode.knownMtime = *item.LastModified
+	}
+	if item.Checksum != nil {
+		inode.knownChecksum = *item.Checksum
+	}
 	if item.StorageClass != nil {
 		inode.s3Metadata["storage-class"] = []byte(*item.StorageClass)
 	} else {
 		delete(inode.s3Metadata, "storage-class")
 	}
+	if inode.fs.flags.ValidateDiskCache {
+		inode.attachDiskCache()
+	}
+	if inode.fs.flags.SymlinkCacheTTL > 0 {
+		if inode.userMetadata == nil {
+			inode.symlinkTarget = inode.fs.cachedSymlink(inode)
+		} else if inode.isSymlink() {
+			inode.fs.rememberSymlink(inode)
+		}
+	}
 	now := time.Now()
 	// don't want to update time if this inode is setup to never expire
 	if inode.AttrTime.Before(now) {
@@ -241,13 +411,229 @@ func (inode *Inode) SetFromBlobItem(item *BlobItemOutput) {
 	}
 }
 
+// Delay between HEADs of --consistent-read
+const CONSISTENT_READ_POLL_INTERVAL = 100 * time.Millisecond
+
+// ETag was changed recently and the server may still return the old one
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) etagSettling() bool {
+	return inode.fs.flags.ConsistentRead > 0 && !inode.etagTime.IsZero() &&
+		!expired(inode.etagTime, inode.fs.flags.ConsistentRead)
+}
+
+// With --consistent-read, poll the server after learning a new ETag until
+// two HEADs in a row return the same ETag and size, and use that version
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) waitConsistentETag() {
+	inode.mu.Lock()
+	if inode.CacheState != ST_CACHED || inode.etagFlushed || !inode.etagSettling() {
+		inode.mu.Unlock()
+		return
+	}
+	deadline := inode.etagTime.Add(inode.fs.flags.ConsistentRead)
+	cloud, key := inode.headKey()
+	inode.mu.Unlock()
+	if cloud == nil {
+		return
+	}
+
+	var last *HeadBlobOutput
+	for {
+		resp, err := cloud.HeadBlob(&HeadBlobInput{Key: key})
+		if err != nil {
+			// Missing objects and errors are handled by the usual code
+			return
+		}
+		if last != nil && NilStr(last.ETag) == NilStr(resp.ETag) && last.Size == resp.Size {
+			break
+		}
+		last = resp
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(CONSISTENT_READ_POLL_INTERVAL)
+	}
+
+	inode.mu.Lock()
+	inode.etagTime = time.Time{}
+	inode.mu.Unlock()
+	inode.SetFromBlobItem(&last.BlobItemOutput)
+	inode.mu.Lock()
+	// This version is confirmed
+	inode.etagTime = time.Time{}
+	inode.mu.Unlock()
+}
+
+// Decide what to keep from local changes of an object changed on the server
+// according to --conflict-policy
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) resolveConflict(item *BlobItemOutput) (keepData, keepMetadata bool) {
+	policy := inode.fs.flags.ConflictPolicy
+	action := "dropping cache"
+	if policy == "keep-local" || policy == "rename-remote" {
+		keepData = inode.mpu != nil
+		for _, b := range inode.buffers {
+			keepData = keepData || b.dirtyID != 0
+		}
+		keepMetadata = !keepData && inode.userMetadataDirty != 0
+		action = "keeping local changes"
+	}
+	if policy == "rename-remote" {
+		conflictKey := inode.saveRemoteVersion(item)
+		action += ", saving remote version as "+conflictKey
+	}
+	s3Log.Warnf("Conflict detected (inode %v): server-side ETag or size of %v"+
+		" (%v, %v) differs from local (%v, %v). File is changed remotely, %v",
+		inode.Id, inode.FullName(), NilStr(item.ETag), item.Size, inode.knownETag, inode.knownSize, action)
+	return
+}
+
+// Copy the remote version of a conflicting object to <name>.conflict-<etag>
+// Flushes are postponed until the copy is done, so it doesn't get the local version
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) saveRemoteVersion(item *BlobItemOutput) string {
+	cloud, key := inode.cloud()
+	suffix := ""
+	if item.ETag != nil {
+		suffix = strings.Trim(*item.ETag, "\"")
+	} else if item.LastModified != nil {
+		suffix = fmt.Sprintf("%v", item.LastModified.Unix())
+	} else {
+		suffix = fmt.Sprintf("%v", item.Size)
+	}
+	conflictKey := key+".conflict-"+suffix
+	copyIn := &CopyBlobInput{
+		Source:       key,
+		Destination:  conflictKey,
+		Size:         PUInt64(item.Size),
+		ETag:         item.ETag,
+		StorageClass: item.StorageClass,
+	}
+	inode.IsFlushing += inode.fs.flags.MaxParallelParts
+	go func() {
+		inode.fs.addInflightChange(conflictKey)
+		_, err := cloud.CopyBlob(copyIn)
+		inode.fs.completeInflightChange(conflictKey)
+		if err != nil {
+			s3Log.Errorf("Failed to save remote version of %v as %v: %v", key, conflictKey, err)
+		}
+		inode.mu.Lock()
+		inode.IsFlushing -= inode.fs.flags.MaxParallelParts
+		inode.fs.WakeupFlusher()
+		inode.mu.Unlock()
+	}()
+	return conflictKey
+}
+
+// Check if the object is changed on the server. ETag is used when the server
+// returns it, otherwise --conflict-detect selects what to compare besides size
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) remoteChanged(item *BlobItemOutput) bool {
+	if item.Size != inode.knownSize {
+		return true
+	}
+	if item.ETag != nil {
+		if inode.knownETag == *item.ETag {
+			return false
+		}
+		cloud, _ := inode.cloud()
+		if cloud == nil || !cloud.Capabilities().OpaqueETag ||
+			item.LastModified == nil || inode.knownMtime.IsZero() {
+			return true
+		}
+		// ETag of encrypted objects may change without changing the object,
+		// so also require another modification time
+		return !item.LastModified.Equal(inode.knownMtime)
+	}
+	mode := inode.fs.flags.ConflictDetect
+	if atomic.CompareAndSwapInt32(&inode.fs.noETagLogged, 0, 1) {
+		if mode == "mtime" || mode == "checksum" {
+			s3Log.Infof("Server doesn't return ETag for %v, falling back to %v for change detection",
+				inode.FullName(), mode)
+		} else {
+			s3Log.Warnf("Server doesn't return ETag for %v, only size is used for change detection."+
+				" Consider using --conflict-detect=mtime or --conflict-detect=checksum", inode.FullName())
+		}
+	}
+	switch mode {
+	case "mtime":
+		// Modification time is unknown right after our own upload
+		if item.LastModified != nil && !inode.knownMtime.IsZero() {
+			return !item.LastModified.Equal(inode.knownMtime)
+		}
+	case "checksum":
+		// Checksum is only returned by HEAD, so listings can't detect changes
+		if item.Checksum != nil && inode.knownChecksum != "" {
+			return *item.Checksum != inode.knownChecksum
+		}
+	}
+	return false
+}
+
+// Mount point of an inode and the inode path relative to it, cached by cloud()
+type inodeCloudPath struct {
+	gen   uint64
+	mount *Inode
+	path  string
+}
+
+// Walking the parent chain is repeated work for every operation in deep trees,
+// so the result is cached until something is renamed or (un)mounted
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) cloud() (cloud StorageBackend, path string) {
 	var prefix string
+	var mount *Inode
+
+	gen := atomic.LoadUint64(&inode.fs.cloudGen)
+	if cached, ok := inode.cloudPath.Load().(*inodeCloudPath); ok && cached.gen == gen {
+		mount, path = cached.mount, cached.path
+		cloud = mount.dir.cloud
+	}
+	if cloud == nil {
+		mount, path = inode.resolveCloudPath()
+		if mount != nil {
+			cloud = mount.dir.cloud
+			inode.cloudPath.Store(&inodeCloudPath{gen: gen, mount: mount, path: path})
+		}
+	}
+
+	if cloud != nil {
+		// the error backend produces a mount.err file
+		// at the root and is not aware of prefix
+		_, isErr := cloud.(StorageBackendInitError)
+		if !isErr {
+			// we call init here instead of
+			// relying on the wrapper to call init
+			// because we want to return the right
+			// prefix
+			if c, ok := cloud.(*StorageBackendInitWrapper); ok {
+				err := c.Init("")
+				isErr = err != nil
+			}
+		}
+
+		if !isErr {
+			prefix = mount.dir.mountPrefix
+		}
+	}
+
+	if path == "" {
+		path = strings.TrimRight(prefix, "/")
+	} else {
+		path = prefix + path
+	}
+	return
+}
+
+// Find the nearest mount point and the path of the inode relative to it
+func (inode *Inode) resolveCloudPath() (mount *Inode, path string) {
 	var dir *Inode
 
 	if inode.dir == nil {
 		path = inode.Name
+		if inode.cloudName != "" {
+			path = inode.cloudName
+		}
 		dir = inode.Parent
 	} else {
 		dir = inode
@@ -255,24 +641,7 @@ func (inode *Inode) cloud() (cloud StorageBackend, path string) {
 
 	for p := dir; p != nil; p = p.Parent {
 		if p.dir.cloud != nil {
-			cloud = p.dir.cloud
-			// the error backend produces a mount.err file
-			// at the root and is not aware of prefix
-			_, isErr := cloud.(StorageBackendInitError)
-			if !isErr {
-				// we call init here instead of
-				// relying on the wrapper to call init
-				// because we want to return the right
-				// prefix
-				if c, ok := cloud.(*StorageBackendInitWrapper); ok {
-					err := c.Init("")
-					isErr = err != nil
-				}
-			}
-
-			if !isErr {
-				prefix = p.dir.mountPrefix
-			}
+			mount = p
 			break
 		}
 
@@ -283,12 +652,6 @@ func (inode *Inode) cloud() (cloud StorageBackend, path string) {
 			path = p.Name + "/" + path
 		}
 	}
-
-	if path == "" {
-		path = strings.TrimRight(prefix, "/")
-	} else {
-		path = prefix + path
-	}
 	return
 }
 
@@ -323,10 +686,17 @@ func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
 		Rdev:   inode.Attributes.Rdev,
 	}
 
+	if inode.fs.flags.EnablePerms && inode.userMetadata != nil {
+		// The access ACL may be set by another client without changing the mode
+		if perm, ok := aclMode(inode.userMetadata[ACL_ACCESS_ATTR]); ok {
+			attr.Mode = attr.Mode&^os.ModePerm | perm
+		}
+	}
+
 	if inode.dir != nil {
 		attr.Nlink = 2
 		attr.Mode = attr.Mode & os.ModePerm | os.ModeDir
-	} else if inode.userMetadata != nil && inode.userMetadata[inode.fs.flags.SymlinkAttr] != nil {
+	} else if inode.isSymlink() {
 		attr.Nlink = 1
 		attr.Mode = attr.Mode & os.ModePerm | os.ModeSymlink
 	} else {
@@ -336,6 +706,22 @@ func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
 	return
 }
 
+// Symlinks are stored as empty objects with the target in SymlinkAttr.
+// The target doesn't matter, directory objects are never symlinks
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) isSymlink() bool {
+	if inode.dir != nil {
+		return false
+	}
+	if inode.redirectTarget != "" {
+		return true
+	}
+	if inode.userMetadata == nil {
+		return inode.symlinkTarget != ""
+	}
+	return inode.metadataAttr(inode.fs.flags.SymlinkAttr) != nil
+}
+
 func (inode *Inode) logFuse(op string, args ...interface{}) {
 	if fuseLog.Level >= logrus.DebugLevel {
 		fuseLog.Debugln(op, inode.Id, inode.FullName(), args)
@@ -378,11 +764,18 @@ func (inode *Inode) DeRef(n int64) (stale bool) {
 	if res == 0 && inode.CacheState == ST_CACHED {
 		inode.resetCache()
 		inode.fs.mu.Lock()
-		delete(inode.fs.inodes, inode.Id)
+		if inode.fs.inodes[inode.Id] == inode {
+			// The number may still refer to another inode after a rename
+			// with --stable-inode-on-rename
+			delete(inode.fs.inodes, inode.Id)
+		}
 		inode.fs.forgotCnt += 1
 		inode.fs.mu.Unlock()
+		inode.forgotten = true
+		inode.updateUsedBlocks()
 		// Remove from LFRU tracker
-		inode.fs.lfru.Forget(inode.Id)
+		inode.fs.cachePolicy.Forget(inode.Id)
+		inode.forgetVersion()
 	}
 	return res == 0
 }
@@ -397,6 +790,31 @@ func (inode *Inode) isDir() bool {
 	return inode.dir != nil
 }
 
+// Update the running count of blocks used by files known to the mount
+// for --fs-total-size, so statfs doesn't have to walk all inodes. Sizes
+// include local modifications not flushed yet, and each file takes whole
+// blocks so that du agrees with df. Only files known to the mount are
+// counted, i.e. looked up or listed and not forgotten yet, not the whole bucket
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) updateUsedBlocks() {
+	var blocks uint64
+	if inode.Id != 0 && !inode.forgotten && !inode.isDir() && !inode.isVirtual() &&
+		inode.CacheState != ST_DELETED && inode.CacheState != ST_DEAD {
+		blockSize := uint64(inode.fs.statfsBlockSize())
+		blocks = (inode.Attributes.Size + blockSize-1) / blockSize
+	}
+	if blocks != inode.countedBlocks {
+		atomic.AddInt64(&inode.fs.usedBlocks, int64(blocks)-int64(inode.countedBlocks))
+		inode.countedBlocks = blocks
+	}
+}
+
+// Synthetic inodes which aren't children of their parents and can't be modified
+func (inode *Inode) isVirtual() bool {
+	return inode.sidecarOf != nil || inode.versionsOf != nil || inode.versionOf != nil || inode.fs.changeLog != nil &&
+		(inode == inode.fs.controlDir || inode == inode.fs.changeLogFile)
+}
+
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) fillXattrFromHead(resp *HeadBlobOutput) {
 	if resp.ETag != nil {
@@ -407,10 +825,34 @@ func (inode *Inode) fillXattrFromHead(resp *HeadBlobOutput) {
 	} else {
 		inode.s3Metadata["storage-class"] = []byte("STANDARD")
 	}
+	inode.knownContentType = NilStr(resp.ContentType)
+	inode.redirectTarget = NilStr(resp.WebsiteRedirect)
+	if resp.Restore != nil {
+		inode.s3Metadata["restore"] = []byte(restoreStatus(*resp.Restore))
+	} else {
+		delete(inode.s3Metadata, "restore")
+	}
 
 	inode.setMetadata(resp.Metadata)
 }
 
+// Convert x-amz-restore to the value of s3.restore:
+// ongoing-request="true" => ongoing
+// ongoing-request="false", expiry-date="..." => restored expires=...
+func restoreStatus(header string) string {
+	if strings.Contains(header, `ongoing-request="true"`) {
+		return "ongoing"
+	}
+	status := "restored"
+	if i := strings.Index(header, `expiry-date="`); i >= 0 {
+		expiry := header[i+len(`expiry-date="`):]
+		if j := strings.Index(expiry, `"`); j >= 0 {
+			status += " expires="+expiry[0:j]
+		}
+	}
+	return status
+}
+
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) setUserMeta(key string, value []byte) {
 	if inode.userMetadata == nil {
@@ -424,12 +866,76 @@ func (inode *Inode) setUserMeta(key string, value []byte) {
 	inode.userMetadataDirty = 2
 }
 
+// Get a metadata attribute managed by GeeseFS. With --metadata-prefix,
+// attributes saved without the prefix are used when the prefixed one is
+// absent, so existing objects are still understood. Unprefixed attributes
+// are never changed or removed as they may belong to other applications
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) metadataAttr(attr string) []byte {
+	if value := inode.userMetadata[attr]; value != nil {
+		return value
+	}
+	prefix := inode.fs.flags.MetadataPrefix
+	if prefix != "" && strings.HasPrefix(attr, prefix) {
+		return inode.userMetadata[attr[len(prefix):]]
+	}
+	return nil
+}
+
+// Remove a metadata attribute managed by GeeseFS, reverting it to the default
+// value. If an unprefixed attribute would be used instead, the default value
+// is saved explicitly as the unprefixed one can't be removed
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) resetMetadataAttr(attr string, value []byte) {
+	prefix := inode.fs.flags.MetadataPrefix
+	if prefix != "" && strings.HasPrefix(attr, prefix) && inode.userMetadata[attr[len(prefix):]] != nil {
+		inode.setUserMeta(attr, value)
+	} else {
+		inode.setUserMeta(attr, nil)
+	}
+}
+
+// Apply metadata from the server, but keep the locally changed and not yet
+// flushed uid, gid and mode, so that a refresh doesn't revert chmod/chown.
+// They're saved along with the rest of metadata on the next flush
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setMetadataKeepPerms(metadata map[string]*string) {
+	flags := inode.fs.flags
+	local := make(map[string][]byte)
+	for _, attr := range []string{flags.UidAttr, flags.GidAttr, flags.FileModeAttr, flags.RdevAttr, ACL_ACCESS_ATTR} {
+		if attr != "" {
+			local[attr] = inode.userMetadata[attr]
+		}
+	}
+	uid, gid, mode, rdev := inode.Attributes.Uid, inode.Attributes.Gid, inode.Attributes.Mode, inode.Attributes.Rdev
+	inode.setMetadata(metadata)
+	for attr, value := range local {
+		if value != nil {
+			if inode.userMetadata == nil {
+				inode.userMetadata = make(map[string][]byte)
+			}
+			inode.userMetadata[attr] = value
+		} else if inode.userMetadata != nil {
+			delete(inode.userMetadata, attr)
+		}
+	}
+	inode.Attributes.Uid, inode.Attributes.Gid, inode.Attributes.Mode, inode.Attributes.Rdev = uid, gid, mode, rdev
+	inode.userMetadataDirty = 2
+	if inode.CacheState == ST_CACHED {
+		inode.SetCacheState(ST_MODIFIED)
+		inode.fs.WakeupFlusher()
+	}
+}
+
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) setMetadata(metadata map[string]*string) {
 	inode.userMetadata = unescapeMetadata(metadata)
+	inode.setUncompressedSize()
+	inode.setPartManifest()
+	inode.setChecksums()
 	if inode.userMetadata != nil {
 		if inode.fs.flags.EnableMtime {
-			mtimeStr := inode.userMetadata[inode.fs.flags.MtimeAttr]
+			mtimeStr := inode.metadataAttr(inode.fs.flags.MtimeAttr)
 			if mtimeStr != nil {
 				i, err := strconv.ParseUint(string(mtimeStr), 0, 64)
 				if err == nil {
@@ -438,23 +944,23 @@ func (inode *Inode) setMetadata(metadata map[string]*string) {
 			}
 		}
 		if inode.fs.flags.EnablePerms {
-			uidStr := inode.userMetadata[inode.fs.flags.UidAttr]
+			uidStr := inode.metadataAttr(inode.fs.flags.UidAttr)
 			if uidStr != nil {
 				i, err := strconv.ParseUint(string(uidStr), 0, 32)
 				if err == nil {
-					inode.Attributes.Uid = uint32(i)
+					inode.Attributes.Uid = mapIdToLocal(inode.fs.flags.UidMap, uint32(i))
 				}
 			}
-			gidStr := inode.userMetadata[inode.fs.flags.GidAttr]
+			gidStr := inode.metadataAttr(inode.fs.flags.GidAttr)
 			if gidStr != nil {
 				i, err := strconv.ParseUint(string(gidStr), 0, 32)
 				if err == nil {
-					inode.Attributes.Gid = uint32(i)
+					inode.Attributes.Gid = mapIdToLocal(inode.fs.flags.GidMap, uint32(i))
 				}
 			}
 		}
 		if inode.fs.flags.EnablePerms || inode.fs.flags.EnableSpecials {
-			modeStr := inode.userMetadata[inode.fs.flags.FileModeAttr]
+			modeStr := inode.metadataAttr(inode.fs.flags.FileModeAttr)
 			if modeStr != nil {
 				i, err := strconv.ParseUint(string(modeStr), 0, 32)
 				if err == nil {
@@ -463,14 +969,18 @@ func (inode *Inode) setMetadata(metadata map[string]*string) {
 					if inode.fs.flags.EnablePerms {
 						mask = os.ModePerm
 					}
-					if inode.fs.flags.EnableSpecials && (inode.Attributes.Mode & os.ModeType) == 0 {
-						mask = mask | os.ModeType
+					if inode.fs.flags.EnableSpecials && inode.dir == nil && !inode.isSymlink() {
+						// Only special file types may be stored in the mode of
+						// a file object, directories and symlinks are stored differently
+						mask = mask | SPECIAL_FILE_TYPES
 					}
 					rmMask := (os.ModePerm | os.ModeType) ^ mask
 					inode.Attributes.Mode = inode.Attributes.Mode & rmMask | (fm & mask)
 					if (inode.Attributes.Mode & os.ModeDevice) != 0 {
-						rdev, _ := strconv.ParseUint(string(inode.userMetadata[inode.fs.flags.RdevAttr]), 0, 32)
+						rdev, _ := strconv.ParseUint(string(inode.metadataAttr(inode.fs.flags.RdevAttr)), 0, 32)
 						inode.Attributes.Rdev = uint32(rdev)
+					} else {
+						inode.Attributes.Rdev = 0
 					}
 				}
 			}
@@ -478,6 +988,10 @@ func (inode *Inode) setMetadata(metadata map[string]*string) {
 	}
 }
 
+// File types which may be set with mknod and stored in --file-mode-attr
+const SPECIAL_FILE_TYPES = os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe | os.ModeSocket
+
+// LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) setFileMode(newMode os.FileMode) (changed bool, err error) {
 	prevMode := inode.Attributes.Mode
 	if inode.fs.flags.EnableSpecials {
@@ -501,48 +1015,151 @@ func (inode *Inode) setFileMode(newMode os.FileMode) (changed bool, err error) {
 	}
 	if (inode.Attributes.Mode & os.ModeDevice) != 0 {
 		inode.setUserMeta(inode.fs.flags.RdevAttr, []byte(fmt.Sprintf("%d", inode.Attributes.Rdev)))
+	} else if inode.metadataAttr(inode.fs.flags.RdevAttr) != nil {
+		inode.Attributes.Rdev = 0
+		inode.resetMetadataAttr(inode.fs.flags.RdevAttr, []byte("0"))
 	}
 	if inode.Attributes.Mode != defaultMode {
 		inode.setUserMeta(inode.fs.flags.FileModeAttr, []byte(fmt.Sprintf("%d", fuse.ConvertGolangMode(inode.Attributes.Mode))))
 	} else {
-		inode.setUserMeta(inode.fs.flags.FileModeAttr, nil)
+		inode.resetMetadataAttr(inode.fs.flags.FileModeAttr, []byte(fmt.Sprintf("%d", fuse.ConvertGolangMode(defaultMode))))
 	}
+	inode.setAclFromMode()
 	return prevMode != inode.Attributes.Mode, nil
 }
 
+// Translate a uid or gid saved in metadata using --uid-map/--gid-map
+func mapIdToLocal(idMap []IdMapRange, id uint32) uint32 {
+	for _, r := range idMap {
+		if id >= r.Stored && id-r.Stored < r.Count {
+			return r.Local + (id-r.Stored)
+		}
+	}
+	return id
+}
+
+// Reverse of mapIdToLocal, used when saving a uid or gid to metadata
+func mapIdToStored(idMap []IdMapRange, id uint32) uint32 {
+	for _, r := range idMap {
+		if id >= r.Local && id-r.Local < r.Count {
+			return r.Stored + (id-r.Local)
+		}
+	}
+	return id
+}
+
 // FIXME: Move all these xattr-related functions to file.go
 
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) fillXattr() (err error) {
+	return inode.headMetadata(inode.fillXattrFromHead)
+}
+
+// HEAD the object if its metadata isn't loaded yet and apply the result with
+// the inode locked. Parallel calls wait for the same request
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) headMetadata(apply func(resp *HeadBlobOutput)) (err error) {
+	for inode.xattrLoading != nil {
+		// Another HEAD is in progress, use its result
+		loading := inode.xattrLoading
+		inode.mu.Unlock()
+		<-loading
+		inode.mu.Lock()
+	}
 	if !inode.ImplicitDir && inode.userMetadata == nil {
-		cloud, key := inode.cloud()
-		if inode.oldParent != nil {
-			_, key = inode.oldParent.cloud()
-			key = appendChildName(key, inode.oldName)
-		}
-		if inode.isDir() {
-			key += "/"
+		if !inode.headMissingTime.IsZero() && !expired(inode.headMissingTime, inode.fs.flags.NegCacheTTL) {
+			return
 		}
+		cloud, key := inode.headKey()
+		loading := make(chan struct{})
+		inode.xattrLoading = loading
 		inode.mu.Unlock()
 		resp, err := cloud.HeadBlob(&HeadBlobInput{Key: key})
 		inode.mu.Lock()
+		inode.xattrLoading = nil
+		close(loading)
 		if err != nil {
 			err = mapAwsError(err)
 			if err == fuse.ENOENT {
 				err = nil
 				if inode.isDir() {
+					// Directories without an object are implicit, they're never missing
 					inode.ImplicitDir = true
+				} else if inode.fs.flags.NegCacheTTL > 0 {
+					inode.headMissingTime = time.Now()
 				}
 			}
 			return err
 		} else if inode.userMetadata == nil {
-			inode.fillXattrFromHead(resp)
+			apply(resp)
 		}
 	}
 
 	return
 }
 
+// Object key for HEAD requests: the old one if the inode is being renamed
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) headKey() (cloud StorageBackend, key string) {
+	cloud, key = inode.cloud()
+	if inode.oldParent != nil {
+		_, key = inode.oldParent.cloud()
+		key = appendChildName(key, inode.oldName)
+	}
+	if inode.isDir() {
+		key += "/"
+	}
+	return
+}
+
+// Get the current restore status of an archived object. It changes on the
+// server by itself, so it's always requested again
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) getRestoreStatus() ([]byte, error) {
+	if inode.isDir() || inode.CacheState == ST_CREATED {
+		return nil, syscall.ENODATA
+	}
+	cloud, key := inode.headKey()
+	inode.mu.Unlock()
+	resp, err := cloud.HeadBlob(&HeadBlobInput{Key: key})
+	inode.mu.Lock()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	if resp.Restore == nil {
+		delete(inode.s3Metadata, "restore")
+		return []byte{}, nil
+	}
+	status := []byte(restoreStatus(*resp.Restore))
+	inode.s3Metadata["restore"] = status
+	return status, nil
+}
+
+// Start restoring an archived object for `value` days
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) restoreObject(value string) error {
+	days, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || days <= 0 {
+		return syscall.EINVAL
+	}
+	if inode.isDir() || inode.CacheState == ST_CREATED {
+		return syscall.EPERM
+	}
+	cloud, key := inode.headKey()
+	restorable, ok := unwrapCloud(cloud).(RestorableBackend)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	inode.mu.Unlock()
+	err = restorable.RestoreBlob(key, days)
+	inode.mu.Lock()
+	if err != nil {
+		return mapAwsError(err)
+	}
+	inode.s3Metadata["restore"] = []byte("ongoing")
+	return nil
+}
+
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) getXattrMap(name string, userOnly bool) (
 	meta map[string][]byte, newName string, err error) {
@@ -550,14 +1167,31 @@ func (inode *Inode) getXattrMap(name string, userOnly bool) (
 	cloud, _ := inode.cloud()
 	xattrPrefix := cloud.Capabilities().Name + "."
 
-	if strings.HasPrefix(name, xattrPrefix) {
+	if key, ok := inode.tagXattr(name); ok {
+		err = inode.fillTags()
+		if err != nil {
+			return nil, "", err
+		}
+		newName = key
+		meta = inode.tags
+	} else if key := aclAttr(name); key != "" {
+		// POSIX ACLs are stored in user metadata under reserved keys
+		err = inode.fillXattr()
+		if err != nil {
+			return nil, "", err
+		}
+
+		newName = key
+		meta = inode.userMetadata
+	} else if strings.HasPrefix(name, xattrPrefix) {
 		if userOnly {
 			return nil, "", syscall.EPERM
 		}
 
 		newName = name[len(xattrPrefix):]
 		meta = inode.s3Metadata
-	} else if strings.HasPrefix(name, "user.") && name != "user."+inode.fs.flags.SymlinkAttr {
+	} else if strings.HasPrefix(name, "user.") && name != "user."+inode.fs.flags.SymlinkAttr &&
+		aclXattrName(name[5:]) == "" {
 		err = inode.fillXattr()
 		if err != nil {
 			return nil, "", err
@@ -565,6 +1199,16 @@ func (inode *Inode) getXattrMap(name string, userOnly bool) (
 
 		newName = name[5:]
 		meta = inode.userMetadata
+	} else if ns, metaPrefix := inode.fs.xattrNamespace(name); ns != "" {
+		// Additional namespaces (security., trusted. and so on) explicitly
+		// allowed by --xattr-namespaces are stored in user metadata
+		err = inode.fillXattr()
+		if err != nil {
+			return nil, "", err
+		}
+
+		newName = metaPrefix + name[len(ns)+1:]
+		meta = inode.userMetadata
 	} else {
 		if userOnly {
 			return nil, "", syscall.EPERM
@@ -580,6 +1224,32 @@ func (inode *Inode) getXattrMap(name string, userOnly bool) (
 	return
 }
 
+// Find the additional xattr namespace of `name` enabled by --xattr-namespaces
+func (fs *Goofys) xattrNamespace(name string) (ns string, metaPrefix string) {
+	dot := strings.Index(name, ".")
+	if dot <= 0 || fs.flags.XattrNamespaces == nil {
+		return "", ""
+	}
+	metaPrefix, ok := fs.flags.XattrNamespaces[name[0:dot]]
+	if !ok {
+		return "", ""
+	}
+	return name[0:dot], metaPrefix
+}
+
+// Map user metadata key back to the xattr name
+func (fs *Goofys) userMetaXattrName(key string) string {
+	if name := aclXattrName(key); name != "" {
+		return name
+	}
+	for ns, metaPrefix := range fs.flags.XattrNamespaces {
+		if strings.HasPrefix(key, metaPrefix) {
+			return ns + "." + key[len(metaPrefix):]
+		}
+	}
+	return "user." + key
+}
+
 func escapeMetadata(meta map[string][]byte) (metadata map[string]*string) {
 	if meta == nil {
 		return
@@ -609,6 +1279,12 @@ func unescapeMetadata(meta map[string]*string) map[string][]byte {
 func (inode *Inode) SetXattr(name string, value []byte, flags uint32) error {
 	inode.logFuse("SetXattr", name)
 
+	if strings.HasPrefix(name, CONTROL_XATTR_PREFIX) {
+		return inode.setControlXattr(name[len(CONTROL_XATTR_PREFIX):], value)
+	} else if name == FLUSH_PROGRESS_XATTR {
+		return syscall.EPERM
+	}
+
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
@@ -617,11 +1293,56 @@ func (inode *Inode) SetXattr(name string, value []byte, flags uint32) error {
 		return fuse.ENOENT
 	}
 
+	if cloud, _ := inode.cloud(); cloud != nil && cloud.Capabilities().Name == "s3" {
+		if name == "s3.storage-class" {
+			return inode.setStorageClass(string(value))
+		} else if name == "s3.restore" {
+			return inode.restoreObject(string(value))
+		} else if name == "s3.content-type" {
+			return inode.setContentType(string(value))
+		}
+	}
+
+	if key, ok := inode.tagXattr(name); ok {
+		return inode.setTag(key, value, flags)
+	}
+
+	if key := aclAttr(name); key != "" {
+		err := inode.checkAcl(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
 	meta, name, err := inode.getXattrMap(name, true)
 	if err != nil {
 		return err
 	}
 
+	if limit := inode.maxMetadataSize(); limit > 0 {
+		// Check the limit here instead of failing to flush later
+		size := len(xattrEscape(name)) + len(xattrEscape(string(value)))
+		for k, v := range meta {
+			if k != name {
+				size += len(xattrEscape(k)) + len(xattrEscape(string(v)))
+			}
+		}
+		if size > limit {
+			return syscall.E2BIG
+		}
+	}
+
+	limit := inode.fs.flags.MaxXattrValueSize
+	if limit == 0 {
+		cloud, _ := inode.cloud()
+		if cloud != nil {
+			limit = cloud.Capabilities().MaxXattrValueSize
+		}
+	}
+	if limit > 0 && len(xattrEscape(string(value))) > limit {
+		return syscall.E2BIG
+	}
+
 	if flags != 0x0 {
 		_, ok := meta[name]
 		if flags == unix.XATTR_CREATE {
@@ -637,6 +1358,41 @@ func (inode *Inode) SetXattr(name string, value []byte, flags uint32) error {
 
 	meta[name] = Dup(value)
 	inode.userMetadataDirty = 2
+	if name == ACL_ACCESS_ATTR {
+		err = inode.setModeFromAcl()
+		if err != nil {
+			return err
+		}
+	}
+	if inode.CacheState == ST_CACHED {
+		inode.SetCacheState(ST_MODIFIED)
+		inode.fs.WakeupFlusher()
+	}
+	return nil
+}
+
+var WRITABLE_STORAGE_CLASSES = map[string]bool{
+	"STANDARD":            true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// Change the storage class of the object with the next flush. The object is
+// copied into itself if its data isn't changed. GetXattr returns the new class
+// only after it's applied
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setStorageClass(class string) error {
+	if !WRITABLE_STORAGE_CLASSES[class] {
+		return syscall.EINVAL
+	}
+	if inode.isDir() {
+		return syscall.EPERM
+	}
+	inode.storageClass = class
+	inode.userMetadataDirty = 2
 	if inode.CacheState == ST_CACHED {
 		inode.SetCacheState(ST_MODIFIED)
 		inode.fs.WakeupFlusher()
@@ -644,9 +1400,66 @@ func (inode *Inode) SetXattr(name string, value []byte, flags uint32) error {
 	return nil
 }
 
+// Change Content-Type of the object with the next flush, or go back to the
+// guessed one if `contentType` is empty. Metadata is loaded first because
+// it's replaced along with Content-Type
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setContentType(contentType string) error {
+	if contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return syscall.EINVAL
+		}
+	}
+	if inode.isDir() {
+		return syscall.EPERM
+	}
+	err := inode.fillXattr()
+	if err != nil {
+		return err
+	}
+	inode.contentType = contentType
+	inode.userMetadataDirty = 2
+	if inode.CacheState == ST_CACHED {
+		inode.SetCacheState(ST_MODIFIED)
+		inode.fs.WakeupFlusher()
+	}
+	return nil
+}
+
+// Content-Type set with the xattr, or the one of the object on the server,
+// or the one which will be sent with the upload of a new file
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) getContentType() ([]byte, error) {
+	if inode.contentType != "" {
+		return []byte(inode.contentType), nil
+	}
+	if inode.isDir() {
+		return nil, syscall.ENODATA
+	}
+	if inode.CacheState != ST_CREATED {
+		err := inode.fillXattr()
+		if err != nil {
+			return nil, err
+		}
+		if inode.knownContentType != "" && inode.CacheState == ST_CACHED {
+			return []byte(inode.knownContentType), nil
+		}
+	}
+	_, key := inode.cloud()
+	contentType := inode.uploadContentType(key)
+	if contentType == nil {
+		return nil, syscall.ENODATA
+	}
+	return []byte(*contentType), nil
+}
+
 func (inode *Inode) RemoveXattr(name string) error {
 	inode.logFuse("RemoveXattr", name)
 
+	if name == FLUSH_PROGRESS_XATTR {
+		return syscall.EPERM
+	}
+
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
@@ -655,6 +1468,18 @@ func (inode *Inode) RemoveXattr(name string) error {
 		return fuse.ENOENT
 	}
 
+	if key, ok := inode.tagXattr(name); ok {
+		return inode.removeTag(key)
+	}
+
+	if cloud, _ := inode.cloud(); cloud != nil && cloud.Capabilities().Name == "s3" &&
+		name == "s3.content-type" {
+		if inode.contentType == "" {
+			return syscall.ENODATA
+		}
+		return inode.setContentType("")
+	}
+
 	meta, name, err := inode.getXattrMap(name, true)
 	if err != nil {
 		return err
@@ -676,9 +1501,23 @@ func (inode *Inode) RemoveXattr(name string) error {
 func (inode *Inode) GetXattr(name string) ([]byte, error) {
 	inode.logFuse("GetXattr", name)
 
+	if strings.HasPrefix(name, CONTROL_XATTR_PREFIX) {
+		return inode.getControlXattr(name[len(CONTROL_XATTR_PREFIX):])
+	} else if name == FLUSH_PROGRESS_XATTR {
+		return inode.getFlushProgress()
+	}
+
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
+	if cloud, _ := inode.cloud(); cloud != nil && cloud.Capabilities().Name == "s3" {
+		if name == "s3.restore" {
+			return inode.getRestoreStatus()
+		} else if name == "s3.content-type" {
+			return inode.getContentType()
+		}
+	}
+
 	meta, name, err := inode.getXattrMap(name, false)
 	if err != nil {
 		return nil, err
@@ -700,9 +1539,11 @@ func (inode *Inode) ListXattr() ([]string, error) {
 
 	var xattrs []string
 
-	err := inode.fillXattr()
-	if err != nil {
-		return nil, err
+	if !inode.fs.flags.LazyXattrList {
+		err := inode.fillXattr()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	cloud, _ := inode.cloud()
@@ -713,7 +1554,13 @@ func (inode *Inode) ListXattr() ([]string, error) {
 	}
 
 	for k, _ := range inode.userMetadata {
-		xattrs = append(xattrs, "user."+k)
+		xattrs = append(xattrs, inode.fs.userMetaXattrName(k))
+	}
+
+	// Tags are only listed when already loaded: they need a separate request
+	// which may also be unsupported by the server
+	for k, _ := range inode.tags {
+		xattrs = append(xattrs, TAG_XATTR_PREFIX+k)
 	}
 
 	sort.Strings(xattrs)
@@ -722,12 +1569,29 @@ func (inode *Inode) ListXattr() ([]string, error) {
 }
 
 func (inode *Inode) OpenFile() (fh *FileHandle, err error) {
-	inode.logFuse("OpenFile")
+	return inode.Open(true)
+}
+
+// Open the file for reading or for reading and writing
+func (inode *Inode) Open(write bool) (fh *FileHandle, err error) {
+	inode.logFuse("OpenFile", write)
+
+	if inode.fs.flags.ConsistentRead > 0 {
+		inode.waitConsistentETag()
+	}
 
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
+	if write {
+		if inode.fs.flags.ExclusiveWriter && inode.writeHandles > 0 {
+			return nil, syscall.EBUSY
+		}
+		inode.writeHandles++
+	}
+
 	fh = NewFileHandle(inode)
+	fh.writer = write
 
 	n := atomic.AddInt32(&inode.fileHandles, 1)
 	if n == 1 && inode.CacheState == ST_CACHED {
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"sort"
 	"sync"
 	"github.com/google/btree"
 	"github.com/jacobsa/fuse/fuseops"
@@ -14,11 +15,12 @@ type LFRU struct {
 	ageDecrement int64
 	toAge int64
 	maxRecency uint64
+	recencyLimit uint64
 	items map[fuseops.InodeID]*LFRUItem
 	index *btree.BTree
 }
 
-func NewLFRU(popularThreshold int64, maxHits int64, ageInterval int64, ageDecrement int64) *LFRU {
+func NewLFRU(popularThreshold int64, maxHits int64, ageInterval int64, ageDecrement int64, recencyLimit uint64) *LFRU {
 	if maxHits < popularThreshold {
 		maxHits = popularThreshold
 	}
@@ -28,6 +30,7 @@ func NewLFRU(popularThreshold int64, maxHits int64, ageInterval int64, ageDecrem
 		ageInterval: ageInterval,
 		ageDecrement: ageDecrement,
 		toAge: ageInterval,
+		recencyLimit: recencyLimit,
 		items: make(map[fuseops.InodeID]*LFRUItem),
 		index: btree.New(32),
 	}
@@ -65,6 +68,10 @@ func (c *LFRU) Hit(id fuseops.InodeID, hits int64) {
 	}
 	if !item.popular && oldRecency != c.maxRecency {
 		c.maxRecency++
+		// Renumbering can't compact the counter below the number of items
+		if c.recencyLimit > 0 && c.maxRecency >= c.recencyLimit && c.maxRecency > 2*uint64(len(c.items)) {
+			c.normalizeRecency()
+		}
 	}
 	c.toAge--
 	if hits > 0 && c.toAge <= 0 {
@@ -86,7 +93,7 @@ func (c *LFRU) GetHits(id fuseops.InodeID) (r int64) {
 	return r
 }
 
-func (c *LFRU) Pick(prev *LFRUItem) *LFRUItem {
+func (c *LFRU) Pick(prev CacheItem) CacheItem {
 	var next *LFRUItem
 	c.mu.Lock()
 	if prev == nil {
@@ -95,7 +102,7 @@ func (c *LFRU) Pick(prev *LFRUItem) *LFRUItem {
 			return false
 		})
 	} else {
-		c.index.AscendGreaterOrEqual(prev, func(ai btree.Item) bool {
+		c.index.AscendGreaterOrEqual(prev.(*LFRUItem), func(ai btree.Item) bool {
 			a := ai.(*LFRUItem)
 			if a != prev {
 				next = a
@@ -105,6 +112,9 @@ func (c *LFRU) Pick(prev *LFRUItem) *LFRUItem {
 		})
 	}
 	c.mu.Unlock()
+	if next == nil {
+		return nil
+	}
 	return next
 }
 
@@ -118,6 +128,12 @@ func (c *LFRU) Forget(id fuseops.InodeID) {
 	c.mu.Unlock()
 }
 
+func (c *LFRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
 func (c *LFRU) ageAll(decrement int64) {
 	newIndex := btree.New(32)
 	c.index.Ascend(func(ai btree.Item) bool {
@@ -132,6 +148,31 @@ func (c *LFRU) ageAll(decrement int64) {
 	c.index = newIndex
 }
 
+// Renumber recency values of all items preserving their order, so that
+// the counter stays small and comparisons stay meaningful on long-lived mounts
+func (c *LFRU) normalizeRecency() {
+	items := make([]*LFRUItem, 0, len(c.items))
+	for _, item := range c.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].recency < items[j].recency
+	})
+	newIndex := btree.New(32)
+	next := uint64(0)
+	prev := uint64(0)
+	for i, item := range items {
+		if i > 0 && item.recency != prev {
+			next++
+		}
+		prev = item.recency
+		item.recency = next
+		newIndex.ReplaceOrInsert(item)
+	}
+	c.index = newIndex
+	c.maxRecency = next+1
+}
+
 type LFRUItem struct {
 	id fuseops.InodeID
 	popular bool
@@ -10,7 +10,7 @@ type LFRUTest struct{}
 var _ = Suite(&LFRUTest{})
 
 func (s *LFRUTest) TestIterate(t *C) {
-	l := NewLFRU(4, 16, 4, 1)
+	l := NewLFRU(4, 16, 4, 1, 0)
 	l.Hit(29, 6)
 	l.Hit(32, 0)
 	l.Hit(34, 0)
@@ -26,3 +26,21 @@ func (s *LFRUTest) TestIterate(t *C) {
 	i4 := l.Pick(i3)
 	t.Assert(i4, IsNil)
 }
+
+func (s *LFRUTest) TestNormalizeRecency(t *C) {
+	l := NewLFRU(1 << 40, 1 << 40, 1 << 40, 0, 64)
+	l.Hit(1, 1)
+	for i := 0; i < 10000; i++ {
+		l.Hit(fuseops.InodeID(2 + i%10), 1)
+	}
+	t.Assert(l.maxRecency <= 64, Equals, true)
+
+	// The cold item is still evicted first, then the others in LRU order
+	i := l.Pick(nil)
+	for id := 1; id <= 11; id++ {
+		t.Assert(i, NotNil)
+		t.Assert(i.Id(), Equals, fuseops.InodeID(id))
+		i = l.Pick(i)
+	}
+	t.Assert(i, IsNil)
+}
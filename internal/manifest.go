@@ -0,0 +1,130 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Part manifests of multipart uploads. With --part-manifest, sizes and ETags
+// of all parts are saved in the object metadata after completing a multipart
+// upload, so that parts of large objects can be verified individually.
+// The manifest is stored compactly as "<size>:<etag>,<size>:<etag>,..." and
+// returned by the geesefs.part-manifest xattr as "<part> <offset> <size> <etag>"
+// lines. Manifests which don't fit into --max-metadata-size are only kept in
+// memory, the xattr marks them with a PART_MANIFEST_UNSAVED line.
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const PART_MANIFEST_ATTR = "geesefs-part-manifest"
+const PART_MANIFEST_UNSAVED = "# not saved: doesn't fit into --max-metadata-size\n"
+
+// Remember sizes and ETags of the parts of the just completed multipart upload
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) recordPartManifest(mpu *MultipartBlobCommitInput, finalSize uint64) {
+	if !inode.fs.flags.PartManifest {
+		return
+	}
+	numParts := mpu.NumParts
+	entries := make([]string, 0, numParts)
+	for i := uint32(0); i < numParts; i++ {
+		if i >= uint32(len(mpu.Parts)) || mpu.Parts[i] == nil {
+			return
+		}
+		offset, size := inode.partRange(uint64(i))
+		if i == numParts-1 || offset+size > finalSize {
+			// The last part may be shorter or merged with the next one
+			size = finalSize - offset
+		}
+		entries = append(entries, fmt.Sprintf("%v:%v", size, strings.Trim(*mpu.Parts[i], "\"")))
+	}
+	manifest := strings.Join(entries, ",")
+	inode.partManifest = manifest
+	inode.partManifestUnsaved = !inode.metadataFits(PART_MANIFEST_ATTR, manifest)
+	if inode.partManifestUnsaved {
+		log.Warnf("Part manifest of %v (%v parts) doesn't fit into --max-metadata-size,"+
+			" it's only kept in memory until the file is evicted from the cache", inode.FullName(), numParts)
+		return
+	}
+	// Save it with a metadata update
+	inode.userMetadataDirty = 2
+}
+
+// Maximum total size of user metadata from --max-metadata-size or the backend.
+// 0 or less means unlimited
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) maxMetadataSize() int {
+	limit := inode.fs.flags.MaxMetadataSize
+	if limit == 0 {
+		cloud, _ := inode.cloud()
+		if cloud != nil {
+			limit = cloud.Capabilities().MaxMetadataSize
+		}
+	}
+	return limit
+}
+
+// Check if an additional attribute fits into --max-metadata-size along with user metadata
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) metadataFits(attr, value string) bool {
+	limit := inode.maxMetadataSize()
+	if limit <= 0 {
+		return true
+	}
+	size := len(attr) + len(value)
+	for k, v := range escapeMetadata(inode.userMetadata) {
+		size += len(k) + len(*v)
+	}
+	return size <= limit
+}
+
+// Remove the part manifest from user metadata and remember it
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setPartManifest() {
+	inode.partManifest = ""
+	inode.partManifestUnsaved = false
+	manifest := inode.userMetadata[PART_MANIFEST_ATTR]
+	if manifest == nil {
+		return
+	}
+	delete(inode.userMetadata, PART_MANIFEST_ATTR)
+	inode.partManifest = string(manifest)
+}
+
+// Reconstruct part layout from the manifest
+func parsePartManifest(manifest string) ([]MPUPart, error) {
+	var parts []MPUPart
+	offset := uint64(0)
+	for i, entry := range strings.Split(manifest, ",") {
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad part manifest entry: %v", entry)
+		}
+		size, err := strconv.ParseUint(kv[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad part manifest entry: %v", entry)
+		}
+		parts = append(parts, MPUPart{Num: uint32(i+1), Offset: offset, Size: size, ETag: kv[1]})
+		offset += size
+	}
+	return parts, nil
+}
+
+func formatPartManifest(parts []MPUPart) string {
+	var lines []string
+	for _, p := range parts {
+		lines = append(lines, fmt.Sprintf("%v %v %v %v\n", p.Num, p.Offset, p.Size, p.ETag))
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Counters exported by --metrics-addr in Prometheus text format.
+// They're updated where the file system already does its bookkeeping,
+// so a scrape never has to walk all inodes
+type Metrics struct {
+	// inodes in each CacheState except ST_CACHED, which is the rest of fs.inodes
+	cacheStates [ST_DELETED+1]int64
+	// total length of modified buffers not uploaded yet, see FileBuffer.unflushed
+	dirtyBytes int64
+	// buffers released from memory by FreeSomeCleanBuffers
+	evictions int64
+
+	mu sync.Mutex
+	backends map[backendKey]*BackendMetrics
+}
+
+type backendKey struct {
+	name string
+	bucket string
+}
+
+// Counters of one backend, exported with backend and bucket labels
+// so that mounts of other buckets are distinguishable
+type BackendMetrics struct {
+	uploadedBytes uint64
+	downloadedBytes uint64
+	flushErrors uint64
+	multipartUploads int64
+}
+
+var cacheStateNames = [ST_DELETED+1]string{
+	ST_CACHED: "cached",
+	ST_DEAD: "dead",
+	ST_CREATED: "created",
+	ST_MODIFIED: "modified",
+	ST_DELETED: "deleted",
+}
+
+func (m *Metrics) cacheStateChanged(from, to int32) {
+	if from == to {
+		return
+	}
+	atomic.AddInt64(&m.cacheStates[from], -1)
+	atomic.AddInt64(&m.cacheStates[to], 1)
+}
+
+func (m *Metrics) addDirty(size int64) {
+	atomic.AddInt64(&m.dirtyBytes, size)
+}
+
+func (m *Metrics) backend(cloud StorageBackend) *BackendMetrics {
+	key := backendKey{bucket: cloud.Bucket()}
+	if caps := cloud.Capabilities(); caps != nil {
+		key.name = caps.Name
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.backends == nil {
+		m.backends = make(map[backendKey]*BackendMetrics)
+	}
+	b := m.backends[key]
+	if b == nil {
+		b = &BackendMetrics{}
+		m.backends[key] = b
+	}
+	return b
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func (fs *Goofys) WriteMetrics(w io.Writer) {
+	m := &fs.metrics
+	fs.mu.RLock()
+	inodes := int64(len(fs.inodes))
+	forgotten := fs.forgotCnt
+	var throttle *PrefixThrottle
+	if root := fs.inodes[fuseops.RootInodeID]; root != nil && root.dir != nil {
+		if t, ok := unwrapCloud(root.dir.cloud).(PrefixThrottledBackend); ok {
+			throttle = t.PrefixThrottle()
+		}
+	}
+	fs.mu.RUnlock()
+
+	writeMetricHeader(w, "geesefs_inodes", "gauge", "Inodes kept in memory")
+	fmt.Fprintf(w, "geesefs_inodes %v\n", inodes)
+	writeMetricHeader(w, "geesefs_inodes_by_state", "gauge", "Inodes kept in memory by cache state")
+	cached := inodes
+	for state := ST_DEAD; state <= ST_DELETED; state++ {
+		n := atomic.LoadInt64(&m.cacheStates[state])
+		cached -= n
+		fmt.Fprintf(w, "geesefs_inodes_by_state{state=\"%v\"} %v\n", cacheStateNames[state], n)
+	}
+	if cached < 0 {
+		cached = 0
+	}
+	fmt.Fprintf(w, "geesefs_inodes_by_state{state=\"%v\"} %v\n", cacheStateNames[ST_CACHED], cached)
+	writeMetricHeader(w, "geesefs_inodes_forgotten_total", "counter", "Inodes removed from memory")
+	fmt.Fprintf(w, "geesefs_inodes_forgotten_total %v\n", forgotten)
+	writeMetricHeader(w, "geesefs_dirty_bytes", "gauge", "Modified data not yet uploaded to the server")
+	fmt.Fprintf(w, "geesefs_dirty_bytes %v\n", atomic.LoadInt64(&m.dirtyBytes))
+	writeMetricHeader(w, "geesefs_buffer_bytes", "gauge", "Memory used by data buffers")
+	fmt.Fprintf(w, "geesefs_buffer_bytes %v\n", atomic.LoadInt64(&fs.bufferPool.cur))
+	writeMetricHeader(w, "geesefs_cache_evictions_total", "counter", "Buffers evicted from memory to free it")
+	fmt.Fprintf(w, "geesefs_cache_evictions_total %v\n", atomic.LoadInt64(&m.evictions))
+
+	m.mu.Lock()
+	keys := make([]backendKey, 0, len(m.backends))
+	for key := range m.backends {
+		keys = append(keys, key)
+	}
+	backends := make([]*BackendMetrics, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name || keys[i].name == keys[j].name && keys[i].bucket < keys[j].bucket
+	})
+	for i, key := range keys {
+		backends[i] = m.backends[key]
+	}
+	m.mu.Unlock()
+	for _, metric := range []struct {
+		name, kind, help string
+		value func(b *BackendMetrics) interface{}
+	}{
+		{"geesefs_uploaded_bytes_total", "counter", "Bytes uploaded to the server",
+			func(b *BackendMetrics) interface{} { return atomic.LoadUint64(&b.uploadedBytes) }},
+		{"geesefs_downloaded_bytes_total", "counter", "Bytes downloaded from the server",
+			func(b *BackendMetrics) interface{} { return atomic.LoadUint64(&b.downloadedBytes) }},
+		{"geesefs_flush_errors_total", "counter", "Failed flush requests",
+			func(b *BackendMetrics) interface{} { return atomic.LoadUint64(&b.flushErrors) }},
+		{"geesefs_multipart_uploads", "gauge", "Multipart uploads in progress",
+			func(b *BackendMetrics) interface{} { return atomic.LoadInt64(&b.multipartUploads) }},
+	} {
+		writeMetricHeader(w, metric.name, metric.kind, metric.help)
+		for i, key := range keys {
+			fmt.Fprintf(w, "%v{backend=%q,bucket=%q} %v\n", metric.name, key.name, key.bucket, metric.value(backends[i]))
+		}
+	}
+
+	if throttle != nil {
+		writeMetricHeader(w, "geesefs_throttled_responses_total", "counter", "Requests rejected by the server with 503 Slow Down")
+		fmt.Fprintf(w, "geesefs_throttled_responses_total %v\n", throttle.Throttled())
+		rates := throttle.Rates()
+		prefixes := make([]string, 0, len(rates))
+		for prefix := range rates {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		writeMetricHeader(w, "geesefs_prefix_request_rate_limit", "gauge", "Requests per second allowed to a throttled key prefix")
+		for _, prefix := range prefixes {
+			fmt.Fprintf(w, "geesefs_prefix_request_rate_limit{prefix=%q} %v\n", prefix, rates[prefix])
+		}
+	}
+}
+
+func (fs *Goofys) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fs.WriteMetrics(w)
+}
+
+// Serve metrics on /metrics of --metrics-addr
+func (fs *Goofys) StartMetricsServer(addr string) {
+	if strings.Index(addr, ":") == -1 {
+		addr = "127.0.0.1:"+addr
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", fs.ServeMetrics)
+	go func() {
+		log.Errorf("Metrics server at %v stopped: %v", addr, http.ListenAndServe(addr, mux))
+	}()
+}
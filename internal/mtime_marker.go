@@ -0,0 +1,118 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Directory mtime markers. With --dir-mtime-marker, the mtime of a directory
+// updated by creating, removing and renaming its children is saved in an empty
+// <dir>/.mtime object, so that it's kept across remounts even for directories
+// without their own objects. Markers are hidden from listings and lookups.
+// They're saved by the flusher and removed along with their directories.
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const DIR_MTIME_MARKER = ".mtime"
+
+func (fs *Goofys) isMtimeMarker(name string) bool {
+	return fs.flags.DirMtimeMarker && name == DIR_MTIME_MARKER
+}
+
+// Key of the marker of the directory with the given key
+func mtimeMarkerKey(dirKey string) string {
+	if len(dirKey) > 0 && dirKey[len(dirKey)-1] == '/' {
+		dirKey = dirKey[0 : len(dirKey)-1]
+	}
+	return appendChildName(dirKey, DIR_MTIME_MARKER)
+}
+
+// Apply the marker found in the listing of the directory, return false if
+// `name` isn't a marker. The marker doesn't move mtime back because local
+// changes may be newer
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) applyMtimeMarker(name string, obj *BlobItemOutput) bool {
+	if !dir.fs.isMtimeMarker(name) {
+		return false
+	}
+	var mtime time.Time
+	if obj.Metadata != nil && obj.Metadata[dir.fs.flags.MtimeAttr] != nil {
+		i, err := strconv.ParseUint(*obj.Metadata[dir.fs.flags.MtimeAttr], 0, 64)
+		if err == nil {
+			mtime = time.Unix(int64(i), 0)
+		}
+	}
+	if mtime.IsZero() && obj.LastModified != nil {
+		mtime = *obj.LastModified
+	}
+	if mtime.After(dir.Attributes.Mtime) {
+		dir.Attributes.Mtime = mtime
+	}
+	return true
+}
+
+// Save the mtime of the directory in its marker. The flusher sends it like other
+// directory changes, so failed uploads are retried and fsync waits for them
+// LOCKS_REQUIRED(dir.mu)
+func (dir *Inode) sendMtimeMarker() {
+	cloud, dirKey := dir.cloud()
+	key := mtimeMarkerKey(dirKey)
+	params := &PutBlobInput{
+		Key:      key,
+		Body:     bytes.NewReader([]byte{}),
+		Size:     PUInt64(0),
+		Metadata: map[string]*string{dir.fs.flags.MtimeAttr: PString(fmt.Sprintf("%d", dir.Attributes.Mtime.Unix()))},
+	}
+	// Changes made during the upload are saved with the next one
+	dir.dir.mtimeMarkerDirty = false
+	dir.IsFlushing += dir.fs.flags.MaxParallelParts
+	atomic.AddInt64(&dir.fs.activeFlushers, 1)
+	go func() {
+		dir.fs.addInflightChange(key)
+		_, err := cloud.PutBlob(params)
+		dir.fs.completeInflightChange(key)
+		dir.mu.Lock()
+		defer dir.mu.Unlock()
+		atomic.AddInt64(&dir.fs.activeFlushers, -1)
+		dir.IsFlushing -= dir.fs.flags.MaxParallelParts
+		dir.recordFlushError(err)
+		if err != nil {
+			log.Errorf("Failed to save mtime marker %v: %v", key, err)
+			dir.dir.mtimeMarkerDirty = true
+			return
+		}
+		if dir.CacheState == ST_MODIFIED && !dir.dirObjectDirty() {
+			dir.SetCacheState(ST_CACHED)
+		}
+		dir.fs.WakeupFlusher()
+	}()
+}
+
+// Delete the marker of the directory with the given key. The directory
+// isn't deleted until its marker upload is finished, so it can't come back
+func deleteMtimeMarker(fs *Goofys, cloud StorageBackend, dirKey string) error {
+	key := mtimeMarkerKey(dirKey)
+	fs.addInflightChange(key)
+	_, err := cloud.DeleteBlob(&DeleteBlobInput{Key: key})
+	fs.completeInflightChange(key)
+	if err != nil && mapAwsError(err) != syscall.ENOENT {
+		log.Errorf("Failed to delete mtime marker %v: %v", key, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Background prefetch of listed files. With --prefetch-on-readdir, files
+// returned by a complete directory listing get their metadata or the
+// beginning of their content loaded in the background, so that a following
+// stat/getxattr or read of each file doesn't wait for the server.
+// With --xattr-prefetch, metadata of listed files and directories is loaded
+// the same way, but with its own concurrency limit and only from backends
+// where parallel HEAD requests are cheap.
+package internal
+
+import (
+	"sync/atomic"
+)
+
+// Maximum number of parallel prefetch requests of the whole FS
+const PREFETCH_CONCURRENCY = 8
+
+// Start prefetching files returned by the listing
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) startPrefetch() {
+	inodes, xattrInodes := dh.prefetch, dh.xattrPrefetch
+	if len(inodes) == 0 && len(xattrInodes) == 0 {
+		return
+	}
+	// References of queued inodes are now released by prefetchInodes
+	dh.prefetch = nil
+	dh.xattrPrefetch = nil
+	// Stop the previous prefetch if the listing was restarted
+	dh.cancelPrefetch()
+	cancel := new(int32)
+	dh.prefetchCancel = cancel
+	fs := dh.inode.fs
+	if len(inodes) > 0 {
+		prefetch := (*Inode).prefetchMetadata
+		if fs.flags.PrefetchOnReaddir == "content" {
+			prefetch = (*Inode).prefetchContent
+		}
+		go fs.prefetchInodes(inodes, fs.prefetchSlots, cancel, prefetch)
+	}
+	if len(xattrInodes) > 0 {
+		go fs.prefetchInodes(xattrInodes, fs.xattrPrefetchSlots, cancel, (*Inode).prefetchXattr)
+	}
+}
+
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) cancelPrefetch() {
+	if dh.prefetchCancel != nil {
+		atomic.StoreInt32(dh.prefetchCancel, 1)
+		dh.prefetchCancel = nil
+	}
+	releasePrefetch(dh.prefetch)
+	releasePrefetch(dh.xattrPrefetch)
+	dh.prefetch = nil
+	dh.xattrPrefetch = nil
+}
+
+// Release references taken by ReadDir when inodes are queued for prefetch,
+// so that a forget from the kernel doesn't drop them while they're loaded.
+// An inode isn't forgotten here even if it was the last reference, it stays
+// in memory like any other listed inode which isn't looked up yet
+func releasePrefetch(inodes []*Inode) {
+	for _, inode := range inodes {
+		res := atomic.AddInt64(&inode.refcnt, -1)
+		inode.logFuse("Prefetch DeRef", res)
+	}
+}
+
+func (fs *Goofys) prefetchInodes(inodes []*Inode, slots chan struct{}, cancel *int32, prefetch func(*Inode)) {
+	done := make(chan struct{}, len(inodes))
+	started := 0
+	for i, inode := range inodes {
+		slots <- struct{}{}
+		if atomic.LoadInt32(cancel) != 0 {
+			<-slots
+			releasePrefetch(inodes[i:])
+			break
+		}
+		started++
+		go func(inode *Inode) {
+			prefetch(inode)
+			releasePrefetch([]*Inode{inode})
+			<-slots
+			done <- struct{}{}
+		}(inode)
+	}
+	for ; started > 0; started-- {
+		<-done
+	}
+}
+
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) prefetchMetadata() {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+	if inode.CacheState != ST_CACHED || inode.userMetadata != nil {
+		return
+	}
+	err := inode.fillXattr()
+	if err != nil {
+		log.Debugf("Failed to prefetch metadata of %v: %v", inode.FullName(), err)
+	}
+}
+
+// Load metadata of a listed file or directory for --xattr-prefetch.
+// fillXattr uses the old key if the inode is being renamed and doesn't
+// send another HEAD if a getxattr is already loading it
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) prefetchXattr() {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+	if inode.CacheState != ST_CACHED || inode.userMetadata != nil || inode.ImplicitDir {
+		return
+	}
+	cloud, _ := inode.cloud()
+	if cloud == nil || !cloud.Capabilities().ParallelHead {
+		return
+	}
+	err := inode.fillXattr()
+	if err != nil {
+		log.Debugf("Failed to prefetch xattrs of %v: %v", inode.FullName(), err)
+	}
+}
+
+// Load the beginning of the file, but only into free memory so
+// the prefetch never evicts anything from the cache
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) prefetchContent() {
+	fs := inode.fs
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+	if inode.CacheState != ST_CACHED {
+		return
+	}
+	size := inode.Attributes.Size
+	if size > fs.flags.ReadAheadLargeKB*1024 {
+		size = fs.flags.ReadAheadLargeKB*1024
+	}
+	if size == 0 {
+		return
+	}
+	if atomic.LoadInt64(&fs.bufferPool.cur)+int64(size) > fs.bufferPool.max {
+		return
+	}
+	inode.LockRange(0, size, false)
+	_, err := inode.CheckLoadRange(0, size, 0, false)
+	inode.UnlockRange(0, size, false)
+	if err != nil {
+		log.Debugf("Failed to prefetch %v: %v", inode.FullName(), err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Metadata sidecars. With --metadata-sidecar, every file "x" gets a synthetic
+// read-only companion "x.meta" with all its metadata as JSON. Sidecars aren't
+// stored anywhere and aren't children of the directory; real objects win.
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const METADATA_SIDECAR_SUFFIX = ".meta"
+
+type sidecarContent struct {
+	Key    string            `json:"key"`
+	Size   uint64            `json:"size"`
+	Mtime  time.Time         `json:"mtime"`
+	Xattrs map[string]string `json:"xattrs"`
+}
+
+// Generate sidecar contents, loading metadata from the server if required
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) sidecarContents() ([]byte, error) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	err := inode.fillXattr()
+	if err != nil {
+		return nil, err
+	}
+	cloud, key := inode.cloud()
+	cloudXattrPrefix := cloud.Capabilities().Name + "."
+	c := sidecarContent{
+		Key:    key,
+		Size:   inode.Attributes.Size,
+		Mtime:  inode.Attributes.Mtime,
+		Xattrs: make(map[string]string),
+	}
+	for k, v := range inode.s3Metadata {
+		c.Xattrs[cloudXattrPrefix+k] = string(v)
+	}
+	for k, v := range inode.userMetadata {
+		c.Xattrs[inode.fs.userMetaXattrName(k)] = string(v)
+	}
+	data, err := json.MarshalIndent(&c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Look up "x.meta" as a sidecar of "x" if there's no real object with this name
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) lookUpSidecar(ctx context.Context, op *fuseops.LookUpInodeOp) (err error) {
+	targetOp := fuseops.LookUpInodeOp{
+		Parent: op.Parent,
+		Name:   strings.TrimSuffix(op.Name, METADATA_SIDECAR_SUFFIX),
+	}
+	if targetOp.Name == "" {
+		return fuse.ENOENT
+	}
+	err = fs.lookUpInode(ctx, &targetOp)
+	if err != nil {
+		return
+	}
+	fs.mu.RLock()
+	target := fs.getInodeOrDie(targetOp.Entry.Child)
+	fs.mu.RUnlock()
+	// The reference is taken for the kernel which didn't ask for the target
+	defer target.DeRef(1)
+	if target.isDir() {
+		return fuse.ENOENT
+	}
+
+	data, err := target.sidecarContents()
+	if err != nil {
+		return mapAwsError(err)
+	}
+
+	target.mu.Lock()
+	fs.mu.Lock()
+	sidecar := fs.sidecarInode(target)
+	if fs.inodes[sidecar.Id] != sidecar {
+		// Sidecar isn't inserted into the directory, only into the inode table
+		fs.inodes[sidecar.Id] = sidecar
+	}
+	fs.mu.Unlock()
+	mtime := target.Attributes.Mtime
+	target.mu.Unlock()
+
+	sidecar.mu.Lock()
+	sidecar.sidecarData = data
+	sidecar.Attributes.Size = uint64(len(data))
+	sidecar.Attributes.Mtime = mtime
+	sidecar.Attributes.Ctime = mtime
+	sidecar.AttrTime = time.Now()
+	sidecar.mu.Unlock()
+
+	sidecar.Ref()
+	op.Entry.Child = sidecar.Id
+	op.Entry.Attributes = sidecar.InflateAttributes()
+	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	return
+}
+
+// Sidecar inode of the file. Its number is allocated on first use, but the
+// inode is only added to the inode table when it's looked up, so that
+// listings don't fill the table with sidecars nobody opens
+// LOCKS_REQUIRED(target.mu)
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) sidecarInode(target *Inode) *Inode {
+	if target.sidecar == nil {
+		sidecar := NewInode(fs, target.Parent, target.Name+METADATA_SIDECAR_SUFFIX)
+		sidecar.sidecarOf = target
+		sidecar.userMetadata = make(map[string][]byte)
+		sidecar.Attributes.Mode = fs.flags.FileMode &^ 0222
+		sidecar.Id = fs.allocateInodeId()
+		target.sidecar = sidecar
+	}
+	return target.sidecar
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) readSidecar(offset uint64, size uint64) (data [][]byte, bytesRead int) {
+	if offset >= uint64(len(inode.sidecarData)) {
+		return
+	}
+	end := offset+size
+	if end > uint64(len(inode.sidecarData)) {
+		end = uint64(len(inode.sidecarData))
+	}
+	return [][]byte{inode.sidecarData[offset:end]}, int(end-offset)
+}
+
+// Directory entry for the sidecar of a listed file, or nil
+// LOCKS_EXCLUDED(fs.mu)
+func (dh *DirHandle) sidecarEntry(e *DirHandleEntry) *DirHandleEntry {
+	if e.Type != fuseutil.DT_File || e.Name == "." || e.Name == ".." {
+		return nil
+	}
+	name := e.Name+METADATA_SIDECAR_SUFFIX
+	if dh.inode.findChild(name) != nil {
+		// Real object with the same name is listed by itself
+		return nil
+	}
+	fs := dh.inode.fs
+	fs.mu.RLock()
+	target := fs.inodes[e.Inode]
+	fs.mu.RUnlock()
+	if target == nil {
+		return nil
+	}
+	target.mu.Lock()
+	fs.mu.Lock()
+	sidecar := fs.sidecarInode(target)
+	fs.mu.Unlock()
+	target.mu.Unlock()
+	return &DirHandleEntry{
+		Name:  name,
+		Inode: sidecar.Id,
+		Type:  fuseutil.DT_File,
+	}
+}
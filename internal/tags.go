@@ -0,0 +1,165 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Object tags as xattrs. Tags of S3 objects are exposed as s3.tag.<key>
+// xattrs. They're separate from user metadata: they're loaded with
+// GetObjectTagging when one of them is first read or changed and sent with
+// PutObjectTagging right after a change. listxattr only lists loaded tags. Tags of objects which aren't uploaded yet or are being
+// renamed are sent after the upload or the rename. A new upload of the
+// object drops its tags on the server, so known tags are sent again after it.
+package internal
+
+import (
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+const TAG_XATTR_PREFIX = "s3.tag."
+
+// S3 limits of object tags
+const (
+	MAX_OBJECT_TAGS = 10
+	MAX_TAG_KEY_LENGTH = 128
+	MAX_TAG_VALUE_LENGTH = 256
+)
+
+// Return the tag key if `name` is a tag xattr of a backend supporting tags
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) tagXattr(name string) (key string, ok bool) {
+	if !strings.HasPrefix(name, TAG_XATTR_PREFIX) {
+		return "", false
+	}
+	cloud, _ := inode.cloud()
+	if cloud == nil || cloud.Capabilities().Name != "s3" {
+		return "", false
+	}
+	if _, ok := unwrapCloud(cloud).(TaggingBackend); !ok {
+		return "", false
+	}
+	return name[len(TAG_XATTR_PREFIX):], true
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) fillTags() error {
+	if inode.tags != nil {
+		return nil
+	}
+	if inode.CacheState == ST_CREATED {
+		// Not uploaded yet
+		inode.tags = make(map[string][]byte)
+		return nil
+	}
+	if inode.isDir() && inode.ImplicitDir {
+		return syscall.EPERM
+	}
+	cloud, key := inode.headKey()
+	inode.mu.Unlock()
+	tags, err := unwrapCloud(cloud).(TaggingBackend).GetBlobTags(key)
+	inode.mu.Lock()
+	if err != nil {
+		return mapAwsError(err)
+	}
+	if inode.tags == nil {
+		inode.tags = make(map[string][]byte)
+		for k, v := range tags {
+			inode.tags[k] = []byte(v)
+		}
+	}
+	return nil
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setTag(key string, value []byte, flags uint32) error {
+	if key == "" || utf8.RuneCountInString(key) > MAX_TAG_KEY_LENGTH ||
+		utf8.RuneCount(value) > MAX_TAG_VALUE_LENGTH {
+		return syscall.EINVAL
+	}
+	err := inode.fillTags()
+	if err != nil {
+		return err
+	}
+	_, ok := inode.tags[key]
+	if flags == unix.XATTR_CREATE && ok {
+		return syscall.EEXIST
+	} else if flags == unix.XATTR_REPLACE && !ok {
+		return syscall.ENODATA
+	}
+	if !ok && len(inode.tags) >= MAX_OBJECT_TAGS {
+		return syscall.EINVAL
+	}
+	inode.tags[key] = Dup(value)
+	inode.tagsDirty = true
+	return inode.flushTags()
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) removeTag(key string) error {
+	err := inode.fillTags()
+	if err != nil {
+		return err
+	}
+	if _, ok := inode.tags[key]; !ok {
+		return syscall.ENODATA
+	}
+	delete(inode.tags, key)
+	inode.tagsDirty = true
+	return inode.flushTags()
+}
+
+// Send changed tags to the server unless the object isn't there yet.
+// Only one request is sent at a time, the running one repeats itself
+// if tags are changed again meanwhile
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) flushTags() error {
+	if inode.tagsFlushing {
+		return nil
+	}
+	for inode.tagsDirty && inode.CacheState != ST_CREATED && inode.oldParent == nil &&
+		inode.CacheState != ST_DELETED && inode.CacheState != ST_DEAD {
+		cloud, key := inode.headKey()
+		tags := make(map[string]string, len(inode.tags))
+		for k, v := range inode.tags {
+			tags[k] = string(v)
+		}
+		inode.tagsDirty = false
+		inode.tagsFlushing = true
+		inode.mu.Unlock()
+		err := unwrapCloud(cloud).(TaggingBackend).PutBlobTags(key, tags)
+		inode.mu.Lock()
+		inode.tagsFlushing = false
+		if err != nil {
+			inode.tagsDirty = true
+			log.Errorf("Error updating tags of %v: %v", key, err)
+			return mapAwsError(err)
+		}
+	}
+	return nil
+}
+
+// Send tags again after the object is replaced or moved
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) resendTags() {
+	if len(inode.tags) == 0 && !inode.tagsDirty {
+		return
+	}
+	inode.tagsDirty = true
+	go func() {
+		inode.mu.Lock()
+		inode.flushTags()
+		inode.mu.Unlock()
+	}()
+}
@@ -0,0 +1,336 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	// Request rate set for a prefix after the first throttling response
+	THROTTLE_INITIAL_RATE = 100.0
+	THROTTLE_MIN_RATE = 1.0
+	// Rate is increased by this number of requests per second
+	// every second without throttling responses...
+	THROTTLE_RATE_INCREASE = 5.0
+	// ...until it reaches this limit when the prefix is unthrottled again
+	THROTTLE_MAX_RATE = 5000.0
+)
+
+type prefixRate struct {
+	rate float64
+	next time.Time
+	lastChange time.Time
+}
+
+// Adaptive per-prefix request rate limiter. S3 throttles requests per key
+// prefix partition, so only prefixes that received "503 Slow Down" are
+// limited. The rate is halved on every throttling response and increased
+// linearly while requests succeed (AIMD)
+type PrefixThrottle struct {
+	mu sync.Mutex
+	prefixes map[string]*prefixRate
+	// throttling responses received from the server
+	throttled uint64
+	// replaced in tests
+	now func() time.Time
+	sleep func(time.Duration)
+}
+
+// Implemented by backends which throttle requests per prefix
+type PrefixThrottledBackend interface {
+	PrefixThrottle() *PrefixThrottle
+}
+
+func NewPrefixThrottle() *PrefixThrottle {
+	return &PrefixThrottle{
+		prefixes: make(map[string]*prefixRate),
+		now: time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+func keyPrefix(key string) string {
+	return key[0 : strings.LastIndex(key, "/")+1]
+}
+
+// Wait until a request to the prefix is allowed
+func (t *PrefixThrottle) Wait(prefix string) {
+	t.mu.Lock()
+	p := t.prefixes[prefix]
+	if p == nil {
+		t.mu.Unlock()
+		return
+	}
+	now := t.now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(time.Duration(float64(time.Second) / p.rate))
+	t.mu.Unlock()
+	t.sleep(at.Sub(now))
+}
+
+// Adjust the rate of the prefix after a request
+func (t *PrefixThrottle) Done(prefix string, throttled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.prefixes[prefix]
+	now := t.now()
+	if throttled {
+		atomic.AddUint64(&t.throttled, 1)
+		if p == nil {
+			s3Log.Warnf("Requests to prefix \"%v\" are throttled by the server, limiting them to %v per second",
+				prefix, THROTTLE_INITIAL_RATE)
+			t.prefixes[prefix] = &prefixRate{
+				rate: THROTTLE_INITIAL_RATE,
+				lastChange: now,
+			}
+		} else if now.Sub(p.lastChange) >= time.Duration(float64(time.Second) / p.rate) {
+			// Requests sent before the previous decrease don't count
+			p.rate /= 2
+			if p.rate < THROTTLE_MIN_RATE {
+				p.rate = THROTTLE_MIN_RATE
+			}
+			p.lastChange = now
+			s3Log.Debugf("Limiting requests to prefix \"%v\" to %.1f per second", prefix, p.rate)
+		}
+	} else if p != nil && now.Sub(p.lastChange) >= time.Second {
+		p.rate += THROTTLE_RATE_INCREASE
+		p.lastChange = now
+		if p.rate >= THROTTLE_MAX_RATE {
+			s3Log.Infof("Requests to prefix \"%v\" are not throttled anymore", prefix)
+			delete(t.prefixes, prefix)
+		}
+	}
+}
+
+// Current request rate limits of all throttled prefixes
+func (t *PrefixThrottle) Rates() map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rates := make(map[string]float64, len(t.prefixes))
+	for prefix, p := range t.prefixes {
+		rates[prefix] = p.rate
+	}
+	return rates
+}
+
+// Number of throttling responses received from the server
+func (t *PrefixThrottle) Throttled() uint64 {
+	return atomic.LoadUint64(&t.throttled)
+}
+
+// Object key or listing prefix of an SDK request
+func requestKey(r *request.Request) string {
+	v := reflect.ValueOf(r.Params)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	for _, field := range []string{"Key", "Prefix"} {
+		f := v.FieldByName(field)
+		if f.IsValid() {
+			if s, ok := f.Interface().(*string); ok && s != nil {
+				return *s
+			}
+		}
+	}
+	return ""
+}
+
+func isThrottled(r *request.Request) bool {
+	if r.HTTPResponse != nil && r.HTTPResponse.StatusCode == 503 {
+		return true
+	}
+	if awsErr, ok := r.Error.(awserr.Error); ok {
+		return awsErr.Code() == "SlowDown"
+	}
+	return false
+}
+
+// Install SDK handlers applying the throttle to every attempt of every request
+func (t *PrefixThrottle) addHandlers(handlers *request.Handlers) {
+	handlers.Send.PushFront(func(r *request.Request) {
+		t.Wait(keyPrefix(requestKey(r)))
+	})
+	handlers.CompleteAttempt.PushBack(func(r *request.Request) {
+		t.Done(keyPrefix(requestKey(r)), isThrottled(r))
+	})
+}
+
+// Smallest amount of data read between throttle waits
+const MIN_THROTTLE_CHUNK = 4096
+
+// Token bucket shared by all transfers in one direction
+// (--max-upload-bytes-per-sec and --max-download-bytes-per-sec).
+// Transfers never wait for tokens before reading: they take them after the
+// fact and sleep while the bucket is in debt. So concurrent transfers can't
+// starve each other, each of them waits for at most its own share of the debt.
+// nil Throttle means no limit.
+type Throttle struct {
+	mu sync.Mutex
+	// bytes per second
+	rate float64
+	// bytes that may be transferred right now, negative when in debt.
+	// At most one second worth of traffic is accumulated while idle
+	avail float64
+	last time.Time
+	chunk int
+	// replaced in tests
+	now func() time.Time
+	sleep func(time.Duration)
+}
+
+func NewThrottle(rate uint64) *Throttle {
+	if rate == 0 {
+		return nil
+	}
+	chunk := int(rate / 16)
+	if chunk < MIN_THROTTLE_CHUNK {
+		chunk = MIN_THROTTLE_CHUNK
+	}
+	return &Throttle{
+		rate: float64(rate),
+		avail: float64(rate),
+		last: time.Now(),
+		chunk: chunk,
+		now: time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *Throttle) refill() {
+	now := t.now()
+	t.avail += now.Sub(t.last).Seconds() * t.rate
+	if t.avail > t.rate {
+		t.avail = t.rate
+	}
+	t.last = now
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *Throttle) debtTime() time.Duration {
+	if t.avail >= 0 {
+		return 0
+	}
+	return time.Duration(-t.avail / t.rate * float64(time.Second))
+}
+
+// Take tokens for transferred bytes, return the time to wait before
+// transferring more
+func (t *Throttle) Take(size int64) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refill()
+	t.avail -= float64(size)
+	return t.debtTime()
+}
+
+// Time left until the bucket is out of debt
+func (t *Throttle) Delay() time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refill()
+	return t.debtTime()
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (r *throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > r.t.chunk {
+		p = p[0 : r.t.chunk]
+	}
+	n, err = r.r.Read(p)
+	if n > 0 {
+		r.t.sleep(r.t.Take(int64(n)))
+	}
+	return
+}
+
+// Upload bodies are read more than once: SigV4 signing and Content-MD5
+// hash them before sending, and they're read again on retries. Every byte
+// is only charged the first time it's read, so rewinding is free
+type throttledReadSeeker struct {
+	r io.ReadSeeker
+	t *Throttle
+	pos int64
+	charged int64
+}
+
+func (r *throttledReadSeeker) Read(p []byte) (n int, err error) {
+	if len(p) > r.t.chunk {
+		p = p[0 : r.t.chunk]
+	}
+	n, err = r.r.Read(p)
+	r.pos += int64(n)
+	if r.pos > r.charged {
+		r.t.sleep(r.t.Take(r.pos-r.charged))
+		r.charged = r.pos
+	}
+	return
+}
+
+func (r *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+type throttledReadCloser struct {
+	throttledReader
+	c io.Closer
+}
+
+func (r *throttledReadCloser) Close() error {
+	return r.c.Close()
+}
+
+// Wrap an upload body
+func (t *Throttle) ReadSeeker(r io.ReadSeeker) io.ReadSeeker {
+	if t == nil {
+		return r
+	}
+	pos, _ := r.Seek(0, io.SeekCurrent)
+	return &throttledReadSeeker{r: r, t: t, pos: pos, charged: pos}
+}
+
+// Wrap a download body
+func (t *Throttle) ReadCloser(r io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return r
+	}
+	return &throttledReadCloser{throttledReader{r, t}, r}
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ThrottleTest struct{}
+
+var _ = Suite(&ThrottleTest{})
+
+func (s *ThrottleTest) TestUnlimited(t *C) {
+	th := NewThrottle(0)
+	t.Assert(th, IsNil)
+	t.Assert(th.Delay(), Equals, time.Duration(0))
+	r := bytes.NewReader([]byte("data"))
+	t.Assert(th.ReadSeeker(r), Equals, io.ReadSeeker(r))
+}
+
+// Make the throttle use a fake clock, advanced by its sleeps
+func fakeThrottleClock(th *Throttle) (slept *time.Duration) {
+	now := time.Now()
+	slept = new(time.Duration)
+	th.last = now
+	th.now = func() time.Time { return now }
+	th.sleep = func(d time.Duration) {
+		*slept += d
+		now = now.Add(d)
+	}
+	return
+}
+
+func (s *ThrottleTest) TestRate(t *C) {
+	th := NewThrottle(1024*1024)
+	slept := fakeThrottleClock(th)
+	t.Assert(th.Delay(), Equals, time.Duration(0))
+
+	// One second worth of data is allowed immediately, the rest is throttled
+	r := th.ReadSeeker(bytes.NewReader(make([]byte, 2*1024*1024)))
+	data, err := ioutil.ReadAll(r)
+	t.Assert(err, IsNil)
+	t.Assert(len(data), Equals, 2*1024*1024)
+	t.Assert(*slept > time.Second-time.Millisecond, Equals, true)
+	t.Assert(*slept < time.Second+time.Millisecond, Equals, true)
+
+	// Data read again after rewinding isn't charged again
+	_, err = r.Seek(0, io.SeekStart)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadAll(r)
+	t.Assert(err, IsNil)
+	t.Assert(len(data), Equals, 2*1024*1024)
+	t.Assert(*slept < time.Second+time.Millisecond, Equals, true)
+
+	// Downloads are charged for everything they read
+	*slept = 0
+	rc := th.ReadCloser(ioutil.NopCloser(bytes.NewReader(make([]byte, 512*1024))))
+	data, err = ioutil.ReadAll(rc)
+	t.Assert(err, IsNil)
+	t.Assert(len(data), Equals, 512*1024)
+	t.Assert(*slept > 500*time.Millisecond-time.Millisecond, Equals, true)
+	t.Assert(*slept < 500*time.Millisecond+time.Millisecond, Equals, true)
+
+	// Taking more than available puts the bucket in debt
+	wait := th.Take(512*1024)
+	t.Assert(wait > 500*time.Millisecond-time.Millisecond, Equals, true)
+	t.Assert(wait < 500*time.Millisecond+time.Millisecond, Equals, true)
+	t.Assert(th.Delay(), Equals, wait)
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Trash. With --trash=<dir>, removed files are copied on the server to
+// <dir>/<time>/<path> before being deleted, so they stay retrievable.
+// The trash is a regular directory of the mount, and it's also listed by
+// the geesefs.trash xattr of the root directory as "<time>/<path>" lines.
+// Setting geesefs.restore of the root directory to one of these lines moves
+// the file back to its original path. Removals inside the trash are real.
+// Only files of the root bucket are trashed, directory objects and files of
+// buckets mounted into subdirectories are deleted as usual.
+package internal
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const TRASH_TIME_FORMAT = "20060102T150405.000000000Z"
+
+// Stop listing the trash after this number of entries
+const TRASH_LIST_MAX_ENTRIES = 100000
+
+// Key of the trash directory in the root bucket and the key of the root itself
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) trashPrefix() (cloud StorageBackend, trash string, root string) {
+	fs.mu.RLock()
+	cloud, root = fs.getInodeOrDie(fuseops.RootInodeID).cloud()
+	fs.mu.RUnlock()
+	return cloud, appendChildName(root, fs.flags.Trash), root
+}
+
+// Key to move the deleted object to, or "" if it should be deleted for real
+// LOCKS_EXCLUDED(fs.mu)
+func (inode *Inode) trashKey(cloud StorageBackend, key string) string {
+	fs := inode.fs
+	if fs.flags.Trash == "" || inode.isDir() {
+		return ""
+	}
+	trashCloud, trash, root := fs.trashPrefix()
+	if cloud != trashCloud || key == trash || strings.HasPrefix(key, trash+"/") {
+		return ""
+	}
+	if root != "" {
+		key = strings.TrimPrefix(key, root+"/")
+	}
+	return trash+"/"+time.Now().UTC().Format(TRASH_TIME_FORMAT)+"/"+key
+}
+
+// Copy the object to the new key on the server and delete the old one
+func moveObject(cloud StorageBackend, from, to string) error {
+	_, err := cloud.CopyBlob(&CopyBlobInput{
+		Source:      from,
+		Destination: to,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cloud.DeleteBlob(&DeleteBlobInput{
+		Key: from,
+	})
+	return err
+}
+
+// List trashed files as "<time>/<path>" lines, oldest first
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) listTrash() (string, error) {
+	cloud, trash, _ := fs.trashPrefix()
+	prefix := trash+"/"
+	var lines []string
+	var startAfter *string
+	for len(lines) < TRASH_LIST_MAX_ENTRIES {
+		resp, err := cloud.ListBlobs(&ListBlobsInput{
+			Prefix:     &prefix,
+			StartAfter: startAfter,
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, item := range resp.Items {
+			entry := strings.TrimPrefix(*item.Key, prefix)
+			if strings.Index(entry, "/") > 0 && !strings.HasSuffix(entry, "/") {
+				lines = append(lines, entry+"\n")
+			}
+		}
+		if !resp.IsTruncated || len(resp.Items) == 0 {
+			break
+		}
+		// NextContinuationToken is not returned without delimiter
+		startAfter = resp.Items[len(resp.Items)-1].Key
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// Move a trashed file listed as "<time>/<path>" back to its path.
+// Existing files are never overwritten
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) restoreFromTrash(entry string) error {
+	kv := strings.SplitN(entry, "/", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return syscall.EINVAL
+	}
+	if _, err := time.Parse(TRASH_TIME_FORMAT, kv[0]); err != nil {
+		return syscall.EINVAL
+	}
+	cloud, trash, rootKey := fs.trashPrefix()
+	key := appendChildName(rootKey, kv[1])
+	_, err := cloud.HeadBlob(&HeadBlobInput{Key: key})
+	if err == nil {
+		return syscall.EEXIST
+	} else if mapAwsError(err) != fuse.ENOENT {
+		return mapAwsError(err)
+	}
+	fs.addInflightChange(key)
+	err = moveObject(cloud, trash+"/"+entry, key)
+	fs.completeInflightChange(key)
+	if err != nil {
+		return mapAwsError(err)
+	}
+	// Show the file in the next listing of its directory
+	fs.mu.RLock()
+	dir := fs.getInodeOrDie(fuseops.RootInodeID)
+	fs.mu.RUnlock()
+	path := strings.Split(kv[1], "/")
+	for _, name := range path[0 : len(path)-1] {
+		dir.mu.Lock()
+		child := dir.findChildUnlocked(name)
+		dir.mu.Unlock()
+		if child == nil || !child.isDir() {
+			return nil
+		}
+		dir = child
+	}
+	dir.mu.Lock()
+	dir.dir.listDone = false
+	dir.dir.DirTime = time.Time{}
+	dir.mu.Unlock()
+	return nil
+}
@@ -19,6 +19,7 @@ import (
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/jacobsa/fuse"
 )
@@ -135,15 +136,21 @@ func PMetadata(m map[string]string) map[string]*string {
 	return metadata
 }
 
+// Escape non-printable characters as %XX of every their byte,
+// so that binary values like POSIX ACLs are unescaped intact
 func xattrEscape(value string) (s string) {
-	for _, c := range value {
+	for i := 0; i < len(value); {
+		c, size := utf8.DecodeRuneInString(value[i:])
 		if c == '%' {
 			s += "%25"
-		} else if unicode.IsPrint(c) {
-			s += string(c)
+		} else if c != utf8.RuneError && unicode.IsPrint(c) {
+			s += value[i : i+size]
 		} else {
-			s += "%" + fmt.Sprintf("%02X", c)
+			for _, b := range []byte(value[i : i+size]) {
+				s += fmt.Sprintf("%%%02X", b)
+			}
 		}
+		i += size
 	}
 
 	return
@@ -0,0 +1,337 @@
+// Copyright 2021 Yandex LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Version history directories. With --version-history-dirs, every file "x"
+// of a versioned bucket gets a read-only virtual directory "x.versions" with
+// one file per version of the object, named by its time and version ID.
+// Deleted files with previous versions get it too.
+// The directory isn't listed in the parent and is only available by name.
+// Versions are listed when the directory is read and read without caching.
+// Version inodes are freed when the kernel forgets them.
+package internal
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const VERSIONS_DIR_SUFFIX = ".versions"
+
+// File name of the version in the history directory, sorted by time
+func versionFileName(v *BlobVersionOutput) string {
+	return v.LastModified.UTC().Format("20060102T150405Z") + "-" + v.VersionId
+}
+
+// Look up "x.versions" as the version history of "x"
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) lookUpVersionsDir(ctx context.Context, op *fuseops.LookUpInodeOp) (err error) {
+	targetOp := fuseops.LookUpInodeOp{
+		Parent: op.Parent,
+		Name:   strings.TrimSuffix(op.Name, VERSIONS_DIR_SUFFIX),
+	}
+	if targetOp.Name == "" {
+		return fuse.ENOENT
+	}
+	err = fs.lookUpInode(ctx, &targetOp)
+	if err == fuse.ENOENT {
+		return fs.lookUpDeletedVersionsDir(op, targetOp.Name)
+	} else if err != nil {
+		return
+	}
+	fs.mu.RLock()
+	target := fs.getInodeOrDie(targetOp.Entry.Child)
+	fs.mu.RUnlock()
+	// The reference is taken for the kernel which didn't ask for the target
+	defer target.DeRef(1)
+	if target.isDir() || target.isVirtual() {
+		return fuse.ENOENT
+	}
+
+	target.mu.Lock()
+	cloud, _ := target.cloud()
+	if _, ok := unwrapCloud(cloud).(VersionedBackend); !ok {
+		target.mu.Unlock()
+		return fuse.ENOENT
+	}
+	dir := target.versionsDir
+	fs.mu.Lock()
+	if dir == nil || fs.inodes[dir.Id] != dir {
+		// Like sidecars, history directories are only inserted into the inode table
+		dir = fs.newVersionsDir(target, op.Name)
+		fs.inodes[dir.Id] = dir
+		target.versionsDir = dir
+	}
+	fs.mu.Unlock()
+	mtime := target.Attributes.Mtime
+	target.mu.Unlock()
+
+	fs.returnVersionsDir(dir, mtime, op)
+	return
+}
+
+// Look up the version history of a deleted file. The file is represented by
+// an inode which isn't a child of its parent. The history directory exists
+// only if the object has versions, it's created again on every lookup
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) lookUpDeletedVersionsDir(op *fuseops.LookUpInodeOp, name string) error {
+	fs.mu.RLock()
+	parent := fs.getInodeOrDie(op.Parent)
+	fs.mu.RUnlock()
+	target := NewInode(fs, parent, name)
+	target.mu.Lock()
+	cloud, _ := target.cloud()
+	target.mu.Unlock()
+	if _, ok := unwrapCloud(cloud).(VersionedBackend); !ok {
+		return fuse.ENOENT
+	}
+	fs.mu.Lock()
+	dir := fs.newVersionsDir(target, op.Name)
+	fs.mu.Unlock()
+	err := dir.loadVersions()
+	if err != nil {
+		return mapAwsError(err)
+	}
+	dir.mu.Lock()
+	if len(dir.versions) == 0 {
+		dir.mu.Unlock()
+		return fuse.ENOENT
+	}
+	mtime := dir.versions[len(dir.versions)-1].LastModified
+	dir.mu.Unlock()
+	fs.mu.Lock()
+	fs.inodes[dir.Id] = dir
+	fs.mu.Unlock()
+	fs.returnVersionsDir(dir, mtime, op)
+	return nil
+}
+
+// History directory of the file, it isn't inserted into the inode table yet
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) newVersionsDir(target *Inode, name string) *Inode {
+	dir := NewInode(fs, target.Parent, name)
+	dir.ToDir()
+	dir.versionsOf = target
+	dir.userMetadata = make(map[string][]byte)
+	dir.Attributes.Mode = fs.flags.DirMode &^ 0222 | os.ModeDir
+	dir.Id = fs.allocateInodeId()
+	return dir
+}
+
+// Fill the lookup reply with the history directory
+// LOCKS_EXCLUDED(dir.mu)
+func (fs *Goofys) returnVersionsDir(dir *Inode, mtime time.Time, op *fuseops.LookUpInodeOp) {
+	dir.mu.Lock()
+	dir.Attributes.Mtime = mtime
+	dir.Attributes.Ctime = mtime
+	dir.AttrTime = time.Now()
+	dir.mu.Unlock()
+
+	dir.Ref()
+	op.Entry.Child = dir.Id
+	op.Entry.Attributes = dir.InflateAttributes()
+	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+}
+
+// List versions of the file from the server
+// LOCKS_EXCLUDED(dir.mu)
+func (dir *Inode) loadVersions() error {
+	target := dir.versionsOf
+	target.mu.Lock()
+	cloud, key := target.cloud()
+	target.mu.Unlock()
+	versioned, ok := unwrapCloud(cloud).(VersionedBackend)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	versions, err := versioned.ListBlobVersions(key)
+	if err != nil {
+		return err
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].LastModified.Before(versions[j].LastModified)
+	})
+	dir.mu.Lock()
+	dir.versions = versions
+	dir.mu.Unlock()
+	return nil
+}
+
+// Look up a version in the history directory
+// LOCKS_EXCLUDED(dir.mu, fs.mu)
+func (fs *Goofys) lookUpVersion(dir *Inode, op *fuseops.LookUpInodeOp) error {
+	dir.mu.Lock()
+	loaded := dir.versions != nil
+	dir.mu.Unlock()
+	if !loaded {
+		err := dir.loadVersions()
+		if err != nil {
+			return mapAwsError(err)
+		}
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	var version *BlobVersionOutput
+	for i := range dir.versions {
+		if versionFileName(&dir.versions[i]) == op.Name {
+			version = &dir.versions[i]
+			break
+		}
+	}
+	if version == nil {
+		return fuse.ENOENT
+	}
+	fs.mu.Lock()
+	file := fs.versionInode(dir, version)
+	if fs.inodes[file.Id] != file {
+		fs.inodes[file.Id] = file
+	}
+	fs.mu.Unlock()
+
+	file.Ref()
+	op.Entry.Child = file.Id
+	op.Entry.Attributes = file.InflateAttributes()
+	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.EntryExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	return nil
+}
+
+// Inode of a version in the history directory. Like for sidecars, its number
+// is allocated on first use, but it's only added to the inode table on lookup.
+// It's dropped from the directory when forgotten, see forgetVersion()
+// LOCKS_REQUIRED(dir.mu)
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) versionInode(dir *Inode, version *BlobVersionOutput) *Inode {
+	name := versionFileName(version)
+	file := dir.versionFiles[name]
+	if file == nil {
+		file = NewInode(fs, dir, name)
+		file.versionOf = dir.versionsOf
+		file.versionId = version.VersionId
+		file.userMetadata = make(map[string][]byte)
+		file.Attributes.Mode = fs.flags.FileMode &^ 0222
+		file.Attributes.Size = version.Size
+		file.Attributes.Mtime = version.LastModified
+		file.Attributes.Ctime = version.LastModified
+		file.Id = fs.allocateInodeId()
+		if dir.versionFiles == nil {
+			dir.versionFiles = make(map[string]*Inode)
+		}
+		dir.versionFiles[name] = file
+	}
+	return file
+}
+
+// Free version inodes when the kernel forgets them. A forgotten history
+// directory drops all of its versions, it's listed again on the next lookup
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) forgetVersion() {
+	if inode.versionsOf != nil {
+		inode.versions = nil
+		inode.versionFiles = nil
+	} else if inode.versionOf != nil {
+		dir := inode.Parent
+		dir.mu.Lock()
+		// It may be looked up again in the meantime
+		if dir.versionFiles[inode.Name] == inode && atomic.LoadInt64(&inode.refcnt) == 0 {
+			delete(dir.versionFiles, inode.Name)
+		}
+		dir.mu.Unlock()
+	}
+}
+
+// List the history directory, versions are reloaded when listing starts
+// LOCKS_EXCLUDED(dir.mu)
+func (fs *Goofys) readVersionsDir(dir *Inode, op *fuseops.ReadDirOp) error {
+	if op.Offset == 0 {
+		err := dir.loadVersions()
+		if err != nil {
+			return mapAwsError(err)
+		}
+	}
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	entries := []fuseutil.Dirent{
+		{Name: ".", Type: fuseutil.DT_Directory, Inode: dir.Id},
+		{Name: "..", Type: fuseutil.DT_Directory, Inode: dir.Parent.Id},
+	}
+	fs.mu.Lock()
+	for i := range dir.versions {
+		file := fs.versionInode(dir, &dir.versions[i])
+		entries = append(entries, fuseutil.Dirent{
+			Name: file.Name,
+			Type: fuseutil.DT_File,
+			Inode: file.Id,
+		})
+	}
+	fs.mu.Unlock()
+	for i := int(op.Offset); i < len(entries); i++ {
+		e := entries[i]
+		e.Offset = fuseops.DirOffset(i+1)
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+		op.BytesRead += n
+	}
+	return nil
+}
+
+// Read a version of the file directly from the server
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) readVersion(offset uint64, size uint64) (data [][]byte, bytesRead int, err error) {
+	// Attributes of versions never change
+	fileSize := inode.Attributes.Size
+	if offset >= fileSize || size == 0 {
+		return
+	}
+	if offset+size > fileSize {
+		size = fileSize-offset
+	}
+	target := inode.versionOf
+	target.mu.Lock()
+	cloud, key := target.cloud()
+	target.mu.Unlock()
+	resp, err := cloud.GetBlob(&GetBlobInput{
+		Key:       key,
+		Start:     offset,
+		Count:     size,
+		VersionId: &inode.versionId,
+	})
+	if err != nil {
+		return nil, 0, mapAwsError(err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, size)
+	n, err := io.ReadFull(resp.Body, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	atomic.AddUint64(&inode.bytesRead, uint64(n))
+	return [][]byte{buf[0:n]}, n, nil
+}
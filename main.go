@@ -243,6 +243,9 @@ func main() {
 				kill(os.Getppid(), syscall.SIGUSR1)
 			}
 			log.Println("File system has been successfully mounted.")
+			if flags.MetricsAddr != "" {
+				fs.StartMetricsServer(flags.MetricsAddr)
+			}
 			// Let the user unmount with Ctrl-C (SIGINT)
 			registerSIGINTHandler(fs, flags)
 
@@ -260,7 +263,10 @@ func main() {
 				err = fmt.Errorf("MountedFileSystem.Join: %v", err)
 				return
 			}
-			fs.SyncFS(nil)
+			if !fs.FlushOnUnmount(flags.UnmountFlushTimeout) {
+				log.Println("Exiting with unflushed changes.")
+				return
+			}
 
 			log.Println("Successfully exiting.")
 		}